@@ -0,0 +1,206 @@
+// Package adminapi defines the agent commands that only the ghtkn CLI sends. The
+// commands SDK clients use (GET, REVOKE, UNLOCK, ...) are part of the socket protocol in
+// ghtkn-go-sdk/ghtkn/backend/agent; the ones here manage the agent itself, so they are
+// kept out of the SDK and evolve with the agent. They travel in the same request and
+// response envelope as the SDK commands; a response that carries more is decoded into
+// Response, which embeds it.
+//
+// An agent from an older ghtkn answers a command it does not know with "unknown
+// command", so a client must be prepared for that.
+package adminapi
+
+import (
+	"encoding/json"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+)
+
+// CommandPanic asks the agent to revoke every stored token (access and refresh tokens),
+// delete its token directory, lock, and stop, as the incident kill switch 'ghtkn panic'.
+// The response reports the number of client IDs whose tokens were revoked in Count, the
+// client IDs whose tokens could not be revoked (they may still be live) in RevokeFailed,
+// and a failure to delete the token directory in Error. The agent stops after
+// answering, whatever the outcome.
+const CommandPanic = "PANIC"
+
+// CommandTokens asks the agent to list its stored tokens. The response carries them in
+// Response.Tokens, without the tokens themselves. A locked agent answers RespLocked.
+const CommandTokens = "TOKENS"
+
+// CommandPrune asks the agent to delete what no longer serves a purpose from its token
+// directory: tokens whose access token expired with no usable refresh token, tokens that
+// can't be decrypted with the current key, and leftover files. With Request.DryRun it
+// only reports them. The response lists them in Response.Pruned. A locked agent answers
+// RespLocked, since judging a token needs the key.
+const CommandPrune = "PRUNE"
+
+// CommandConfigure asks an unlocked agent to replace its refresh-token setting without
+// locking: EnableRefreshToken, RefreshTokenTTL, and AppRefresh as UNLOCK takes them. It
+// must carry the agent passphrase, since it can enable refresh, and answers
+// RefreshTokenRemovalPending like UNLOCK when it would drop a still-valid refresh token
+// without ConfirmRefreshTokenRemoval. A locked agent answers RespLocked.
+const CommandConfigure = "CONFIGURE"
+
+// CommandUpgrade asks the agent to re-execute the ghtkn binary it was started from, so a
+// running agent picks up an upgraded ghtkn without being stopped. The new process takes
+// over the listening socket and, when the agent is unlocked, the data key and the
+// refresh-token setting, so it needs no passphrase. The agent answers with
+// Response.Upgrading before it re-executes; the next request is served by the new
+// process. It fails while a device flow is in progress, since the flow would be lost.
+const CommandUpgrade = "UPGRADE"
+
+// CommandExport asks the agent for a backup of its stored tokens, refresh tokens
+// included, encrypted under Request.BundlePassphrase (see package bundle). Since the
+// bundle carries the refresh tokens, which the agent otherwise never hands out, it must
+// carry the agent passphrase like CommandConfigure. The response carries the bundle in
+// Response.Bundle and the number of tokens in it in Count. A locked agent answers
+// RespLocked.
+const CommandExport = "EXPORT"
+
+// CommandImport asks the agent to merge the tokens of Request.Bundle, decrypted with
+// Request.BundlePassphrase, into its token store. A token the agent already holds a
+// readable one for is kept, and a refresh token is dropped for an app refresh is
+// disabled for. The response reports each token of the bundle in Response.Imported, and
+// the number imported in Count. A locked agent answers RespLocked.
+//
+// Without a bundle it imports Request.Tokens instead, the tokens 'ghtkn backend migrate'
+// copies from another backend. The agent owns the token lifecycle and refuses SET from a
+// current client, so this path must carry the agent passphrase like CommandConfigure. It
+// also replaces a stored token the agent can no longer serve, one whose access token
+// expired without a refresh token the agent would use, which GET reports as not found.
+const CommandImport = "IMPORT"
+
+// MaxBundleSize is the largest bundle the agent exports or imports: the bundle travels
+// base64-encoded in a single request line, which the agent caps at 64 KiB. It holds the
+// tokens of about a hundred apps.
+const MaxBundleSize = 40 * 1024
+
+// RespUnknownCommand is the error an agent answers a command it does not know with, e.g.
+// an agent from an older ghtkn receiving a newer adminapi command.
+const RespUnknownCommand = "unknown command"
+
+// Request is a request for an adminapi command: the SDK request envelope, plus the
+// fields only adminapi commands read. An agent ignores the fields it does not know.
+type Request struct {
+	agentapi.Request
+
+	// DryRun makes CommandPrune report what it would delete without deleting it.
+	DryRun bool `json:"dry_run,omitempty"`
+	// AppRefresh overrides, per app, the refresh-token setting an UNLOCK or
+	// CommandConfigure sets for every app with EnableRefreshToken and RefreshTokenTTL. An
+	// agent that applied it answers with Response.AppRefreshApplied; an older one ignores
+	// it on UNLOCK.
+	AppRefresh []*AppRefresh `json:"app_refresh,omitempty"`
+	// BundlePassphrase is the passphrase CommandExport encrypts the bundle under, and
+	// CommandImport decrypts it with. It is not the agent passphrase.
+	BundlePassphrase agentapi.SecretBytes `json:"bundle_passphrase,omitempty"`
+	// Bundle is the bundle CommandImport merges.
+	Bundle []byte `json:"bundle,omitempty"`
+	// Tokens are the tokens CommandImport merges when it carries no Bundle.
+	Tokens []*ImportToken `json:"tokens,omitempty"`
+}
+
+// ImportToken is a token CommandImport merges without a bundle: the JSON a backend
+// caches for the app, with at least access_token and expiration_date.
+type ImportToken struct {
+	ClientID string          `json:"client_id"`
+	Token    json.RawMessage `json:"token"`
+}
+
+// AppRefresh is the refresh-token setting of one app, overriding the agent-wide one.
+type AppRefresh struct {
+	ClientID string `json:"client_id"`
+	// Enable lets the agent store and use the app's refresh token. When false, the agent
+	// keeps no refresh token for the app even if refresh is enabled for every other app.
+	Enable bool `json:"enable,omitempty"`
+	// TTL is how long the app's token may sit unused before the agent discards it. Zero
+	// means the agent-wide RefreshTokenTTL. It applies only with Enable.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// Response is the agent's response to an adminapi command: the SDK response envelope,
+// plus the fields only adminapi commands set.
+type Response struct {
+	agentapi.Response
+
+	// Tokens lists the stored tokens, for CommandTokens.
+	Tokens []*TokenInfo `json:"tokens,omitempty"`
+	// Pruned lists what CommandPrune deleted, or would delete with DryRun.
+	Pruned []*PrunedFile `json:"pruned,omitempty"`
+	// AppRefreshApplied reports that an UNLOCK or CommandConfigure applied
+	// Request.AppRefresh. An agent from an older ghtkn unlocks without it.
+	AppRefreshApplied bool `json:"app_refresh_applied,omitempty"`
+	// AbandonedDeviceFlows lists, in the response to a STOP, the client IDs whose device
+	// flow was still running when the agent gave up waiting for it, so the user must
+	// authenticate those apps again. An agent from an older ghtkn stops without waiting
+	// for the flows and without reporting them.
+	AbandonedDeviceFlows []string `json:"abandoned_device_flows,omitempty"`
+	// PID is, in the response to a STOP or CommandPanic, the process ID of the stopping
+	// agent, so the client can wait until the process has exited. An agent from an older
+	// ghtkn leaves it zero.
+	PID int `json:"pid,omitempty"`
+	// Upgrading reports that the agent accepted CommandUpgrade and re-executes once the
+	// response is written.
+	Upgrading bool `json:"upgrading,omitempty"`
+	// Ephemeral reports, in the response to a STATUS, that the agent keeps its tokens in
+	// memory only ('ghtkn agent start --ephemeral'), so UNLOCK and CommandConfigure need no
+	// passphrase. An agent from an older ghtkn leaves it false.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// Unlocking reports, in the response to a STATUS, that the agent is locked but an
+	// UNLOCK is deriving the data key. An agent from an older ghtkn leaves it false.
+	Unlocking bool `json:"unlocking,omitempty"`
+	// Bundle is the encrypted bundle CommandExport produced.
+	Bundle []byte `json:"bundle,omitempty"`
+	// Imported reports, for CommandImport, what became of each token of the bundle.
+	Imported []*ImportedToken `json:"imported,omitempty"`
+}
+
+// ImportedToken is what CommandImport did with a token of the bundle.
+type ImportedToken struct {
+	ClientID string `json:"client_id"`
+	Result   string `json:"result"`
+	// Error is why storing the token failed, with ImportResultFailed.
+	Error string `json:"error,omitempty"`
+}
+
+// Results of importing a token.
+const (
+	ImportResultImported = "imported"
+	// ImportResultKept means the agent already held a readable token for the app and
+	// kept it rather than replace a token it may be refreshing.
+	ImportResultKept   = "kept"
+	ImportResultFailed = "failed"
+)
+
+// PrunedFile is a file CommandPrune deleted or would delete.
+type PrunedFile struct {
+	// Name is the file's path relative to the token directory; for a token it is the
+	// client ID.
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+	// Error is why deleting it failed. It is empty on success and with DryRun.
+	Error string `json:"error,omitempty"`
+}
+
+// Reasons a file is pruned, besides the leftover kinds of the token store.
+const (
+	PruneReasonExpired       = "expired"
+	PruneReasonUndecryptable = "undecryptable"
+)
+
+// TokenInfo describes a stored token without revealing it.
+type TokenInfo struct {
+	ClientID string `json:"client_id"`
+	// ExpiresAt is when the access token expires. It is zero for a token that never
+	// expires or can't be decrypted.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// LastUsed is when a client last fetched the token. It is zero when no use has been
+	// recorded.
+	LastUsed time.Time `json:"last_used,omitzero"`
+	// Refreshable reports whether a valid refresh token is stored with it.
+	Refreshable bool `json:"refreshable,omitempty"`
+	// Unreadable reports that the token file can't be decrypted with the current key,
+	// e.g. one written under a previous key; it will be re-minted on the next get.
+	Unreadable bool `json:"unreadable,omitempty"`
+}
@@ -0,0 +1,48 @@
+package adminapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+)
+
+// Send sends req to the agent listening on the Unix socket at path and returns its
+// response, decoded with the adminapi fields. It is agentapi.Send for the commands whose
+// request or response carries more than the SDK envelope. A missing or refusing socket is reported
+// as agentapi.ErrAgentNotRunning, so agentapi.IsNotRunning applies.
+func Send(ctx context.Context, path string, req *Request) (*Response, error) {
+	d := net.Dialer{Timeout: agentapi.DialTimeout}
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", agentapi.ErrAgentNotRunning, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, fmt.Errorf("set the deadline: %w", err)
+		}
+	}
+	if req.ProtocolVersion == 0 {
+		req.ProtocolVersion = agentapi.ProtocolVersion
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal the request: %w", err)
+	}
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		return nil, fmt.Errorf("send the request: %w", err)
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read the response: %w", err)
+	}
+	resp := &Response{}
+	if err := json.Unmarshal(line, resp); err != nil {
+		return nil, fmt.Errorf("parse the response: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,95 @@
+// Package bundle is the file format of 'ghtkn agent export' and 'ghtkn agent import': a
+// backup of the tokens an agent stores, refresh tokens included, encrypted under a
+// passphrase of its own with the same Argon2id and AES-256-GCM as the key file. The
+// bundle does not depend on the agent's key, so it can be imported into an agent with
+// another passphrase, on another machine.
+package bundle
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+)
+
+// Bundle layout: magic || version(1) || keyfile.SealWithPassphrase(JSON of Contents).
+const (
+	magic   = "GHTKNBDL"
+	version = 1
+)
+
+// ErrNotBundle is returned by Open for data that is not a bundle, or one written by a
+// newer ghtkn.
+var ErrNotBundle = errors.New("the file is not a ghtkn agent bundle")
+
+// ErrIncorrectPassphrase is returned by Open when the bundle can't be decrypted with the
+// passphrase, which means the passphrase is wrong (or the bundle is corrupt).
+var ErrIncorrectPassphrase = errors.New("incorrect bundle passphrase")
+
+// Contents is what a bundle carries.
+type Contents struct {
+	// CreatedAt is when the bundle was exported.
+	CreatedAt time.Time `json:"created_at"`
+	Tokens    []*Token  `json:"tokens"`
+}
+
+// Token is a stored token as the agent persists it, refresh token included.
+type Token struct {
+	ClientID string          `json:"client_id"`
+	Token    json.RawMessage `json:"token"`
+}
+
+// Seal encrypts contents under passphrase.
+func Seal(passphrase []byte, contents *Contents) ([]byte, error) {
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return nil, fmt.Errorf("marshal the bundle: %w", err)
+	}
+	defer zero(plaintext)
+	sealed, err := keyfile.SealWithPassphrase(passphrase, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt the bundle: %w", err)
+	}
+	blob := make([]byte, 0, len(magic)+1+len(sealed))
+	blob = append(blob, magic...)
+	blob = append(blob, version)
+	return append(blob, sealed...), nil
+}
+
+// Open decrypts a bundle produced by Seal with passphrase.
+func Open(passphrase, blob []byte) (*Contents, error) {
+	if !bytes.HasPrefix(blob, []byte(magic)) || len(blob) < len(magic)+1 || blob[len(magic)] != version {
+		return nil, ErrNotBundle
+	}
+	plaintext, err := keyfile.OpenWithPassphrase(passphrase, blob[len(magic)+1:])
+	if err != nil {
+		if errors.Is(err, keyfile.ErrIncorrectPassphrase) {
+			return nil, ErrIncorrectPassphrase
+		}
+		return nil, fmt.Errorf("decrypt the bundle: %w", err)
+	}
+	defer zero(plaintext)
+	contents := &Contents{}
+	if err := json.Unmarshal(plaintext, contents); err != nil {
+		return nil, fmt.Errorf("parse the bundle: %w", err)
+	}
+	return contents, nil
+}
+
+// Zero overwrites the tokens of contents, so they do not linger once imported or
+// exported.
+func (c *Contents) Zero() {
+	for _, t := range c.Tokens {
+		zero(t.Token)
+	}
+}
+
+// zero overwrites b with zeros.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,49 @@
+package bundle_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/bundle"
+)
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+	contents := &bundle.Contents{
+		CreatedAt: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		Tokens: []*bundle.Token{
+			{ClientID: "Iv1.a", Token: json.RawMessage(`{"access_token":"ghu_a","refresh_token":"ghr_a"}`)},
+		},
+	}
+	blob, err := bundle.Seal([]byte("bundle pw"), contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		name       string
+		passphrase string
+		blob       []byte
+		want       *bundle.Contents
+		wantErr    error
+	}{
+		{name: "round trip", passphrase: "bundle pw", blob: blob, want: contents},
+		{name: "wrong passphrase", passphrase: "wrong", blob: blob, wantErr: bundle.ErrIncorrectPassphrase},
+		{name: "not a bundle", passphrase: "bundle pw", blob: []byte(`{"tokens":[]}`), wantErr: bundle.ErrNotBundle},
+		{name: "truncated", passphrase: "bundle pw", blob: blob[:8], wantErr: bundle.ErrNotBundle},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := bundle.Open([]byte(d.passphrase), d.blob)
+			if !errors.Is(err, d.wantErr) {
+				t.Fatalf("Open() error = %v, want %v", err, d.wantErr)
+			}
+			if diff := cmp.Diff(d.want, got); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
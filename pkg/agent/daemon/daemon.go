@@ -0,0 +1,82 @@
+// Package daemon runs the ghtkn agent as a background daemon for 'ghtkn agent start
+// --daemon': the command starts a detached copy of itself and returns once that copy
+// serves the socket, or reports why it couldn't start. It is the built-in replacement for
+// wrapping the agent in nohup on hosts and in containers without a service manager.
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// envReady tells an agent started by Spawn that it is the daemon, and which file
+// descriptor it reports its readiness on. It is internal to Spawn and removed from the
+// environment as soon as it is read, so the hooks and the re-executed agent of an
+// upgrade don't inherit it.
+const envReady = "GHTKN_AGENT_DAEMON_READY"
+
+// readyMessage is what the daemon writes to the readiness pipe once it serves the socket.
+// Anything else, including the pipe closing without it, means the daemon failed to start;
+// failedPrefix then introduces the reason, if the daemon could tell it.
+const (
+	readyMessage = "ready\n"
+	failedPrefix = "failed: "
+)
+
+// Readiness is how a daemon started by Spawn tells the command that started it that it
+// serves the socket.
+type Readiness struct {
+	file *os.File
+}
+
+// TakeReadiness returns the Readiness of a daemon started by Spawn, and nil when the
+// agent was not started by Spawn. It removes envReady from the environment.
+func TakeReadiness() (*Readiness, error) {
+	value := os.Getenv(envReady)
+	if value == "" {
+		return nil, nil //nolint:nilnil // not a daemon is a normal start, not an error
+	}
+	if err := os.Unsetenv(envReady); err != nil {
+		return nil, fmt.Errorf("remove %s from the environment: %w", envReady, err)
+	}
+	fd, err := strconv.ParseUint(strings.TrimSpace(value), 10, 31)
+	if err != nil {
+		return nil, fmt.Errorf("%s: parse the file descriptor: %w", envReady, err)
+	}
+	return &Readiness{file: os.NewFile(uintptr(fd), "ghtkn agent readiness")}, nil
+}
+
+// Ready reports that the daemon serves the socket, and releases the command waiting for
+// it. It is a no-op on a nil Readiness, and after the first call.
+func (r *Readiness) Ready() {
+	if r == nil || r.file == nil {
+		return
+	}
+	_, _ = r.file.WriteString(readyMessage)
+	_ = r.file.Close()
+	r.file = nil
+}
+
+// Fail reports that the daemon failed to start because of err, which the command waiting
+// for it then returns. It is a no-op on a nil Readiness, and after Ready.
+func (r *Readiness) Fail(err error) {
+	if r == nil || r.file == nil {
+		return
+	}
+	_, _ = r.file.WriteString(failedPrefix + strings.ReplaceAll(err.Error(), "\n", " ") + "\n")
+	_ = r.file.Close()
+	r.file = nil
+}
+
+// Close releases the readiness pipe without reporting readiness, so the command waiting
+// for it learns that the daemon failed to start. It is a no-op on a nil Readiness, and
+// after Ready.
+func (r *Readiness) Close() {
+	if r == nil || r.file == nil {
+		return
+	}
+	_ = r.file.Close()
+	r.file = nil
+}
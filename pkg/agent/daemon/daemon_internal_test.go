@@ -0,0 +1,71 @@
+package daemon
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		report func(*Readiness)
+		want   string
+	}{
+		{
+			name:   "ready",
+			report: func(r *Readiness) { r.Ready() },
+			want:   readyMessage,
+		},
+		{
+			name: "failed, on one line",
+			report: func(r *Readiness) {
+				r.Fail(errors.New("listen:\nanother ghtkn agent is already running"))
+			},
+			want: failedPrefix + "listen: another ghtkn agent is already running\n",
+		},
+		{
+			name:   "closed without a report",
+			report: func(r *Readiness) { r.Close() },
+		},
+		{
+			name: "only the first report counts",
+			report: func(r *Readiness) {
+				r.Ready()
+				r.Fail(errors.New("stopped"))
+				r.Close()
+			},
+			want: readyMessage,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			pr, pw, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pr.Close()
+			tt.report(&Readiness{file: pw})
+			got, err := io.ReadAll(pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("readiness pipe = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReadiness_nil verifies that an agent not started as a daemon can report through
+// its nil Readiness.
+func TestReadiness_nil(t *testing.T) {
+	t.Parallel()
+	var r *Readiness
+	r.Ready()
+	r.Fail(errors.New("failed"))
+	r.Close()
+}
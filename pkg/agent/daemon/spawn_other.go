@@ -0,0 +1,13 @@
+//go:build !unix
+
+package daemon
+
+import (
+	"context"
+	"errors"
+)
+
+// Spawn is not supported off Unix, which has no sessions to detach the agent into.
+func Spawn(_ context.Context, _ []string) (int, error) {
+	return 0, errors.New("--daemon is not supported on Windows")
+}
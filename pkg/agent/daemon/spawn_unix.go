@@ -0,0 +1,76 @@
+//go:build unix
+
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readyTimeout bounds how long Spawn waits for the daemon to serve the socket. Starting
+// takes well under a second; this only keeps a daemon stuck on startup from hanging the
+// command.
+const readyTimeout = 30 * time.Second
+
+// Spawn starts args (the command line of this process, os.Args) again as a daemon: in a
+// session of its own, so it outlives the terminal and isn't sent its SIGHUP, with its
+// standard streams on /dev/null. It waits until the daemon reports that it serves the
+// socket (see Readiness) and returns its process ID. When the daemon fails to start, it
+// returns the reason the daemon reported, or else its exit status.
+func Spawn(ctx context.Context, args []string) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("resolve the ghtkn binary: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("create the readiness pipe: %w", err)
+	}
+	defer r.Close()
+	cmd := exec.Command(executable, args[1:]...) //nolint:gosec // re-executes this very command
+	// ExtraFiles[0] is file descriptor 3 in the daemon.
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.Env = append(os.Environ(), envReady+"=3")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		_ = w.Close()
+		return 0, fmt.Errorf("start the agent daemon: %w", err)
+	}
+	// Close this process's copy of the write end, so the read sees EOF if the daemon dies.
+	_ = w.Close()
+
+	report := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		report <- line
+	}()
+	timer := time.NewTimer(readyTimeout)
+	defer timer.Stop()
+	select {
+	case line := <-report:
+		if line == readyMessage {
+			pid := cmd.Process.Pid
+			_ = cmd.Process.Release()
+			return pid, nil
+		}
+		waitErr := cmd.Wait()
+		if reason, ok := strings.CutPrefix(line, failedPrefix); ok {
+			return 0, fmt.Errorf("the agent daemon failed to start: %s", strings.TrimSuffix(reason, "\n"))
+		}
+		if err := waitErr; err != nil {
+			return 0, fmt.Errorf("the agent daemon failed to start: %w", err)
+		}
+		return 0, errors.New("the agent daemon exited before serving the socket")
+	case <-timer.C:
+		return 0, fmt.Errorf("the agent daemon (pid %d) did not serve the socket within %s; it may still be starting", cmd.Process.Pid, readyTimeout)
+	case <-ctx.Done():
+		return 0, fmt.Errorf("wait for the agent daemon (pid %d): %w", cmd.Process.Pid, ctx.Err())
+	}
+}
@@ -0,0 +1,87 @@
+// Package filelock serializes access to the agent's files across processes with an
+// advisory lock on a lock file: flock on Unix and LockFileEx on Windows. A mutex only
+// serializes the goroutines of one process, while two agents pointed at the same token
+// directory, or 'ghtkn agent fsck' running beside an agent, are separate processes.
+//
+// The lock is advisory: it only keeps out processes that take it too, which every part
+// of ghtkn that writes the key file or the token directory does.
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultTimeout is how long Acquire waits by default for another process to release
+// the lock. The agent holds it only for the duration of one file operation, so running
+// out of it means the holder is stuck rather than busy.
+const DefaultTimeout = 10 * time.Second
+
+// retryInterval is how often Acquire retries while another process holds the lock.
+const retryInterval = 20 * time.Millisecond
+
+// filePerm is the permission of the lock file (current user only), like the files it
+// guards.
+const filePerm os.FileMode = 0o600
+
+// ErrLocked is returned (wrapped) when another process held the lock for the whole
+// timeout.
+var ErrLocked = errors.New("another process holds the lock")
+
+// Lock is an acquired lock. Release it once the guarded files are no longer touched.
+type Lock struct {
+	f *os.File
+}
+
+// Acquire takes the exclusive lock on the file at path, creating the file if needed. It
+// retries while another process holds the lock and gives up after timeout with an error
+// wrapping ErrLocked, which names the file so the user can find out which process holds
+// it. The parent directory must exist.
+func Acquire(path string, timeout time.Duration) (*Lock, error) {
+	return acquire(path, timeout, true)
+}
+
+// AcquireShared is Acquire for a shared lock, which any number of holders can hold at
+// once while nobody holds the exclusive lock.
+func AcquireShared(path string, timeout time.Duration) (*Lock, error) {
+	return acquire(path, timeout, false)
+}
+
+// acquire implements Acquire and AcquireShared.
+func acquire(path string, timeout time.Duration, exclusive bool) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, fmt.Errorf("open the lock file: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLock(f, exclusive)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if ok {
+			return &Lock{f: f}, nil
+		}
+		if !time.Now().Before(deadline) {
+			_ = f.Close()
+			return nil, fmt.Errorf("%w on %s: another ghtkn agent, or a ghtkn command such as 'ghtkn agent fsck', may be using the same files", ErrLocked, path)
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// Release releases the lock and closes the lock file. The lock file itself is kept, since
+// removing it would let two processes lock different files under the same name.
+func (l *Lock) Release() error {
+	uerr := unlock(l.f)
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("close the lock file: %w", err)
+	}
+	if uerr != nil {
+		return fmt.Errorf("unlock the lock file: %w", uerr)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package filelock_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/filelock"
+)
+
+func TestAcquire(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	l, err := filelock.Acquire(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A second open file, as another process would have, is refused while the lock is
+	// held.
+	if _, err := filelock.Acquire(path, 50*time.Millisecond); !errors.Is(err, filelock.ErrLocked) {
+		t.Fatalf("Acquire() while held: error = %v, want %v", err, filelock.ErrLocked)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = filelock.Acquire(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Acquire() after Release: %v", err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquire_waits(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	l, err := filelock.Acquire(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = l.Release()
+	}()
+	l2, err := filelock.Acquire(path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Acquire() must wait for the holder to release: %v", err)
+	}
+	if err := l2.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireShared(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "lock")
+	l1, err := filelock.AcquireShared(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := filelock.AcquireShared(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("a shared lock must not exclude another shared lock: %v", err)
+	}
+	if _, err := filelock.Acquire(path, 50*time.Millisecond); !errors.Is(err, filelock.ErrLocked) {
+		t.Fatalf("Acquire() while shared locks are held: error = %v, want %v", err, filelock.ErrLocked)
+	}
+	for _, l := range []*filelock.Lock{l1, l2} {
+		if err := l.Release(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := filelock.Acquire(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Acquire() after the shared locks are released: %v", err)
+	}
+	if _, err := filelock.AcquireShared(path, 50*time.Millisecond); !errors.Is(err, filelock.ErrLocked) {
+		t.Fatalf("AcquireShared() while the exclusive lock is held: error = %v, want %v", err, filelock.ErrLocked)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+}
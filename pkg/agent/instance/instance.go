@@ -0,0 +1,99 @@
+// Package instance lets one user run several ghtkn agents side by side, each with
+// its own socket, key file, and token directory, and so its own passphrase and
+// cache. An instance is only a name: Apply turns it into the three paths every
+// other part of ghtkn already reads from GHTKN_AGENT_SOCKET, GHTKN_AGENT_KEY, and
+// GHTKN_AGENT_TOKEN_DIR, so nothing downstream has to know instances exist.
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/env"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// EnvInstance names the agent instance, as --instance does.
+const EnvInstance = "GHTKN_AGENT_INSTANCE"
+
+// validName restricts a name to what is safe in a file name on every OS and in a
+// service unit name, since it ends up in both.
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Validate reports whether name can name an instance.
+func Validate(name string) error {
+	if !validName.MatchString(name) {
+		return slogerr.With(errors.New("the agent instance name may contain only letters, digits, '-', and '_'"), //nolint:wrapcheck
+			"instance", name)
+	}
+	return nil
+}
+
+// Apply resolves the paths of the instance name and exports them with setEnv, so
+// that this process and every process it starts (the agent spawned by --daemon,
+// 'ghtkn exec', a service definition) talk to the same agent. Each path is the
+// default one with "-<name>" added to its base name, before any extension:
+// agent.sock becomes agent-work.sock, key becomes key-work, and the token
+// directory agent becomes agent-work.
+//
+// A path already set in the environment must be the instance's own, as in a child
+// that inherited the exported paths, which makes Apply safe to run again there. Any
+// other path is an error naming its variable: it belongs to another agent, and
+// using it would mix that agent's socket or tokens into the instance. An empty name
+// is the default instance, for which Apply does nothing.
+func Apply(getEnv func(string) string, setEnv func(string, string) error, goos, name string) error {
+	if name == "" {
+		return nil
+	}
+	if err := Validate(name); err != nil {
+		return err
+	}
+	paths := []struct {
+		env     string
+		resolve func(func(string) string, string) (string, error)
+	}{
+		{env.AgentSocket, agentapi.SocketPath},
+		{env.AgentKey, keyfile.KeyPath},
+		{env.AgentTokenDir, tokenstore.TokenDir},
+	}
+	for _, p := range paths {
+		// Resolve the default path, which the variable itself would override.
+		path, err := p.resolve(func(k string) string {
+			if k == p.env {
+				return ""
+			}
+			return getEnv(k)
+		}, goos)
+		if err != nil {
+			return err
+		}
+		path = suffix(path, name)
+		if v := getEnv(p.env); v != "" {
+			if v != path {
+				return slogerr.With(fmt.Errorf("%s is set to another agent's path; unset it to use the agent instance", p.env), //nolint:wrapcheck
+					"instance", name, "path", v, "instance_path", path)
+			}
+			continue
+		}
+		if err := setEnv(p.env, path); err != nil {
+			return fmt.Errorf("set %s: %w", p.env, err)
+		}
+	}
+	if err := setEnv(EnvInstance, name); err != nil {
+		return fmt.Errorf("set %s: %w", EnvInstance, err)
+	}
+	return nil
+}
+
+// suffix inserts "-<name>" into the base name of path, before its extension.
+func suffix(path, name string) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	return dir + strings.TrimSuffix(base, ext) + "-" + name + ext
+}
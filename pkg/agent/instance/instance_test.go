@@ -0,0 +1,125 @@
+package instance_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/instance"
+)
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		name     string
+		env      map[string]string
+		instance string
+		want     map[string]string
+		wantErr  bool
+		// errContains is what the error must mention, e.g. the conflicting variable.
+		errContains string
+	}{
+		{
+			name: "default instance",
+			env:  map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000", "HOME": "/home/me"},
+			want: map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000", "HOME": "/home/me"},
+		},
+		{
+			name:     "suffixed paths",
+			env:      map[string]string{"XDG_RUNTIME_DIR": "/run/user/1000", "HOME": "/home/me"},
+			instance: "work",
+			want: map[string]string{
+				"XDG_RUNTIME_DIR":       "/run/user/1000",
+				"HOME":                  "/home/me",
+				"GHTKN_AGENT_SOCKET":    "/run/user/1000/ghtkn/agent-work.sock",
+				"GHTKN_AGENT_KEY":       "/home/me/.local/share/ghtkn/key-work",
+				"GHTKN_AGENT_TOKEN_DIR": "/home/me/.cache/ghtkn/agent-work",
+				"GHTKN_AGENT_INSTANCE":  "work",
+			},
+		},
+		{
+			name: "an explicit path conflicts",
+			env: map[string]string{
+				"HOME":               "/home/me",
+				"GHTKN_AGENT_SOCKET": "/tmp/agent.sock",
+			},
+			instance:    "personal",
+			wantErr:     true,
+			errContains: "GHTKN_AGENT_SOCKET",
+		},
+		{
+			name: "a path of another instance conflicts",
+			env: map[string]string{
+				"HOME":                  "/home/me",
+				"GHTKN_AGENT_TOKEN_DIR": "/home/me/.cache/ghtkn/agent-work",
+				"GHTKN_AGENT_INSTANCE":  "work",
+			},
+			instance:    "personal",
+			wantErr:     true,
+			errContains: "GHTKN_AGENT_TOKEN_DIR",
+		},
+		{
+			name: "the paths of the same instance",
+			env: map[string]string{
+				"XDG_RUNTIME_DIR":       "/run/user/1000",
+				"HOME":                  "/home/me",
+				"GHTKN_AGENT_SOCKET":    "/run/user/1000/ghtkn/agent-work.sock",
+				"GHTKN_AGENT_KEY":       "/home/me/.local/share/ghtkn/key-work",
+				"GHTKN_AGENT_TOKEN_DIR": "/home/me/.cache/ghtkn/agent-work",
+				"GHTKN_AGENT_INSTANCE":  "work",
+			},
+			instance: "work",
+			want: map[string]string{
+				"XDG_RUNTIME_DIR":       "/run/user/1000",
+				"HOME":                  "/home/me",
+				"GHTKN_AGENT_SOCKET":    "/run/user/1000/ghtkn/agent-work.sock",
+				"GHTKN_AGENT_KEY":       "/home/me/.local/share/ghtkn/key-work",
+				"GHTKN_AGENT_TOKEN_DIR": "/home/me/.cache/ghtkn/agent-work",
+				"GHTKN_AGENT_INSTANCE":  "work",
+			},
+		},
+		{
+			name:     "invalid name",
+			env:      map[string]string{"HOME": "/home/me"},
+			instance: "../work",
+			wantErr:  true,
+		},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+			env := map[string]string{}
+			for k, v := range d.env {
+				env[k] = v
+			}
+			getEnv := func(k string) string { return env[k] }
+			setEnv := func(k, v string) error {
+				env[k] = v
+				return nil
+			}
+			err := instance.Apply(getEnv, setEnv, "linux", d.instance)
+			if d.wantErr {
+				if err == nil {
+					t.Fatal("error must be returned")
+				}
+				if !strings.Contains(err.Error(), d.errContains) {
+					t.Fatalf("the error must mention %s: %v", d.errContains, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(d.want, env); diff != "" {
+				t.Fatal(diff)
+			}
+			// A child process inherits the exported paths and must resolve the same ones.
+			if err := instance.Apply(getEnv, setEnv, "linux", d.instance); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(d.want, env); diff != "" {
+				t.Fatalf("Apply is not idempotent: %s", diff)
+			}
+		})
+	}
+}
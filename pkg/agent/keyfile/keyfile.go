@@ -8,8 +8,10 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/crypt"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/filelock"
 )
 
 // Key file layout: version(1) || salt(saltLen) || wrapped data key (nonce||ciphertext).
@@ -18,6 +20,7 @@ import (
 const (
 	keyFileVersion                = 1
 	keyFilePerm       os.FileMode = 0o600       // matches crypt.AtomicWrite
+	keyDirPerm        os.FileMode = 0o700       // matches crypt.AtomicWrite
 	keyFileHeaderSize             = 1 + saltLen // version byte + salt
 )
 
@@ -29,11 +32,20 @@ var ErrIncorrectPassphrase = errors.New("incorrect passphrase")
 // If the file does not exist, it generates a new data key, wraps it with a
 // passphrase-derived KEK, writes the key file (0600), and returns the data key.
 // The bool result reports whether a new key file was created.
+//
+// It holds the key file's lock (see lock) from the read to the write, so two agents
+// unlocking at once can't both find no key file and each write their own, leaving one
+// agent's tokens under a key that no longer exists.
 func LoadOrCreateDataKey(path string, passphrase []byte) ([]byte, bool, error) {
+	l, err := lock(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer l.Release() //nolint:errcheck
 	blob, err := os.ReadFile(path)
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			dataKey, cerr := CreateDataKey(path, passphrase)
+			dataKey, cerr := createDataKey(path, passphrase)
 			return dataKey, true, cerr
 		}
 		return nil, false, fmt.Errorf("read the key file: %w", err)
@@ -45,26 +57,66 @@ func LoadOrCreateDataKey(path string, passphrase []byte) ([]byte, bool, error) {
 	return dataKey, false, nil
 }
 
-// CreateDataKey generates a new random data key and salt, wraps the data key with
-// the passphrase-derived KEK, and writes the key file atomically.
-func CreateDataKey(path string, passphrase []byte) ([]byte, error) {
+// LoadDataKey loads the data key from path, decrypting it with passphrase. Unlike
+// LoadOrCreateDataKey it never creates a key file: it is for re-verifying the passphrase
+// of an agent that is already unlocked, where a missing key file is an error.
+func LoadDataKey(path string, passphrase []byte) ([]byte, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read the key file: %w", err)
+	}
+	return unwrapDataKey(blob, passphrase)
+}
+
+// GenerateDataKey returns a new random data key, without wrapping or writing it. It is
+// the key of an ephemeral agent, which keeps its tokens in memory and has no key file.
+func GenerateDataKey() ([]byte, error) {
 	dataKey := make([]byte, dataKeyLen)
 	if _, err := rand.Read(dataKey); err != nil {
 		return nil, fmt.Errorf("generate a data key: %w", err)
 	}
-	salt := make([]byte, saltLen)
-	if _, err := rand.Read(salt); err != nil {
-		return nil, fmt.Errorf("generate a salt: %w", err)
+	return dataKey, nil
+}
+
+// CreateDataKey generates a new random data key and salt, wraps the data key with
+// the passphrase-derived KEK, and writes the key file atomically, under the key file's
+// lock (see lock).
+func CreateDataKey(path string, passphrase []byte) ([]byte, error) {
+	l, err := lock(path)
+	if err != nil {
+		return nil, err
 	}
-	kek := deriveKEK(passphrase, salt)
-	defer zero(kek) // the KEK is only needed to wrap the data key; do not keep it in memory
-	wrapped, err := crypt.Seal(kek, dataKey)
+	defer l.Release() //nolint:errcheck
+	return createDataKey(path, passphrase)
+}
+
+// lock takes the cross-process lock guarding the key file at path. The lock is on a
+// separate file next to it, "<key file>.lock", since the key file itself is replaced by
+// a rename on every write. The directory is created if needed, as writing the key file
+// would.
+func lock(path string) (*filelock.Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), keyDirPerm); err != nil {
+		return nil, fmt.Errorf("create the key file directory: %w", err)
+	}
+	l, err := filelock.Acquire(path+".lock", filelock.DefaultTimeout)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return l, nil
+}
+
+// createDataKey is CreateDataKey without the lock, for a caller already holding it.
+func createDataKey(path string, passphrase []byte) ([]byte, error) {
+	dataKey, err := GenerateDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := SealWithPassphrase(passphrase, dataKey)
 	if err != nil {
 		return nil, fmt.Errorf("wrap the data key: %w", err)
 	}
-	blob := make([]byte, 0, keyFileHeaderSize+len(wrapped))
+	blob := make([]byte, 0, 1+len(wrapped))
 	blob = append(blob, keyFileVersion)
-	blob = append(blob, salt...)
 	blob = append(blob, wrapped...)
 	if err := crypt.AtomicWrite(path, blob); err != nil {
 		return nil, fmt.Errorf("write the key file: %w", err)
@@ -81,16 +133,48 @@ func unwrapDataKey(blob, passphrase []byte) ([]byte, error) {
 	if blob[0] != keyFileVersion {
 		return nil, fmt.Errorf("unsupported key file version: %d", blob[0])
 	}
-	salt := blob[1:keyFileHeaderSize]
-	wrapped := blob[keyFileHeaderSize:]
+	dataKey, err := OpenWithPassphrase(passphrase, blob[1:])
+	if err != nil {
+		if errors.Is(err, ErrIncorrectPassphrase) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unwrap the data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// SealWithPassphrase encrypts plaintext under a key derived from passphrase with a fresh
+// random salt, as the key file wraps the data key, and returns salt||nonce||ciphertext.
+// It is also how 'ghtkn agent export' protects a backup bundle with a passphrase of its
+// own.
+func SealWithPassphrase(passphrase, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate a salt: %w", err)
+	}
 	kek := deriveKEK(passphrase, salt)
-	defer zero(kek) // the KEK is only needed to unwrap the data key; do not keep it in memory
-	dataKey, err := crypt.Open(kek, wrapped)
+	defer zero(kek) // the KEK is only needed to seal plaintext; do not keep it in memory
+	sealed, err := crypt.Seal(kek, plaintext)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return append(salt, sealed...), nil
+}
+
+// OpenWithPassphrase decrypts a blob produced by SealWithPassphrase. It returns
+// ErrIncorrectPassphrase when decryption fails.
+func OpenWithPassphrase(passphrase, blob []byte) ([]byte, error) {
+	if len(blob) < saltLen {
+		return nil, ErrIncorrectPassphrase
+	}
+	kek := deriveKEK(passphrase, blob[:saltLen])
+	defer zero(kek) // the KEK is only needed to open blob; do not keep it in memory
+	plaintext, err := crypt.Open(kek, blob[saltLen:])
 	if err != nil {
 		if errors.Is(err, crypt.ErrDecrypt) {
 			return nil, ErrIncorrectPassphrase
 		}
-		return nil, fmt.Errorf("unwrap the data key: %w", err)
+		return nil, err //nolint:wrapcheck
 	}
-	return dataKey, nil
+	return plaintext, nil
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
@@ -60,6 +61,33 @@ func TestLoadOrCreateDataKey_wrongPassphrase(t *testing.T) {
 	}
 }
 
+func TestLoadOrCreateDataKey_concurrent(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "key")
+	pass := []byte("correct horse")
+
+	// Unlocking agents that race to create the key file must end up with the same key:
+	// one creates it and the others load it.
+	const n = 4
+	keys := make([][]byte, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Go(func() {
+			keys[i], _, errs[i] = keyfile.LoadOrCreateDataKey(path, pass)
+		})
+	}
+	wg.Wait()
+	for i := range n {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if !bytes.Equal(keys[i], keys[0]) {
+			t.Fatal("concurrent calls must return the same data key")
+		}
+	}
+}
+
 func TestKeyPath(t *testing.T) {
 	t.Parallel()
 	data := []struct {
@@ -0,0 +1,166 @@
+// Package logfile provides the log file of a ghtkn agent started with --log-file: an
+// append-only file that is rotated by size, so an agent that runs for months as a
+// daemon does not fill the disk.
+package logfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// filePerm is the permission of the log file (current user only). The agent logs client
+// IDs and what it does with their tokens, never the tokens themselves.
+const filePerm os.FileMode = 0o600
+
+// Writer is an io.Writer that appends to a log file and rotates it once it would grow
+// past a size: path is renamed to path.1, path.1 to path.2, and so on, the oldest beyond
+// the number of backups kept is deleted, and a new file is started. It is safe for
+// concurrent use. A line is never split across two files.
+type Writer struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	// stderr makes the file also receive what the process writes to its standard error,
+	// e.g. the trace of a panic (see Options.Stderr).
+	stderr bool
+	file   *os.File
+	size   int64
+}
+
+// Options configures Open.
+type Options struct {
+	// MaxSize is the size in bytes past which the file is rotated. Zero disables
+	// rotation.
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept.
+	MaxBackups int
+	// Stderr points the process's standard error at the log file, and keeps it on the
+	// current file across rotations. A detached agent has no terminal, so this is where a
+	// Go runtime error ends up. It is only supported on Unix.
+	Stderr bool
+}
+
+// Open opens the log file at path for appending, creating it if needed.
+func Open(path string, opts *Options) (*Writer, error) {
+	if opts.MaxSize < 0 {
+		return nil, errors.New("the maximum log file size must not be negative")
+	}
+	if opts.MaxBackups < 0 {
+		return nil, errors.New("the number of rotated log files must not be negative")
+	}
+	w := &Writer{
+		path:       path,
+		maxSize:    opts.MaxSize,
+		maxBackups: opts.MaxBackups,
+		stderr:     opts.Stderr,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write appends p to the log file, rotating it first when p would take it past the
+// maximum size. A write larger than the maximum size goes to a file of its own.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			if w.file == nil {
+				return 0, err
+			}
+			// Keep logging rather than losing the line, and leave a trace of why the file
+			// grows past its maximum size.
+			fmt.Fprintf(w.file, "rotate the log file: %v\n", err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err //nolint:wrapcheck
+}
+
+// Close closes the log file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err //nolint:wrapcheck
+}
+
+// open opens the file at w.path for appending and records its size.
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm)
+	if err != nil {
+		return fmt.Errorf("open the log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat the log file: %w", err)
+	}
+	if w.stderr {
+		if err := redirectStderr(f); err != nil {
+			_ = f.Close()
+			return fmt.Errorf("point the standard error at the log file: %w", err)
+		}
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files by one, moves the current file to path.1, and opens a
+// new one. It is called with w.mu held. The current file is closed first, since Windows
+// can't rename an open file; when rotating fails, logging goes on in the file at path.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("close the log file: %w", err)
+	}
+	w.file = nil
+	rotateErr := w.shift()
+	if err := w.open(); err != nil {
+		return errors.Join(rotateErr, err)
+	}
+	return rotateErr
+}
+
+// shift makes room for a new log file: it deletes the oldest rotated file and renames
+// the others and the current one down the line. Without backups it just deletes the
+// current file.
+func (w *Writer) shift() error {
+	if w.maxBackups == 0 {
+		if err := os.Remove(w.path); err != nil {
+			return fmt.Errorf("delete the log file: %w", err)
+		}
+		return nil
+	}
+	if err := os.Remove(w.backup(w.maxBackups)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete the oldest log file: %w", err)
+	}
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(w.backup(i), w.backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("rotate the log files: %w", err)
+		}
+	}
+	if err := os.Rename(w.path, w.backup(1)); err != nil {
+		return fmt.Errorf("rotate the log file: %w", err)
+	}
+	return nil
+}
+
+// backup returns the path of the i-th rotated file.
+func (w *Writer) backup(i int) string {
+	return w.path + "." + strconv.Itoa(i)
+}
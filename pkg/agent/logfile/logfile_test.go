@@ -0,0 +1,146 @@
+package logfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/logfile"
+)
+
+// readLogs returns the content of the log file and of each rotated file that exists,
+// keyed by file name.
+func readLogs(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := map[string]string{}
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs[e.Name()] = string(b)
+	}
+	return logs
+}
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		opts *logfile.Options
+		// existing is the content of the log file before it is opened.
+		existing string
+		lines    []string
+		want     map[string]string
+	}{
+		{
+			name:  "no rotation",
+			opts:  &logfile.Options{},
+			lines: []string{"a\n", "b\n", "c\n"},
+			want:  map[string]string{"agent.log": "a\nb\nc\n"},
+		},
+		{
+			name:  "rotated, keeping two backups",
+			opts:  &logfile.Options{MaxSize: 4, MaxBackups: 2},
+			lines: []string{"a\n", "b\n", "c\n", "d\n", "e\n", "f\n", "g\n"},
+			want: map[string]string{
+				"agent.log":   "g\n",
+				"agent.log.1": "e\nf\n",
+				"agent.log.2": "c\nd\n",
+			},
+		},
+		{
+			name:  "rotated without backups",
+			opts:  &logfile.Options{MaxSize: 4},
+			lines: []string{"a\n", "b\n", "c\n"},
+			want:  map[string]string{"agent.log": "c\n"},
+		},
+		{
+			name:     "appended to an existing file, which counts toward the size",
+			opts:     &logfile.Options{MaxSize: 4, MaxBackups: 1},
+			existing: "old\n",
+			lines:    []string{"a\n"},
+			want: map[string]string{
+				"agent.log":   "a\n",
+				"agent.log.1": "old\n",
+			},
+		},
+		{
+			name:  "a line larger than the maximum size is not split",
+			opts:  &logfile.Options{MaxSize: 4, MaxBackups: 1},
+			lines: []string{"a\n", "too long\n"},
+			want: map[string]string{
+				"agent.log":   "too long\n",
+				"agent.log.1": "a\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			path := filepath.Join(dir, "agent.log")
+			if tt.existing != "" {
+				if err := os.WriteFile(path, []byte(tt.existing), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w, err := logfile.Open(path, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range tt.lines {
+				if _, err := w.Write([]byte(line)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, readLogs(t, dir)); diff != "" {
+				t.Fatalf("log files (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestOpen_perm(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no POSIX permission bits")
+	}
+	path := filepath.Join(t.TempDir(), "agent.log")
+	w, err := logfile.Open(path, &logfile.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The log names the apps the agent serves tokens for; keep it to the current user.
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("perm = %o, want %o", perm, 0o600)
+	}
+}
+
+func TestWriter_closed(t *testing.T) {
+	t.Parallel()
+	w, err := logfile.Open(filepath.Join(t.TempDir(), "agent.log"), &logfile.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("a\n")); err == nil {
+		t.Fatal("writing to a closed log file must fail")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package logfile
+
+import (
+	"errors"
+	"os"
+)
+
+// redirectStderr is not supported off Unix, where the agent can't be detached.
+func redirectStderr(_ *os.File) error {
+	return errors.New("not supported on this OS")
+}
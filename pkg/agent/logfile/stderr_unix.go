@@ -0,0 +1,14 @@
+//go:build unix
+
+package logfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// redirectStderr makes the process's standard error descriptor refer to f.
+func redirectStderr(f *os.File) error {
+	return unix.Dup2(int(f.Fd()), int(os.Stderr.Fd())) //nolint:wrapcheck
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// The environment variables systemd passes the sockets of a socket-activated service in
+// (see sd_listen_fds(3)).
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+)
+
+// listenFDsStart is the first file descriptor systemd passes (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// activatedListener returns the socket systemd opened for the agent when it started the
+// agent on a connection (see 'ghtkn agent install-service --socket-activation'), and nil
+// when the agent was not socket activated. It removes systemd's variables from the
+// environment, so the hooks the agent runs don't take the socket for theirs.
+func activatedListener() (net.Listener, error) {
+	pid, fds := os.Getenv(envListenPID), os.Getenv(envListenFDs)
+	for _, k := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		if err := os.Unsetenv(k); err != nil {
+			return nil, fmt.Errorf("remove %s from the environment: %w", k, err)
+		}
+	}
+	activated, err := parseListenFDs(pid, fds, os.Getpid())
+	if err != nil || !activated {
+		return nil, err
+	}
+	f := os.NewFile(listenFDsStart, "ghtkn agent socket")
+	// net.FileListener takes its own copy of the descriptor.
+	defer f.Close()
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("take over the socket systemd passed: %w", err)
+	}
+	return listener, nil
+}
+
+// parseListenFDs reports whether the values of LISTEN_PID and LISTEN_FDS pass this
+// process, whose process ID is self, the one socket the agent serves. Variables meant for
+// another process, which inherited them by mistake, are ignored.
+func parseListenFDs(pid, fds string, self int) (bool, error) {
+	if pid == "" || fds == "" {
+		return false, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != self {
+		return false, nil //nolint:nilerr // meant for another process
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil {
+		return false, fmt.Errorf("parse %s: %w", envListenFDs, err)
+	}
+	switch {
+	case n == 0:
+		return false, nil
+	case n > 1:
+		return false, errors.New("systemd passed more than one socket; the agent serves one, so give its .socket unit a single ListenStream")
+	}
+	return true, nil
+}
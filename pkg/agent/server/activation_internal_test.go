@@ -0,0 +1,39 @@
+package server
+
+import "testing"
+
+func TestParseListenFDs(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		pid     string
+		fds     string
+		want    bool
+		wantErr bool
+	}{
+		{name: "not activated"},
+		{name: "activated", pid: "100", fds: "1", want: true},
+		{name: "meant for another process", pid: "99", fds: "1"},
+		{name: "no socket", pid: "100", fds: "0"},
+		{name: "more than one socket", pid: "100", fds: "2", wantErr: true},
+		{name: "invalid count", pid: "100", fds: "x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseListenFDs(tt.pid, tt.fds, 100)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("parseListenFDs(%q, %q) = %v, want %v", tt.pid, tt.fds, got, tt.want)
+			}
+		})
+	}
+}
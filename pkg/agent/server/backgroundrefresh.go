@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+const (
+	// backgroundRefreshLead is how long before its expiration a stored access token is
+	// renewed in the background. It is well above the min_expiration clients usually ask
+	// for, so a GET finds a token that is valid for it and never waits on GitHub.
+	backgroundRefreshLead = 30 * time.Minute
+	// backgroundRefreshInterval is how often the background refresher looks for expiring
+	// tokens. It is a fraction of backgroundRefreshLead, so every token is seen several
+	// times inside its window and a failed attempt (e.g. offline) is retried.
+	backgroundRefreshInterval = 5 * time.Minute
+)
+
+// refreshGuard serializes refreshes per client ID and tracks which tokens the background
+// refresher may renew. Rotating refresh tokens are single-use, so two refreshes of the
+// same token racing each other make one fail, which looks exactly like a leaked refresh
+// token; holding the client's lock across the GitHub call rules that out.
+type refreshGuard struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+	// used holds the client IDs whose token a client fetched since the background
+	// refresher last renewed it. Only those are renewed after the first pass, so a token
+	// nobody uses is renewed at most once and then left to expire, and the refresh-token
+	// sweep still sees it as unused.
+	used map[string]struct{}
+}
+
+// lock locks clientID's refresh lock and returns the function that unlocks it.
+func (g *refreshGuard) lock(clientID string) func() {
+	g.mu.Lock()
+	if g.locks == nil {
+		g.locks = map[string]*sync.Mutex{}
+	}
+	l, ok := g.locks[clientID]
+	if !ok {
+		l = &sync.Mutex{}
+		g.locks[clientID] = l
+	}
+	g.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// lockAll locks every client's refresh lock and keeps new ones from being created, so no
+// refresh is in progress until the returned function unlocks them. An upgrading agent
+// holds them across the re-exec: a refresh cut off between GitHub rotating the refresh
+// token and the agent storing the new one would lose it. A refresh that holds a lock may
+// still need g.mu, so g.mu is only held once every existing lock has been taken.
+func (g *refreshGuard) lockAll() func() {
+	var held []*sync.Mutex
+	for {
+		g.mu.Lock()
+		var pending []*sync.Mutex
+		for _, l := range g.locks {
+			if !slices.Contains(held, l) {
+				pending = append(pending, l)
+			}
+		}
+		if len(pending) == 0 {
+			return func() {
+				for _, l := range held {
+					l.Unlock()
+				}
+				g.mu.Unlock()
+			}
+		}
+		g.mu.Unlock()
+		for _, l := range pending {
+			l.Lock()
+			held = append(held, l)
+		}
+	}
+}
+
+// markUsed records that a client fetched clientID's token.
+func (g *refreshGuard) markUsed(clientID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.used == nil {
+		g.used = map[string]struct{}{}
+	}
+	g.used[clientID] = struct{}{}
+}
+
+// wasUsed reports whether a client fetched clientID's token since it was last renewed in
+// the background.
+func (g *refreshGuard) wasUsed(clientID string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.used[clientID]
+	return ok
+}
+
+// clearUsed forgets that clientID's token was fetched, once it has been renewed in the
+// background, so it is renewed again only after the next fetch.
+func (g *refreshGuard) clearUsed(clientID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.used, clientID)
+}
+
+// startBackgroundRefresh launches the job that renews stored access tokens shortly
+// before they expire, so a GET is served from disk instead of paying a GitHub round-trip
+// (and failing offline) the first time a client asks after a break. It runs once
+// immediately, renewing every expiring token since the user has just unlocked the agent,
+// and then every backgroundRefreshInterval, renewing only the tokens fetched since their
+// last background renewal, until ctx is canceled (LOCK or agent shutdown).
+//
+// A token that expired longer ago than its app's TTL is left alone even on the first
+// pass: it is unused past the refresh-token TTL, and the sweep discards it. The tokens
+// of apps policy does not enable refresh for are never renewed.
+//
+// It is started only when refresh is enabled for some app. It is called from
+// handleUnlock with s.mu held; it spawns a goroutine and returns. The store is passed
+// in directly so the goroutine does not depend on the locked state.
+func (s *Server) startBackgroundRefresh(ctx context.Context, st tokenstore.Cache, policy *refreshPolicy) {
+	go func() {
+		s.refreshExpiringTokens(ctx, st, policy, true)
+		ticker := time.NewTicker(backgroundRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.refreshExpiringTokens(ctx, st, policy, false)
+			}
+		}
+	}()
+}
+
+// refreshExpiringTokens renews every stored token of an app with refresh enabled that
+// expires within backgroundRefreshLead: on the first pass after unlock every such
+// token, afterwards only those a client fetched since their last background renewal.
+func (s *Server) refreshExpiringTokens(ctx context.Context, st tokenstore.Cache, policy *refreshPolicy, firstPass bool) {
+	ids, err := st.ClientIDs()
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("list stored tokens for the background refresh")
+		}
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		enabled, ttl := policy.forClient(id)
+		if !enabled {
+			continue
+		}
+		s.refreshInBackground(ctx, st, id, time.Now().Add(-ttl), firstPass)
+	}
+}
+
+// refreshInBackground renews clientID's stored token when it expires within
+// backgroundRefreshLead, carries a valid refresh token, and did not expire before
+// idleCutoff. It is best-effort: a failed refresh is logged and the token left as is,
+// unless another process sharing the token directory refreshed it first (see
+// refreshedByPeer). It never raises the incident warning, since a failure here is usually
+// the agent being offline; the next GET retries the refresh itself and raises it if the
+// refresh token really is dead.
+func (s *Server) refreshInBackground(ctx context.Context, st tokenstore.Cache, clientID string, idleCutoff time.Time, firstPass bool) {
+	unlock := s.refresh.lock(clientID)
+	defer unlock()
+	// Read under the refresh lock, so a GET that refreshed the token while this waited
+	// is seen and the token is not refreshed twice.
+	token, ok, resp := s.readStoredToken(st, clientID)
+	if resp != nil || !ok {
+		return
+	}
+	defer scrub(token)
+	if !s.needsBackgroundRefresh(token) || tokenExpiredBefore(token, idleCutoff) {
+		return
+	}
+	if !firstPass && !s.refresh.wasUsed(clientID) {
+		return
+	}
+	refreshToken := s.validRefreshToken(token)
+	//nolint:bodyclose // RefreshToken reads and closes the response body internally; it returns the decoded value.
+	newToken, _, _, err := s.client.RefreshToken(ctx, clientID, refreshToken)
+	if err != nil {
+		// Another agent or process sharing the token directory may have consumed this
+		// rotating refresh token first; the stored token is then fresh already.
+		if s.refreshedByPeer(st, clientID, backgroundRefreshLead) != nil {
+			s.refresh.clearUsed(clientID)
+			if s.logger != nil {
+				s.logger.Debug("an expiring token was already refreshed outside the agent", "client_id", clientID)
+			}
+			return
+		}
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("refresh an expiring token in the background; the next get retries it", "client_id", clientID)
+		}
+		return
+	}
+	fresh, err := s.storeRefreshed(st, clientID, newToken, sessionStartedAt(token), backgroundRefreshLead)
+	scrub(fresh)
+	if err != nil {
+		return
+	}
+	s.refresh.clearUsed(clientID)
+	if s.logger != nil {
+		s.logger.Info("refreshed an expiring token in the background", "client_id", clientID)
+	}
+}
+
+// needsBackgroundRefresh reports whether a stored token expires within
+// backgroundRefreshLead and can be refreshed. A never-expiring token never needs it.
+func (s *Server) needsBackgroundRefresh(raw json.RawMessage) bool {
+	token := &struct {
+		ExpirationDate time.Time `json:"expiration_date"`
+	}{}
+	if err := json.Unmarshal(raw, token); err != nil || token.ExpirationDate.IsZero() {
+		return false
+	}
+	return s.validRefreshToken(raw) != "" && !s.tokenValid(raw, backgroundRefreshLead)
+}
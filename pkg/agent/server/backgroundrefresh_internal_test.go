@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+)
+
+// refreshCounter is a fake token endpoint that counts refreshes and answers with a fresh
+// 8-hour token, or with status when it is not 200.
+type refreshCounter struct {
+	calls  int
+	status int
+}
+
+func (f *refreshCounter) RoundTrip(*http.Request) (*http.Response, error) {
+	f.calls++
+	body := `{"access_token":"new-access","refresh_token":"new-refresh","expires_in":28800,"refresh_token_expires_in":15897600}`
+	if f.status != http.StatusOK {
+		body = "{}"
+	}
+	return &http.Response{StatusCode: f.status, Body: io.NopCloser(strings.NewReader(body)), Header: make(http.Header)}, nil
+}
+
+// seedWithRefresh stores an access token expiring at expiration with a refresh token
+// valid for a day. It must be called from within a synctest bubble.
+func seedWithRefresh(t *testing.T, c *Server, clientID string, expiration time.Time) {
+	t.Helper()
+	seeded := fmt.Sprintf(`{"access_token":"old","expiration_date":"%s","refresh_token":"old-refresh","refresh_token_expiration_date":"%s"}`,
+		expiration.Format(time.RFC3339), time.Now().Add(24*time.Hour).Format(time.RFC3339))
+	if err := c.store.Set(clientID, json.RawMessage(seeded)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storedAccessToken returns the access token stored for clientID.
+func storedAccessToken(t *testing.T, c *Server, clientID string) string {
+	t.Helper()
+	raw, ok, err := c.store.Get(clientID)
+	if err != nil || !ok {
+		t.Fatalf("get the stored token of %s: ok=%v err=%v", clientID, ok, err)
+	}
+	token := &storedToken{}
+	if err := json.Unmarshal(raw, token); err != nil {
+		t.Fatal(err)
+	}
+	return token.AccessToken
+}
+
+// TestServer_refreshExpiringTokens_firstPass verifies that the pass right after unlock
+// renews every token expiring within the lead time that carries a valid refresh token,
+// and leaves alone fresh tokens, tokens without a refresh token, and tokens idle past the
+// TTL, which the sweep discards.
+func TestServer_refreshExpiringTokens_firstPass(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		rt := &refreshCounter{status: http.StatusOK}
+		setClientTransport(c, rt)
+		now := time.Now()
+		seedWithRefresh(t, c, "Iv1.expiring", now.Add(10*time.Minute))
+		seedWithRefresh(t, c, "Iv1.expired", now.Add(-time.Hour))
+		seedWithRefresh(t, c, "Iv1.fresh", now.Add(5*time.Hour))
+		seedWithRefresh(t, c, "Iv1.idle", now.Add(-10*24*time.Hour))
+		seedToken(t, c, "Iv1.norefresh", now.Add(10*time.Minute))
+
+		c.refreshExpiringTokens(t.Context(), c.store, &refreshPolicy{enabled: true, ttl: 7 * 24 * time.Hour}, true)
+
+		if rt.calls != 2 {
+			t.Fatalf("refreshes = %d, want 2", rt.calls)
+		}
+		for id, want := range map[string]string{
+			"Iv1.expiring":  "new-access",
+			"Iv1.expired":   "new-access",
+			"Iv1.fresh":     "old",
+			"Iv1.idle":      "old",
+			"Iv1.norefresh": "x",
+		} {
+			if got := storedAccessToken(t, c, id); got != want {
+				t.Errorf("access token of %s = %q, want %q", id, got, want)
+			}
+		}
+	})
+}
+
+// TestServer_refreshExpiringTokens_onlyUsed verifies that after the first pass only
+// tokens a client fetched since their last background renewal are renewed, so an unused
+// token is not kept alive forever.
+func TestServer_refreshExpiringTokens_onlyUsed(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		rt := &refreshCounter{status: http.StatusOK}
+		setClientTransport(c, rt)
+		const clientID = "Iv1.used"
+		seedWithRefresh(t, c, clientID, time.Now().Add(10*time.Minute))
+
+		c.refreshExpiringTokens(t.Context(), c.store, &refreshPolicy{enabled: true, ttl: 7 * 24 * time.Hour}, false)
+		if rt.calls != 0 {
+			t.Fatalf("an unused token was refreshed %d times", rt.calls)
+		}
+
+		// A GET served from the store counts as a use.
+		if got := c.handleGet(t.Context(), &agentapi.Request{ProtocolVersion: 1, Command: agentapi.CommandGet, ClientID: clientID}, true); !got.OK {
+			t.Fatalf("GET failed: %s", got.Error)
+		}
+		c.refreshExpiringTokens(t.Context(), c.store, &refreshPolicy{enabled: true, ttl: 7 * 24 * time.Hour}, false)
+		if rt.calls != 1 {
+			t.Fatalf("refreshes = %d, want 1", rt.calls)
+		}
+		if c.refresh.wasUsed(clientID) {
+			t.Fatal("the use should be forgotten once the token is renewed")
+		}
+	})
+}
+
+// TestServer_refreshExpiringTokens_failure verifies that a failed background refresh
+// (e.g. offline) keeps the stored token and the recorded use, so a later pass or the
+// next GET retries it.
+func TestServer_refreshExpiringTokens_failure(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		setClientTransport(c, &refreshCounter{status: http.StatusInternalServerError})
+		const clientID = "Iv1.offline"
+		seedWithRefresh(t, c, clientID, time.Now().Add(10*time.Minute))
+		c.refresh.markUsed(clientID)
+
+		c.refreshExpiringTokens(t.Context(), c.store, &refreshPolicy{enabled: true, ttl: 7 * 24 * time.Hour}, false)
+
+		if got := storedAccessToken(t, c, clientID); got != "old" {
+			t.Fatalf("access token = %q, want the old one kept", got)
+		}
+		if !c.refresh.wasUsed(clientID) {
+			t.Fatal("the use should be kept so the refresh is retried")
+		}
+	})
+}
+
+// peerRefresher is a fake token endpoint standing in for a refresh that another process
+// sharing the token directory won: it stores that process's fresh token and then fails,
+// as GitHub does for the refresh token consumed first.
+type peerRefresher struct {
+	store func()
+}
+
+func (f *peerRefresher) RoundTrip(*http.Request) (*http.Response, error) {
+	f.store()
+	return &http.Response{StatusCode: http.StatusBadRequest, Body: io.NopCloser(strings.NewReader(`{"error":"bad_refresh_token"}`)), Header: make(http.Header)}, nil
+}
+
+// TestServer_refreshExpiringTokens_peer verifies that a background refresh failing
+// because another process sharing the token directory refreshed the token first keeps
+// that process's token, forgets the use, and does not warn.
+func TestServer_refreshExpiringTokens_peer(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		var buf bytes.Buffer
+		c.logger = slog.New(slog.NewTextHandler(&buf, nil))
+		const clientID = "Iv1.shared"
+		setClientTransport(c, &peerRefresher{store: func() {
+			seeded := fmt.Sprintf(`{"access_token":"peer","expiration_date":"%s","refresh_token":"peer-refresh","refresh_token_expiration_date":"%s"}`,
+				time.Now().Add(8*time.Hour).Format(time.RFC3339), time.Now().Add(24*time.Hour).Format(time.RFC3339))
+			if err := c.store.Set(clientID, json.RawMessage(seeded)); err != nil {
+				t.Error(err)
+			}
+		}})
+		seedWithRefresh(t, c, clientID, time.Now().Add(10*time.Minute))
+		c.refresh.markUsed(clientID)
+
+		c.refreshExpiringTokens(t.Context(), c.store, &refreshPolicy{enabled: true, ttl: 7 * 24 * time.Hour}, false)
+
+		if got := storedAccessToken(t, c, clientID); got != "peer" {
+			t.Fatalf("access token = %q, want the peer's", got)
+		}
+		if c.refresh.wasUsed(clientID) {
+			t.Fatal("the use should be forgotten once the token is renewed")
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("a peer's refresh must not be warned about, got %q", buf.String())
+		}
+	})
+}
+
+// TestRefreshGuard_lockAll verifies that lockAll waits for a refresh in progress and
+// keeps new ones from starting until it is released.
+func TestRefreshGuard_lockAll(t *testing.T) {
+	t.Parallel()
+	g := &refreshGuard{}
+	unlockA := g.lock("Iv1.a")
+	locked := make(chan func())
+	go func() { locked <- g.lockAll() }()
+	select {
+	case <-locked:
+		t.Fatal("lockAll must wait for the refresh in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockA()
+	var unlockAll func()
+	select {
+	case unlockAll = <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lockAll must return once the refresh in progress ends")
+	}
+
+	refreshed := make(chan struct{})
+	go func() {
+		g.lock("Iv1.b")()
+		close(refreshed)
+	}()
+	select {
+	case <-refreshed:
+		t.Fatal("a new refresh must wait until lockAll is released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlockAll()
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a new refresh must proceed once lockAll is released")
+	}
+}
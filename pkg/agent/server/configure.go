@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/refreshtoken"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+// handleConfigure replaces the refresh-token setting of an unlocked agent, as UNLOCK
+// would set it, without locking it. Enabling refresh is bound to the passphrase, so the
+// request must carry it: it is checked against the key file and the data key in use,
+// and a wrong one changes nothing (see verifyPassphrase). Turning refresh off for an
+// app that has a still-valid refresh token stored needs the same confirmation as
+// UNLOCK. The change applies at once: the refresh tokens of the apps refresh is now off
+// for are stripped, and the sweeps restart with the new setting.
+//
+// The passphrase is checked without s.mu (see verifiedStore), so the agent keeps serving
+// while the key is derived; a LOCK arriving meanwhile makes the request fail.
+func (s *Server) handleConfigure(ctx context.Context, req *adminapi.Request) *adminapi.Response {
+	defer scrub(req.Passphrase)
+	policy := s.newRefreshPolicy(req.EnableRefreshToken, req.RefreshTokenTTL, req.AppRefresh)
+	if policy.anyEnabled() && !refreshtoken.Supported(s.goos) {
+		return errorResponse(errMsgRefreshTokenUnsupportedOS)
+	}
+	st, resp := s.verifiedStore(req.Passphrase, errMsgConfigure)
+	if resp != nil {
+		return resp
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store != st {
+		// Locked since the passphrase was checked.
+		return errorResponse(agentapi.RespLocked)
+	}
+	if s.needsRefreshRemovalConfirmation(&req.Request, policy, s.store) {
+		return &adminapi.Response{Response: agentapi.Response{RefreshTokenRemovalPending: true, Error: errMsgRefreshTokenRemovalPending}}
+	}
+	s.applyRefreshPolicy(ctx, s.store, policy)
+	if s.logger != nil {
+		s.logger.Info("agent reconfigured", "refresh_token_enabled", policy.enabled, "refresh_token_ttl", policy.ttl)
+	}
+	s.logRefreshPolicy(policy)
+	return &adminapi.Response{
+		Response:          agentapi.Response{OK: true, RefreshTokenEnabled: policy.enabled},
+		AppRefreshApplied: len(req.AppRefresh) > 0,
+	}
+}
+
+// verifyPassphrase checks passphrase against the key file and the data key of st, the
+// store of the unlocked agent, returning the response to send when it does not
+// authenticate this agent, or failMsg when it can't be checked. Deriving the key takes
+// about a second (Argon2id), so the caller should not hold s.mu; it must check that st
+// is still in use before acting on the result.
+//
+// An ephemeral agent has no passphrase to check: it was unlocked without one, so
+// requiring one here would protect nothing.
+func (s *Server) verifyPassphrase(st tokenstore.Cache, passphrase []byte, failMsg string) *adminapi.Response {
+	if s.ephemeral {
+		return nil
+	}
+	dataKey, err := s.loadDataKey(s.keyFile, passphrase)
+	if err != nil {
+		if errors.Is(err, keyfile.ErrIncorrectPassphrase) {
+			return errorResponse(keyfile.ErrIncorrectPassphrase.Error())
+		}
+		return errorResponse(failMsg)
+	}
+	// The key file may have been replaced since the unlock (e.g. by 'ghtkn agent reset'
+	// from another agent); a passphrase for a different key does not authenticate this one.
+	matches := st.HasKey(dataKey)
+	scrub(dataKey)
+	if !matches {
+		return errorResponse(keyfile.ErrIncorrectPassphrase.Error())
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+)
+
+// TestServer_respond_configure verifies that CONFIGURE needs an unlocked agent and its
+// passphrase, and that it applies a new refresh setting live: enabling refresh with a
+// TTL, then turning it off, which strips the stored refresh token once confirmed.
+func TestServer_respond_configure(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	c.keyFile = filepath.Join(t.TempDir(), "key")
+	c.tokenDir = t.TempDir()
+	configure := func(req string) *adminapi.Response {
+		t.Helper()
+		got, _ := c.respond(t.Context(), strings.NewReader(req+"\n"))
+		return got
+	}
+
+	if diff := cmp.Diff(errorResponse(agentapi.RespLocked), configure(`{"protocol_version":1,"command":"CONFIGURE","passphrase":"pw","enable_refresh_token":true}`)); diff != "" {
+		t.Fatalf("CONFIGURE while locked (-want +got):\n%s", diff)
+	}
+	if resp, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK","passphrase":"pw"}`+"\n")); !resp.OK {
+		t.Fatalf("unlock failed: %+v", resp)
+	}
+
+	// A wrong passphrase changes nothing.
+	if diff := cmp.Diff(errorResponse(keyfile.ErrIncorrectPassphrase.Error()), configure(`{"protocol_version":1,"command":"CONFIGURE","passphrase":"wrong","enable_refresh_token":true}`)); diff != "" {
+		t.Fatalf("CONFIGURE with a wrong passphrase (-want +got):\n%s", diff)
+	}
+	if c.refreshEnabled() {
+		t.Fatal("a wrong passphrase must not enable refresh")
+	}
+
+	// Enable refresh with a three-day TTL.
+	got := configure(`{"protocol_version":1,"command":"CONFIGURE","passphrase":"pw","enable_refresh_token":true,"refresh_token_ttl":259200000000000}`)
+	if diff := cmp.Diff(&adminapi.Response{Response: agentapi.Response{OK: true, RefreshTokenEnabled: true}}, got); diff != "" {
+		t.Fatalf("CONFIGURE --enable-refresh (-want +got):\n%s", diff)
+	}
+	if enabled, ttl := c.refreshState(); !enabled || ttl != 3*24*time.Hour {
+		t.Fatalf("refresh state = %v, %v; want true, 72h", enabled, ttl)
+	}
+	const seeded = `{"access_token":"ghu_a","expiration_date":"2999-01-01T00:00:00Z","refresh_token":"ghr_a","refresh_token_expiration_date":"2999-06-01T00:00:00Z"}`
+	if err := c.store.Set("Iv1.x", json.RawMessage(seeded)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Turning it off would drop the refresh token, so it needs confirmation.
+	if got := configure(`{"protocol_version":1,"command":"CONFIGURE","passphrase":"pw"}`); !got.RefreshTokenRemovalPending {
+		t.Fatalf("CONFIGURE without confirmation: %+v", got)
+	}
+	if !c.refreshEnabled() {
+		t.Fatal("an unconfirmed CONFIGURE must not change the setting")
+	}
+	if got := configure(`{"protocol_version":1,"command":"CONFIGURE","passphrase":"pw","confirm_refresh_token_removal":true}`); !got.OK || got.RefreshTokenEnabled {
+		t.Fatalf("confirmed CONFIGURE: %+v", got)
+	}
+	raw, ok, err := c.store.Get("Iv1.x")
+	if err != nil || !ok {
+		t.Fatalf("read the token: ok=%v err=%v", ok, err)
+	}
+	if c.validRefreshToken(raw) != "" {
+		t.Fatal("the refresh token must be stripped once refresh is turned off")
+	}
+}
+
+// TestServer_respond_configure_verifyUnlocked verifies that the agent keeps answering
+// while CONFIGURE derives the key to check the passphrase, and that a LOCK arriving
+// meanwhile makes CONFIGURE fail instead of configuring the locked agent.
+func TestServer_respond_configure_verifyUnlocked(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	c.keyFile = filepath.Join(t.TempDir(), "key")
+	c.tokenDir = t.TempDir()
+	if resp, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK","passphrase":"pw"}`+"\n")); !resp.OK {
+		t.Fatalf("unlock failed: %+v", resp)
+	}
+	deriving := make(chan struct{})
+	release := make(chan struct{})
+	c.loadDataKey = func(path string, passphrase []byte) ([]byte, error) {
+		close(deriving)
+		<-release
+		return keyfile.LoadDataKey(path, passphrase)
+	}
+	configured := make(chan *adminapi.Response, 1)
+	go func() {
+		got, _ := c.respond(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"CONFIGURE","passphrase":"pw","enable_refresh_token":true}`+"\n"))
+		configured <- got
+	}()
+	<-deriving
+
+	status, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"STATUS"}`+"\n"))
+	if !status.OK || status.Locked {
+		t.Fatalf("STATUS during CONFIGURE must report unlocked, got %+v", status)
+	}
+	c.handleLock()
+	close(release)
+	if diff := cmp.Diff(errorResponse(agentapi.RespLocked), <-configured); diff != "" {
+		t.Fatalf("CONFIGURE overtaken by LOCK (-want +got):\n%s", diff)
+	}
+	if c.refreshEnabled() {
+		t.Fatal("a CONFIGURE overtaken by LOCK must not enable refresh")
+	}
+}
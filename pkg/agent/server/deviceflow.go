@@ -129,7 +129,7 @@ func (s *Server) pollAndStore(ctx context.Context, logger *slog.Logger, clientID
 	if st == nil {
 		return errors.New("the backend is locked, so the minted token was discarded")
 	}
-	raw, err := s.encodeToken(token, enableRefreshToken)
+	raw, err := s.encodeToken(token, enableRefreshToken, time.Now())
 	if err != nil {
 		return fmt.Errorf("encode the minted access token: %w", err)
 	}
@@ -145,11 +145,14 @@ func (s *Server) pollAndStore(ctx context.Context, logger *slog.Logger, clientID
 // encodeToken converts a device flow access token into the JSON the agent stores: the
 // token value plus an absolute expiration date computed from ExpiresIn. When
 // enableRefreshToken is set it also stores the refresh token and its own (longer)
-// expiration computed from RefreshTokenExpiresIn.
-func (s *Server) encodeToken(token *deviceflow.AccessToken, enableRefreshToken bool) (json.RawMessage, error) {
+// expiration computed from RefreshTokenExpiresIn. sessionStartedAt is when the session
+// the token belongs to began: now for a token minted by the device flow, and the
+// previous token's for a refreshed one.
+func (s *Server) encodeToken(token *deviceflow.AccessToken, enableRefreshToken bool, sessionStartedAt time.Time) (json.RawMessage, error) {
 	now := time.Now()
 	ac := &storedToken{
-		AccessToken: token.AccessToken,
+		AccessToken:      token.AccessToken,
+		SessionStartedAt: sessionStartedAt,
 	}
 	// expires_in=0 means the token never expires (a GitHub App with user-token
 	// expiration disabled); leave ExpirationDate the zero time, which the expiry checks
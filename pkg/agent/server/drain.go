@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// DefaultDrainTimeout is how long a stopping agent waits by default for the device flows
+// in progress. A flow the user has just approved completes on its next poll, which
+// GitHub spaces a few seconds apart, so this covers it with room to spare without
+// holding up a service manager's stop.
+const DefaultDrainTimeout = 10 * time.Second
+
+const (
+	// drainGrace is the least time a stopping agent leaves in-flight connections to write
+	// their responses after the device flows are settled, so the STOP acknowledgment goes
+	// out even when the flows took the whole drain timeout. It is also how long canceled
+	// flows get to record that they gave up.
+	drainGrace = time.Second
+	// drainPollInterval is how often a stopping agent checks whether the work it waits
+	// for has finished.
+	drainPollInterval = 100 * time.Millisecond
+)
+
+// drain winds down a stopping agent once it no longer accepts connections. It waits up
+// to drainTimeout for the device flows in progress, so a flow the user has just approved
+// stores its token instead of being lost; then it cancels the remaining work (the flows
+// that did not complete are marked failed) and waits for the connections still being
+// served to write their responses. A locked agent can't store what a flow mints, so it
+// does not wait for the flows at all; that is also what keeps PANIC, which locks before
+// it stops, from being held up.
+//
+// It returns the client IDs whose flow it abandoned and the number of connections that
+// were still open when it gave up on them. The abandoned flows are also handed to the
+// STOP handler waiting on s.drained, so 'ghtkn agent stop' can report them.
+func (s *Server) drain(cancelWork context.CancelFunc) ([]string, int64) {
+	deadline := time.Now().Add(s.drainTimeout)
+	servers := s.flowServers()
+	waitUntil(deadline, func() bool { return !anyDeviceFlowRunning(servers, true) })
+	running := make([][]string, len(servers))
+	for i, srv := range servers {
+		running[i] = srv.runningDeviceFlows()
+	}
+	cancelWork()
+	// A canceled flow gives up at once and keeps its marker, now failed; only a flow that
+	// stored its token clears it. Give the flows a moment to settle so one that completed
+	// right at the deadline is not reported as abandoned.
+	waitUntil(time.Now().Add(drainGrace), func() bool { return !anyDeviceFlowRunning(servers, false) })
+	var abandoned []string
+	for i, srv := range servers {
+		for _, clientID := range running[i] {
+			if _, ok := srv.deviceFlow(clientID); ok {
+				abandoned = append(abandoned, clientID)
+			}
+		}
+	}
+	s.abandoned = abandoned
+	if s.drained != nil {
+		close(s.drained)
+	}
+	if grace := time.Now().Add(drainGrace); deadline.Before(grace) {
+		deadline = grace
+	}
+	waitUntil(deadline, func() bool { return s.activeConns.Load() == 0 })
+	return abandoned, s.activeConns.Load()
+}
+
+// stop asks the running agent to stop and waits until it has settled its device flows
+// (see drain). It returns the client IDs whose flow the stop abandoned.
+func (s *Server) stop() []string {
+	s.shutdown()
+	if s.drained == nil {
+		return nil
+	}
+	<-s.drained
+	return s.abandoned
+}
+
+// anyDeviceFlowRunning reports whether a device flow of any of servers is still running.
+// With unlockedOnly it ignores the flows of a locked server, which could not store what
+// they mint.
+func anyDeviceFlowRunning(servers []*Server, unlockedOnly bool) bool {
+	for _, srv := range servers {
+		if unlockedOnly && srv.tokenStore() == nil {
+			continue
+		}
+		if len(srv.runningDeviceFlows()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runningDeviceFlows returns the client IDs whose device flow is still running, i.e.
+// recorded and not marked failed, sorted.
+func (s *Server) runningDeviceFlows() []string {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	var ids []string
+	for clientID, st := range s.status {
+		if st.errMsg == "" {
+			ids = append(ids, clientID)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// waitUntil polls done until it reports true or deadline passes. It reports whether done
+// did.
+func waitUntil(deadline time.Time, done func() bool) bool {
+	for {
+		if done() {
+			return true
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		time.Sleep(min(drainPollInterval, remaining))
+	}
+}
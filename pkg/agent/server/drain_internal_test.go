@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// fakeDeviceFlow records a running device flow for clientID, like startDeviceFlow, and
+// ends it like pollAndStore would: it completes (clears the marker) after d, or fails
+// (marks it failed) when ctx is canceled first.
+func fakeDeviceFlow(ctx context.Context, c *Server, clientID string, d time.Duration) {
+	c.statusMu.Lock()
+	c.status[clientID] = &deviceFlowState{userCode: "ABCD-1234"}
+	c.statusMu.Unlock()
+	go func() {
+		select {
+		case <-time.After(d):
+			c.clearDeviceFlow(clientID)
+		case <-ctx.Done():
+			c.failDeviceFlow(clientID)
+		}
+	}()
+}
+
+func TestServer_drain(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		locked bool
+		// flows maps a client ID to how long its device flow takes to complete.
+		flows map[string]time.Duration
+		// failed is a client ID whose flow had already failed before the stop.
+		failed        string
+		wantAbandoned []string
+		// maxElapsed bounds how long the drain may take.
+		maxElapsed time.Duration
+	}{
+		{
+			name: "no flow",
+		},
+		{
+			name:       "a flow that completes within the timeout",
+			flows:      map[string]time.Duration{"Iv1.a": 3 * time.Second},
+			maxElapsed: 3*time.Second + drainPollInterval,
+		},
+		{
+			name:          "a flow the timeout cuts off",
+			flows:         map[string]time.Duration{"Iv1.a": 3 * time.Second, "Iv1.b": time.Hour},
+			wantAbandoned: []string{"Iv1.b"},
+			maxElapsed:    10*time.Second + drainPollInterval,
+		},
+		{
+			name:          "locked: the flows are not waited for",
+			locked:        true,
+			flows:         map[string]time.Duration{"Iv1.a": 3 * time.Second},
+			wantAbandoned: []string{"Iv1.a"},
+			maxElapsed:    drainPollInterval,
+		},
+		{
+			name:   "a flow that failed before the stop is not reported",
+			failed: "Iv1.c",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			synctest.Test(t, func(t *testing.T) {
+				c := newUnlockedServer(t)
+				if tt.locked {
+					c.store = nil
+				}
+				c.drainTimeout = 10 * time.Second
+				c.drained = make(chan struct{})
+				workCtx, cancelWork := context.WithCancel(t.Context())
+				defer cancelWork()
+				for clientID, d := range tt.flows {
+					fakeDeviceFlow(workCtx, c, clientID, d)
+				}
+				if tt.failed != "" {
+					c.status[tt.failed] = &deviceFlowState{errMsg: errMsgDeviceFlowFailed}
+				}
+
+				start := time.Now()
+				abandoned, unfinished := c.drain(cancelWork)
+				if diff := cmp.Diff(tt.wantAbandoned, abandoned); diff != "" {
+					t.Fatalf("abandoned flows (-want +got):\n%s", diff)
+				}
+				if unfinished != 0 {
+					t.Fatalf("unfinished connections = %d, want 0", unfinished)
+				}
+				if elapsed := time.Since(start); elapsed > tt.maxElapsed {
+					t.Fatalf("drain took %s, want at most %s", elapsed, tt.maxElapsed)
+				}
+				if workCtx.Err() == nil {
+					t.Fatal("drain must cancel the remaining work")
+				}
+				select {
+				case <-c.drained:
+				default:
+					t.Fatal("drain must release the STOP handler")
+				}
+				for _, clientID := range tt.wantAbandoned {
+					if st, ok := c.deviceFlow(clientID); !ok || st.errMsg == "" {
+						t.Fatalf("the abandoned flow of %s must be marked failed: %+v", clientID, st)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestServer_handleConn_stopReportsAbandoned verifies that the response to STOP is
+// written once the agent has settled its device flows, and lists the ones it abandoned
+// and the agent's process ID.
+func TestServer_handleConn_stopReportsAbandoned(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		c.drainTimeout = 10 * time.Second
+		c.drained = make(chan struct{})
+		workCtx, cancelWork := context.WithCancel(t.Context())
+		defer cancelWork()
+		fakeDeviceFlow(workCtx, c, "Iv1.done", 3*time.Second)
+		fakeDeviceFlow(workCtx, c, "Iv1.slow", time.Hour)
+		c.shutdown = func() {
+			go c.drain(cancelWork)
+		}
+
+		client, server := net.Pipe()
+		defer client.Close()
+		go c.handleConn(workCtx, server, slog.New(slog.DiscardHandler))
+		if _, err := client.Write([]byte(`{"protocol_version":1,"command":"STOP"}` + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(client).ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &adminapi.Response{}
+		if err := json.Unmarshal(line, got); err != nil {
+			t.Fatal(err)
+		}
+		if !got.OK {
+			t.Fatalf("STOP failed: %+v", got)
+		}
+		if diff := cmp.Diff([]string{"Iv1.slow"}, got.AbandonedDeviceFlows); diff != "" {
+			t.Fatalf("abandoned flows (-want +got):\n%s", diff)
+		}
+		if got.PID != os.Getpid() {
+			t.Fatalf("pid = %d, want the agent's %d", got.PID, os.Getpid())
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/bundle"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// Error messages returned to the clients of EXPORT and IMPORT.
+const (
+	errMsgExport              = "export the tokens"
+	errMsgImport              = "import the tokens"
+	errMsgBundlePassphrase    = "a bundle passphrase is required"
+	errMsgBundleTooLarge      = "the agent stores too many tokens to fit in a bundle"
+	errMsgBundleIncorrectPass = "incorrect bundle passphrase"
+	errMsgNotBundle           = "the file is not a ghtkn agent bundle"
+	errMsgImportInvalidToken  = "the bundle holds no valid token for the app"
+	errMsgImportReadStored    = "read the stored token"
+)
+
+// handleExport encrypts every readable stored token, refresh token included, into a
+// bundle under the bundle passphrase. The bundle hands out refresh tokens, which the
+// agent never gives a client otherwise, so the request must carry the agent passphrase
+// too. A token that can't be decrypted is left out: it is re-minted on the next get
+// anyway. Neither the agent passphrase check (see verifiedStore) nor the bundle's
+// Argon2id derivation holds s.mu, so the agent keeps serving meanwhile.
+func (s *Server) handleExport(req *adminapi.Request) *adminapi.Response {
+	defer scrub(req.Passphrase)
+	defer scrub(req.BundlePassphrase)
+	if len(req.BundlePassphrase) == 0 {
+		return errorResponse(errMsgBundlePassphrase)
+	}
+	st, resp := s.verifiedStore(req.Passphrase, errMsgExport)
+	if resp != nil {
+		return resp
+	}
+	ids, err := st.ClientIDs()
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("list stored tokens to export")
+		}
+		return errorResponse(errMsgExport)
+	}
+	contents := &bundle.Contents{CreatedAt: time.Now()}
+	defer contents.Zero()
+	for _, id := range ids {
+		raw, ok, err := st.Get(id)
+		if err != nil || !ok {
+			if err != nil && s.logger != nil {
+				slogerr.WithError(s.logger, err).Warn("leave an unreadable token out of the export", "client_id", id)
+			}
+			continue
+		}
+		contents.Tokens = append(contents.Tokens, &bundle.Token{ClientID: id, Token: raw})
+	}
+	blob, err := bundle.Seal(req.BundlePassphrase, contents)
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("seal the export bundle")
+		}
+		return errorResponse(errMsgExport)
+	}
+	if len(blob) > adminapi.MaxBundleSize {
+		return errorResponse(errMsgBundleTooLarge)
+	}
+	if s.logger != nil {
+		s.logger.Info("exported the stored tokens", "count", len(contents.Tokens))
+	}
+	return &adminapi.Response{Response: agentapi.Response{OK: true, Count: len(contents.Tokens)}, Bundle: blob}
+}
+
+// verifiedStore returns the token store once passphrase is verified, or the response to
+// send when the agent is locked or the passphrase does not authenticate it (failMsg when
+// it can't be checked). The passphrase is checked without s.mu, so the agent keeps
+// serving while the key is derived; a LOCK arriving meanwhile makes it fail.
+func (s *Server) verifiedStore(passphrase []byte, failMsg string) (tokenstore.Cache, *adminapi.Response) {
+	st := s.tokenStore()
+	if st == nil {
+		return nil, errorResponse(agentapi.RespLocked)
+	}
+	resp := s.verifyPassphrase(st, passphrase, failMsg)
+	if s.tokenStore() != st {
+		// Locked, and maybe unlocked again, while the passphrase was checked: it was
+		// checked against a key no longer in use.
+		return nil, errorResponse(agentapi.RespLocked)
+	}
+	if resp != nil {
+		return nil, resp
+	}
+	return st, nil
+}
+
+// handleImport merges the tokens of a bundle into the token store. A token the agent
+// already holds a readable one for is kept, since the agent may be refreshing it and
+// GitHub invalidates a refresh token once it is used. The refresh token of an app
+// refresh is disabled for is dropped, as an unlock with that setting would drop it. An
+// imported token is recorded as used at the import, so the refresh-token TTL counts from
+// there rather than from its last use on the exporting machine.
+//
+// A request without a bundle imports its plaintext tokens instead (see
+// adminapi.CommandImport), once the agent passphrase it carries is verified. That path
+// replaces a stored token the agent can no longer serve (see unusableToken), since the
+// backend it implements replaces the cached token on Set.
+func (s *Server) handleImport(req *adminapi.Request) *adminapi.Response {
+	defer scrub(req.Passphrase)
+	defer scrub(req.BundlePassphrase)
+	st, contents, resp := s.importContents(req)
+	if resp != nil {
+		return resp
+	}
+	defer contents.Zero()
+	policy := s.currentRefreshPolicy()
+	now := time.Now()
+	resp = &adminapi.Response{Response: agentapi.Response{OK: true}}
+	replaceUnusable := len(req.Bundle) == 0
+	for _, t := range contents.Tokens {
+		imported := s.importToken(st, policy, t, now, replaceUnusable)
+		if imported.Result == adminapi.ImportResultImported {
+			resp.Count++
+		}
+		if imported.Result == adminapi.ImportResultFailed {
+			resp.OK = false
+			resp.Error = errMsgImport
+		}
+		resp.Imported = append(resp.Imported, imported)
+	}
+	if s.logger != nil {
+		s.logger.Info("imported tokens", "count", resp.Count, "from_bundle", len(req.Bundle) > 0)
+	}
+	return resp
+}
+
+// importContents returns the token store and the tokens an IMPORT merges into it, or the
+// response to send when the agent is locked or the tokens can't be read.
+func (s *Server) importContents(req *adminapi.Request) (tokenstore.Cache, *bundle.Contents, *adminapi.Response) {
+	if len(req.Bundle) == 0 {
+		st, resp := s.verifiedStore(req.Passphrase, errMsgImport)
+		if resp != nil {
+			return nil, nil, resp
+		}
+		contents := &bundle.Contents{}
+		for _, t := range req.Tokens {
+			contents.Tokens = append(contents.Tokens, &bundle.Token{ClientID: t.ClientID, Token: t.Token})
+		}
+		return st, contents, nil
+	}
+	st := s.tokenStore()
+	if st == nil {
+		return nil, nil, errorResponse(agentapi.RespLocked)
+	}
+	contents, err := bundle.Open(req.BundlePassphrase, req.Bundle)
+	if err != nil {
+		switch {
+		case errors.Is(err, bundle.ErrIncorrectPassphrase):
+			return nil, nil, errorResponse(errMsgBundleIncorrectPass)
+		case errors.Is(err, bundle.ErrNotBundle):
+			return nil, nil, errorResponse(errMsgNotBundle)
+		}
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("open the import bundle")
+		}
+		return nil, nil, errorResponse(errMsgImport)
+	}
+	return st, contents, nil
+}
+
+// importToken stores the token t of a bundle, unless a readable one is already stored;
+// with replaceUnusable, one the agent can no longer serve is replaced.
+func (s *Server) importToken(st tokenstore.Cache, policy *refreshPolicy, t *bundle.Token, now time.Time, replaceUnusable bool) *adminapi.ImportedToken {
+	imported := &adminapi.ImportedToken{ClientID: t.ClientID, Result: adminapi.ImportResultFailed}
+	if !validAccessToken(t.Token) {
+		imported.Error = errMsgImportInvalidToken
+		return imported
+	}
+	stored, ok, err := st.Get(t.ClientID)
+	replace := ok && replaceUnusable && s.unusableToken(stored, policy.refreshEnabledFor(t.ClientID), now)
+	scrub(stored)
+	switch {
+	case errors.Is(err, tokenstore.ErrInvalidClientID):
+		imported.Error = errMsgInvalidClientID
+		return imported
+	case ok && !replace:
+		imported.Result = adminapi.ImportResultKept
+		return imported
+	case err != nil && !errors.Is(err, tokenstore.ErrDecryptToken):
+		imported.Error = errMsgImportReadStored
+		return imported
+	}
+	token := t.Token
+	if !policy.refreshEnabledFor(t.ClientID) {
+		if stripped, changed := stripRefreshToken(token); changed {
+			defer scrub(stripped)
+			token = stripped
+		}
+	}
+	if err := st.Set(t.ClientID, token); err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("store an imported token", "client_id", t.ClientID)
+		}
+		imported.Error = errMsgSet
+		return imported
+	}
+	if err := st.Touch(t.ClientID, now); err != nil && s.logger != nil {
+		slogerr.WithError(s.logger, err).Warn("record the import of a token", "client_id", t.ClientID)
+	}
+	imported.Result = adminapi.ImportResultImported
+	return imported
+}
+
+// validAccessToken reports whether raw is a stored token with an access token, the least
+// a token must have for the agent to serve or refresh it.
+func validAccessToken(raw []byte) bool {
+	// Only the access token's presence matters; do not materialize it as a Go string.
+	token := &struct {
+		AccessToken json.RawMessage `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(raw, token); err != nil {
+		return false
+	}
+	defer scrub(token.AccessToken)
+	return len(token.AccessToken) > len(`""`) && token.AccessToken[0] == '"'
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+)
+
+// TestServer_respond_exportImport verifies that EXPORT needs the agent passphrase and a
+// bundle passphrase, and that IMPORT merges the bundle into another agent: it keeps the
+// token that agent already holds, and drops the refresh token of an app refresh is
+// disabled for there.
+func TestServer_respond_exportImport(t *testing.T) {
+	t.Parallel()
+	send := func(c *Server, req *adminapi.Request) *adminapi.Response {
+		t.Helper()
+		req.ProtocolVersion = agentapi.ProtocolVersion
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := c.respond(t.Context(), bytes.NewReader(append(b, '\n')))
+		return got
+	}
+
+	src := New("")
+	src.keyFile = filepath.Join(t.TempDir(), "key")
+	src.tokenDir = t.TempDir()
+	export := &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandExport, Passphrase: []byte("pw")}, BundlePassphrase: []byte("bundle pw")}
+	if diff := cmp.Diff(errorResponse(agentapi.RespLocked), send(src, export)); diff != "" {
+		t.Fatalf("EXPORT while locked (-want +got):\n%s", diff)
+	}
+	if resp := send(src, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandUnlock, Passphrase: []byte("pw")}}); !resp.OK {
+		t.Fatalf("unlock failed: %+v", resp)
+	}
+	const (
+		tokenA = `{"access_token":"ghu_a","expiration_date":"2999-01-01T00:00:00Z","refresh_token":"ghr_a","refresh_token_expiration_date":"2999-06-01T00:00:00Z"}`
+		tokenB = `{"access_token":"ghu_b","expiration_date":"2999-01-01T00:00:00Z","refresh_token":"ghr_b","refresh_token_expiration_date":"2999-06-01T00:00:00Z"}`
+	)
+	for id, token := range map[string]string{"Iv1.a": tokenA, "Iv1.b": tokenB} {
+		if err := src.store.Set(id, json.RawMessage(token)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wrongPass := &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandExport, Passphrase: []byte("wrong")}, BundlePassphrase: []byte("bundle pw")}
+	if diff := cmp.Diff(errorResponse(keyfile.ErrIncorrectPassphrase.Error()), send(src, wrongPass)); diff != "" {
+		t.Fatalf("EXPORT with a wrong passphrase (-want +got):\n%s", diff)
+	}
+	noBundlePass := &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandExport, Passphrase: []byte("pw")}}
+	if diff := cmp.Diff(errorResponse(errMsgBundlePassphrase), send(src, noBundlePass)); diff != "" {
+		t.Fatalf("EXPORT without a bundle passphrase (-want +got):\n%s", diff)
+	}
+	exported := send(src, export)
+	if !exported.OK || exported.Count != 2 || len(exported.Bundle) == 0 {
+		t.Fatalf("EXPORT: %+v", exported)
+	}
+
+	dst := newUnlockedServer(t)
+	const kept = `{"access_token":"ghu_kept","expiration_date":"2999-01-01T00:00:00Z"}`
+	if err := dst.store.Set("Iv1.a", json.RawMessage(kept)); err != nil {
+		t.Fatal(err)
+	}
+	wrongBundlePass := &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandImport}, BundlePassphrase: []byte("wrong"), Bundle: exported.Bundle}
+	if diff := cmp.Diff(errorResponse(errMsgBundleIncorrectPass), send(dst, wrongBundlePass)); diff != "" {
+		t.Fatalf("IMPORT with a wrong bundle passphrase (-want +got):\n%s", diff)
+	}
+	got := send(dst, &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandImport}, BundlePassphrase: []byte("bundle pw"), Bundle: exported.Bundle})
+	want := &adminapi.Response{
+		Response: agentapi.Response{OK: true, Count: 1},
+		Imported: []*adminapi.ImportedToken{
+			{ClientID: "Iv1.a", Result: adminapi.ImportResultKept},
+			{ClientID: "Iv1.b", Result: adminapi.ImportResultImported},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("IMPORT (-want +got):\n%s", diff)
+	}
+
+	raw, ok, err := dst.store.Get("Iv1.a")
+	if err != nil || !ok || string(raw) != kept {
+		t.Fatalf("the stored token must be kept: %s ok=%v err=%v", raw, ok, err)
+	}
+	raw, ok, err = dst.store.Get("Iv1.b")
+	if err != nil || !ok {
+		t.Fatalf("read the imported token: ok=%v err=%v", ok, err)
+	}
+	if dst.validRefreshToken(raw) != "" {
+		t.Fatal("the refresh token must be dropped while refresh is disabled")
+	}
+	if meta, err := dst.store.Metadata("Iv1.b"); err != nil || meta.LastUsed.IsZero() {
+		t.Fatalf("the import must be recorded as a use: %+v, %v", meta, err)
+	}
+}
+
+// TestServer_respond_importTokens verifies that IMPORT without a bundle, the path 'ghtkn
+// backend migrate' uses, stores plaintext tokens only with the agent passphrase, and that
+// it replaces a stored token that expired but keeps one that is still valid.
+func TestServer_respond_importTokens(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	c.keyFile = filepath.Join(t.TempDir(), "key")
+	c.tokenDir = t.TempDir()
+	send := func(req *adminapi.Request) *adminapi.Response {
+		t.Helper()
+		req.ProtocolVersion = agentapi.ProtocolVersion
+		b, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := c.respond(t.Context(), bytes.NewReader(append(b, '\n')))
+		return got
+	}
+	if resp := send(&adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandUnlock, Passphrase: []byte("pw")}}); !resp.OK {
+		t.Fatalf("unlock failed: %+v", resp)
+	}
+	const valid = `{"access_token":"ghu_a","expiration_date":"2999-01-01T00:00:00Z"}`
+	for id, token := range map[string]string{
+		"Iv1.expired": `{"access_token":"ghu_old","expiration_date":"2000-01-01T00:00:00Z"}`,
+		"Iv1.valid":   `{"access_token":"ghu_old","expiration_date":"2999-01-01T00:00:00Z"}`,
+	} {
+		if err := c.store.Set(id, json.RawMessage(token)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokens := []*adminapi.ImportToken{
+		{ClientID: "Iv1.a", Token: json.RawMessage(valid)},
+		{ClientID: "Iv1.b", Token: json.RawMessage(`{"expiration_date":"2999-01-01T00:00:00Z"}`)},
+		{ClientID: "Iv1.expired", Token: json.RawMessage(valid)},
+		{ClientID: "Iv1.valid", Token: json.RawMessage(valid)},
+	}
+
+	wrong := &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandImport, Passphrase: []byte("wrong")}, Tokens: tokens}
+	if diff := cmp.Diff(errorResponse(keyfile.ErrIncorrectPassphrase.Error()), send(wrong)); diff != "" {
+		t.Fatalf("IMPORT with a wrong passphrase (-want +got):\n%s", diff)
+	}
+	got := send(&adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandImport, Passphrase: []byte("pw")}, Tokens: tokens})
+	want := &adminapi.Response{
+		Response: agentapi.Response{Error: errMsgImport, Count: 2},
+		Imported: []*adminapi.ImportedToken{
+			{ClientID: "Iv1.a", Result: adminapi.ImportResultImported},
+			{ClientID: "Iv1.b", Result: adminapi.ImportResultFailed, Error: errMsgImportInvalidToken},
+			{ClientID: "Iv1.expired", Result: adminapi.ImportResultImported},
+			{ClientID: "Iv1.valid", Result: adminapi.ImportResultKept},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("IMPORT (-want +got):\n%s", diff)
+	}
+	if _, ok, err := c.store.Get("Iv1.a"); err != nil || !ok {
+		t.Fatalf("read the imported token: ok=%v err=%v", ok, err)
+	}
+}
+
+// TestServer_respond_export_verifyUnlocked verifies that the agent keeps answering while
+// EXPORT derives the key to check the agent passphrase, and that EXPORT then completes.
+func TestServer_respond_export_verifyUnlocked(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	c.keyFile = filepath.Join(t.TempDir(), "key")
+	c.tokenDir = t.TempDir()
+	if resp, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK","passphrase":"pw"}`+"\n")); !resp.OK {
+		t.Fatalf("unlock failed: %+v", resp)
+	}
+	deriving := make(chan struct{})
+	release := make(chan struct{})
+	c.loadDataKey = func(path string, passphrase []byte) ([]byte, error) {
+		close(deriving)
+		<-release
+		return keyfile.LoadDataKey(path, passphrase)
+	}
+	exported := make(chan *adminapi.Response, 1)
+	go func() {
+		got, _ := c.respond(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"EXPORT","passphrase":"pw","bundle_passphrase":"bundle pw"}`+"\n"))
+		exported <- got
+	}()
+	<-deriving
+
+	get, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"GET","client_id":"Iv1.x"}`+"\n"))
+	if diff := cmp.Diff(&agentapi.Response{Error: agentapi.RespNotFound}, get); diff != "" {
+		t.Fatalf("GET during EXPORT (-want +got):\n%s", diff)
+	}
+	close(release)
+	if got := <-exported; !got.OK || len(got.Bundle) == 0 {
+		t.Fatalf("EXPORT must complete, got %+v", got)
+	}
+}
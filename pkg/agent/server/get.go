@@ -8,6 +8,7 @@ import (
 
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/go-github-device-flow/deviceflow"
 	"github.com/suzuki-shunsuke/slog-error/slogerr"
 )
 
@@ -59,7 +60,7 @@ func pendingResponse(state *deviceFlowState) *agentapi.Response {
 // cleared only on a clean completion, which stores the freshly minted token over any
 // previous one). So a token present here is that freshly minted one, even though the
 // pre-flow token was never deleted up front.
-func (s *Server) deviceFlowResult(st *tokenstore.Store, clientID string) *agentapi.Response {
+func (s *Server) deviceFlowResult(st tokenstore.Cache, clientID string) *agentapi.Response {
 	token, ok, resp := s.readStoredToken(st, clientID)
 	defer scrub(token)
 	switch {
@@ -166,7 +167,7 @@ func (s *Server) handleGet(ctx context.Context, req *agentapi.Request, enableRef
 	// the flow completed and stored its token, overwriting any pre-flow one. Return that
 	// token as is (no freshness check); its absence means the flow ended without a token.
 	if req.AwaitDeviceFlow {
-		return s.deviceFlowResult(st, req.ClientID)
+		return s.servedToken(st, req.ClientID, s.deviceFlowResult(st, req.ClientID))
 	}
 
 	// Serve a valid cached token, or silently refresh an expiring one. A nil result
@@ -175,7 +176,12 @@ func (s *Server) handleGet(ctx context.Context, req *agentapi.Request, enableRef
 	// must reach the user regardless of which outcome is ultimately returned.
 	resp, warning := s.cachedToken(ctx, st, req, enableRefreshToken)
 	if resp != nil {
-		return withWarning(resp, warning)
+		return withWarning(s.servedToken(st, req.ClientID, resp), warning)
+	}
+	// The incident policy may have locked the agent while refreshing; st is then the
+	// scrubbed store of the previous unlock, so a device flow must not store into it.
+	if s.tokenStore() == nil {
+		return withWarning(&agentapi.Response{Error: agentapi.RespLocked}, warning)
 	}
 
 	// No valid cached token. Start the flow only when the client asked to; the server
@@ -190,13 +196,28 @@ func (s *Server) handleGet(ctx context.Context, req *agentapi.Request, enableRef
 	return withWarning(&agentapi.Response{Error: agentapi.RespNotFound}, warning)
 }
 
+// servedToken records that a client fetched clientID's token when resp carries one, and
+// returns resp. The use is recorded in the token's metadata, which the refresh-token
+// sweep judges idleness by, and for the background refresher (see refreshGuard). Failing
+// to record it only makes the token look idle sooner, so it does not fail the GET.
+func (s *Server) servedToken(st tokenstore.Cache, clientID string, resp *agentapi.Response) *agentapi.Response {
+	if !resp.OK || len(resp.Token) == 0 {
+		return resp
+	}
+	s.refresh.markUsed(clientID)
+	if err := st.Touch(clientID, time.Now()); err != nil && s.logger != nil {
+		slogerr.WithError(s.logger, err).Warn("record the last use of a token", "client_id", clientID)
+	}
+	return resp
+}
+
 // cachedToken serves the stored token for the request: the token itself when it is still
 // valid for MinExpiration, or a silently refreshed token when it is expiring, refresh is
 // enabled, and a valid refresh token is stored. It returns a nil response to fall through
 // to the device flow (no token, expired with no usable refresh), or an error response on
 // a store error. The second result is a security warning to surface to the user (see
 // refreshAccessToken); it may be non-empty even when the response is nil.
-func (s *Server) cachedToken(ctx context.Context, st *tokenstore.Store, req *agentapi.Request, enableRefreshToken bool) (*agentapi.Response, string) {
+func (s *Server) cachedToken(ctx context.Context, st tokenstore.Cache, req *agentapi.Request, enableRefreshToken bool) (*agentapi.Response, string) {
 	token, ok, resp := s.readStoredToken(st, req.ClientID)
 	if resp != nil {
 		return resp, ""
@@ -218,11 +239,12 @@ func (s *Server) cachedToken(ctx context.Context, st *tokenstore.Store, req *age
 // validRefreshToken returns the stored refresh token if it is present and still valid
 // (per the clock), or "" otherwise.
 func (s *Server) validRefreshToken(raw json.RawMessage) string {
-	// Parse only the refresh token and its expiration; the access token is not read
-	// here, so it is never materialized as a Go string.
+	// Parse only the refresh token, its expiration, and the session start; the access
+	// token is not read here, so it is never materialized as a Go string.
 	token := &struct {
 		RefreshToken               string    `json:"refresh_token"`
 		RefreshTokenExpirationDate time.Time `json:"refresh_token_expiration_date"`
+		SessionStartedAt           time.Time `json:"session_started_at"`
 	}{}
 	if err := json.Unmarshal(raw, token); err != nil {
 		return ""
@@ -233,9 +255,36 @@ func (s *Server) validRefreshToken(raw json.RawMessage) string {
 	if !time.Now().Before(token.RefreshTokenExpirationDate) {
 		return "" // the refresh token has expired
 	}
+	if s.sessionExpired(token.SessionStartedAt) {
+		return "" // the session is past its maximum age
+	}
 	return token.RefreshToken
 }
 
+// sessionExpired reports whether a session that started at startedAt is past the
+// agent's maximum session age, so its tokens must not be refreshed. Without a maximum
+// no session expires. A session with no recorded start (a token stored before the agent
+// recorded it) counts as expired under a maximum, since its age can't be proven to be
+// within it; the user authenticates once more and the new session is dated.
+func (s *Server) sessionExpired(startedAt time.Time) bool {
+	if s.maxSessionAge <= 0 {
+		return false
+	}
+	return startedAt.IsZero() || !time.Now().Before(startedAt.Add(s.maxSessionAge))
+}
+
+// sessionStartedAt returns when the session of a stored token began, or the zero time
+// when it is not recorded.
+func sessionStartedAt(raw json.RawMessage) time.Time {
+	token := &struct {
+		SessionStartedAt time.Time `json:"session_started_at"`
+	}{}
+	if err := json.Unmarshal(raw, token); err != nil {
+		return time.Time{}
+	}
+	return token.SessionStartedAt
+}
+
 // refreshAccessToken tries to silently refresh an expiring access token using a stored,
 // still-valid refresh token. It returns a response carrying the new token on success, or
 // a nil response to fall back to the device flow (no usable refresh token, or the refresh
@@ -245,13 +294,35 @@ func (s *Server) validRefreshToken(raw json.RawMessage) string {
 // The second result is a warning to surface to the user. When the refresh token is still
 // within its expiration yet the refresh fails, that is a possible incident (the refresh
 // token may have leaked or been revoked), so the warning is set even though the response
-// falls back to the device flow.
+// falls back to the device flow. The agent's incident policy (see IncidentPolicy) is
+// applied then too, and the warning says what it did.
 //
-// A rotating refresh token is single-use, so a concurrent GET for the same client that
-// consumed it first makes this refresh fail even though nothing is wrong. Before raising
-// the incident warning, refreshAccessToken re-reads the stored token to see whether a
-// sibling already refreshed it; if so it serves that token and stays silent.
-func (s *Server) refreshAccessToken(ctx context.Context, st *tokenstore.Store, clientID string, raw json.RawMessage, minExpiration time.Duration) (*agentapi.Response, string) {
+// A rotating refresh token is single-use, so a concurrent refresh of the same token makes
+// this one fail even though nothing is wrong. Refreshes within the agent (GETs and the
+// background refresher) are serialized per client ID, and each re-reads the stored token
+// once it holds the lock, so they never race. Before raising the incident warning,
+// refreshAccessToken still re-reads the stored token to see whether a refresh outside the
+// agent stored a fresh one; if so it serves that token and stays silent.
+func (s *Server) refreshAccessToken(ctx context.Context, st tokenstore.Cache, clientID string, raw json.RawMessage, minExpiration time.Duration) (*agentapi.Response, string) {
+	if s.validRefreshToken(raw) == "" {
+		if s.sessionExpired(sessionStartedAt(raw)) && s.logger != nil {
+			s.logger.Info("the session reached the maximum session age, so the token is not refreshed; authenticate again with ghtkn auth",
+				"client_id", clientID, "max_session_age", s.maxSessionAge)
+		}
+		return nil, ""
+	}
+	// Refresh one token at a time per client: a concurrent GET or the background
+	// refresher may be refreshing this very token. Once the lock is held, the stored token
+	// is re-read, since the holder before may have refreshed it already.
+	unlock := s.refresh.lock(clientID)
+	defer unlock()
+	if current, ok, resp := s.readStoredToken(st, clientID); resp == nil && ok {
+		defer scrub(current)
+		if s.tokenValid(current, minExpiration) {
+			return tokenResponse(current), ""
+		}
+		raw = current
+	}
 	refreshToken := s.validRefreshToken(raw)
 	if refreshToken == "" {
 		return nil, ""
@@ -260,12 +331,10 @@ func (s *Server) refreshAccessToken(ctx context.Context, st *tokenstore.Store, c
 	//nolint:bodyclose // RefreshToken reads and closes the response body internally; it returns the decoded value.
 	newToken, _, _, err := s.client.RefreshToken(ctx, clientID, refreshToken)
 	if err != nil {
-		// The refresh may have failed only because a concurrent GET for the same client
-		// consumed this rotating refresh token first and stored a fresh one. If a sibling
-		// already refreshed it, serve that instead of raising a false incident warning.
-		// (This narrows but does not fully close the window: a sibling that succeeded on
-		// GitHub but has not yet stored its token is not visible here. Fully closing it
-		// needs per-client serialization.)
+		// A refresh by a client the lock does not cover (another agent sharing the token
+		// directory, or a legacy client SETting a token) may have consumed this rotating
+		// refresh token first. If one already stored a fresh token, serve that instead of
+		// raising a false incident warning.
 		if resp := s.refreshedByPeer(st, clientID, minExpiration); resp != nil {
 			return resp, ""
 		}
@@ -274,30 +343,44 @@ func (s *Server) refreshAccessToken(ctx context.Context, st *tokenstore.Store, c
 		if s.logger != nil {
 			slogerr.WithError(s.logger, err).Error("a still-valid refresh token failed to refresh; possible incident", "client_id", clientID)
 		}
-		return nil, incidentWarning(clientID)
+		return nil, incidentWarning(clientID) + incidentActionsMessage(s.respondToIncident(ctx, st, clientID))
+	}
+
+	fresh, _ := s.storeRefreshed(st, clientID, newToken, sessionStartedAt(raw), minExpiration)
+	if fresh == nil {
+		return nil, ""
 	}
+	defer scrub(fresh)
+	// Return the refreshed token even if the store write failed.
+	return tokenResponse(fresh), ""
+}
 
-	fresh, err := s.encodeToken(newToken, true)
+// storeRefreshed encodes a token GitHub just refreshed and stores it for clientID,
+// carrying over sessionStartedAt from the token it replaces. It returns the encoded token, which the caller must scrub, and the store error if any. A
+// token that can't be encoded is logged and returned as nil. When the write fails the
+// encoded token is still returned, so a GET can serve it, but the stored token now
+// carries a spent refresh token and is dropped (see dropStaleAfterFailedStore).
+func (s *Server) storeRefreshed(st tokenstore.Cache, clientID string, newToken *deviceflow.AccessToken, sessionStartedAt time.Time, minExpiration time.Duration) (json.RawMessage, error) {
+	fresh, err := s.encodeToken(newToken, true, sessionStartedAt)
 	if err != nil {
 		if s.logger != nil {
 			slogerr.WithError(s.logger, err).Error("encode the refreshed access token", "client_id", clientID)
 		}
-		return nil, ""
+		return nil, err
 	}
-	defer scrub(fresh)
-	// Return the refreshed token so this get succeeds even if the store write fails below.
 	if err := st.Set(clientID, fresh); err != nil {
 		if s.logger != nil {
 			slogerr.WithError(s.logger, err).Warn("store the refreshed access token", "client_id", clientID)
 		}
-		// GitHub rotated the refresh token, so the copy in `fresh` (returned but not
-		// persisted) is the only live one and the stored token's refresh token is now spent.
-		// Left in place, the next get would try that dead refresh token, fail, and raise a
-		// false incident warning. Drop the stale stored token so the next get re-authenticates
-		// via the device flow instead.
+		// GitHub rotated the refresh token, so the copy in `fresh` (not persisted) is the
+		// only live one and the stored token's refresh token is now spent. Left in place,
+		// the next get would try that dead refresh token, fail, and raise a false incident
+		// warning. Drop the stale stored token so the next get re-authenticates via the
+		// device flow instead.
 		s.dropStaleAfterFailedStore(st, clientID, minExpiration)
+		return fresh, err //nolint:wrapcheck
 	}
-	return tokenResponse(fresh), ""
+	return fresh, nil
 }
 
 // dropStaleAfterFailedStore best-effort discards the cached token for clientID after a
@@ -313,7 +396,7 @@ func (s *Server) refreshAccessToken(ctx context.Context, st *tokenstore.Store, c
 // failure is directory-level (permissions) the delete also fails and the stale token
 // remains, but then the agent cannot store any token at all, a louder problem than one
 // false incident warning, and this is no worse than leaving it in place.
-func (s *Server) dropStaleAfterFailedStore(st *tokenstore.Store, clientID string, minExpiration time.Duration) {
+func (s *Server) dropStaleAfterFailedStore(st tokenstore.Cache, clientID string, minExpiration time.Duration) {
 	if _, err := st.DeleteIf(clientID, func(raw json.RawMessage) bool {
 		return !s.tokenValid(raw, minExpiration)
 	}); err != nil && s.logger != nil {
@@ -322,11 +405,11 @@ func (s *Server) dropStaleAfterFailedStore(st *tokenstore.Store, clientID string
 }
 
 // refreshedByPeer re-reads the stored token after a failed refresh and returns a token
-// response when it now satisfies minExpiration, i.e. a concurrent GET for the same client
-// already refreshed it (rotating refresh tokens are single-use, so a sibling consuming
-// this one first is the most likely cause of the failure). It returns nil when no usable
+// response when it now satisfies minExpiration, i.e. something outside this agent's
+// per-client refresh lock already refreshed it (rotating refresh tokens are single-use,
+// so a sibling consuming this one first is the most likely cause of the failure). It returns nil when no usable
 // refreshed token is present, so the caller falls back to the incident warning.
-func (s *Server) refreshedByPeer(st *tokenstore.Store, clientID string, minExpiration time.Duration) *agentapi.Response {
+func (s *Server) refreshedByPeer(st tokenstore.Cache, clientID string, minExpiration time.Duration) *agentapi.Response {
 	token, ok, resp := s.readStoredToken(st, clientID)
 	if resp != nil || !ok {
 		return nil
@@ -293,6 +293,83 @@ func TestServer_handleGet_refreshTokenExpired(t *testing.T) {
 	})
 }
 
+// TestServer_handleGet_maxSessionAge verifies that a token is refreshed only while its
+// session is within the maximum session age, that the session start is carried over to
+// the refreshed token, and that a token with no recorded session start is not refreshed
+// under a limit.
+func TestServer_handleGet_maxSessionAge(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name          string
+		maxSessionAge time.Duration
+		startedAgo    time.Duration // 0 stores no session start
+		wantRefresh   bool
+	}{
+		{name: "no limit", startedAgo: 90 * 24 * time.Hour, wantRefresh: true},
+		{name: "no limit and no start", wantRefresh: true},
+		{name: "within the age", maxSessionAge: 30 * 24 * time.Hour, startedAgo: 29 * 24 * time.Hour, wantRefresh: true},
+		{name: "past the age", maxSessionAge: 30 * 24 * time.Hour, startedAgo: 31 * 24 * time.Hour},
+		{name: "exactly the age", maxSessionAge: 30 * 24 * time.Hour, startedAgo: 30 * 24 * time.Hour},
+		{name: "no recorded start", maxSessionAge: 30 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			synctest.Test(t, func(t *testing.T) {
+				c := newUnlockedServer(t)
+				c.maxSessionAge = tt.maxSessionAge
+				rt := &refreshRoundTripper{
+					status: http.StatusOK,
+					body:   `{"access_token":"new-access","refresh_token":"new-refresh","expires_in":28800,"refresh_token_expires_in":15897600}`,
+				}
+				setClientTransport(c, rt)
+				const clientID = "Iv1.session"
+				now := time.Now()
+				var startedAt time.Time
+				if tt.startedAgo != 0 {
+					startedAt = now.Add(-tt.startedAgo)
+				}
+				//nolint:gosec // G117: serializing a token in a test to seed the store.
+				seeded, err := json.Marshal(&storedToken{
+					AccessToken:                "old",
+					ExpirationDate:             now.Add(-time.Hour),
+					RefreshToken:               "old-refresh",
+					RefreshTokenExpirationDate: now.Add(24 * time.Hour),
+					SessionStartedAt:           startedAt,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := c.store.Set(clientID, seeded); err != nil {
+					t.Fatal(err)
+				}
+
+				got := c.handleGet(t.Context(), &agentapi.Request{ProtocolVersion: 1, Command: agentapi.CommandGet, ClientID: clientID}, true)
+
+				if !tt.wantRefresh {
+					if diff := cmp.Diff(&agentapi.Response{Error: agentapi.RespNotFound}, got); diff != "" {
+						t.Fatalf("GET past the session age (-want +got):\n%s", diff)
+					}
+					if rt.called {
+						t.Fatal("must not refresh a token past the maximum session age")
+					}
+					return
+				}
+				if !got.OK || !rt.called {
+					t.Fatalf("GET within the session age must refresh; resp=%+v called=%v", got, rt.called)
+				}
+				stored, ok, err := c.store.Get(clientID)
+				if err != nil || !ok {
+					t.Fatalf("stored token get: ok=%v err=%v", ok, err)
+				}
+				if diff := cmp.Diff(startedAt, sessionStartedAt(stored)); diff != "" {
+					t.Fatalf("session start after the refresh (-want +got):\n%s", diff)
+				}
+			})
+		})
+	}
+}
+
 // TestServer_handleGet_refreshDisabled verifies that a valid refresh token is not used
 // when refresh is disabled.
 func TestServer_handleGet_refreshDisabled(t *testing.T) {
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// hookTimeout bounds a single run of a hook (the incident hook or the revoked-token hook),
+// so a hook that hangs (e.g. a notifier waiting on an unreachable server) does not keep a
+// goroutine and a child process around for the agent's lifetime.
+const hookTimeout = time.Minute
+
+// Environment variables the incident hook receives on top of the agent's own environment.
+const (
+	envIncidentClientID = "GHTKN_INCIDENT_CLIENT_ID"
+	envIncidentActions  = "GHTKN_INCIDENT_ACTIONS"
+)
+
+// Incident actions, as reported in the audit log, the hook's GHTKN_INCIDENT_ACTIONS, and
+// the warning returned to the client.
+const (
+	incidentActionRevoke = "revoke"
+	incidentActionDelete = "delete"
+	incidentActionLock   = "lock"
+)
+
+var (
+	errIncidentNothingToRevoke = errors.New("no readable stored token to revoke")
+	errIncidentDeleteRevoked   = errors.New("the tokens were revoked but could not be deleted")
+)
+
+// IncidentPolicy is how the agent responds on its own when a refresh token that is still
+// within its expiration fails to refresh (see refreshAccessToken): a strong signal that
+// the refresh token leaked and was used elsewhere. The zero value only warns the client,
+// which is the behavior without a policy. It is set when the agent starts and never
+// changes afterwards, so it needs no lock.
+type IncidentPolicy struct {
+	// Revoke revokes the app's stored access and refresh tokens via GitHub's credential
+	// revocation API and deletes them, as REVOKE does. A leaked refresh token is rotated
+	// on use, so the copy the agent holds is usually already spent, but the access token
+	// and any sibling credential minted from it are not.
+	Revoke bool
+	// Delete deletes the app's stored token without revoking it, so the agent stops
+	// trying the spent refresh token and the next get re-authenticates via the device flow.
+	// Revoke deletes the token too, so with Revoke, Delete only matters when the
+	// revocation fails (e.g. GitHub is unreachable): the token is then deleted anyway.
+	Delete bool
+	// Lock locks the agent, so nothing can be obtained from it until the user unlocks it
+	// again with the passphrase.
+	Lock bool
+	// Hook is a program run (without arguments) after the other actions, e.g. to notify
+	// the user. It receives the client ID in GHTKN_INCIDENT_CLIENT_ID and the actions
+	// taken, comma separated, in GHTKN_INCIDENT_ACTIONS. It runs in the background, so a
+	// slow hook does not delay the response, and is killed after hookTimeout.
+	Hook string
+}
+
+// respondToIncident applies the agent's incident policy for clientID and returns the
+// actions that succeeded, in the order they ran. Every step is recorded in the agent log,
+// which is the audit trail of the incident: the policy in force, the outcome of each
+// action, and the hook launch. A failed action is logged and skipped; it does not stop
+// the following ones, since containment is best-effort by nature.
+//
+// Lock runs last among the store actions because revoke and delete need the data key it
+// discards. The caller must not hold s.mu.
+func (s *Server) respondToIncident(ctx context.Context, st tokenstore.Cache, clientID string) []string {
+	policy := s.incident
+	if policy == (IncidentPolicy{}) {
+		return nil
+	}
+	if s.logger != nil {
+		s.logger.Warn("apply the refresh-token incident policy", "client_id", clientID,
+			"revoke", policy.Revoke, "delete", policy.Delete, "lock", policy.Lock, "hook", policy.Hook)
+	}
+	var actions []string
+	revoked := false
+	if policy.Revoke {
+		revoked = s.revokeIncident(ctx, st, clientID)
+		if revoked {
+			actions = append(actions, incidentActionRevoke)
+		}
+	}
+	// A revocation that did not succeed leaves the suspected-leaked token stored.
+	if policy.Delete && !revoked {
+		if err := st.Delete(clientID); err != nil {
+			s.auditIncident(clientID, incidentActionDelete, err)
+		} else {
+			s.auditIncident(clientID, incidentActionDelete, nil)
+			actions = append(actions, incidentActionDelete)
+		}
+	}
+	if policy.Lock {
+		s.handleLock()
+		s.auditIncident(clientID, incidentActionLock, nil)
+		actions = append(actions, incidentActionLock)
+	}
+	if policy.Hook != "" {
+		// The hook must outlive the GET that triggered it, but not the agent.
+		go s.runIncidentHook(context.WithoutCancel(ctx), clientID, actions)
+	}
+	return actions
+}
+
+// revokeIncident revokes and deletes clientID's stored tokens, reporting whether both the
+// revocation and the deletion succeeded. It reuses the REVOKE command's helpers.
+func (s *Server) revokeIncident(ctx context.Context, st tokenstore.Cache, clientID string) bool {
+	tokens, attempted, revokeFailed := s.collectRevocableTokens(st, []string{clientID})
+	if len(revokeFailed) != 0 || len(tokens) == 0 {
+		s.auditIncident(clientID, incidentActionRevoke, errIncidentNothingToRevoke)
+		return false
+	}
+	if err := s.revoker.Revoke(ctx, tokens); err != nil {
+		s.auditIncident(clientID, incidentActionRevoke, err)
+		return false
+	}
+	if cleanupFailed := s.deleteRevoked(st, attempted); len(cleanupFailed) != 0 {
+		s.auditIncident(clientID, incidentActionRevoke, errIncidentDeleteRevoked)
+		return false
+	}
+	s.auditIncident(clientID, incidentActionRevoke, nil)
+	return true
+}
+
+// auditIncident records the outcome of one incident action in the agent log.
+func (s *Server) auditIncident(clientID, action string, err error) {
+	if s.logger == nil {
+		return
+	}
+	if err != nil {
+		slogerr.WithError(s.logger, err).Error("refresh-token incident response failed", "client_id", clientID, "action", action)
+		return
+	}
+	s.logger.Warn("refresh-token incident response", "client_id", clientID, "action", action)
+}
+
+// runIncidentHook runs the incident hook and waits for it to exit.
+func (s *Server) runIncidentHook(ctx context.Context, clientID string, actions []string) {
+	s.runHook(ctx, "refresh-token incident hook", s.incident.Hook, clientID,
+		envIncidentClientID+"="+clientID,
+		envIncidentActions+"="+strings.Join(actions, ","))
+}
+
+// runHook runs hook, named name in the log, about clientID with env added to the agent's
+// environment, and waits for it to exit. Its output is discarded: the hook runs detached
+// from any terminal, so anything it wants recorded it must send somewhere itself.
+func (s *Server) runHook(ctx context.Context, name, hook, clientID string, env ...string) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, hook)
+	cmd.Env = append(os.Environ(), env...)
+	if s.logger != nil {
+		s.logger.Warn("run the "+name, "client_id", clientID, "hook", hook)
+	}
+	if err := cmd.Run(); err != nil && s.logger != nil {
+		slogerr.WithError(s.logger, err).Error("the "+name+" failed", "client_id", clientID, "hook", hook)
+	}
+}
+
+// incidentActionsMessage describes the incident actions taken, to be appended to the
+// incident warning. It returns "" when none were taken.
+func incidentActionsMessage(actions []string) string {
+	if len(actions) == 0 {
+		return ""
+	}
+	descriptions := make([]string, len(actions))
+	for i, action := range actions {
+		switch action {
+		case incidentActionRevoke:
+			descriptions[i] = "revoked and deleted this app's tokens"
+		case incidentActionDelete:
+			descriptions[i] = "deleted this app's stored token"
+		case incidentActionLock:
+			descriptions[i] = "locked the agent"
+		default:
+			descriptions[i] = action
+		}
+	}
+	return fmt.Sprintf(" The ghtkn agent has already %s.", strings.Join(descriptions, " and "))
+}
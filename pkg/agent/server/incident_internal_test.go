@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+)
+
+// TestServer_handleGet_incidentPolicy verifies that a still-valid refresh token failing
+// to refresh triggers the configured incident policy, and that the warning says what the
+// agent did.
+func TestServer_handleGet_incidentPolicy(t *testing.T) {
+	t.Parallel()
+	const clientID = "Iv1.incident"
+	tests := []struct {
+		name        string
+		policy      IncidentPolicy
+		revokeErr   error
+		wantError   string
+		wantRevoked []string
+		wantStored  bool
+		wantLocked  bool
+		wantActions string
+	}{
+		{
+			name:       "no policy only warns",
+			wantError:  errMsgStartDeviceFlow,
+			wantStored: true,
+		},
+		{
+			name:        "delete",
+			policy:      IncidentPolicy{Delete: true},
+			wantError:   errMsgStartDeviceFlow,
+			wantActions: "deleted this app's stored token",
+		},
+		{
+			name:        "revoke fails, delete",
+			policy:      IncidentPolicy{Revoke: true, Delete: true},
+			revokeErr:   errors.New("github is unreachable"),
+			wantError:   errMsgStartDeviceFlow,
+			wantRevoked: []string{"old", "old-refresh"},
+			wantActions: "deleted this app's stored token",
+		},
+		{
+			name:        "revoke and lock",
+			policy:      IncidentPolicy{Revoke: true, Delete: true, Lock: true},
+			wantError:   agentapi.RespLocked,
+			wantRevoked: []string{"old", "old-refresh"},
+			wantLocked:  true,
+			wantActions: "revoked and deleted this app's tokens and locked the agent",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			synctest.Test(t, func(t *testing.T) {
+				c := newUnlockedServer(t)
+				c.incident = tt.policy
+				rev := &fakeRevoker{err: tt.revokeErr}
+				c.revoker = rev
+				setClientTransport(c, &refreshRoundTripper{status: http.StatusInternalServerError, body: `{}`})
+				seedExpiredWithRefresh(t, c, clientID, time.Now().Add(24*time.Hour))
+				st := c.store
+
+				got := c.handleGet(t.Context(), &agentapi.Request{ProtocolVersion: 1, Command: agentapi.CommandGet, ClientID: clientID, StartDeviceFlow: true}, true)
+				// The GET asks to start a device flow, which the fake transport fails,
+				// unless the agent locked itself.
+				if !strings.HasPrefix(got.Error, tt.wantError) {
+					t.Fatalf("resp.Error = %q, want %q", got.Error, tt.wantError)
+				}
+				if !strings.HasPrefix(got.Warning, incidentWarning(clientID)) {
+					t.Fatalf("the incident warning is missing: %q", got.Warning)
+				}
+				if tt.wantActions == "" && got.Warning != incidentWarning(clientID) {
+					t.Fatalf("no action was taken, but the warning reports one: %q", got.Warning)
+				}
+				if !strings.Contains(got.Warning, tt.wantActions) {
+					t.Fatalf("the warning %q does not report %q", got.Warning, tt.wantActions)
+				}
+				if diff := cmp.Diff(tt.wantRevoked, rev.tokens); diff != "" {
+					t.Fatalf("revoked tokens (-want +got):\n%s", diff)
+				}
+				if locked := c.tokenStore() == nil; locked != tt.wantLocked {
+					t.Fatalf("locked = %v, want %v", locked, tt.wantLocked)
+				}
+				if tt.wantLocked {
+					return // the store is scrubbed, so the token can no longer be read.
+				}
+				if _, ok, err := st.Get(clientID); err != nil || ok != tt.wantStored {
+					t.Fatalf("stored token: ok=%v err=%v, want ok=%v", ok, err, tt.wantStored)
+				}
+			})
+		})
+	}
+}
+
+// TestServer_runIncidentHook verifies that the hook gets the client ID and the actions
+// taken in its environment.
+func TestServer_runIncidentHook(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\necho \"$GHTKN_INCIDENT_CLIENT_ID $GHTKN_INCIDENT_ACTIONS\" > " + out + "\n"
+	if err := os.WriteFile(hook, []byte(script), 0o700); err != nil { //nolint:gosec // G306: the hook must be executable.
+		t.Fatal(err)
+	}
+	c := NewWithOptions("", &Options{Incident: IncidentPolicy{Hook: hook}})
+	c.runIncidentHook(t.Context(), "Iv1.hook", []string{incidentActionRevoke, incidentActionLock})
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "Iv1.hook revoke,lock\n"; got != want {
+		t.Fatalf("hook output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// defaultAPIBaseURL is the GitHub REST API the liveness check calls.
+const defaultAPIBaseURL = "https://api.github.com"
+
+// envRevokedClientID is the environment variable the revoked-token hook receives the
+// client ID in, on top of the agent's own environment.
+const envRevokedClientID = "GHTKN_REVOKED_CLIENT_ID"
+
+// LivenessPolicy configures the optional job that checks the stored access tokens
+// against the GitHub API and drops those GitHub no longer accepts: tokens revoked out of
+// band, e.g. in the GitHub UI, by suspending the app, or by the user revoking its
+// authorization. Without it the agent keeps serving such a token until it expires, and
+// the tools using it fail with a 401. The zero value disables the job. It is set when the
+// agent starts and never changes afterwards, so it needs no lock.
+type LivenessPolicy struct {
+	// Interval is how often the stored tokens are checked while the agent is unlocked.
+	// Each check is one cheap authenticated API call per unexpired token.
+	Interval time.Duration
+	// Hook is a program run (without arguments) after a token is dropped, e.g. to notify
+	// the user. It receives the client ID in GHTKN_REVOKED_CLIENT_ID, runs in the
+	// background, and is killed after hookTimeout.
+	Hook string
+}
+
+// startLivenessCheck launches the liveness check (see LivenessPolicy) when it is
+// enabled. It runs once immediately and then every Interval until ctx is canceled (LOCK
+// or agent shutdown). It is called with s.mu held; it spawns a goroutine and returns.
+func (s *Server) startLivenessCheck(ctx context.Context, st tokenstore.Cache) {
+	if s.liveness.Interval <= 0 {
+		return
+	}
+	go func() {
+		s.checkLiveness(ctx, st)
+		ticker := time.NewTicker(s.liveness.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.checkLiveness(ctx, st)
+			}
+		}
+	}()
+}
+
+// checkLiveness checks every stored, unexpired access token against the GitHub API and
+// drops those GitHub rejects. It is best-effort: a token that can't be read or checked
+// is left as is until the next run.
+func (s *Server) checkLiveness(ctx context.Context, st tokenstore.Cache) {
+	ids, err := st.ClientIDs()
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("list stored tokens for the liveness check")
+		}
+		return
+	}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		s.checkTokenLiveness(ctx, st, id)
+	}
+}
+
+// checkTokenLiveness checks clientID's stored access token and, when GitHub rejects it,
+// deletes it and runs the revoked-token hook. The delete only happens if the stored
+// token is still the one checked, so a token refreshed or re-minted meanwhile is kept.
+// Deleting the whole token also drops its refresh token: GitHub revokes it together with
+// the access token when an authorization is revoked, and the next get re-authenticates
+// via the device flow either way.
+func (s *Server) checkTokenLiveness(ctx context.Context, st tokenstore.Cache, clientID string) {
+	raw, ok, resp := s.readStoredToken(st, clientID)
+	if resp != nil || !ok {
+		return
+	}
+	token := &storedToken{}
+	err := json.Unmarshal(raw, token)
+	scrub(raw)
+	if err != nil || token.AccessToken == "" {
+		return
+	}
+	if !token.ExpirationDate.IsZero() && !time.Now().Before(token.ExpirationDate) {
+		return // expired: GitHub would reject it anyway, and refresh or the sweep takes care of it
+	}
+	live, err := s.tokenLive(ctx, token.AccessToken)
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Debug("check a stored token against the GitHub API", "client_id", clientID)
+		}
+		return
+	}
+	if live {
+		return
+	}
+	checked := token.AccessToken
+	deleted, err := st.DeleteIf(clientID, func(raw json.RawMessage) bool {
+		current := &storedToken{}
+		return json.Unmarshal(raw, current) == nil && current.AccessToken == checked
+	})
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("delete a stored token GitHub no longer accepts", "client_id", clientID)
+		}
+		return
+	}
+	if !deleted {
+		return
+	}
+	if s.logger != nil {
+		s.logger.Warn("deleted a stored token GitHub no longer accepts; it was revoked outside ghtkn, and the next get re-authenticates", "client_id", clientID)
+	}
+	if s.liveness.Hook != "" {
+		go s.runHook(context.WithoutCancel(ctx), "revoked-token hook", s.liveness.Hook, clientID,
+			envRevokedClientID+"="+clientID)
+	}
+}
+
+// tokenLive reports whether GitHub accepts accessToken, by fetching the authenticated
+// user (GET /user), which every user access token can do whatever its permissions. Only
+// a 401 means the token is dead; any other failure (offline, rate limited, a GitHub
+// outage) is returned as an error, so the token is not dropped on a guess.
+func (s *Server) tokenLive(ctx context.Context, accessToken string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.apiBaseURL+"/user", nil)
+	if err != nil {
+		return false, fmt.Errorf("create a request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := s.apiClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("send a request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusUnauthorized:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGitHubAPI is a local stand-in for api.github.com that answers GET /user by the
+// bearer token: 200 for "live", 401 for "revoked", and 500 otherwise. It records the
+// tokens it was asked about.
+type fakeGitHubAPI struct {
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (f *fakeGitHubAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("Authorization")
+	f.mu.Lock()
+	f.tokens = append(f.tokens, token)
+	f.mu.Unlock()
+	switch {
+	case r.URL.Path != "/user":
+		w.WriteHeader(http.StatusNotFound)
+	case token == "Bearer live":
+		fmt.Fprint(w, `{"login":"octocat"}`)
+	case token == "Bearer revoked":
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// TestServer_checkLiveness verifies that the liveness check deletes only the tokens
+// GitHub rejects with a 401, keeps those it accepts or could not check, does not call
+// GitHub for an expired token, and runs the revoked-token hook for a deleted one.
+func TestServer_checkLiveness(t *testing.T) {
+	t.Parallel()
+	api := &fakeGitHubAPI{}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\necho \"$GHTKN_REVOKED_CLIENT_ID\" > " + out + "\n"
+	if err := os.WriteFile(hook, []byte(script), 0o700); err != nil { //nolint:gosec // G306: the hook must be executable.
+		t.Fatal(err)
+	}
+	c := newUnlockedServer(t)
+	c.liveness = LivenessPolicy{Interval: time.Hour, Hook: hook}
+	c.apiBaseURL = srv.URL
+	c.apiClient = srv.Client()
+
+	later := time.Now().Add(time.Hour).Format(time.RFC3339)
+	for id, token := range map[string]string{
+		"Iv1.live":    `{"access_token":"live","expiration_date":"` + later + `"}`,
+		"Iv1.revoked": `{"access_token":"revoked","expiration_date":"` + later + `"}`,
+		"Iv1.outage":  `{"access_token":"outage","expiration_date":"` + later + `"}`,
+		"Iv1.expired": `{"access_token":"revoked","expiration_date":"` + time.Now().Add(-time.Hour).Format(time.RFC3339) + `"}`,
+	} {
+		if err := c.store.Set(id, json.RawMessage(token)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.checkLiveness(t.Context(), c.store)
+
+	for id, want := range map[string]bool{"Iv1.live": true, "Iv1.revoked": false, "Iv1.outage": true, "Iv1.expired": true} {
+		_, ok, err := c.store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("%s kept = %v, want %v", id, ok, want)
+		}
+	}
+	api.mu.Lock()
+	calls := len(api.tokens)
+	api.mu.Unlock()
+	if calls != 3 {
+		t.Errorf("API calls = %d, want 3 (the expired token is not checked)", calls)
+	}
+
+	// The hook runs in the background.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		b, err := os.ReadFile(out)
+		if err == nil && len(b) > 0 {
+			if got, want := string(b), "Iv1.revoked\n"; got != want {
+				t.Fatalf("hook output = %q, want %q", got, want)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the revoked-token hook did not run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -14,9 +14,15 @@ import (
 // runs under the store lock (Store.Zero), so it serializes with an in-flight
 // Get/Set/Delete rather than racing it; a request that reads the store after the key is
 // zeroed simply fails to decrypt and is treated as a cache miss.
+//
+// A LOCK that arrives while an UNLOCK is deriving the key wins: that UNLOCK fails and the
+// agent stays locked.
 func (s *Server) handleLock() *agentapi.Response {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	// Counted even while locked: an UNLOCK deriving the key must not unlock the agent
+	// once it is told to stay locked.
+	s.locks++
 	if s.store == nil {
 		return &agentapi.Response{OK: true, Locked: true}
 	}
@@ -29,6 +35,7 @@ func (s *Server) handleLock() *agentapi.Response {
 	s.store = nil
 	s.enableRefreshToken = false
 	s.refreshTokenTTL = 0
+	s.appRefresh = nil
 	if s.logger != nil {
 		s.logger.Info("agent locked")
 	}
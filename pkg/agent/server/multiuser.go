@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// DefaultSharedSocket is where a multi-user agent listens unless GHTKN_AGENT_SOCKET says
+// otherwise. The per-user defaults would put it under the home or runtime directory of
+// the user running the agent, which the other users can't reach.
+const DefaultSharedSocket = "/run/ghtkn/agent.sock"
+
+// DefaultStateDir is where a multi-user agent keeps the key file and the token directory
+// of each user, unless Options.StateDir says otherwise.
+const DefaultStateDir = "/var/lib/ghtkn/agent"
+
+// stateDirPerm keeps the state of every user to the user running the agent: the users
+// themselves reach it only through the agent.
+const stateDirPerm os.FileMode = 0o700
+
+// Error messages returned to the clients of a multi-user agent.
+const (
+	errMsgIdentifyPeer  = "the agent could not identify the user connecting to it"
+	errMsgPrincipal     = "the agent could not prepare its state for the user connecting to it"
+	errMsgStopForbidden = "only the user running the shared ghtkn agent can stop it"
+)
+
+// multiUser is what a multi-user agent (see Options.MultiUser) keeps besides the state
+// of each user.
+type multiUser struct {
+	// stateDir holds a directory per uid with that user's key file and token directory.
+	stateDir string
+	// owner is the uid the agent runs as, the only user who may stop it.
+	owner uint32
+
+	// mu guards principals.
+	mu sync.Mutex
+	// principals is the state of each user that has connected, keyed by uid. An entry is
+	// never removed: it holds the user's lock state, device flows, and background jobs.
+	principals map[uint32]*Server
+}
+
+// principal identifies the user a Server holds the state of, in a multi-user agent.
+type principal struct {
+	uid uint32
+	// owner reports that the user runs the agent, and so may stop it.
+	owner bool
+}
+
+// principalFor returns the state of the user uid, creating it on the user's first
+// connection. The state is a Server of its own, locked until the user unlocks it, with
+// its own key file and token directory under the state directory and the options of the
+// agent, so every user gets the agent exactly as a single-user agent serves them: lock
+// state, refresh settings, device flows, and tokens never cross users.
+func (s *Server) principalFor(uid uint32) (*Server, error) {
+	m := s.multiUser
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, ok := m.principals[uid]; ok {
+		return p, nil
+	}
+	p := &Server{
+		status:        map[string]*deviceFlowState{},
+		client:        s.client,
+		revoker:       s.revoker,
+		goos:          s.goos,
+		incident:      s.incident,
+		liveness:      s.liveness,
+		apiClient:     s.apiClient,
+		apiBaseURL:    s.apiBaseURL,
+		loadDataKey:   s.loadDataKey,
+		maxSessionAge: s.maxSessionAge,
+		drainTimeout:  s.drainTimeout,
+		version:       s.version,
+		ephemeral:     s.ephemeral,
+		principal:     &principal{uid: uid, owner: uid == m.owner},
+	}
+	if s.logger != nil {
+		p.logger = s.logger.With("uid", uid)
+	}
+	if !s.ephemeral {
+		dir := filepath.Join(m.stateDir, formatUID(uid))
+		if err := os.MkdirAll(dir, stateDirPerm); err != nil {
+			return nil, fmt.Errorf("create the state directory of the user: %w", err)
+		}
+		p.keyFile = filepath.Join(dir, "key")
+		p.tokenDir = filepath.Join(dir, "tokens")
+	}
+	m.principals[uid] = p
+	return p, nil
+}
+
+// mayStop reports whether the client s answers may stop the agent: anyone who can reach
+// a single-user agent's socket, but only the owner of a multi-user one.
+func (s *Server) mayStop() bool {
+	return s.principal == nil || s.principal.owner
+}
+
+// flowServers returns the servers whose device flows a stopping agent settles (see
+// drain): the agent itself, or every user a multi-user agent serves.
+func (s *Server) flowServers() []*Server {
+	if s.multiUser == nil {
+		return []*Server{s}
+	}
+	s.multiUser.mu.Lock()
+	defer s.multiUser.mu.Unlock()
+	servers := make([]*Server, 0, len(s.multiUser.principals))
+	for _, p := range s.multiUser.principals {
+		servers = append(servers, p)
+	}
+	return servers
+}
+
+// checkMultiUser reports why the agent can't serve every user of the host, if it can't.
+func checkMultiUser() error {
+	if !peerCredSupported {
+		return errors.New("the multi-user agent is only supported on Linux")
+	}
+	return nil
+}
+
+// formatUID formats uid as the name of the user's state directory.
+func formatUID(uid uint32) string {
+	return strconv.FormatUint(uint64(uid), 10)
+}
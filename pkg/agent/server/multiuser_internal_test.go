@@ -0,0 +1,69 @@
+//go:build linux
+
+package server
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+)
+
+// TestServe_multiUser verifies that a multi-user agent serves each connection with the
+// state of the uid on the other end: the caller unlocks its own key file under the state
+// directory, another user's state stays locked, and a caller who does not run the agent
+// can't stop it.
+func TestServe_multiUser(t *testing.T) {
+	t.Parallel()
+	stateDir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "s.sock")
+	c := NewWithOptions("", &Options{MultiUser: true, StateDir: stateDir})
+	uid := uint32(os.Getuid()) //nolint:gosec // a uid on Linux
+	c.multiUser.owner = uid + 1
+	listener, err := listenShared(t.Context(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go c.serve(t.Context(), listener, slog.New(slog.DiscardHandler)) //nolint:errcheck // serve returns nil once the listener is closed
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != sharedSocketFilePerm {
+		t.Fatalf("socket permission = %o, want %o", perm, sharedSocketFilePerm)
+	}
+
+	resp, err := agentapi.Send(t.Context(), path, &agentapi.Request{Command: agentapi.CommandUnlock, Passphrase: []byte("pw")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.OK {
+		t.Fatalf("UNLOCK = %+v", resp)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, formatUID(uid), "key")); err != nil {
+		t.Fatalf("the key file must be created in the caller's state directory: %v", err)
+	}
+
+	other, err := c.principalFor(uid + 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.tokenStore() != nil {
+		t.Fatal("another user's state must stay locked")
+	}
+	if other.mayStop() {
+		t.Fatal("a user who does not run the agent must not be allowed to stop it")
+	}
+
+	resp, err = agentapi.Send(t.Context(), path, &agentapi.Request{Command: agentapi.CommandStop})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != errMsgStopForbidden {
+		t.Fatalf("STOP by a user who does not run the agent = %+v, want %q", resp, errMsgStopForbidden)
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// handlePanic is the agent side of 'ghtkn panic', the kill switch for a suspected
+// compromise: it revokes every stored token in one batch, locks, and deletes the token
+// directory. The caller stops the agent after the response is written.
+//
+// It needs no passphrase, like LOCK and STOP: every step only takes access away. A
+// locked agent cannot decrypt its tokens to revoke them, so it reports every stored
+// client ID as a revoke failure (the tokens may be live) and still deletes them.
+//
+// Revocation comes first because it needs the data key that locking discards, and the
+// tokens are deleted even when revocation fails: the machine is assumed compromised, so
+// a copy left on disk helps only the attacker.
+//
+// It holds every refresh lock from before it lists the tokens until the agent is locked.
+// A refresh in between would have GitHub rotate a token into a fresh pair that is never
+// revoked, and the locks also keep the background refresher from starting one.
+func (s *Server) handlePanic(ctx context.Context) *agentapi.Response {
+	unlockRefresh := s.refresh.lockAll()
+	defer unlockRefresh()
+	resp := &agentapi.Response{OK: true, Locked: true}
+	if st := s.tokenStore(); st != nil {
+		resp.Count, resp.RevokeFailed = s.revokeAll(ctx, st)
+		s.handleLock()
+	} else if s.tokenDir != "" {
+		// Listing the client IDs needs no data key.
+		ids, err := tokenstore.New(nil, s.tokenDir).ClientIDs()
+		if err != nil && s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("list the stored tokens to report them unrevoked")
+		}
+		resp.RevokeFailed = ids
+	}
+	if s.tokenDir != "" {
+		if err := os.RemoveAll(s.tokenDir); err != nil {
+			if s.logger != nil {
+				slogerr.WithError(s.logger, err).Error("delete the token directory")
+			}
+			resp.OK = false
+			resp.Error = fmt.Sprintf("%s: %s", errMsgDeleteTokenDir, err)
+		}
+	}
+	if s.logger != nil {
+		s.logger.Warn("panic: revoked and deleted the stored tokens; the agent is locked and stops",
+			"revoked", resp.Count, "revoke_failed", resp.RevokeFailed)
+	}
+	return resp
+}
+
+// revokeAll revokes the tokens stored for every client ID in one batch. It returns how
+// many client IDs had their tokens revoked and which could not be revoked.
+func (s *Server) revokeAll(ctx context.Context, st tokenstore.Cache) (int, []string) {
+	ids, err := st.ClientIDs()
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Error("list the stored tokens to revoke")
+		}
+		return 0, nil
+	}
+	tokens, attempted, revokeFailed := s.collectRevocableTokens(st, ids)
+	if len(tokens) == 0 {
+		return 0, revokeFailed
+	}
+	if err := s.revoker.Revoke(ctx, tokens); err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Error("revoke the stored tokens")
+		}
+		return 0, append(revokeFailed, attempted...)
+	}
+	return len(attempted), revokeFailed
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+// newPanicServer returns an unlocked server whose token directory holds a token with a
+// refresh token for Iv1.a and one without for Iv1.b.
+func newPanicServer(t *testing.T) *Server {
+	t.Helper()
+	c := New("")
+	c.tokenDir = filepath.Join(t.TempDir(), "tokens")
+	c.store = tokenstore.New(testDataKey(t), c.tokenDir)
+	for clientID, token := range map[string]string{
+		"Iv1.a": `{"access_token":"ghu_a","expiration_date":"2999-01-01T00:00:00Z","refresh_token":"ghr_a"}`,
+		"Iv1.b": `{"access_token":"ghu_b","expiration_date":"2999-01-01T00:00:00Z"}`,
+	} {
+		if err := c.store.Set(clientID, json.RawMessage(token)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// TestServer_handle_panic verifies that PANIC revokes every stored access and refresh
+// token, deletes the token directory, locks the agent, and asks it to stop.
+func TestServer_handle_panic(t *testing.T) {
+	t.Parallel()
+	c := newPanicServer(t)
+	rev := &fakeRevoker{}
+	c.revoker = rev
+
+	got, shutdown := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"PANIC"}`+"\n"))
+	if diff := cmp.Diff(&agentapi.Response{OK: true, Locked: true, Count: 2}, got); diff != "" {
+		t.Fatalf("PANIC (-want +got):\n%s", diff)
+	}
+	if !shutdown {
+		t.Fatal("PANIC must stop the agent")
+	}
+	if diff := cmp.Diff([]string{"ghu_a", "ghr_a", "ghu_b"}, rev.tokens); diff != "" {
+		t.Fatalf("revoked tokens (-want +got):\n%s", diff)
+	}
+	if c.tokenStore() != nil {
+		t.Fatal("PANIC must lock the agent")
+	}
+	if _, err := os.Stat(c.tokenDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the token directory must be deleted, stat err = %v", err)
+	}
+}
+
+// TestServer_handlePanic_revokeFails verifies that tokens are deleted even when
+// revocation fails, and the failure is reported per client ID.
+func TestServer_handlePanic_revokeFails(t *testing.T) {
+	t.Parallel()
+	c := newPanicServer(t)
+	c.revoker = &fakeRevoker{err: errors.New("boom")}
+
+	got := c.handlePanic(t.Context())
+	if diff := cmp.Diff(&agentapi.Response{OK: true, Locked: true, RevokeFailed: []string{"Iv1.a", "Iv1.b"}}, got); diff != "" {
+		t.Fatalf("PANIC (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(c.tokenDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the token directory must be deleted, stat err = %v", err)
+	}
+}
+
+// TestServer_handlePanic_locked verifies that a locked agent, which cannot decrypt its
+// tokens, reports them all as unrevoked and still deletes them.
+func TestServer_handlePanic_locked(t *testing.T) {
+	t.Parallel()
+	c := newPanicServer(t)
+	rev := &fakeRevoker{}
+	c.revoker = rev
+	c.handleLock()
+
+	got := c.handlePanic(t.Context())
+	if diff := cmp.Diff(&agentapi.Response{OK: true, Locked: true, RevokeFailed: []string{"Iv1.a", "Iv1.b"}}, got); diff != "" {
+		t.Fatalf("PANIC (-want +got):\n%s", diff)
+	}
+	if len(rev.tokens) != 0 {
+		t.Fatalf("a locked agent cannot revoke, but revoked %v", rev.tokens)
+	}
+	if _, err := os.Stat(c.tokenDir); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the token directory must be deleted, stat err = %v", err)
+	}
+}
+
+// TestServer_handlePanic_refreshInFlight verifies that PANIC waits for a refresh in
+// flight and revokes the token it stored, rather than the one GitHub rotated away.
+func TestServer_handlePanic_refreshInFlight(t *testing.T) {
+	t.Parallel()
+	c := newPanicServer(t)
+	rev := &fakeRevoker{}
+	c.revoker = rev
+
+	unlock := c.refresh.lock("Iv1.a")
+	done := make(chan *agentapi.Response)
+	go func() { done <- c.handlePanic(t.Context()) }()
+	select {
+	case <-done:
+		unlock()
+		t.Fatal("PANIC must wait for the refresh in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	rotated := `{"access_token":"ghu_a2","expiration_date":"2999-01-01T00:00:00Z","refresh_token":"ghr_a2"}`
+	if err := c.store.Set("Iv1.a", json.RawMessage(rotated)); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	got := <-done
+	if diff := cmp.Diff(&agentapi.Response{OK: true, Locked: true, Count: 2}, got); diff != "" {
+		t.Fatalf("PANIC (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"ghu_a2", "ghr_a2", "ghu_b"}, rev.tokens); diff != "" {
+		t.Fatalf("revoked tokens (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredSupported reports whether peerUID can identify the peer of a connection, which
+// a multi-user agent depends on.
+const peerCredSupported = true
+
+// peerUID returns the uid of the process on the other end of conn, as the kernel
+// recorded it when the process connected (SO_PEERCRED). Unlike anything the client
+// sends, the client can't forge it.
+func peerUID(conn net.Conn) (uint32, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, errors.New("the connection is not on a Unix domain socket")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, fmt.Errorf("get the raw connection: %w", err)
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return 0, fmt.Errorf("control the connection: %w", err)
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("get the peer credentials: %w", credErr)
+	}
+	return cred.Uid, nil
+}
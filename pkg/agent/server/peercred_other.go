@@ -0,0 +1,17 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredSupported reports whether peerUID can identify the peer of a connection, which
+// a multi-user agent depends on.
+const peerCredSupported = false
+
+// peerUID is only implemented on Linux, with SO_PEERCRED.
+func peerUID(net.Conn) (uint32, error) {
+	return 0, errors.New("identifying the peer of a connection is only supported on Linux")
+}
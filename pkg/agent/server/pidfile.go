@@ -0,0 +1,43 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// pidFilePerm is the permission of the pid file. A process ID is no secret, and tools
+// that stop or monitor the agent by its pid file may run as another user.
+const pidFilePerm os.FileMode = 0o644
+
+// writePIDFile writes the agent's process ID to path. It is called once the agent serves
+// the socket, which only one agent can do at a time, so it replaces whatever is there: a
+// pid file left by an agent that was killed. An agent re-executed by an upgrade keeps
+// its process ID and writes the same file again.
+func writePIDFile(path string) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), pidFilePerm); err != nil {
+		return fmt.Errorf("write the pid file: %w", err)
+	}
+	return nil
+}
+
+// removePIDFile removes the pid file at path when it still holds the agent's process ID,
+// so a stopping agent doesn't delete the file of one started after it.
+func removePIDFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read the pid file: %w", err)
+	}
+	if string(bytes.TrimSpace(b)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove the pid file: %w", err)
+	}
+	return nil
+}
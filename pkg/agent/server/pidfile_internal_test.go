@@ -0,0 +1,53 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "agent.pid")
+	// A pid file left by an agent that was killed is replaced.
+	if err := os.WriteFile(path, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(os.Getpid()) + "\n"; string(b) != want {
+		t.Fatalf("pid file = %q, want %q", b, want)
+	}
+	if err := removePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the pid file must be removed, stat: %v", err)
+	}
+	// Removing a pid file that is already gone is not an error.
+	if err := removePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRemovePIDFile_anotherAgent verifies that a stopping agent leaves the pid file of an
+// agent started after it alone.
+func TestRemovePIDFile_anotherAgent(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "agent.pid")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid()+1)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("another agent's pid file must be kept: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// leftoverMinAge is how old a temporary file must be before it counts as left over by
+// an interrupted write. A write replaces its temporary file within milliseconds, so this
+// only keeps one in progress from being deleted under it.
+const leftoverMinAge = time.Hour
+
+// handlePrune deletes, or with dryRun only lists, what no longer serves a purpose in the
+// token directory (see prune).
+func (s *Server) handlePrune(dryRun bool) *adminapi.Response {
+	st := s.tokenStore()
+	if st == nil {
+		return errorResponse(agentapi.RespLocked)
+	}
+	pruned, err := s.prune(st, s.currentRefreshPolicy(), dryRun)
+	if err != nil {
+		return errorResponse(errMsgPrune)
+	}
+	resp := &adminapi.Response{Response: agentapi.Response{OK: true}, Pruned: pruned}
+	for _, p := range pruned {
+		if p.Error != "" {
+			resp.OK = false
+			resp.Error = errMsgPrune
+		}
+	}
+	return resp
+}
+
+// prune deletes, or with dryRun only lists, the tokens whose access token expired with
+// no usable refresh token (any refresh token counts as unusable when policy disables
+// refresh for the app, since the agent would never use it), the tokens that can't be
+// decrypted with the current key, and the leftover files in the token directory. Each
+// check and its delete run under the store lock, so a token stored again in the
+// meantime is kept. A failed delete is reported on its entry; only failing to list the
+// directory fails prune as a whole.
+func (s *Server) prune(st tokenstore.Cache, policy *refreshPolicy, dryRun bool) ([]*adminapi.PrunedFile, error) {
+	ids, err := st.ClientIDs()
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("list stored tokens to prune")
+		}
+		return nil, err //nolint:wrapcheck
+	}
+	now := time.Now()
+	var pruned []*adminapi.PrunedFile
+	for _, id := range ids {
+		refreshEnabled := policy.refreshEnabledFor(id)
+		expired := func(raw json.RawMessage) bool {
+			return s.unusableToken(raw, refreshEnabled, now)
+		}
+		if p := s.pruneToken(st, id, expired, dryRun); p != nil {
+			pruned = append(pruned, p)
+		}
+	}
+	leftovers, err := st.Leftovers(now.Add(-leftoverMinAge))
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("list leftover files to prune")
+		}
+		return nil, err //nolint:wrapcheck
+	}
+	for _, leftover := range leftovers {
+		p := &adminapi.PrunedFile{Name: leftover.Name, Reason: leftover.Kind}
+		if !dryRun {
+			if err := st.RemoveLeftover(leftover); err != nil {
+				p.Error = err.Error()
+			}
+		}
+		pruned = append(pruned, p)
+	}
+	s.logPruned(pruned, dryRun)
+	return pruned, nil
+}
+
+// unusableToken reports whether the stored token raw can no longer serve a GET: its
+// access token expired before now with no usable refresh token, where any refresh token
+// counts as unusable when refresh is disabled for the app.
+func (s *Server) unusableToken(raw json.RawMessage, refreshEnabled bool, now time.Time) bool {
+	return tokenExpiredBefore(raw, now) && (!refreshEnabled || s.validRefreshToken(raw) == "")
+}
+
+// pruneToken deletes, or with dryRun only judges, the token stored for clientID when it
+// is expired or undecryptable, and returns the entry describing it, or nil when the
+// token is kept.
+func (s *Server) pruneToken(st tokenstore.Cache, clientID string, expired func(json.RawMessage) bool, dryRun bool) *adminapi.PrunedFile {
+	if dryRun {
+		raw, ok, err := st.Get(clientID)
+		defer scrub(raw)
+		switch {
+		case errors.Is(err, tokenstore.ErrDecryptToken):
+			return &adminapi.PrunedFile{Name: clientID, Reason: adminapi.PruneReasonUndecryptable}
+		case err == nil && ok && expired(raw):
+			return &adminapi.PrunedFile{Name: clientID, Reason: adminapi.PruneReasonExpired}
+		default:
+			return nil
+		}
+	}
+	if deleted, err := st.DeleteUnreadable(clientID); err != nil || deleted {
+		return prunedToken(clientID, adminapi.PruneReasonUndecryptable, err)
+	}
+	deleted, err := st.DeleteIf(clientID, expired)
+	if err != nil || deleted {
+		return prunedToken(clientID, adminapi.PruneReasonExpired, err)
+	}
+	return nil
+}
+
+// prunedToken builds the entry for a pruned token, carrying the delete error if any.
+func prunedToken(clientID, reason string, err error) *adminapi.PrunedFile {
+	p := &adminapi.PrunedFile{Name: clientID, Reason: reason}
+	if err != nil {
+		p.Error = err.Error()
+	}
+	return p
+}
+
+// logPruned records what prune deleted in the agent log.
+func (s *Server) logPruned(pruned []*adminapi.PrunedFile, dryRun bool) {
+	if s.logger == nil || dryRun {
+		return
+	}
+	for _, p := range pruned {
+		if p.Error != "" {
+			s.logger.Warn("prune a file in the token directory", "name", p.Name, "reason", p.Reason, "error", p.Error)
+			continue
+		}
+		s.logger.Info("pruned a file in the token directory", "name", p.Name, "reason", p.Reason)
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+// newPruneServer returns an unlocked server over dir seeded with one of each kind of
+// file prune judges. It runs on the real clock, since prune compares the temporary
+// files' modification times, which the file system stamps with the real time.
+func newPruneServer(t *testing.T, dir string) *Server {
+	t.Helper()
+	c := New("")
+	c.store = tokenstore.New(testDataKey(t), dir)
+	now := time.Now()
+	seedToken(t, c, "Iv1.expired", now.Add(-time.Hour))
+	seedToken(t, c, "Iv1.valid", now.Add(time.Hour))
+	seedWithRefresh(t, c, "Iv1.refreshable", now.Add(-time.Hour))
+	// A token written under another key can't be decrypted with this one.
+	otherKey := make([]byte, 32)
+	if err := tokenstore.New(otherKey, dir).Set("Iv1.otherkey", json.RawMessage(`{"access_token":"x"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Metadata of a token that is gone.
+	seedToken(t, c, "Iv1.gone", now.Add(time.Hour))
+	if err := c.store.Touch("Iv1.gone", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "Iv1.gone")); err != nil {
+		t.Fatal(err)
+	}
+	// An old temporary file is a leftover; a recent one may be a write in progress.
+	for name, age := range map[string]time.Duration{".ghtkn-tmp-old": 2 * time.Hour, ".ghtkn-tmp-new": 0} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+// sortPruned orders prune entries by name, so the expectations do not depend on the
+// directory listing order.
+var sortPruned = cmpopts.SortSlices(func(a, b *adminapi.PrunedFile) bool { return a.Name < b.Name }) //nolint:gochecknoglobals // a read-only test option
+
+// TestServer_prune verifies what prune deletes: expired tokens without a usable refresh
+// token, undecryptable tokens, old temporary files, and orphaned metadata, and with
+// refresh disabled also expired tokens that carry a refresh token.
+func TestServer_prune(t *testing.T) {
+	t.Parallel()
+	base := []*adminapi.PrunedFile{
+		{Name: "Iv1.expired", Reason: adminapi.PruneReasonExpired},
+		{Name: "Iv1.otherkey", Reason: adminapi.PruneReasonUndecryptable},
+		{Name: ".ghtkn-tmp-old", Reason: tokenstore.LeftoverTempFile},
+		{Name: filepath.Join(".meta", "Iv1.gone"), Reason: tokenstore.LeftoverMetadata},
+	}
+	data := []struct {
+		name           string
+		refreshEnabled bool
+		want           []*adminapi.PrunedFile
+	}{
+		{name: "refresh enabled", refreshEnabled: true, want: base},
+		{name: "refresh disabled", want: append([]*adminapi.PrunedFile{{Name: "Iv1.refreshable", Reason: adminapi.PruneReasonExpired}}, base...)},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			c := newPruneServer(t, dir)
+
+			dry, err := c.prune(c.store, &refreshPolicy{enabled: d.refreshEnabled}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(d.want, dry, sortPruned); diff != "" {
+				t.Fatalf("dry run (-want +got):\n%s", diff)
+			}
+			for _, p := range d.want {
+				if _, err := os.Stat(filepath.Join(dir, p.Name)); err != nil {
+					t.Fatalf("a dry run must not delete %s: %v", p.Name, err)
+				}
+			}
+
+			got, err := c.prune(c.store, &refreshPolicy{enabled: d.refreshEnabled}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(d.want, got, sortPruned); diff != "" {
+				t.Fatalf("prune (-want +got):\n%s", diff)
+			}
+			for _, p := range d.want {
+				if _, err := os.Stat(filepath.Join(dir, p.Name)); !os.IsNotExist(err) {
+					t.Fatalf("%s must be deleted, stat err = %v", p.Name, err)
+				}
+			}
+			for _, name := range []string{"Iv1.valid", ".ghtkn-tmp-new"} {
+				if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+					t.Fatalf("%s must be kept: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+// TestServer_prune_afterLock verifies that a prune racing LOCK does not mistake every
+// token for undecryptable once the key is zeroed.
+func TestServer_prune_afterLock(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	c := newPruneServer(t, dir)
+	st := c.store
+	c.handleLock()
+
+	if _, err := c.prune(st, &refreshPolicy{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Iv1.valid")); err != nil {
+		t.Fatalf("a prune after LOCK must not delete a valid token: %v", err)
+	}
+}
+
+// TestServer_handlePrune_locked verifies that a locked agent refuses to prune.
+func TestServer_handlePrune_locked(t *testing.T) {
+	t.Parallel()
+	if got := New("").handlePrune(false); got.OK {
+		t.Fatalf("a locked agent must refuse to prune, got %+v", got)
+	}
+}
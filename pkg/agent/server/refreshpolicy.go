@@ -0,0 +1,123 @@
+package server
+
+import (
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// refreshPolicy is the refresh-token setting of an unlocked agent: whether a stored
+// refresh token may be used and how long a token may sit unused before the sweep
+// discards it, agent-wide and overridden per app. It is set from UNLOCK and never
+// modified afterwards (a new unlock builds a new one), so a copy can be handed to the
+// sweep goroutines.
+type refreshPolicy struct {
+	enabled bool
+	ttl     time.Duration
+	// apps overrides enabled and ttl per client ID.
+	apps map[string]appRefreshRule
+}
+
+// appRefreshRule is the refresh-token setting of one app, overriding the agent-wide one.
+type appRefreshRule struct {
+	enabled bool
+	ttl     time.Duration
+}
+
+// forClient returns whether clientID's token may be refreshed and how long it may sit
+// unused before the sweep discards it.
+func (p *refreshPolicy) forClient(clientID string) (bool, time.Duration) {
+	if rule, ok := p.apps[clientID]; ok {
+		return rule.enabled, rule.ttl
+	}
+	return p.enabled, p.ttl
+}
+
+// refreshEnabledFor reports whether clientID's token may be refreshed.
+func (p *refreshPolicy) refreshEnabledFor(clientID string) bool {
+	enabled, _ := p.forClient(clientID)
+	return enabled
+}
+
+// anyEnabled reports whether refresh is enabled for some app: agent-wide, or by a rule.
+func (p *refreshPolicy) anyEnabled() bool {
+	if p.enabled {
+		return true
+	}
+	for _, rule := range p.apps {
+		if rule.enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// allEnabled reports whether refresh is enabled for every app, i.e. no stored refresh
+// token has to be dropped.
+func (p *refreshPolicy) allEnabled() bool {
+	if !p.enabled {
+		return false
+	}
+	for _, rule := range p.apps {
+		if !rule.enabled {
+			return false
+		}
+	}
+	return true
+}
+
+// newRefreshPolicy builds the policy an UNLOCK asks for. A rule without a TTL uses the
+// agent-wide one, and a rule's TTL is clamped like the agent-wide one (see
+// resolveRefreshTokenTTL). A later rule for the same client ID replaces an earlier one.
+func (s *Server) newRefreshPolicy(enabled bool, ttl time.Duration, rules []*adminapi.AppRefresh) *refreshPolicy {
+	policy := &refreshPolicy{
+		enabled: enabled,
+		ttl:     s.resolveRefreshTokenTTL(ttl),
+	}
+	for _, rule := range rules {
+		if rule == nil || rule.ClientID == "" {
+			continue
+		}
+		if policy.apps == nil {
+			policy.apps = make(map[string]appRefreshRule, len(rules))
+		}
+		r := appRefreshRule{enabled: rule.Enable, ttl: policy.ttl}
+		if rule.TTL > 0 {
+			r.ttl = s.resolveRefreshTokenTTL(rule.TTL)
+		}
+		policy.apps[rule.ClientID] = r
+	}
+	return policy
+}
+
+// currentRefreshPolicy returns the refresh-token policy of the current unlock. It is the
+// zero policy (refresh disabled for every app) while the agent is locked.
+func (s *Server) currentRefreshPolicy() *refreshPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.refreshPolicyLocked()
+}
+
+// refreshPolicyLocked is currentRefreshPolicy for a caller holding s.mu.
+func (s *Server) refreshPolicyLocked() *refreshPolicy {
+	return &refreshPolicy{
+		enabled: s.enableRefreshToken,
+		ttl:     s.refreshTokenTTL,
+		apps:    s.appRefresh,
+	}
+}
+
+// logRefreshPolicy records the per-app rules of an unlock, so the audit trail shows
+// which apps could be refreshed. It is called with s.mu held.
+func (s *Server) logRefreshPolicy(policy *refreshPolicy) {
+	if s.logger == nil {
+		return
+	}
+	for clientID, rule := range policy.apps {
+		if rule.enabled {
+			s.logger.Info("refresh tokens are enabled for an app", "client_id", clientID, "refresh_token_ttl", rule.ttl)
+		} else {
+			s.logger.Info("refresh tokens are disabled for an app", "client_id", clientID)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+func TestServer_newRefreshPolicy(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	policy := c.newRefreshPolicy(false, 0, []*adminapi.AppRefresh{
+		{ClientID: "Iv1.ro", Enable: true, TTL: 14 * 24 * time.Hour},
+		{ClientID: "Iv1.default", Enable: true},
+		{ClientID: "Iv1.admin", Enable: true},
+		{ClientID: "Iv1.admin"}, // a later rule replaces an earlier one
+		{ClientID: "Iv1.long", Enable: true, TTL: 365 * 24 * time.Hour},
+		{}, // no client ID: ignored
+	})
+	type rule struct {
+		Enabled bool
+		TTL     time.Duration
+	}
+	got := map[string]rule{}
+	for _, id := range []string{"Iv1.ro", "Iv1.default", "Iv1.admin", "Iv1.long", "Iv1.other"} {
+		enabled, ttl := policy.forClient(id)
+		got[id] = rule{Enabled: enabled, TTL: ttl}
+	}
+	want := map[string]rule{
+		"Iv1.ro":      {Enabled: true, TTL: 14 * 24 * time.Hour},
+		"Iv1.default": {Enabled: true, TTL: defaultRefreshTokenTTL},
+		"Iv1.admin":   {TTL: defaultRefreshTokenTTL},
+		"Iv1.long":    {Enabled: true, TTL: 6 * 30 * 24 * time.Hour}, // capped
+		"Iv1.other":   {TTL: defaultRefreshTokenTTL},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("rules (-want +got):\n%s", diff)
+	}
+	if !policy.anyEnabled() || policy.allEnabled() {
+		t.Fatalf("anyEnabled = %v, allEnabled = %v, want true, false", policy.anyEnabled(), policy.allEnabled())
+	}
+}
+
+// TestServer_respond_unlock_appRefresh verifies that an UNLOCK with per-app rules keeps
+// the refresh token of the app refresh is enabled for, strips it from the app refresh is
+// disabled for, and reports that the rules were applied.
+func TestServer_respond_unlock_appRefresh(t *testing.T) {
+	t.Parallel()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	tokenDir := t.TempDir()
+	st := seedRefreshToken(t, keyFile, tokenDir, "2999-06-01T00:00:00Z")
+	const seeded = `{"access_token":"ghu_b","expiration_date":"2999-01-01T00:00:00Z","refresh_token":"ghr_b","refresh_token_expiration_date":"2999-06-01T00:00:00Z"}`
+	if err := st.Set("Iv1.admin", json.RawMessage(seeded)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New("")
+	c.keyFile = keyFile
+	c.tokenDir = tokenDir
+	unlock := func(confirm bool) *adminapi.Response {
+		t.Helper()
+		req := fmt.Sprintf(`{"protocol_version":1,"command":"UNLOCK","passphrase":"pw","confirm_refresh_token_removal":%t,`+
+			`"app_refresh":[{"client_id":"Iv1.x","enable":true},{"client_id":"Iv1.admin"}]}`, confirm)
+		got, _ := c.respond(t.Context(), strings.NewReader(req+"\n"))
+		return got
+	}
+	// The admin app's refresh token is still valid, so dropping it needs confirmation.
+	if got := unlock(false); !got.RefreshTokenRemovalPending || got.AppRefreshApplied {
+		t.Fatalf("unconfirmed UNLOCK: %+v", got)
+	}
+	got := unlock(true)
+	if diff := cmp.Diff(&adminapi.Response{Response: agentapi.Response{OK: true}, AppRefreshApplied: true}, got); diff != "" {
+		t.Fatalf("UNLOCK (-want +got):\n%s", diff)
+	}
+
+	for id, want := range map[string]bool{"Iv1.x": true, "Iv1.admin": false} {
+		raw, ok, err := c.store.Get(id)
+		if err != nil || !ok {
+			t.Fatalf("read the token of %s: ok=%v err=%v", id, ok, err)
+		}
+		if refreshable := c.validRefreshToken(raw) != ""; refreshable != want {
+			t.Errorf("%s keeps its refresh token: %v, want %v", id, refreshable, want)
+		}
+	}
+	if !c.currentRefreshPolicy().refreshEnabledFor("Iv1.x") || c.currentRefreshPolicy().refreshEnabledFor("Iv1.admin") {
+		t.Fatal("the per-app rules must be in force after unlock")
+	}
+
+	// An SDK client's re-unlock does not see the rules applied.
+	reunlock, _ := c.respond(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK","passphrase":"pw","app_refresh":[{"client_id":"Iv1.admin","enable":true}]}`+"\n"))
+	if reunlock.AppRefreshApplied || c.currentRefreshPolicy().refreshEnabledFor("Iv1.admin") {
+		t.Fatalf("a re-unlock must not change the rules: %+v", reunlock)
+	}
+}
+
+// TestServer_dispatchGet_appRefreshDisabled verifies that a GET does not refresh the
+// token of an app refresh is disabled for, even with refresh enabled for the agent, and
+// that the background refresh skips it too.
+func TestServer_dispatchGet_appRefreshDisabled(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		c.enableRefreshToken = true
+		c.refreshTokenTTL = defaultRefreshTokenTTL
+		c.appRefresh = map[string]appRefreshRule{"Iv1.admin": {}}
+		rt := &refreshCounter{status: http.StatusOK}
+		setClientTransport(c, rt)
+		seedExpiredWithRefresh(t, c, "Iv1.admin", time.Now().Add(24*time.Hour))
+		seedExpiredWithRefresh(t, c, "Iv1.ro", time.Now().Add(24*time.Hour))
+
+		got, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"GET","client_id":"Iv1.admin"}`+"\n"))
+		if diff := cmp.Diff(&agentapi.Response{Error: agentapi.RespNotFound}, got); diff != "" {
+			t.Fatalf("GET of the refresh-disabled app (-want +got):\n%s", diff)
+		}
+		c.refreshExpiringTokens(t.Context(), c.store, c.currentRefreshPolicy(), true)
+		if rt.calls != 1 {
+			t.Fatalf("refreshes = %d, want 1 (only Iv1.ro)", rt.calls)
+		}
+		if got := storedAccessToken(t, c, "Iv1.admin"); got != "old" {
+			t.Fatalf("access token of Iv1.admin = %q, want it not refreshed", got)
+		}
+	})
+}
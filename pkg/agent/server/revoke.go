@@ -40,7 +40,7 @@ func (s *Server) handleRevoke(ctx context.Context, req *agentapi.Request) *agent
 // access tokens to revoke, the client IDs they belong to (same order), and the client
 // IDs whose token could not be read (which the caller reports as revoke failures).
 // Client IDs with no stored token are skipped.
-func (s *Server) collectRevocableTokens(st *tokenstore.Store, clientIDs []string) (tokens, attempted, revokeFailed []string) {
+func (s *Server) collectRevocableTokens(st tokenstore.Cache, clientIDs []string) (tokens, attempted, revokeFailed []string) {
 	for _, clientID := range clientIDs {
 		raw, ok, resp := s.readStoredToken(st, clientID)
 		if resp != nil {
@@ -71,7 +71,7 @@ func (s *Server) collectRevocableTokens(st *tokenstore.Store, clientIDs []string
 
 // deleteRevoked deletes the stored copies of already-revoked tokens and returns the
 // client IDs whose deletion failed (a cleanup issue, not a revoke failure).
-func (s *Server) deleteRevoked(st *tokenstore.Store, clientIDs []string) []string {
+func (s *Server) deleteRevoked(st tokenstore.Cache, clientIDs []string) []string {
 	var cleanupFailed []string
 	for _, clientID := range clientIDs {
 		if err := st.Delete(clientID); err != nil {
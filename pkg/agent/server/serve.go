@@ -14,6 +14,7 @@ import (
 	"time"
 
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
 	"github.com/suzuki-shunsuke/slog-error/slogerr"
 )
@@ -40,7 +41,7 @@ const (
 	errMsgEmptyRequest    = "empty request"
 	errMsgInvalidRequest  = "invalid request"
 	errMsgReadRequest     = "read the request"
-	errMsgUnknownCommand  = "unknown command"
+	errMsgUnknownCommand  = adminapi.RespUnknownCommand
 	errMsgInvalidClientID = "invalid client id"
 	errMsgGet             = "get the token"
 	errMsgSet             = "set the token"
@@ -52,6 +53,12 @@ const (
 	errMsgDeviceFlowFailed = "the ghtkn agent's device flow did not complete; the one-time code may have expired. Run the command again to retry."
 	errMsgDelete           = "delete the token"
 	errMsgUnlock           = "unlock the agent"
+	// errMsgUnlockInterrupted is returned to an UNLOCK a LOCK overtook while it derived
+	// the data key.
+	errMsgUnlockInterrupted = "the agent was locked while it was being unlocked; unlock it again"
+	errMsgConfigure         = "configure the agent"
+	errMsgDeleteTokenDir    = "delete the token directory"
+	errMsgPrune             = "prune the token directory"
 	// errMsgRefreshTokenRemovalPending accompanies RefreshTokenRemovalPending so an older
 	// client that does not understand the field still shows a meaningful reason.
 	errMsgRefreshTokenRemovalPending = "stored refresh tokens would be removed; confirm the removal or rerun with --enable-refresh to keep them"
@@ -62,8 +69,9 @@ const (
 
 // serve accepts connections until the listener is closed and handles each one.
 // It returns nil when the listener is closed (e.g. on shutdown). ctx is the server's
-// context; it is passed to handlers so a device flow started to satisfy a GET keeps
-// running after the request connection closes and stops on server shutdown.
+// work context; it is passed to handlers so a device flow started to satisfy a GET keeps
+// running after the request connection closes, and it outlives the listener, so a
+// stopping agent can let that flow complete (see drain).
 func (s *Server) serve(ctx context.Context, listener net.Listener, logger *slog.Logger) error {
 	for {
 		conn, err := listener.Accept()
@@ -71,16 +79,26 @@ func (s *Server) serve(ctx context.Context, listener net.Listener, logger *slog.
 			if errors.Is(err, net.ErrClosed) {
 				return nil
 			}
+			// An UPGRADE stops the accept loop with a deadline rather than by closing the
+			// listener, which the upgraded process takes over (see pauseAccept).
+			if errors.Is(err, os.ErrDeadlineExceeded) && s.upgrading.Load() {
+				return nil
+			}
 			return err //nolint:wrapcheck
 		}
-		go s.handleConn(ctx, conn, logger)
+		s.activeConns.Add(1)
+		go func() {
+			defer s.activeConns.Add(-1)
+			s.handleConn(ctx, conn, logger)
+		}()
 	}
 }
 
 // handleConn reads a single request from conn, processes it, writes the response,
 // and closes the connection. Each connection serves exactly one request.
-// When the request asks the agent to stop, the shutdown is triggered only after
-// the response has been written so the client always receives the acknowledgment.
+// When the request asks the agent to stop, the response is written only once the agent
+// has stopped accepting connections and settled its device flows, so it can report the
+// flows the stop abandoned; the agent waits for it before exiting.
 func (s *Server) handleConn(ctx context.Context, conn net.Conn, logger *slog.Logger) {
 	defer conn.Close()
 	// Bound the read: a client that connects but never sends a full request line must not
@@ -89,7 +107,11 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn, logger *slog.Log
 		logger.Error("set the read deadline", "error", err)
 		return
 	}
-	resp, shutdown := s.handle(ctx, io.LimitReader(conn, maxRequestBytes))
+	resp, shutdown := s.respondTo(ctx, conn, logger)
+	if shutdown && s.shutdown != nil {
+		resp.AbandonedDeviceFlows = s.stop()
+		resp.PID = os.Getpid()
+	}
 	// Stamp this agent's protocol version on every response so a client can tell how old
 	// the agent is. A client that needs the server-owned token lifecycle refuses an agent
 	// that does not set it (agentapi.ErrObsoleteAgent): such an agent predates the
@@ -113,17 +135,47 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn, logger *slog.Log
 		logger.Error("set the write deadline", "error", err)
 		return
 	}
+	// Stop accepting before answering an UPGRADE, so the client's next request waits for
+	// the upgraded process rather than being served by this one.
+	if resp.Upgrading && s.pauseAccept != nil {
+		s.pauseAccept()
+	}
 	if _, err := conn.Write(b); err != nil {
 		logger.Error("write the agent response", "error", err)
 	}
-	if shutdown && s.shutdown != nil {
-		s.shutdown()
+}
+
+// respondTo reads and processes the request on conn, as respond does. A multi-user agent
+// processes it with the state of the user on the other end (see principalFor).
+func (s *Server) respondTo(ctx context.Context, conn net.Conn, logger *slog.Logger) (*adminapi.Response, bool) {
+	r := io.LimitReader(conn, maxRequestBytes)
+	if s.multiUser == nil {
+		return s.respond(ctx, r)
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		slogerr.WithError(logger, err).Error("identify the peer of a connection")
+		return errorResponse(errMsgIdentifyPeer), false
 	}
+	p, err := s.principalFor(uid)
+	if err != nil {
+		slogerr.WithError(logger, err).Error("prepare the state of a user", "uid", uid)
+		return errorResponse(errMsgPrincipal), false
+	}
+	return p.respond(ctx, r)
 }
 
 // handle reads and processes one request, returning the response to send and
-// whether the agent should shut down afterwards.
+// whether the agent should shut down afterwards. It is respond without the adminapi
+// fields, for callers that only need the SDK envelope.
 func (s *Server) handle(ctx context.Context, r io.Reader) (*agentapi.Response, bool) {
+	resp, shutdown := s.respond(ctx, r)
+	return &resp.Response, shutdown
+}
+
+// respond reads and processes one request, returning the response to send, including the
+// fields only adminapi commands set, and whether the agent should shut down afterwards.
+func (s *Server) respond(ctx context.Context, r io.Reader) (*adminapi.Response, bool) {
 	line, err := bufio.NewReader(r).ReadBytes('\n')
 	// An UNLOCK request line carries the passphrase; zero the request bytes once the
 	// request has been dispatched so the plaintext does not linger. req.Passphrase is a
@@ -132,16 +184,17 @@ func (s *Server) handle(ctx context.Context, r io.Reader) (*agentapi.Response, b
 	// ReadBytes returns io.EOF together with the data when there is no trailing
 	// newline, so a non-empty line is still valid in that case.
 	if err != nil && !errors.Is(err, io.EOF) {
-		return &agentapi.Response{Error: errMsgReadRequest}, false
+		return errorResponse(errMsgReadRequest), false
 	}
 	line = bytes.TrimSpace(line)
 	if len(line) == 0 {
-		return &agentapi.Response{Error: errMsgEmptyRequest}, false
+		return errorResponse(errMsgEmptyRequest), false
 	}
-	req := &agentapi.Request{}
-	if err := json.Unmarshal(line, req); err != nil {
-		return &agentapi.Response{Error: errMsgInvalidRequest}, false
+	adminReq := &adminapi.Request{}
+	if err := json.Unmarshal(line, adminReq); err != nil {
+		return errorResponse(errMsgInvalidRequest), false
 	}
+	req := &adminReq.Request
 	// A SET request (legacy client) carries a client-minted token; json.Unmarshal copied
 	// it out of line into its own buffer, so scrub it once dispatch is done. handleSet's
 	// Store.Set takes its own copy, so this does not corrupt the stored token.
@@ -153,11 +206,43 @@ func (s *Server) handle(ctx context.Context, r io.Reader) (*agentapi.Response, b
 	// this agent itself is out of date; both fail fast with a clear "upgrade" message.
 	switch {
 	case req.ProtocolVersion < agentapi.MinProtocolVersion:
-		return &agentapi.Response{Error: agentapi.RespObsoleteClient}, false
+		return errorResponse(agentapi.RespObsoleteClient), false
 	case req.ProtocolVersion > agentapi.ProtocolVersion:
-		return &agentapi.Response{Error: agentapi.RespObsoleteAgent}, false
+		return errorResponse(agentapi.RespObsoleteAgent), false
+	}
+	return s.dispatchAdmin(ctx, adminReq)
+}
+
+// errorResponse builds an error response.
+func errorResponse(msg string) *adminapi.Response {
+	return &adminapi.Response{Response: agentapi.Response{Error: msg}}
+}
+
+// dispatchAdmin routes the adminapi commands whose request or response carries more than
+// the SDK envelope, and everything else to dispatch.
+func (s *Server) dispatchAdmin(ctx context.Context, req *adminapi.Request) (*adminapi.Response, bool) {
+	switch req.Command {
+	case adminapi.CommandTokens:
+		return s.handleTokens(), false
+	case adminapi.CommandPrune:
+		return s.handlePrune(req.DryRun), false
+	case adminapi.CommandConfigure:
+		return s.handleConfigure(ctx, req), false
+	case adminapi.CommandUpgrade:
+		return s.handleUpgrade(), false
+	case adminapi.CommandExport:
+		return s.handleExport(req), false
+	case adminapi.CommandImport:
+		return s.handleImport(req), false
+	case agentapi.CommandStatus:
+		return &adminapi.Response{Response: *s.handleStatus(), Ephemeral: s.ephemeral, Unlocking: s.unlockInProgress()}, false
+	case agentapi.CommandUnlock:
+		resp, applied := s.handleUnlock(ctx, &req.Request, req.AppRefresh)
+		return &adminapi.Response{Response: *resp, AppRefreshApplied: applied}, false
+	default:
+		resp, shutdown := s.dispatch(ctx, &req.Request)
+		return &adminapi.Response{Response: *resp}, shutdown
 	}
-	return s.dispatch(ctx, req)
 }
 
 // dispatch routes a request to the matching handler.
@@ -169,12 +254,14 @@ func (s *Server) handle(ctx context.Context, r io.Reader) (*agentapi.Response, b
 // client never sets StartDeviceFlow (the field did not exist), so GET never starts a
 // flow on its own; refresh is disabled explicitly here.
 //
+// The ghtkn-only commands in adminapi are routed here too.
+//
 //nolint:cyclop // a command router has one case per protocol command; its complexity scales with the command set by design.
 func (s *Server) dispatch(ctx context.Context, req *agentapi.Request) (*agentapi.Response, bool) {
 	legacy := req.ProtocolVersion < agentapi.ProtocolVersionServerLifecycle
 	switch req.Command {
 	case agentapi.CommandGet:
-		return s.handleGet(ctx, req, s.refreshEnabled() && !legacy), false
+		return s.handleGet(ctx, req, s.currentRefreshPolicy().refreshEnabledFor(req.ClientID) && !legacy), false
 	case agentapi.CommandSet:
 		return s.handleSet(req, legacy), false
 	case agentapi.CommandRevoke:
@@ -184,11 +271,19 @@ func (s *Server) dispatch(ctx context.Context, req *agentapi.Request) (*agentapi
 	case agentapi.CommandStatus:
 		return s.handleStatus(), false
 	case agentapi.CommandUnlock:
-		return s.handleUnlock(ctx, req), false
+		resp, _ := s.handleUnlock(ctx, req, nil)
+		return resp, false
 	case agentapi.CommandLock:
 		return s.handleLock(), false
 	case agentapi.CommandStop:
+		if !s.mayStop() {
+			return &agentapi.Response{Error: errMsgStopForbidden}, false
+		}
 		return &agentapi.Response{OK: true}, true
+	case adminapi.CommandPanic:
+		// In a multi-user agent a user's PANIC contains that user's tokens; the agent
+		// keeps serving the others.
+		return s.handlePanic(ctx), s.mayStop()
 	default:
 		return &agentapi.Response{Error: errMsgUnknownCommand}, false
 	}
@@ -199,7 +294,7 @@ func (s *Server) dispatch(ctx context.Context, req *agentapi.Request) (*agentapi
 // back on a hard error. An undecryptable token (e.g. after a key rotation) is reported
 // as a miss (ok false, resp nil) so the caller re-mints it instead of failing with an
 // opaque error.
-func (s *Server) readStoredToken(st *tokenstore.Store, clientID string) (json.RawMessage, bool, *agentapi.Response) {
+func (s *Server) readStoredToken(st tokenstore.Cache, clientID string) (json.RawMessage, bool, *agentapi.Response) {
 	token, ok, err := st.Get(clientID)
 	switch {
 	case errors.Is(err, tokenstore.ErrInvalidClientID):
@@ -216,7 +311,7 @@ func (s *Server) readStoredToken(st *tokenstore.Store, clientID string) (json.Ra
 }
 
 // tokenStore returns the current token store, or nil when the agent is locked.
-func (s *Server) tokenStore() *tokenstore.Store {
+func (s *Server) tokenStore() tokenstore.Cache {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.store
@@ -7,6 +7,10 @@
 // 'ghtkn agent unlock' command prompts for the passphrase on a terminal and sends
 // it over the socket; only then is the data key loaded and tokens become readable.
 //
+// One agent, usually run by root, can also serve every user of a host on a shared socket
+// (see Options.MultiUser), keeping the state of each user apart by the uid the kernel
+// reports for the connection.
+//
 // Tokens are encrypted at rest with AES-256-GCM under a data key that is itself
 // wrapped with a passphrase-derived (Argon2id) key-encryption key. The derived
 // keys live only in memory. The socket protocol (in ghtkn-go-sdk/ghtkn/backend/agent)
@@ -19,8 +23,10 @@ import (
 	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
 	"github.com/suzuki-shunsuke/go-github-device-flow/deviceflow"
 	"github.com/suzuki-shunsuke/go-revoke-github-access-token/revoke"
@@ -42,18 +48,65 @@ type revoker interface {
 
 // Server runs the ghtkn agent server.
 type Server struct {
-	// mu guards store, which is swapped from nil (locked) to a disk store on unlock.
+	// mu guards store, which is swapped from nil (locked) to a disk store on unlock, or
+	// to a memory store for an ephemeral agent.
 	mu    sync.RWMutex
-	store *tokenstore.Store // nil while locked
+	store tokenstore.Cache // nil while locked
+	// unlocking is non-nil while an UNLOCK derives the data key, and closed when it is
+	// done. Deriving the key takes about a second (Argon2id), so it happens outside mu;
+	// unlocking keeps a second UNLOCK from deriving it at the same time and lets STATUS
+	// report the unlock in progress (see beginUnlock). It is guarded by mu.
+	unlocking chan struct{}
+	// locks counts the LOCKs, so an UNLOCK that a LOCK overtook while it derived the key
+	// discards the key rather than unlocking the agent after all. It is guarded by mu.
+	locks uint64
 
 	// shutdown cancels the serve loop. It is set while the server is running
 	// (see Start) and invoked when a STOP command is received.
 	shutdown context.CancelFunc
+	// drainTimeout bounds how long a stopping agent waits for the device flows in
+	// progress (see drain). It is read-only after New, so it needs no lock.
+	drainTimeout time.Duration
+	// activeConns counts the connections being served, so a stopping agent can wait for
+	// their responses (see drain).
+	activeConns atomic.Int64
+	// drained is closed once a stopping agent has settled its device flows, and abandoned
+	// then lists the client IDs of the flows it cut off, for the STOP handler to report.
+	// drained is set in Start; abandoned is written only before drained is closed.
+	drained   chan struct{}
+	abandoned []string
+	// executable is the ghtkn binary an UPGRADE re-executes (see ExecutablePath). It is
+	// set in Start, and empty when it could not be resolved.
+	executable string
+	// upgrading is set while an accepted UPGRADE is being carried out, so a second one is
+	// refused and serve knows the listener stopped accepting for the upgrade.
+	upgrading atomic.Bool
+	// pauseAccept makes serve stop accepting connections without closing the listener,
+	// which the upgraded process takes over. It is set in Start and invoked right before
+	// the response to an UPGRADE is written.
+	pauseAccept func()
+	// socketActivated reports that systemd opened the socket and keeps it, so the agent
+	// must not remove it when it stops. It is set in Start.
+	socketActivated bool
+	// pidFile and ready are Options.PIDFile and Options.Ready. They are read-only after
+	// New.
+	pidFile string
+	ready   func()
 	// logger is the server logger, set in Start so socket handlers can log.
 	logger *slog.Logger
-	// keyFile and tokenDir are the server's on-disk locations, set in Start.
+	// keyFile and tokenDir are the server's on-disk locations, set in Start. Both are
+	// empty for an ephemeral agent.
 	keyFile  string
 	tokenDir string
+	// ephemeral is Options.Ephemeral. It is read-only after New.
+	ephemeral bool
+	// multiUser is set when the agent serves every user of the host (see
+	// Options.MultiUser). Such an agent holds no unlocked state of its own: it answers
+	// each connection with the Server of the user on the other end (see principalFor).
+	multiUser *multiUser
+	// principal is set on the Server holding one user's state in a multi-user agent. It
+	// is read-only after principalFor.
+	principal *principal
 
 	// statusMu guards status.
 	statusMu sync.Mutex
@@ -74,16 +127,40 @@ type Server struct {
 	// sweep discards it (see sweep.go). It is part of the unlocked state (guarded by mu),
 	// set from UNLOCK, and only used when enableRefreshToken is set.
 	refreshTokenTTL time.Duration
-	// sweepCancel stops the refresh-token sweep started at unlock. It is part of the
-	// unlocked state (guarded by mu): UNLOCK sets it to a cancel func derived from the
-	// server context, and LOCK calls it so the sweep goroutine does not outlive the
-	// unlocked state (which would leak a goroutine and run multiple sweeps across
-	// lock/unlock cycles). It is nil when refresh is disabled (no sweep runs).
+	// appRefresh overrides enableRefreshToken and refreshTokenTTL per client ID (see
+	// refreshPolicy). It is part of the unlocked state (guarded by mu), set from UNLOCK
+	// and replaced, never modified, by the next one.
+	appRefresh map[string]appRefreshRule
+	// sweepCancel stops the sweep, the liveness check and, with refresh enabled, the
+	// background refresh started at unlock. It is part of the unlocked state (guarded by mu): UNLOCK sets it
+	// to a cancel func derived from the server context, and LOCK calls it so the
+	// goroutines do not outlive the unlocked state (which would leak them and run several
+	// of each across lock/unlock cycles). It is nil while locked.
 	sweepCancel context.CancelFunc
+	// refresh serializes token refreshes per client ID and tracks which tokens the
+	// background refresher renews (see backgroundrefresh.go). It has its own locks.
+	refresh refreshGuard
 	// goos is the GOOS the agent runs on, set in New and overridable in tests. It gates
 	// the refresh-token feature (see refreshtoken.Supported); it is read-only after New,
 	// so it needs no lock.
 	goos string
+	// maxSessionAge is how long after the device flow a session's tokens may still be
+	// refreshed (see sessionExpired); zero means no limit. It is read-only after New, so
+	// it needs no lock.
+	maxSessionAge time.Duration
+	// incident is how the agent responds to a possible refresh-token leak (see
+	// IncidentPolicy). It is read-only after New, so it needs no lock.
+	incident IncidentPolicy
+	// liveness configures the check that drops tokens revoked out of band (see
+	// LivenessPolicy). It is read-only after New, so it needs no lock.
+	liveness LivenessPolicy
+	// apiClient and apiBaseURL are what the liveness check calls the GitHub REST API
+	// with. They are set in New and overridable in tests; read-only afterwards.
+	apiClient  *http.Client
+	apiBaseURL string
+	// loadDataKey is keyfile.LoadDataKey, which verifyPassphrase checks a passphrase with.
+	// It is set in New and overridable in tests; read-only afterwards.
+	loadDataKey func(path string, passphrase []byte) ([]byte, error)
 	// version is the ghtkn version this agent was built from, reported in the STATUS
 	// response so clients can see that a long-running agent predates the ghtkn that
 	// queries it. It is never empty: New falls back to UnknownVersion. It is read-only
@@ -100,7 +177,8 @@ type Server struct {
 const UnknownVersion = "unknown"
 
 // refreshEnabled reports whether refreshing expiring access tokens with stored refresh
-// tokens is enabled. It is set at unlock time.
+// tokens is enabled agent-wide. It is set at unlock time; an app may override it (see
+// refreshPolicy).
 func (s *Server) refreshEnabled() bool {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -116,25 +194,89 @@ func (s *Server) refreshState() (bool, time.Duration) {
 	return s.enableRefreshToken, s.refreshTokenTTL
 }
 
-// New creates a new agent Server. The server starts locked (no token store);
-// it is unlocked later via the UNLOCK command. version is the ghtkn version the agent
-// reports in its STATUS response; an empty version becomes UnknownVersion.
+// Options holds the agent settings fixed when it starts, as opposed to the unlocked
+// state set by UNLOCK.
+type Options struct {
+	// Incident is the response to a possible refresh-token leak.
+	Incident IncidentPolicy
+	// MaxSessionAge bounds how long one authorization can be extended by refreshing:
+	// past it from the device flow, the agent refuses to refresh the token and the user
+	// must authenticate again. Unlike the refresh-token TTL, which discards a token left
+	// unused, it ends a session however much it is used. Zero means no limit.
+	MaxSessionAge time.Duration
+	// Liveness enables the periodic check that drops stored tokens GitHub no longer
+	// accepts.
+	Liveness LivenessPolicy
+	// DrainTimeout is how long a stopping agent waits for the device flows in progress to
+	// complete before it abandons them. Zero abandons them at once.
+	DrainTimeout time.Duration
+	// PIDFile is a file the agent writes its process ID to once it serves the socket, and
+	// removes when it stops. Empty means none.
+	PIDFile string
+	// Ready is called once the agent serves the socket, e.g. to release the command that
+	// started it as a daemon. Nil means nothing is notified.
+	Ready func()
+	// Ephemeral keeps the tokens in memory only (see tokenstore.Memory): the agent has no
+	// key file and no token directory, UNLOCK needs no passphrase and generates a random
+	// data key, and every token is gone once the agent is locked or exits.
+	Ephemeral bool
+	// MultiUser makes one agent, usually run by root, serve every user of the host on a
+	// shared socket. It tells the users apart by the uid the kernel reports for each
+	// connection and keeps a separate key file, token directory, and lock state per uid.
+	// Only the user running the agent may stop it. It is only supported on Linux.
+	MultiUser bool
+	// StateDir is where a multi-user agent keeps the state of each user. Empty means
+	// DefaultStateDir.
+	StateDir string
+}
+
+// New creates a new agent Server with the default options. The server starts locked
+// (no token store); it is unlocked later via the UNLOCK command. version is the ghtkn
+// version the agent reports in its STATUS response; an empty version becomes
+// UnknownVersion.
 //
 // The controller reads the clock with time.Now rather than an injectable hook: tests
 // that need a controlled clock run inside a testing/synctest bubble, where the time
 // package itself is fake.
 func New(version string) *Server {
+	return NewWithOptions(version, nil)
+}
+
+// NewWithOptions creates a new agent Server like New, with opts applied. A nil opts is
+// the same as New.
+func NewWithOptions(version string, opts *Options) *Server {
+	if opts == nil {
+		opts = &Options{}
+	}
 	if version == "" {
 		version = UnknownVersion
 	}
 	// One HTTP client, shared by the device-flow and revoke clients, with a per-request
 	// timeout so no GitHub call can block a handler goroutine indefinitely.
 	httpClient := &http.Client{Timeout: githubHTTPTimeout}
-	return &Server{
-		status:  map[string]*deviceFlowState{},
-		client:  deviceflow.New(&deviceflow.Input{HTTPClient: httpClient}),
-		revoker: revoke.New(httpClient),
-		goos:    runtime.GOOS,
-		version: version,
+	s := &Server{
+		status:        map[string]*deviceFlowState{},
+		client:        deviceflow.New(&deviceflow.Input{HTTPClient: httpClient}),
+		revoker:       revoke.New(httpClient),
+		goos:          runtime.GOOS,
+		incident:      opts.Incident,
+		liveness:      opts.Liveness,
+		apiClient:     httpClient,
+		apiBaseURL:    defaultAPIBaseURL,
+		loadDataKey:   keyfile.LoadDataKey,
+		maxSessionAge: opts.MaxSessionAge,
+		drainTimeout:  opts.DrainTimeout,
+		pidFile:       opts.PIDFile,
+		ready:         opts.Ready,
+		ephemeral:     opts.Ephemeral,
+		version:       version,
+	}
+	if opts.MultiUser {
+		stateDir := opts.StateDir
+		if stateDir == "" {
+			stateDir = DefaultStateDir
+		}
+		s.multiUser = &multiUser{stateDir: stateDir, principals: map[uint32]*Server{}}
 	}
+	return s
 }
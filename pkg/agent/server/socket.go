@@ -18,6 +18,10 @@ var errAgentRunning = errors.New("another ghtkn agent is already running")
 const (
 	socketDirPerm  os.FileMode = 0o700 // accessible only by the current user
 	socketFilePerm os.FileMode = 0o600 // accessible only by the current user
+	// A multi-user agent's socket is open to every user: the agent tells them apart by
+	// the uid the kernel reports for the peer (see peerUID), not by who may connect.
+	sharedSocketDirPerm  os.FileMode = 0o755
+	sharedSocketFilePerm os.FileMode = 0o666
 )
 
 // listen creates the Unix domain socket listener at path.
@@ -25,7 +29,18 @@ const (
 // refuses to start when a live agent is already listening, and restricts the socket
 // to the current user.
 func listen(ctx context.Context, path string) (net.Listener, error) {
-	if err := os.MkdirAll(filepath.Dir(path), socketDirPerm); err != nil {
+	return listenWithPerm(ctx, path, socketDirPerm, socketFilePerm)
+}
+
+// listenShared is listen for a multi-user agent, whose socket every user may connect to.
+func listenShared(ctx context.Context, path string) (net.Listener, error) {
+	return listenWithPerm(ctx, path, sharedSocketDirPerm, sharedSocketFilePerm)
+}
+
+// listenWithPerm is listen with the permissions of the socket and of its directory, when
+// it has to be created.
+func listenWithPerm(ctx context.Context, path string, dirPerm, filePerm os.FileMode) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
 		return nil, fmt.Errorf("create the socket directory: %w", err)
 	}
 	if err := cleanupStaleSocket(ctx, path); err != nil {
@@ -36,7 +51,7 @@ func listen(ctx context.Context, path string) (net.Listener, error) {
 	if err != nil {
 		return nil, fmt.Errorf("listen on the socket: %w", err)
 	}
-	if err := os.Chmod(path, socketFilePerm); err != nil {
+	if err := os.Chmod(path, filePerm); err != nil {
 		_ = listener.Close()
 		return nil, fmt.Errorf("restrict the socket permissions: %w", err)
 	}
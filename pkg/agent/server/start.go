@@ -2,20 +2,26 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"runtime"
+	"time"
 
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/env"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/harden"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
 )
 
 // Start runs the agent server in the foreground.
 // It opens the Unix domain socket and serves clients until ctx is canceled or a STOP
-// command is received, then removes the socket and exits. The agent starts locked;
+// command is received, then drains the work in flight (see drain), removes the socket,
+// and exits. The agent starts locked;
 // clients use 'ghtkn agent unlock' to load the data key. Because Start needs no
 // terminal, it can run as a background service.
 //
@@ -28,35 +34,130 @@ func (s *Server) Start(ctx context.Context, logger *slog.Logger) error {
 	// elsewhere).
 	harden.Process(logger)
 
-	keyFile, err := keyfile.KeyPath(os.Getenv, runtime.GOOS)
-	if err != nil {
-		return err //nolint:wrapcheck
+	if s.multiUser != nil {
+		if err := checkMultiUser(); err != nil {
+			return err
+		}
+		s.multiUser.owner = uint32(os.Geteuid()) //nolint:gosec // a uid, which checkMultiUser has ensured is not Windows' -1
 	}
-	dir, err := tokenstore.TokenDir(os.Getenv, runtime.GOOS)
-	if err != nil {
-		return err //nolint:wrapcheck
+	if !s.ephemeral && s.multiUser == nil {
+		keyFile, err := keyfile.KeyPath(os.Getenv, runtime.GOOS)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		dir, err := tokenstore.TokenDir(os.Getenv, runtime.GOOS)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+		s.keyFile = keyFile
+		s.tokenDir = dir
 	}
-	s.keyFile = keyFile
-	s.tokenDir = dir
 	s.logger = logger
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	s.shutdown = cancel
+	// The handlers, and what they start (device flows, the sweeps), run on workCtx rather
+	// than ctx: it outlives the listener, so a stopping agent can let them finish first.
+	workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+	s.drained = make(chan struct{})
 
-	path, err := agentapi.SocketPath(os.Getenv, runtime.GOOS)
+	path, err := s.socketPath()
 	if err != nil {
-		return err //nolint:wrapcheck
+		return err
 	}
 
-	listener, err := listen(ctx, path)
+	// An agent re-executed by an UPGRADE takes over the socket and the unlocked state of
+	// the one it replaces instead of opening its own.
+	handoffValue := os.Getenv(envHandoff)
+	if err := os.Unsetenv(envHandoff); err != nil {
+		return fmt.Errorf("remove %s from the environment: %w", envHandoff, err)
+	}
+	handoff, err := takeHandoff(handoffValue)
+	if err != nil {
+		return err
+	}
+	// An agent systemd started on a connection serves the socket systemd opened, which
+	// systemd keeps listening on once the agent stops.
+	activated, err := activatedListener()
 	if err != nil {
 		return err
 	}
-	defer os.Remove(path)
+	var listener net.Listener
+	switch {
+	case handoff != nil:
+		listener = handoff.listener
+		s.socketActivated = handoff.state.SocketActivated
+	case activated != nil:
+		listener = activated
+		s.socketActivated = true
+		if addr := listener.Addr().String(); addr != path {
+			logger.Warn("the socket systemd passed is not where clients look for the agent; set GHTKN_AGENT_SOCKET to the same path for both",
+				"socket", addr, "client_socket", path)
+		}
+	default:
+		if s.multiUser != nil {
+			listener, err = listenShared(ctx, path)
+		} else {
+			listener, err = listen(ctx, path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !s.socketActivated {
+		defer os.Remove(path)
+	}
 	defer listener.Close()
+	s.pauseAccept = func() {
+		if err := setAcceptDeadline(listener, time.Now()); err != nil {
+			slogerr.WithError(logger, err).Error("stop accepting connections for the upgrade")
+		}
+	}
+	if s.executable, err = ExecutablePath(os.Args[0]); err != nil {
+		slogerr.WithError(logger, err).Warn("the agent can't be upgraded in place")
+	}
+
+	if s.pidFile != "" {
+		if err := writePIDFile(s.pidFile); err != nil {
+			return err
+		}
+		defer func() {
+			if err := removePIDFile(s.pidFile); err != nil {
+				slogerr.WithError(logger, err).Warn("remove the pid file", "pid_file", s.pidFile)
+			}
+		}()
+	}
+
+	if handoff != nil {
+		s.resume(workCtx, handoff.state)
+		logger.Info("ghtkn agent upgraded in place", "socket", listener.Addr().String(), "previous_version", handoff.state.Version,
+			"version", s.version, "locked", handoff.state.DataKey == nil)
+	} else {
+		logger.Info("ghtkn agent started", "socket", listener.Addr().String(), "pid", os.Getpid(), "socket_activated", s.socketActivated,
+			"locked", true, "ephemeral", s.ephemeral)
+	}
+	if s.incident != (IncidentPolicy{}) {
+		// Record the policy in force, so the audit trail of an incident shows what the
+		// agent was configured to do about it.
+		logger.Info("refresh-token incident policy", "revoke", s.incident.Revoke,
+			"delete", s.incident.Delete, "lock", s.incident.Lock, "hook", s.incident.Hook)
+	}
 
-	logger.Info("ghtkn agent started", "socket", path, "locked", true)
+	if s.multiUser != nil {
+		logger.Info("the agent serves every user of the host", "state_dir", s.multiUser.stateDir, "owner_uid", s.multiUser.owner)
+	}
+	if s.maxSessionAge > 0 {
+		logger.Info("tokens are not refreshed past the maximum session age", "max_session_age", s.maxSessionAge)
+	}
+	if s.liveness.Interval > 0 {
+		logger.Info("cached tokens are checked against the GitHub API", "interval", s.liveness.Interval, "hook", s.liveness.Hook)
+	}
+
+	if s.ready != nil {
+		s.ready()
+	}
 
 	// Close the listener when the context is canceled (signal or STOP command)
 	// so that serve returns.
@@ -65,10 +166,46 @@ func (s *Server) Start(ctx context.Context, logger *slog.Logger) error {
 		listener.Close()
 	}()
 
-	if err := s.serve(ctx, listener, logger); err != nil {
-		return fmt.Errorf("serve the agent socket: %w", err)
+	for {
+		if err := s.serve(workCtx, listener, logger); err != nil {
+			return fmt.Errorf("serve the agent socket: %w", err)
+		}
+		if !s.upgrading.Load() || ctx.Err() != nil {
+			break
+		}
+		// reexec only returns when the upgrade failed; keep serving with this binary.
+		slogerr.WithError(logger, s.reexec(workCtx, listener)).Error("upgrade the agent in place; it keeps running the current binary")
+		if err := setAcceptDeadline(listener, time.Time{}); err != nil {
+			return fmt.Errorf("accept connections again after a failed upgrade: %w", err)
+		}
 	}
 
+	logger.Info("ghtkn agent stopping", "drain_timeout", s.drainTimeout)
+	abandoned, unfinished := s.drain(cancelWork)
+	if len(abandoned) > 0 || unfinished > 0 {
+		logger.Warn("ghtkn agent stopped before finishing its work in flight; the abandoned device flows must be run again",
+			"abandoned_device_flows", abandoned, "unfinished_connections", unfinished)
+		return nil
+	}
 	logger.Info("ghtkn agent stopped")
 	return nil
 }
+
+// setAcceptDeadline sets the deadline of listener's Accept. A deadline in the past makes
+// serve return without closing the listener (see pauseAccept); the zero time clears it.
+func setAcceptDeadline(listener net.Listener, t time.Time) error {
+	ul, ok := listener.(*net.UnixListener)
+	if !ok {
+		return errors.New("the agent socket is not a Unix domain socket")
+	}
+	return ul.SetDeadline(t) //nolint:wrapcheck
+}
+
+// socketPath resolves the socket the agent listens on. A multi-user agent listens on
+// DefaultSharedSocket unless GHTKN_AGENT_SOCKET is set.
+func (s *Server) socketPath() (string, error) {
+	if s.multiUser != nil && os.Getenv(env.AgentSocket) == "" {
+		return DefaultSharedSocket, nil
+	}
+	return agentapi.SocketPath(os.Getenv, runtime.GOOS) //nolint:wrapcheck
+}
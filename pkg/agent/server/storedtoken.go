@@ -15,4 +15,9 @@ type storedToken struct {
 	ExpirationDate             time.Time `json:"expiration_date"`
 	RefreshToken               string    `json:"refresh_token"`
 	RefreshTokenExpirationDate time.Time `json:"refresh_token_expiration_date"`
+	// SessionStartedAt is when the user authorized the app via the device flow. A refresh
+	// carries it over unchanged, so it dates the whole chain of refreshed tokens; the
+	// agent refuses to refresh past Options.MaxSessionAge from it. It is absent from
+	// tokens stored before the agent recorded it.
+	SessionStartedAt time.Time `json:"session_started_at,omitzero"`
 }
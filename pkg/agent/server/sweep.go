@@ -19,9 +19,9 @@ const (
 	// that refresh token is otherwise valid for. Use --refresh-token-ttl to trade
 	// convenience for a shorter or longer window.
 	defaultRefreshTokenTTL = 7 * 24 * time.Hour
-	// refreshTokenSweepInterval is how often the sweep runs while the agent is unlocked.
-	// Checking every stored token's expiration daily is cheap relative to the risk of an
-	// unused refresh token lingering.
+	// refreshTokenSweepInterval is how often the sweep runs while the agent is unlocked,
+	// with refresh enabled or not. Checking every stored token's expiration daily is cheap
+	// relative to the risk of an unused refresh token lingering.
 	refreshTokenSweepInterval = 24 * time.Hour
 )
 
@@ -44,16 +44,38 @@ func (s *Server) resolveRefreshTokenTTL(ttl time.Duration) time.Duration {
 }
 
 // startRefreshTokenSweep launches the background job that discards tokens unused for
-// longer than ttl. It runs once immediately and then every refreshTokenSweepInterval
-// until ctx is canceled (agent shutdown). It is started only when refresh tokens are
-// enabled, since that is when an unused refresh token is worth reclaiming; with refresh
-// disabled, unlock strips refresh tokens outright instead.
+// longer than their app's TTL in policy. It runs once immediately and then every
+// refreshTokenSweepInterval until ctx is canceled (agent shutdown). It is started only
+// when refresh tokens are enabled for some app, since that is when an unused refresh
+// token is worth reclaiming; unlock strips the refresh tokens of the other apps outright
+// instead.
 //
 // It is called from handleUnlock with c.mu held; it spawns a goroutine and returns. The
 // store is passed in directly so the goroutine does not depend on the locked state.
-func (s *Server) startRefreshTokenSweep(ctx context.Context, st *tokenstore.Store, ttl time.Duration) {
+func (s *Server) startRefreshTokenSweep(ctx context.Context, st tokenstore.Cache, policy *refreshPolicy) {
+	s.startSweep(ctx, func() {
+		s.sweepExpiredTokens(st, policy)
+	})
+}
+
+// startExpiredTokenSweep launches the background job that prunes the token directory
+// (see prune) while refresh is disabled: an expired access token is then useless, since
+// the agent will never refresh it, and a token file written under a previous key can
+// never be read again. Both would otherwise stay on disk forever. It runs once
+// immediately and then every refreshTokenSweepInterval until ctx is canceled.
+//
+// It is called from handleUnlock with c.mu held; it spawns a goroutine and returns.
+func (s *Server) startExpiredTokenSweep(ctx context.Context, st tokenstore.Cache) {
+	s.startSweep(ctx, func() {
+		_, _ = s.prune(st, &refreshPolicy{}, false) // prune logs what it deletes and why it fails
+	})
+}
+
+// startSweep runs sweep once immediately and then every refreshTokenSweepInterval in a
+// goroutine until ctx is canceled.
+func (s *Server) startSweep(ctx context.Context, sweep func()) {
 	go func() {
-		s.sweepExpiredTokens(st, ttl)
+		sweep()
 		ticker := time.NewTicker(refreshTokenSweepInterval)
 		defer ticker.Stop()
 		for {
@@ -61,19 +83,18 @@ func (s *Server) startRefreshTokenSweep(ctx context.Context, st *tokenstore.Stor
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				s.sweepExpiredTokens(st, ttl)
+				sweep()
 			}
 		}
 	}()
 }
 
-// sweepExpiredTokens deletes every stored token whose access token expired more than
-// ttl ago. A token file is rewritten with a fresh expiration each time it is minted or
-// refreshed, so an expiration far in the past means the token has not been used for at
-// least ttl; discarding the whole file reclaims the lingering refresh token and keeps
-// stale files from accumulating. It is best-effort: read/delete errors are logged and
-// skipped.
-func (s *Server) sweepExpiredTokens(st *tokenstore.Store, ttl time.Duration) {
+// sweepExpiredTokens deletes every stored token that no client has fetched for longer
+// than its app's TTL in policy, judged by the last use recorded in its metadata (see
+// tokenIdleSince). Discarding the whole file reclaims the lingering refresh token and
+// keeps stale files from accumulating. It is best-effort: read/delete errors are logged
+// and skipped.
+func (s *Server) sweepExpiredTokens(st tokenstore.Cache, policy *refreshPolicy) {
 	ids, err := st.ClientIDs()
 	if err != nil {
 		if s.logger != nil {
@@ -81,13 +102,15 @@ func (s *Server) sweepExpiredTokens(st *tokenstore.Store, ttl time.Duration) {
 		}
 		return
 	}
-	cutoff := time.Now().Add(-ttl)
+	now := time.Now()
 	for _, id := range ids {
-		// Read the expiration and delete under the store's lock in one operation, so a
-		// concurrent refresh that stores a fresh token cannot slip in between the check and
-		// the delete and have its new token discarded (see Store.DeleteIf).
-		deleted, err := st.DeleteIf(id, func(raw json.RawMessage) bool {
-			return tokenExpiredBefore(raw, cutoff)
+		_, ttl := policy.forClient(id)
+		cutoff := now.Add(-ttl)
+		// Read the last use and delete under the store's lock in one operation, so a
+		// concurrent GET or refresh cannot slip in between the check and the delete and
+		// have its token discarded (see Store.DeleteIfStale).
+		deleted, err := st.DeleteIfStale(id, func(raw json.RawMessage, meta *tokenstore.Metadata) bool {
+			return tokenIdleSince(raw, meta, cutoff)
 		})
 		if err != nil {
 			if s.logger != nil {
@@ -101,6 +124,19 @@ func (s *Server) sweepExpiredTokens(st *tokenstore.Store, ttl time.Duration) {
 	}
 }
 
+// tokenIdleSince reports whether the token was last used before cutoff. The last use is
+// the one recorded in its metadata. A token without one (stored before the agent
+// recorded uses, or by a legacy client's SET and never fetched since) falls back to its
+// access-token expiration: the token is rewritten with a fresh expiration each time it is
+// minted or refreshed, so an expiration before cutoff still means it has not been used
+// since.
+func tokenIdleSince(raw json.RawMessage, meta *tokenstore.Metadata, cutoff time.Time) bool {
+	if !meta.LastUsed.IsZero() {
+		return meta.LastUsed.Before(cutoff)
+	}
+	return tokenExpiredBefore(raw, cutoff)
+}
+
 // tokenExpiredBefore reports whether the token's access-token expiration is before
 // cutoff. An unparsable token, or one without an expiration, is treated as not expired
 // so a decode glitch never deletes data.
@@ -59,7 +59,7 @@ func TestServer_sweepExpiredTokens(t *testing.T) {
 		seedToken(t, c, "Iv1.recent", now.Add(-2*24*time.Hour)) // expired 2d ago: within the TTL
 		seedToken(t, c, "Iv1.fresh", now.Add(time.Hour))        // still valid
 
-		c.sweepExpiredTokens(c.store, 7*24*time.Hour)
+		c.sweepExpiredTokens(c.store, &refreshPolicy{enabled: true, ttl: 7 * 24 * time.Hour})
 
 		if _, ok, _ := c.store.Get("Iv1.stale"); ok {
 			t.Fatal("a token unused past the TTL must be swept")
@@ -73,6 +73,36 @@ func TestServer_sweepExpiredTokens(t *testing.T) {
 	})
 }
 
+// TestServer_sweepExpiredTokens_lastUsed verifies that the sweep judges idleness by the
+// recorded last use when there is one: a token read constantly but never refreshed is
+// kept although it expired long ago, and one last used past the TTL is discarded although
+// it has not expired.
+func TestServer_sweepExpiredTokens_lastUsed(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		now := time.Now()
+
+		seedToken(t, c, "Iv1.used", now.Add(-10*24*time.Hour))
+		if err := c.store.Touch("Iv1.used", now.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		seedToken(t, c, "Iv1.idle", now.Add(time.Hour))
+		if err := c.store.Touch("Iv1.idle", now.Add(-10*24*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+
+		c.sweepExpiredTokens(c.store, &refreshPolicy{enabled: true, ttl: 7 * 24 * time.Hour})
+
+		if _, ok, _ := c.store.Get("Iv1.used"); !ok {
+			t.Fatal("a token used within the TTL must not be swept")
+		}
+		if _, ok, _ := c.store.Get("Iv1.idle"); ok {
+			t.Fatal("a token last used past the TTL must be swept")
+		}
+	})
+}
+
 // TestServer_startRefreshTokenSweep verifies the periodic half of the sweep: the
 // background job sweeps once immediately and then again every refreshTokenSweepInterval,
 // and stops when the context is canceled. The bubble's fake clock makes the day between
@@ -88,7 +118,7 @@ func TestServer_startRefreshTokenSweep(t *testing.T) {
 		// survives the immediate sweep and is discarded by the next tick.
 		seedToken(t, c, "Iv1.aging", time.Now().Add(-6*24*time.Hour-time.Hour))
 
-		c.startRefreshTokenSweep(ctx, c.store, ttl)
+		c.startRefreshTokenSweep(ctx, c.store, &refreshPolicy{enabled: true, ttl: ttl})
 		synctest.Wait() // the immediate sweep has run
 		if _, ok, _ := c.store.Get("Iv1.aging"); !ok {
 			t.Fatal("the immediate sweep must keep a token still within the TTL")
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// handleTokens lists the stored tokens for 'ghtkn agent status': each one's expiration,
+// last use, and whether it can be refreshed, never the token itself. A token that can't
+// be read is listed as unreadable rather than failing the listing.
+func (s *Server) handleTokens() *adminapi.Response {
+	st := s.tokenStore()
+	if st == nil {
+		return errorResponse(agentapi.RespLocked)
+	}
+	ids, err := st.ClientIDs()
+	if err != nil {
+		if s.logger != nil {
+			slogerr.WithError(s.logger, err).Warn("list stored tokens")
+		}
+		return errorResponse(errMsgGet)
+	}
+	resp := &adminapi.Response{Response: agentapi.Response{OK: true, Count: len(ids)}}
+	for _, id := range ids {
+		resp.Tokens = append(resp.Tokens, s.tokenInfo(st, id))
+	}
+	return resp
+}
+
+// tokenInfo describes the token stored for clientID.
+func (s *Server) tokenInfo(st tokenstore.Cache, clientID string) *adminapi.TokenInfo {
+	info := &adminapi.TokenInfo{ClientID: clientID}
+	raw, ok, err := st.Get(clientID)
+	if err != nil || !ok {
+		info.Unreadable = errors.Is(err, tokenstore.ErrDecryptToken)
+		return info
+	}
+	defer scrub(raw)
+	token := &struct {
+		ExpirationDate time.Time `json:"expiration_date"`
+	}{}
+	if err := json.Unmarshal(raw, token); err == nil {
+		info.ExpiresAt = token.ExpirationDate
+	}
+	info.Refreshable = s.validRefreshToken(raw) != ""
+	if meta, err := st.Metadata(clientID); err == nil {
+		info.LastUsed = meta.LastUsed
+	}
+	return info
+}
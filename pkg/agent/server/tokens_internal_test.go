@@ -0,0 +1,51 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// TestServer_respond_tokens verifies that TOKENS lists the stored tokens with their
+// expiration, last use, and refreshability, and that a GET records the last use.
+func TestServer_respond_tokens(t *testing.T) {
+	t.Parallel()
+	synctest.Test(t, func(t *testing.T) {
+		c := newUnlockedServer(t)
+		now := time.Now().Truncate(time.Second)
+		seedToken(t, c, "Iv1.plain", now.Add(time.Hour))
+		seedWithRefresh(t, c, "Iv1.refresh", now.Add(2*time.Hour))
+		if got := c.handleGet(t.Context(), &agentapi.Request{ProtocolVersion: 1, Command: agentapi.CommandGet, ClientID: "Iv1.plain"}, false); !got.OK {
+			t.Fatalf("GET failed: %s", got.Error)
+		}
+
+		got, shutdown := c.respond(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"TOKENS"}`+"\n"))
+		if shutdown {
+			t.Fatal("TOKENS must not stop the agent")
+		}
+		want := &adminapi.Response{
+			Response: agentapi.Response{OK: true, Count: 2},
+			Tokens: []*adminapi.TokenInfo{
+				{ClientID: "Iv1.plain", ExpiresAt: now.Add(time.Hour), LastUsed: time.Now()},
+				{ClientID: "Iv1.refresh", ExpiresAt: now.Add(2 * time.Hour), Refreshable: true},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("TOKENS (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// TestServer_respond_tokensLocked verifies that a locked agent refuses to list tokens.
+func TestServer_respond_tokensLocked(t *testing.T) {
+	t.Parallel()
+	got, _ := New("").respond(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"TOKENS"}`+"\n"))
+	if got.Error != agentapi.RespLocked {
+		t.Fatalf("error = %q, want %q", got.Error, agentapi.RespLocked)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/refreshtoken"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
@@ -14,15 +15,27 @@ import (
 )
 
 // handleUnlock loads (or creates) the data key from the request passphrase and
-// switches the agent to an unlocked, disk-backed store. It is idempotent: unlocking
-// an already-unlocked agent succeeds without re-reading the key.
+// switches the agent to an unlocked, disk-backed store; an ephemeral agent switches to a
+// memory store instead (see openStore). It is idempotent: unlocking an already-unlocked
+// agent succeeds without re-reading the key.
 //
-// Refresh-token handling is bound to this passphrase-authenticated unlock. When refresh
-// is enabled it starts the periodic sweep (see sweep.go) that discards tokens unused
-// past the TTL. When refresh is disabled it strips every stored refresh token, so a
-// refresh token left over from a previous refresh-enabled run can no longer leak. ctx is
-// the server context; the sweep it starts runs until the agent shuts down.
-func (s *Server) handleUnlock(ctx context.Context, req *agentapi.Request) *agentapi.Response {
+// The key is derived outside s.mu, so the agent keeps answering GET and STATUS while it
+// takes its second or so; only one UNLOCK derives it at a time (see beginUnlock), and a
+// LOCK arriving meanwhile makes it fail (see handleLock).
+//
+// Refresh-token handling is bound to this passphrase-authenticated unlock: the request
+// sets it for every app, and appRefresh overrides it per app (see refreshPolicy). It
+// strips the stored refresh token of every app refresh is disabled for, so a refresh
+// token left over from a previous refresh-enabled run can no longer leak. When refresh
+// is enabled for some app it starts the periodic sweep (see sweep.go) that discards
+// tokens unused past their TTL and the background refresh (see backgroundrefresh.go)
+// that renews expiring tokens; otherwise it starts the sweep that discards expired and
+// undecryptable tokens. ctx is the server context; the sweep it starts runs until the
+// agent shuts down or is locked.
+//
+// The second return value reports whether appRefresh was applied, which is only the
+// case when this request unlocked the agent.
+func (s *Server) handleUnlock(ctx context.Context, req *agentapi.Request, appRefresh []*adminapi.AppRefresh) (*agentapi.Response, bool) {
 	// The passphrase is only needed to derive the data key; zero it afterwards. Scrub on
 	// entry so it is zeroed even on the already-unlocked early return below.
 	defer scrub(req.Passphrase)
@@ -30,32 +43,29 @@ func (s *Server) handleUnlock(ctx context.Context, req *agentapi.Request) *agent
 	// this OS can't keep safe (see refreshtoken.Supported), and leaving the agent locked
 	// makes that impossible to miss. The CLI rejects --enable-refresh before prompting
 	// for the passphrase; this covers any other client.
-	if req.EnableRefreshToken && !refreshtoken.Supported(s.goos) {
-		return &agentapi.Response{Error: errMsgRefreshTokenUnsupportedOS}
+	policy := s.newRefreshPolicy(req.EnableRefreshToken, req.RefreshTokenTTL, appRefresh)
+	if policy.anyEnabled() && !refreshtoken.Supported(s.goos) {
+		return &agentapi.Response{Error: errMsgRefreshTokenUnsupportedOS}, false
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.store != nil {
-		// Already unlocked: the refresh setting is fixed at the first unlock and can't
-		// be flipped here (this path never verifies the passphrase). Report the current
-		// state so a re-unlock still shows it.
-		return &agentapi.Response{OK: true, RefreshTokenEnabled: s.enableRefreshToken}
+	locks, done, resp := s.beginUnlock(ctx)
+	if resp != nil {
+		return resp, false
 	}
-	dataKey, created, err := keyfile.LoadOrCreateDataKey(s.keyFile, req.Passphrase)
-	if err != nil {
-		if errors.Is(err, keyfile.ErrIncorrectPassphrase) {
-			return &agentapi.Response{Error: keyfile.ErrIncorrectPassphrase.Error()}
-		}
-		return &agentapi.Response{Error: errMsgUnlock}
+	// done runs after the deferred s.mu.Unlock below, so an UNLOCK waiting for this one
+	// finds the agent unlocked when it wakes up.
+	defer done()
+	// The key is derived without s.mu, so GET and STATUS are answered meanwhile.
+	store, created, errResp := s.openStore(req.Passphrase)
+	if errResp != nil {
+		return errResp, false
 	}
-	store := tokenstore.New(dataKey, s.tokenDir)
 	// Refresh is being turned off while a still-valid refresh token is stored: dropping it
 	// forces the affected apps back through the device flow, so do not do it silently on a
 	// forgotten --enable-refresh. Answer with RefreshTokenRemovalPending (staying locked,
 	// nothing bound) so the client can prompt; a confirmed re-unlock carries
 	// ConfirmRefreshTokenRemoval and falls through to strip below. A first-ever unlock has
 	// no stored tokens, so this never blocks key creation.
-	if s.needsRefreshRemovalConfirmation(req, store) {
+	if s.needsRefreshRemovalConfirmation(req, policy, store) {
 		// Nothing is bound to s.store on this path, so the data key just derived (and held
 		// by store) would otherwise linger un-zeroed until GC. Scrub it now, as every other
 		// path ends the key's life via s.store.Zero() (see handleLock).
@@ -63,26 +73,124 @@ func (s *Server) handleUnlock(ctx context.Context, req *agentapi.Request) *agent
 		if s.logger != nil {
 			s.logger.Info("unlock without --enable-refresh found stored refresh tokens; awaiting confirmation to drop them")
 		}
-		return &agentapi.Response{RefreshTokenRemovalPending: true, Error: errMsgRefreshTokenRemovalPending}
+		return &agentapi.Response{RefreshTokenRemovalPending: true, Error: errMsgRefreshTokenRemovalPending}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks != locks {
+		store.Zero()
+		if s.logger != nil {
+			s.logger.Info("the agent was locked while unlocking; it stays locked")
+		}
+		return &agentapi.Response{Error: errMsgUnlockInterrupted}, false
 	}
 	s.store = store
 	// Bind refresh enablement and its TTL to this passphrase-authenticated unlock.
-	s.enableRefreshToken = req.EnableRefreshToken
-	s.refreshTokenTTL = s.resolveRefreshTokenTTL(req.RefreshTokenTTL)
+	s.applyRefreshPolicy(ctx, store, policy)
 	s.logUnlocked(store, created)
-	if s.enableRefreshToken {
-		// Discard tokens unused past the TTL until the agent shuts down or is locked. The
-		// sweep is bound to a cancelable child of the server context so LOCK can stop it
-		// (see handleLock); otherwise a later unlock would start a second sweep while this
-		// one keeps running.
-		sweepCtx, cancel := context.WithCancel(ctx)
-		s.sweepCancel = cancel
-		s.startRefreshTokenSweep(sweepCtx, store, s.refreshTokenTTL)
+	s.logRefreshPolicy(policy)
+	return &agentapi.Response{OK: true, RefreshTokenEnabled: s.enableRefreshToken}, true
+}
+
+// beginUnlock makes the calling UNLOCK the only one deriving the data key, waiting for
+// the one in progress, if any, to finish first. It returns the LOCK count the unlock
+// starts from and the function that ends it, or the response to send instead: the
+// agent is already unlocked, possibly by the UNLOCK waited for, or ctx ended. An UNLOCK
+// that waited for one with an incorrect passphrase derives the key with its own.
+func (s *Server) beginUnlock(ctx context.Context) (uint64, func(), *agentapi.Response) {
+	for {
+		s.mu.Lock()
+		if s.store != nil {
+			// Already unlocked: the refresh setting can't be flipped here (this path never
+			// verifies the passphrase; CONFIGURE does). Report the current state so a
+			// re-unlock still shows it.
+			resp := &agentapi.Response{OK: true, RefreshTokenEnabled: s.enableRefreshToken}
+			s.mu.Unlock()
+			return 0, nil, resp
+		}
+		wait := s.unlocking
+		if wait == nil {
+			unlocking := make(chan struct{})
+			s.unlocking = unlocking
+			locks := s.locks
+			s.mu.Unlock()
+			return locks, func() {
+				s.mu.Lock()
+				s.unlocking = nil
+				s.mu.Unlock()
+				close(unlocking)
+			}, nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return 0, nil, &agentapi.Response{Error: errMsgUnlock}
+		}
+	}
+}
+
+// unlockInProgress reports whether an UNLOCK is deriving the data key.
+func (s *Server) unlockInProgress() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.unlocking != nil
+}
+
+// openStore loads (or creates) the data key with passphrase and returns the store it
+// unlocks, and whether the key was created. An ephemeral agent has no key file to load:
+// it arms a memory store under a data key generated for this unlock, ignoring the
+// passphrase. On failure it returns the response to send instead.
+func (s *Server) openStore(passphrase []byte) (tokenstore.Cache, bool, *agentapi.Response) {
+	if s.ephemeral {
+		dataKey, err := keyfile.GenerateDataKey()
+		if err != nil {
+			return nil, false, &agentapi.Response{Error: errMsgUnlock}
+		}
+		return tokenstore.NewMemory(dataKey), false, nil
+	}
+	dataKey, created, err := keyfile.LoadOrCreateDataKey(s.keyFile, passphrase)
+	if err != nil {
+		if errors.Is(err, keyfile.ErrIncorrectPassphrase) {
+			return nil, false, &agentapi.Response{Error: keyfile.ErrIncorrectPassphrase.Error()}
+		}
+		return nil, false, &agentapi.Response{Error: errMsgUnlock}
+	}
+	return tokenstore.New(dataKey, s.tokenDir), created, nil
+}
+
+// applyRefreshPolicy makes policy the refresh-token setting of the unlocked agent: it
+// strips the stored refresh tokens of the apps refresh is off for and (re)starts the
+// background jobs (the sweeps, and the liveness check when enabled) to match. It is called with s.mu held, from UNLOCK and CONFIGURE; a sweep
+// started by an earlier call is stopped first.
+func (s *Server) applyRefreshPolicy(ctx context.Context, store tokenstore.Cache, policy *refreshPolicy) {
+	if s.sweepCancel != nil {
+		s.sweepCancel()
+		s.sweepCancel = nil
+	}
+	s.enableRefreshToken = policy.enabled
+	s.refreshTokenTTL = policy.ttl
+	s.appRefresh = policy.apps
+	if !policy.allEnabled() {
+		// Drop the refresh tokens a previous refresh-enabled run left for the apps refresh
+		// is now off for.
+		s.stripRefreshTokens(store, policy)
+	}
+	// The sweeps are bound to a cancelable child of the server context so LOCK can stop
+	// them (see handleLock); otherwise a later unlock would start a second sweep while
+	// this one keeps running.
+	sweepCtx, cancel := context.WithCancel(ctx)
+	s.sweepCancel = cancel
+	if policy.anyEnabled() {
+		// Discard tokens unused past their TTL until the agent shuts down or is locked.
+		s.startRefreshTokenSweep(sweepCtx, store, policy)
+		// Renew expiring tokens ahead of time, so GETs are served from disk.
+		s.startBackgroundRefresh(sweepCtx, store, policy)
 	} else {
-		// Refresh is off: drop any refresh tokens left by a previous refresh-enabled run.
-		s.stripRefreshTokens(store)
+		// Refresh is off: keep discarding tokens as they expire.
+		s.startExpiredTokenSweep(sweepCtx, store)
 	}
-	return &agentapi.Response{OK: true, RefreshTokenEnabled: s.enableRefreshToken}
+	s.startLivenessCheck(sweepCtx, store)
 }
 
 // logUnlocked logs the result of a successful unlock: the refresh-token state, and,
@@ -90,7 +198,7 @@ func (s *Server) handleUnlock(ctx context.Context, req *agentapi.Request) *agent
 // previous key. Those files can't be decrypted with the new key (e.g. the key file was
 // deleted while the tokens remained), so they are orphaned and will be re-minted.
 // It is called with c.mu held.
-func (s *Server) logUnlocked(store *tokenstore.Store, created bool) {
+func (s *Server) logUnlocked(store tokenstore.Cache, created bool) {
 	if s.logger == nil {
 		return
 	}
@@ -100,23 +208,25 @@ func (s *Server) logUnlocked(store *tokenstore.Store, created bool) {
 			s.logger.Warn("found cached token files that predate the new agent key; they can't be decrypted and will be re-minted on the next get", "path", s.tokenDir, "count", n)
 		}
 	}
-	s.logger.Info("agent unlocked", "refresh_token_enabled", s.enableRefreshToken)
+	s.logger.Info("agent unlocked", "refresh_token_enabled", s.enableRefreshToken, "ephemeral", s.ephemeral)
 }
 
 // needsRefreshRemovalConfirmation reports whether this unlock would silently drop a
-// still-valid stored refresh token: refresh is being turned off, the user has not yet
-// confirmed the removal, and at least one stored token still carries a usable refresh
-// token. When true, handleUnlock stays locked and asks the client to confirm.
-func (s *Server) needsRefreshRemovalConfirmation(req *agentapi.Request, store *tokenstore.Store) bool {
-	return !req.EnableRefreshToken && !req.ConfirmRefreshTokenRemoval && s.hasValidRefreshToken(store)
+// still-valid stored refresh token: refresh is being turned off for some app, the user
+// has not yet confirmed the removal, and at least one of those apps' stored tokens still
+// carries a usable refresh token. When true, handleUnlock stays locked and asks the
+// client to confirm.
+func (s *Server) needsRefreshRemovalConfirmation(req *agentapi.Request, policy *refreshPolicy, store tokenstore.Cache) bool {
+	return !policy.allEnabled() && !req.ConfirmRefreshTokenRemoval && s.hasValidRefreshToken(store, policy)
 }
 
-// hasValidRefreshToken reports whether any stored token carries a refresh token that is
-// still valid (present and unexpired, per validRefreshToken). It gates the removal
+// hasValidRefreshToken reports whether the stored token of any app policy disables
+// refresh for carries a refresh token that is still valid (present and unexpired, per
+// validRefreshToken). It gates the removal
 // confirmation on unlock: an already-expired or absent refresh token is worthless, so
 // dropping it needs no prompt. It is best-effort — a store or per-token read error is
 // treated as "nothing valid found" so a glitch never forces a spurious prompt.
-func (s *Server) hasValidRefreshToken(st *tokenstore.Store) bool {
+func (s *Server) hasValidRefreshToken(st tokenstore.Cache, policy *refreshPolicy) bool {
 	ids, err := st.ClientIDs()
 	if err != nil {
 		if s.logger != nil {
@@ -125,6 +235,9 @@ func (s *Server) hasValidRefreshToken(st *tokenstore.Store) bool {
 		return false
 	}
 	for _, id := range ids {
+		if policy.refreshEnabledFor(id) {
+			continue
+		}
 		raw, ok, err := st.Get(id)
 		if err != nil || !ok {
 			continue
@@ -138,12 +251,13 @@ func (s *Server) hasValidRefreshToken(st *tokenstore.Store) bool {
 	return false
 }
 
-// stripRefreshTokens removes the refresh token from every stored token, keeping the
-// access token and its expiration. It is best-effort: per-token failures are logged and
-// skipped rather than failing the unlock, since this is security cleanup, not a
-// correctness requirement. The credentials are not revoked (that would send the user a
-// notification email); they are simply dropped from the backend.
-func (s *Server) stripRefreshTokens(st *tokenstore.Store) {
+// stripRefreshTokens removes the refresh token from the stored token of every app
+// policy disables refresh for, keeping the access token and its expiration. It is
+// best-effort: per-token failures are logged and skipped rather than failing the
+// unlock, since this is security cleanup, not a correctness requirement. The
+// credentials are not revoked (that would send the user a notification email); they are
+// simply dropped from the backend.
+func (s *Server) stripRefreshTokens(st tokenstore.Cache, policy *refreshPolicy) {
 	ids, err := st.ClientIDs()
 	if err != nil {
 		if s.logger != nil {
@@ -152,6 +266,9 @@ func (s *Server) stripRefreshTokens(st *tokenstore.Store) {
 		return
 	}
 	for _, id := range ids {
+		if policy.refreshEnabledFor(id) {
+			continue
+		}
 		raw, ok, err := st.Get(id)
 		if err != nil || !ok {
 			// Unreadable/undecryptable/absent: nothing to strip.
@@ -12,6 +12,8 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/filelock"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/refreshtoken"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
 )
@@ -202,7 +204,7 @@ func TestServer_handle_unlock_stripsRefreshWhenDisabled(t *testing.T) {
 // seedRefreshToken unlocks c1 with refresh enabled over key/dir and stores a token
 // carrying a refresh token that expires at refreshExp. It returns the store (backed by the
 // passphrase-derived key) so a caller can read the token back without re-deriving the key.
-func seedRefreshToken(t *testing.T, keyFile, tokenDir, refreshExp string) *tokenstore.Store {
+func seedRefreshToken(t *testing.T, keyFile, tokenDir, refreshExp string) tokenstore.Cache {
 	t.Helper()
 	c1 := New("")
 	c1.keyFile = keyFile
@@ -289,3 +291,131 @@ func TestServer_handle_unlock_noPromptWhenRefreshExpired(t *testing.T) {
 		t.Fatal("an expired refresh token must not block the unlock")
 	}
 }
+
+// TestServer_handle_unlock_ephemeral verifies that an ephemeral agent unlocks without a
+// key file or a passphrase, keeps its tokens in memory, reports itself in STATUS, and
+// loses them when locked.
+func TestServer_handle_unlock_ephemeral(t *testing.T) {
+	t.Parallel()
+	c := NewWithOptions("", &Options{Ephemeral: true})
+
+	status, _ := c.respond(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"STATUS"}`+"\n"))
+	if !status.Ephemeral || !status.Locked || status.Initialized {
+		t.Fatalf("STATUS before unlock = %+v, want ephemeral, locked, and not initialized", status)
+	}
+	unlock, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK"}`+"\n"))
+	if diff := cmp.Diff(&agentapi.Response{OK: true}, unlock); diff != "" {
+		t.Fatalf("UNLOCK (-want +got):\n%s", diff)
+	}
+	st, ok := c.tokenStore().(*tokenstore.Memory)
+	if !ok {
+		t.Fatalf("the store of an ephemeral agent = %T, want *tokenstore.Memory", c.tokenStore())
+	}
+	if err := st.Set("Iv1.x", json.RawMessage(`{"access_token":"ghu_a","expiration_date":"2999-01-01T00:00:00Z"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if get, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"GET","client_id":"Iv1.x"}`+"\n")); !get.OK {
+		t.Fatalf("GET = %+v", get)
+	}
+
+	c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"LOCK"}`+"\n"))
+	if n := st.Len(); n != 0 {
+		t.Fatalf("tokens after LOCK = %d, want 0", n)
+	}
+	c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK"}`+"\n"))
+	if get, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"GET","client_id":"Iv1.x"}`+"\n")); get.Error != agentapi.RespNotFound {
+		t.Fatalf("GET after re-unlock = %+v, want not found", get)
+	}
+}
+
+// holdUnlock starts an UNLOCK with passphrase that blocks deriving the key: it holds the
+// key file's lock, which the UNLOCK waits for, until release is called. It returns once
+// the UNLOCK is in progress, and the channel the UNLOCK's response arrives on.
+func holdUnlock(t *testing.T, c *Server, passphrase string) (resp <-chan *agentapi.Response, release func()) {
+	t.Helper()
+	l, err := filelock.Acquire(c.keyFile+".lock", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan *agentapi.Response, 1)
+	go func() {
+		r, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK","passphrase":"`+passphrase+`"}`+"\n"))
+		ch <- r
+	}()
+	for !c.unlockInProgress() {
+		time.Sleep(time.Millisecond)
+	}
+	return ch, func() {
+		if err := l.Release(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestServer_handleUnlock_unlocking verifies that the agent keeps answering while an
+// UNLOCK derives the key: STATUS reports it locked and unlocking, GET reports it locked,
+// and a second UNLOCK waits for the first rather than deriving the key again.
+func TestServer_handleUnlock_unlocking(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	c.keyFile = filepath.Join(t.TempDir(), "key")
+	c.tokenDir = t.TempDir()
+
+	first, release := holdUnlock(t, c, "pw")
+	status, _ := c.dispatchAdmin(t.Context(), &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
+	if !status.OK || !status.Locked || !status.Unlocking {
+		t.Fatalf("STATUS during the unlock must report locked and unlocking, got %+v", status)
+	}
+	get, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"GET","client_id":"Iv1.x"}`+"\n"))
+	if diff := cmp.Diff(&agentapi.Response{Error: agentapi.RespLocked}, get); diff != "" {
+		t.Fatalf("GET during the unlock (-want +got):\n%s", diff)
+	}
+	second := make(chan *agentapi.Response, 1)
+	go func() {
+		r, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK","passphrase":"pw"}`+"\n"))
+		second <- r
+	}()
+	select {
+	case r := <-second:
+		t.Fatalf("the second UNLOCK must wait for the first, got %+v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	for _, ch := range []<-chan *agentapi.Response{first, second} {
+		if diff := cmp.Diff(&agentapi.Response{OK: true}, <-ch); diff != "" {
+			t.Fatalf("UNLOCK (-want +got):\n%s", diff)
+		}
+	}
+	status, _ = c.dispatchAdmin(t.Context(), &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
+	if status.Locked || status.Unlocking {
+		t.Fatalf("STATUS after the unlock must report unlocked, got %+v", status)
+	}
+}
+
+// TestServer_handleUnlock_lockedMeanwhile verifies that a LOCK arriving while an UNLOCK
+// derives the key makes that UNLOCK fail and leaves the agent locked, and that the next
+// UNLOCK unlocks it.
+func TestServer_handleUnlock_lockedMeanwhile(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	c.keyFile = filepath.Join(t.TempDir(), "key")
+	c.tokenDir = t.TempDir()
+
+	first, release := holdUnlock(t, c, "pw")
+	lockResp := c.handleLock()
+	if diff := cmp.Diff(&agentapi.Response{OK: true, Locked: true}, lockResp); diff != "" {
+		t.Fatalf("LOCK during the unlock (-want +got):\n%s", diff)
+	}
+	release()
+	if diff := cmp.Diff(&agentapi.Response{Error: errMsgUnlockInterrupted}, <-first); diff != "" {
+		t.Fatalf("UNLOCK overtaken by LOCK (-want +got):\n%s", diff)
+	}
+	if c.tokenStore() != nil || c.unlockInProgress() {
+		t.Fatal("the agent must stay locked")
+	}
+	unlock, _ := c.handle(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UNLOCK","passphrase":"pw"}`+"\n"))
+	if diff := cmp.Diff(&agentapi.Response{OK: true}, unlock); diff != "" {
+		t.Fatalf("UNLOCK after LOCK (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+// envHandoff tells an agent started by an upgrading one where to take over from: the
+// file descriptors of the listening socket and of the pipe the handoff state is read
+// from, as "<socket>,<state>". It is internal to the upgrade and removed from the
+// environment as soon as it is read, so the hooks the agent runs don't inherit it.
+const envHandoff = "GHTKN_AGENT_HANDOFF"
+
+// Reexecuted reports whether this process is an agent re-executed by an upgrading one,
+// i.e. it is to take over the socket and state named by envHandoff. It runs the command
+// line of the agent it replaces, --daemon included, but is that agent already.
+func Reexecuted() bool {
+	return os.Getenv(envHandoff) != ""
+}
+
+// Error messages returned to an UPGRADE the agent can't carry out.
+const (
+	errMsgUpgradeUnsupportedOS = "upgrading the agent in place is not supported on Windows; restart it instead"
+	errMsgUpgradeNoExecutable  = "the agent could not resolve the ghtkn binary it was started from; restart it instead"
+	errMsgUpgradeDeviceFlow    = "a device flow is in progress and would be lost; upgrade once it completes"
+	errMsgUpgradeUnlocking     = "the agent is being unlocked; upgrade once the unlock completes"
+	errMsgUpgradeInProgress    = "the agent is already upgrading"
+	errMsgUpgradeEphemeral     = "an ephemeral agent keeps its tokens in memory, which an upgrade can't carry over; restart it instead"
+	errMsgUpgradeMultiUser     = "a multi-user agent holds the unlocked state of several users, which an upgrade can't carry over; restart it instead"
+)
+
+// handoffState is what an upgrading agent hands the process it re-executes, besides the
+// listening socket: the unlocked state that UNLOCK and CONFIGURE set, so the new process
+// serves tokens without asking for the passphrase again. It travels through a pipe,
+// never the disk.
+type handoffState struct {
+	// Version is the version of the agent handing off, for the new process's log.
+	Version string `json:"version"`
+	// DataKey is the data key of an unlocked agent; it is nil while the agent is locked.
+	DataKey            []byte                 `json:"data_key,omitempty"`
+	EnableRefreshToken bool                   `json:"enable_refresh_token,omitempty"`
+	RefreshTokenTTL    time.Duration          `json:"refresh_token_ttl,omitempty"`
+	AppRefresh         []*adminapi.AppRefresh `json:"app_refresh,omitempty"`
+	// SocketActivated reports that systemd opened the socket (see activatedListener), so
+	// the agent must leave it in place when it stops.
+	SocketActivated bool `json:"socket_activated,omitempty"`
+}
+
+// handoff is what an agent started by an upgrading one takes over.
+type handoff struct {
+	listener net.Listener
+	state    *handoffState
+}
+
+// handleUpgrade accepts an UPGRADE: the agent re-executes the binary it was started from
+// once the response is written (see reexec). Like LOCK, it needs no passphrase: the
+// binary is the one the user started the agent with, not one the client names, and the
+// unlocked state only moves to the same user's new process. It is refused while a
+// device flow is in progress, since the goroutine polling GitHub would not survive the
+// re-exec, and while an UNLOCK is deriving the key, since its result would be lost too.
+func (s *Server) handleUpgrade() *adminapi.Response {
+	switch {
+	case s.goos == "windows":
+		return errorResponse(errMsgUpgradeUnsupportedOS)
+	case s.executable == "":
+		return errorResponse(errMsgUpgradeNoExecutable)
+	case s.ephemeral:
+		return errorResponse(errMsgUpgradeEphemeral)
+	case s.principal != nil:
+		return errorResponse(errMsgUpgradeMultiUser)
+	case len(s.runningDeviceFlows()) > 0:
+		return errorResponse(errMsgUpgradeDeviceFlow)
+	case s.unlockInProgress():
+		return errorResponse(errMsgUpgradeUnlocking)
+	case !s.upgrading.CompareAndSwap(false, true):
+		return errorResponse(errMsgUpgradeInProgress)
+	}
+	if s.logger != nil {
+		s.logger.Info("upgrading the agent in place", "executable", s.executable)
+	}
+	return &adminapi.Response{Response: agentapi.Response{OK: true}, Upgrading: true}
+}
+
+// prepareReexec gets the agent ready to hand off once it has stopped accepting
+// connections: it waits for the requests in flight, including the UPGRADE itself, to be
+// answered, and stops the background jobs. It returns the handoff state, and the
+// function that undoes the preparation when the re-exec fails. It locks every refresh
+// lock and s.mu and leaves them locked until then, so nothing changes the unlocked state
+// or the stored tokens in between. The refresh locks come first, as on the GET path: a
+// failed refresh holds its client's lock while an incident may lock the agent, which
+// takes s.mu.
+func (s *Server) prepareReexec(ctx context.Context) (*handoffState, func(), error) {
+	waitUntil(time.Now().Add(writeResponseTimeout), func() bool { return s.activeConns.Load() == 0 })
+	// A GET in flight when the UPGRADE came in may have started a flow since.
+	if flows := s.runningDeviceFlows(); len(flows) > 0 {
+		return nil, nil, fmt.Errorf("device flows started during the upgrade: %s", strings.Join(flows, ", "))
+	}
+	unlockRefresh := s.refresh.lockAll()
+	s.mu.Lock()
+	// An UNLOCK still deriving the key when the wait gave up would unlock the agent
+	// after the handoff.
+	if s.unlocking != nil {
+		s.mu.Unlock()
+		unlockRefresh()
+		return nil, nil, errors.New("an unlock started during the upgrade")
+	}
+	if s.sweepCancel != nil {
+		s.sweepCancel()
+		s.sweepCancel = nil
+	}
+	state := &handoffState{Version: s.version, SocketActivated: s.socketActivated}
+	if s.store != nil {
+		state.DataKey = s.store.CopyKey()
+		state.EnableRefreshToken = s.enableRefreshToken
+		state.RefreshTokenTTL = s.refreshTokenTTL
+		for clientID, rule := range s.appRefresh {
+			state.AppRefresh = append(state.AppRefresh, &adminapi.AppRefresh{ClientID: clientID, Enable: rule.enabled, TTL: rule.ttl})
+		}
+	}
+	undo := func() {
+		scrub(state.DataKey)
+		if s.store != nil {
+			s.applyRefreshPolicy(ctx, s.store, s.refreshPolicyLocked())
+		}
+		s.mu.Unlock()
+		unlockRefresh()
+		s.upgrading.Store(false)
+	}
+	return state, undo, nil
+}
+
+// resume restores the unlocked state an upgrading agent handed off. A locked agent hands
+// off no data key, and the new process stays locked. It is called before the agent
+// serves any request; ctx is the work context the background jobs run on.
+func (s *Server) resume(ctx context.Context, state *handoffState) {
+	if state.DataKey == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store = tokenstore.New(state.DataKey, s.tokenDir)
+	s.applyRefreshPolicy(ctx, s.store, s.newRefreshPolicy(state.EnableRefreshToken, state.RefreshTokenTTL, state.AppRefresh))
+}
+
+// takeHandoff takes over from the upgrading agent that started this process, given the
+// value of envHandoff. It returns nil when the value is empty, i.e. the agent was started
+// normally.
+func takeHandoff(value string) (*handoff, error) {
+	if value == "" {
+		return nil, nil //nolint:nilnil // no handoff is a normal start, not an error
+	}
+	socketFD, stateFD, err := parseHandoff(value)
+	if err != nil {
+		return nil, err
+	}
+	// net.FileListener takes its own copy of the descriptor; close the inherited ones so
+	// they don't leak into the hooks the agent runs.
+	socketFile := os.NewFile(socketFD, "ghtkn agent socket")
+	defer socketFile.Close()
+	stateFile := os.NewFile(stateFD, "ghtkn agent handoff")
+	defer stateFile.Close()
+	raw, err := io.ReadAll(io.LimitReader(stateFile, maxRequestBytes))
+	defer scrub(raw)
+	if err != nil {
+		return nil, fmt.Errorf("read the handoff state: %w", err)
+	}
+	state := &handoffState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("parse the handoff state: %w", err)
+	}
+	listener, err := net.FileListener(socketFile)
+	if err != nil {
+		scrub(state.DataKey)
+		return nil, fmt.Errorf("take over the agent socket: %w", err)
+	}
+	return &handoff{listener: listener, state: state}, nil
+}
+
+// parseHandoff parses the value of envHandoff.
+func parseHandoff(value string) (uintptr, uintptr, error) {
+	socket, state, ok := strings.Cut(value, ",")
+	if !ok {
+		return 0, 0, fmt.Errorf("%s must be <socket fd>,<state fd>: %q", envHandoff, value)
+	}
+	socketFD, err := strconv.ParseUint(socket, 10, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: parse the socket fd: %w", envHandoff, err)
+	}
+	stateFD, err := strconv.ParseUint(state, 10, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: parse the state fd: %w", envHandoff, err)
+	}
+	return uintptr(socketFD), uintptr(stateFD), nil
+}
+
+// ExecutablePath returns the path of the ghtkn binary this process was started from, for
+// an upgrade to re-execute or a service definition to run, given the path the process
+// was invoked by (os.Args[0]). It prefers the path the process was invoked by over the file
+// it resolves to (os.Executable), so a symlink that an upgrade repoints (e.g. Homebrew's)
+// leads to the new binary rather than to the old one, which may have been removed.
+func ExecutablePath(arg0 string) (string, error) {
+	if arg0 != "" {
+		path := arg0
+		if !strings.ContainsRune(arg0, filepath.Separator) {
+			p, err := exec.LookPath(arg0)
+			if err == nil {
+				path = p
+			}
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			if _, err := os.Stat(abs); err == nil {
+				return abs, nil
+			}
+		}
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("resolve the ghtkn binary: %w", err)
+	}
+	return path, nil
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+func TestServer_handleUpgrade(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		goos       string
+		executable string
+		flow       bool
+		unlocking  bool
+		upgrading  bool
+		want       *adminapi.Response
+	}{
+		{
+			name:       "accepted",
+			goos:       "linux",
+			executable: "/usr/local/bin/ghtkn",
+			want:       &adminapi.Response{Response: agentapi.Response{OK: true}, Upgrading: true},
+		},
+		{
+			name:       "windows",
+			goos:       "windows",
+			executable: `C:\ghtkn.exe`,
+			want:       errorResponse(errMsgUpgradeUnsupportedOS),
+		},
+		{
+			name: "no executable",
+			goos: "linux",
+			want: errorResponse(errMsgUpgradeNoExecutable),
+		},
+		{
+			name:       "a device flow in progress",
+			goos:       "linux",
+			executable: "/usr/local/bin/ghtkn",
+			flow:       true,
+			want:       errorResponse(errMsgUpgradeDeviceFlow),
+		},
+		{
+			name:       "an unlock in progress",
+			goos:       "linux",
+			executable: "/usr/local/bin/ghtkn",
+			unlocking:  true,
+			want:       errorResponse(errMsgUpgradeUnlocking),
+		},
+		{
+			name:       "already upgrading",
+			goos:       "linux",
+			executable: "/usr/local/bin/ghtkn",
+			upgrading:  true,
+			want:       errorResponse(errMsgUpgradeInProgress),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			c := New("")
+			c.goos = tt.goos
+			c.executable = tt.executable
+			if tt.flow {
+				c.status["Iv1.flow"] = &deviceFlowState{userCode: "ABCD-1234"}
+			}
+			if tt.unlocking {
+				c.unlocking = make(chan struct{})
+			}
+			c.upgrading.Store(tt.upgrading)
+			got, shutdown := c.respond(t.Context(), strings.NewReader(`{"protocol_version":1,"command":"UPGRADE"}`+"\n"))
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("response (-want +got):\n%s", diff)
+			}
+			if shutdown {
+				t.Fatal("UPGRADE must not shut the agent down")
+			}
+		})
+	}
+}
+
+// TestServer_prepareReexec_resume verifies that the unlocked state an upgrading agent
+// hands off is restored by the new process, and that a failed re-exec leaves the agent
+// as it was.
+func TestServer_prepareReexec_resume(t *testing.T) {
+	t.Parallel()
+	old := newUnlockedServer(t)
+	old.tokenDir = t.TempDir()
+	old.mu.Lock()
+	old.applyRefreshPolicy(t.Context(), old.store, old.newRefreshPolicy(true, 7*24*time.Hour, []*adminapi.AppRefresh{{ClientID: "Iv1.admin"}}))
+	old.mu.Unlock()
+	old.upgrading.Store(true)
+
+	state, undo, err := old.prepareReexec(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state.DataKey, testDataKey(t)) {
+		t.Fatal("the handoff state must carry the data key")
+	}
+	// Copy the state before undo scrubs the key.
+	handedOff := *state
+	handedOff.DataKey = bytes.Clone(state.DataKey)
+	undo()
+	if old.upgrading.Load() || old.sweepCancel == nil || !old.store.HasKey(testDataKey(t)) {
+		t.Fatal("a failed re-exec must leave the agent unlocked with its background jobs running")
+	}
+	old.mu.Lock()
+	old.sweepCancel()
+	old.mu.Unlock()
+
+	upgraded := New("")
+	upgraded.tokenDir = old.tokenDir
+	upgraded.resume(t.Context(), &handedOff)
+	t.Cleanup(func() {
+		upgraded.mu.Lock()
+		defer upgraded.mu.Unlock()
+		upgraded.sweepCancel()
+	})
+	if upgraded.tokenStore() == nil || !upgraded.tokenStore().HasKey(testDataKey(t)) {
+		t.Fatal("the upgraded agent must be unlocked with the handed-off key")
+	}
+	policy := upgraded.currentRefreshPolicy()
+	if !policy.refreshEnabledFor("Iv1.other") || policy.refreshEnabledFor("Iv1.admin") || policy.ttl != 7*24*time.Hour {
+		t.Fatalf("the upgraded agent must keep the refresh settings, got %+v", policy)
+	}
+}
+
+// blockingRoundTripper is a fake token endpoint that reports each request on entered
+// and fails it once release is closed.
+type blockingRoundTripper struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	f.entered <- struct{}{}
+	<-f.release
+	return &http.Response{StatusCode: http.StatusInternalServerError, Body: io.NopCloser(strings.NewReader("{}")), Header: make(http.Header)}, nil
+}
+
+// TestServer_prepareReexec_incidentLock verifies that an upgrade preparing while a
+// refresh fails and the incident policy locks the agent waits for the refresh rather
+// than deadlocking with it: the refresh holds its client's refresh lock while locking
+// the agent takes s.mu.
+func TestServer_prepareReexec_incidentLock(t *testing.T) {
+	t.Parallel()
+	const clientID = "Iv1.incident"
+	c := newUnlockedServer(t)
+	c.incident = IncidentPolicy{Lock: true}
+	rt := &blockingRoundTripper{entered: make(chan struct{}), release: make(chan struct{})}
+	setClientTransport(c, rt)
+	seedExpiredWithRefresh(t, c, clientID, time.Now().Add(24*time.Hour))
+
+	got := make(chan *agentapi.Response, 1)
+	go func() {
+		got <- c.handleGet(t.Context(), &agentapi.Request{ProtocolVersion: 1, Command: agentapi.CommandGet, ClientID: clientID}, true)
+	}()
+	<-rt.entered
+	c.upgrading.Store(true)
+	type prepared struct {
+		undo func()
+		err  error
+	}
+	done := make(chan prepared, 1)
+	go func() {
+		_, undo, err := c.prepareReexec(t.Context())
+		done <- prepared{undo: undo, err: err}
+	}()
+	// Let the upgrade reach the locks before the refresh fails.
+	time.Sleep(50 * time.Millisecond)
+	close(rt.release)
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case resp := <-got:
+		if resp.Error != agentapi.RespLocked {
+			t.Fatalf("resp.Error = %q, want %q", resp.Error, agentapi.RespLocked)
+		}
+	case <-timeout:
+		t.Fatal("the GET deadlocked with the upgrade")
+	}
+	select {
+	case p := <-done:
+		if p.err != nil {
+			t.Fatal(p.err)
+		}
+		p.undo()
+	case <-timeout:
+		t.Fatal("the upgrade deadlocked with the GET")
+	}
+	if c.tokenStore() != nil {
+		t.Fatal("the incident policy must lock the agent")
+	}
+}
+
+// TestServer_resume_locked verifies that a locked agent's upgrade leaves the new process
+// locked.
+func TestServer_resume_locked(t *testing.T) {
+	t.Parallel()
+	c := New("")
+	c.resume(t.Context(), &handoffState{Version: "v1.0.0"})
+	if c.tokenStore() != nil {
+		t.Fatal("a locked agent's handoff must not unlock the new process")
+	}
+}
+
+func TestParseHandoff(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		value     string
+		wantSock  uintptr
+		wantState uintptr
+		wantErr   bool
+	}{
+		{name: "valid", value: "5,9", wantSock: 5, wantState: 9},
+		{name: "one fd", value: "5", wantErr: true},
+		{name: "not a number", value: "5,x", wantErr: true},
+		{name: "negative", value: "-1,9", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			sock, state, err := parseHandoff(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sock != tt.wantSock || state != tt.wantState {
+				t.Fatalf("parseHandoff(%q) = %d, %d, want %d, %d", tt.value, sock, state, tt.wantSock, tt.wantState)
+			}
+		})
+	}
+}
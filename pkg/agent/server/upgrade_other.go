@@ -0,0 +1,16 @@
+//go:build !unix
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// reexec is not supported off Unix: Windows can't replace a running process, and
+// handleUpgrade refuses the UPGRADE before it gets here.
+func (s *Server) reexec(_ context.Context, _ net.Listener) error {
+	s.upgrading.Store(false)
+	return errors.New("upgrading the agent in place is not supported on this OS")
+}
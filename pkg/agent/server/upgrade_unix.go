@@ -0,0 +1,86 @@
+//go:build unix
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// reexec replaces the agent process with a fresh run of s.executable, with the same
+// arguments, once the agent has stopped accepting connections for an UPGRADE. The new
+// process inherits the listening socket, so connections made meanwhile wait in its
+// backlog rather than being refused, and reads the handoff state from a pipe (see
+// takeHandoff). Replacing the process keeps its PID, so a service manager sees the same
+// agent. It only returns on failure, after undoing the preparation, and the agent then
+// keeps serving with the current binary.
+func (s *Server) reexec(ctx context.Context, listener net.Listener) error {
+	ul, ok := listener.(*net.UnixListener)
+	if !ok {
+		s.upgrading.Store(false)
+		return errors.New("the agent socket is not a Unix domain socket")
+	}
+	state, undo, err := s.prepareReexec(ctx)
+	if err != nil {
+		s.upgrading.Store(false)
+		return err
+	}
+	defer undo()
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("marshal the handoff state: %w", err)
+	}
+	defer scrub(raw)
+
+	socketFile, err := ul.File()
+	if err != nil {
+		return fmt.Errorf("duplicate the agent socket: %w", err)
+	}
+	defer socketFile.Close()
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("create the handoff pipe: %w", err)
+	}
+	defer stateR.Close()
+	// The state is far smaller than a pipe buffer, so the write completes without a
+	// reader; the deadline only guards against blocking forever if it ever grew past one.
+	if err := stateW.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		stateW.Close()
+		return fmt.Errorf("set the handoff pipe deadline: %w", err)
+	}
+	_, err = stateW.Write(raw)
+	stateW.Close()
+	if err != nil {
+		return fmt.Errorf("write the handoff state: %w", err)
+	}
+
+	// Go opens every descriptor close-on-exec; clear it on the two the new process takes
+	// over. The connections being served keep it, so they close with this process.
+	socketFD, stateFD := socketFile.Fd(), stateR.Fd()
+	for _, fd := range []uintptr{socketFD, stateFD} {
+		if _, err := unix.FcntlInt(fd, unix.F_SETFD, 0); err != nil {
+			return fmt.Errorf("pass a descriptor to the new agent: %w", err)
+		}
+	}
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, envHandoff+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, fmt.Sprintf("%s=%d,%d", envHandoff, socketFD, stateFD))
+	if s.logger != nil {
+		s.logger.Info("re-executing the agent", "executable", s.executable)
+	}
+	err = syscall.Exec(s.executable, os.Args, env) //nolint:gosec // the binary the agent was started from, resolved at startup
+	return fmt.Errorf("execute %s: %w", s.executable, err)
+}
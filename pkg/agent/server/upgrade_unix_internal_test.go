@@ -0,0 +1,97 @@
+//go:build unix
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestTakeHandoff verifies that a re-executed agent takes over the listening socket and
+// reads the handoff state from the inherited descriptors.
+func TestTakeHandoff(t *testing.T) {
+	t.Parallel()
+	// A short dir keeps the socket path under the OS sun_path limit (t.TempDir embeds
+	// the long test name).
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "s.sock")
+	listener, err := listen(t.Context(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	socketFile, err := listener.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socketFile.Close()
+
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stateR.Close()
+	want := &handoffState{Version: "v1.0.0", DataKey: testDataKey(t), EnableRefreshToken: true, RefreshTokenTTL: time.Hour}
+	raw, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stateW.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	stateW.Close()
+
+	// takeHandoff closes the descriptors it is given, as the re-executed agent owns them;
+	// hand it duplicates so the test's files close their own.
+	socketFD, err := syscall.Dup(int(socketFile.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateFD, err := syscall.Dup(int(stateR.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := takeHandoff(fmt.Sprintf("%d,%d", socketFD, stateFD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.listener.Close()
+	if got.state.Version != want.Version || !bytes.Equal(got.state.DataKey, want.DataKey) ||
+		!got.state.EnableRefreshToken || got.state.RefreshTokenTTL != time.Hour {
+		t.Fatalf("handoff state = %+v, want %+v", got.state, want)
+	}
+
+	// The taken-over listener accepts connections made to the socket.
+	go func() {
+		var d net.Dialer
+		conn, err := d.DialContext(t.Context(), "unix", path)
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := got.listener.Accept()
+	if err != nil {
+		t.Fatalf("accept on the taken-over socket: %v", err)
+	}
+	conn.Close()
+}
+
+// TestTakeHandoff_none verifies that a normal start takes nothing over.
+func TestTakeHandoff_none(t *testing.T) {
+	t.Parallel()
+	got, err := takeHandoff("")
+	if err != nil || got != nil {
+		t.Fatalf("takeHandoff(\"\") = %+v, %v, want nil, nil", got, err)
+	}
+}
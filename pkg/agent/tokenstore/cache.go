@@ -0,0 +1,33 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Cache is what the agent needs of a token store. Store keeps the tokens in files under
+// the token directory; Memory keeps them in the process, for an agent that must leave
+// nothing on disk. Both encrypt every token under the data key, report the same errors,
+// and lock the same way, so the agent runs the same code paths on either.
+type Cache interface {
+	Get(clientID string) (json.RawMessage, bool, error)
+	Set(clientID string, token json.RawMessage) error
+	Delete(clientID string) error
+	DeleteIf(clientID string, pred func(raw json.RawMessage) bool) (bool, error)
+	DeleteIfStale(clientID string, pred func(raw json.RawMessage, meta *Metadata) bool) (bool, error)
+	DeleteUnreadable(clientID string) (bool, error)
+	Touch(clientID string, usedAt time.Time) error
+	Metadata(clientID string) (*Metadata, error)
+	Len() int
+	ClientIDs() ([]string, error)
+	Leftovers(before time.Time) ([]*Leftover, error)
+	RemoveLeftover(leftover *Leftover) error
+	Zero()
+	HasKey(key []byte) bool
+	CopyKey() []byte
+}
+
+var (
+	_ Cache = (*Store)(nil)
+	_ Cache = (*Memory)(nil)
+)
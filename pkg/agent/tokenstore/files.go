@@ -0,0 +1,160 @@
+package tokenstore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of files Files reports besides the leftovers (LeftoverTempFile and
+// LeftoverMetadata).
+const (
+	// FileDirectory is the token directory itself or its metadata directory.
+	FileDirectory = "directory"
+	// FileToken is an encrypted token.
+	FileToken = "token"
+	// FileMetadata is the metadata of a stored token.
+	FileMetadata = "metadata"
+	// FileLock is a lock file serializing access to the directory or to one client ID's
+	// files across processes.
+	FileLock = "lock file"
+	// FileInvalidName is a file the store never writes, so it never reads it either.
+	FileInvalidName = "invalid name"
+)
+
+var errNotRemovable = errors.New("not a removable file in the token directory")
+
+// File is a file in the token directory, as Files lists it.
+type File struct {
+	// Name is the file's path relative to the token directory; the directory itself
+	// is ".".
+	Name string
+	Kind string
+	// Mode is the file's mode, not following a symbolic link.
+	Mode fs.FileMode
+}
+
+// Files lists everything in the token directory and its metadata and lock directories,
+// the directories included, classified by kind. Unlike Leftovers it reports every
+// temporary file whatever its age, so it is meant for a directory no agent is writing
+// to. A missing directory has no files.
+func (s *Store) Files() ([]*File, error) {
+	unlock, err := s.lockDir(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var files []*File
+	for _, dir := range []string{"", metadataDir, idLockDir} {
+		info, err := os.Lstat(filepath.Join(s.dir, dir))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("read the token directory: %w", err)
+		}
+		if !info.IsDir() {
+			// A file named like the metadata or lock directory is listed with the token
+			// directory's entries.
+			continue
+		}
+		name := "."
+		if dir != "" {
+			name = dir
+		}
+		files = append(files, &File{Name: name, Kind: FileDirectory, Mode: info.Mode()})
+		entries, err := os.ReadDir(filepath.Join(s.dir, dir))
+		if err != nil {
+			return nil, fmt.Errorf("read the token directory: %w", err)
+		}
+		for _, e := range entries {
+			if dir == "" && (e.Name() == metadataDir || e.Name() == idLockDir) && e.IsDir() {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				return nil, fmt.Errorf("read the token directory: %w", err)
+			}
+			files = append(files, &File{
+				Name: filepath.Join(dir, e.Name()),
+				Kind: s.fileKindLocked(dir, e.Name(), info.Mode()),
+				Mode: info.Mode(),
+			})
+		}
+	}
+	return files, nil
+}
+
+// fileKindLocked classifies the file name in dir, which is "", metadataDir, or
+// idLockDir. The caller must hold the directory lock exclusively.
+func (s *Store) fileKindLocked(dir, name string, mode fs.FileMode) string {
+	switch {
+	case !mode.IsRegular():
+		return FileInvalidName
+	case dir == idLockDir && validClientID(name):
+		return FileLock
+	case dir == idLockDir:
+		return FileInvalidName
+	case strings.HasPrefix(name, tempFilePrefix):
+		return LeftoverTempFile
+	case dir == "" && name == lockFileName:
+		return FileLock
+	case !validClientID(name):
+		return FileInvalidName
+	case dir == "":
+		return FileToken
+	case s.tokenExistsLocked(name):
+		return FileMetadata
+	default:
+		return LeftoverMetadata
+	}
+}
+
+// RemoveFile removes a file Files reported as a leftover or with an invalid name. The
+// kind is re-checked under the lock, so a file that became a token or the metadata of
+// one in the meantime is kept. A directory is never removed. A file that is already
+// gone is not an error.
+func (s *Store) RemoveFile(file *File) error {
+	if file.Kind == LeftoverTempFile || file.Kind == LeftoverMetadata {
+		return s.RemoveLeftover(&Leftover{Name: file.Name, Kind: file.Kind})
+	}
+	dir, name := filepath.Split(file.Name)
+	dir = filepath.Clean(dir)
+	if file.Kind != FileInvalidName || (dir != "." && dir != metadataDir && dir != idLockDir) {
+		return fmt.Errorf("%w: %s", errNotRemovable, file.Name)
+	}
+	unlock, err := s.lockDir(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := filepath.Join(s.dir, file.Name)
+	info, err := os.Lstat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("remove a file with an invalid name: %w", err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%w: %s is a directory", errNotRemovable, file.Name)
+	}
+	if dir == "." {
+		dir = ""
+	}
+	if s.fileKindLocked(dir, name, info.Mode()) != FileInvalidName {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove a file with an invalid name: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package tokenstore_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+func TestStore_Files(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := tokenstore.New(testDataKey(t), dir)
+	if err := s.Set("Iv1.a", json.RawMessage(`{"access_token":"x"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".meta", "nested"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{".meta/Iv1.a", ".meta/Iv1.gone", ".ghtkn-tmp-123", "bad name", ".meta/.ghtkn-tmp-456"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := s.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range files {
+		got[f.Name] = f.Kind
+	}
+	want := map[string]string{
+		".":                                      tokenstore.FileDirectory,
+		".meta":                                  tokenstore.FileDirectory,
+		"Iv1.a":                                  tokenstore.FileToken,
+		filepath.Join(".meta", "Iv1.a"):          tokenstore.FileMetadata,
+		filepath.Join(".meta", "Iv1.gone"):       tokenstore.LeftoverMetadata,
+		filepath.Join(".meta", "nested"):         tokenstore.FileInvalidName,
+		".ghtkn-lock":                            tokenstore.FileLock,
+		".ghtkn-tmp-123":                         tokenstore.LeftoverTempFile,
+		".locks":                                 tokenstore.FileDirectory,
+		filepath.Join(".locks", "Iv1.a"):         tokenstore.FileLock,
+		filepath.Join(".meta", ".ghtkn-tmp-456"): tokenstore.LeftoverTempFile,
+		"bad name":                               tokenstore.FileInvalidName,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Files() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, f := range files {
+		err := s.RemoveFile(f)
+		switch f.Kind {
+		case tokenstore.FileDirectory, tokenstore.FileToken, tokenstore.FileMetadata, tokenstore.FileLock:
+			if err == nil {
+				t.Fatalf("RemoveFile(%s) must fail for a %s", f.Name, f.Kind)
+			}
+		case tokenstore.FileInvalidName:
+			if f.Mode.IsDir() && err == nil {
+				t.Fatalf("RemoveFile(%s) must not remove a directory", f.Name)
+			}
+		default:
+			if err != nil {
+				t.Fatalf("RemoveFile(%s): %v", f.Name, err)
+			}
+		}
+	}
+	files, err = s.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = map[string]string{}
+	for _, f := range files {
+		got[f.Name] = f.Kind
+	}
+	want = map[string]string{
+		".":                              tokenstore.FileDirectory,
+		".meta":                          tokenstore.FileDirectory,
+		".ghtkn-lock":                    tokenstore.FileLock,
+		".locks":                         tokenstore.FileDirectory,
+		filepath.Join(".locks", "Iv1.a"): tokenstore.FileLock,
+		"Iv1.a":                          tokenstore.FileToken,
+		filepath.Join(".meta", "Iv1.a"):  tokenstore.FileMetadata,
+		filepath.Join(".meta", "nested"): tokenstore.FileInvalidName,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Files() after RemoveFile mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestStore_Files_missingDir(t *testing.T) {
+	t.Parallel()
+	files, err := tokenstore.New(testDataKey(t), filepath.Join(t.TempDir(), "missing")).Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Files() = %v, want none", files)
+	}
+}
+
+func TestStore_RemoveFile_outsideDir(t *testing.T) {
+	t.Parallel()
+	s := tokenstore.New(testDataKey(t), t.TempDir())
+	for _, name := range []string{"../x", ".meta/../../x", "a/b"} {
+		if err := s.RemoveFile(&tokenstore.File{Name: name, Kind: tokenstore.FileInvalidName}); err == nil {
+			t.Fatalf("RemoveFile(%s) must fail", name)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package tokenstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempFilePrefix is the prefix of the temporary files crypt.AtomicWrite creates next to
+// the file it replaces.
+const tempFilePrefix = ".ghtkn-tmp-"
+
+// Kinds of leftover files.
+const (
+	// LeftoverTempFile is a temporary file an interrupted write left behind.
+	LeftoverTempFile = "temporary file"
+	// LeftoverMetadata is the metadata of a token that is gone.
+	LeftoverMetadata = "orphaned metadata"
+)
+
+var errNotLeftover = errors.New("not a leftover in the token directory")
+
+// Leftover is a file in the token directory that no token needs any more.
+type Leftover struct {
+	// Name is the file's path relative to the token directory.
+	Name string
+	Kind string
+}
+
+// Leftovers lists the files in the token directory that no token needs: temporary files
+// last modified before before, and metadata whose token is gone. The age bound keeps a
+// write in progress from being reported. A missing directory has none.
+func (s *Store) Leftovers(before time.Time) ([]*Leftover, error) {
+	unlock, err := s.lockDir(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var leftovers []*Leftover
+	for _, dir := range []string{"", metadataDir} {
+		entries, err := os.ReadDir(filepath.Join(s.dir, dir))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("read the token directory: %w", err)
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				continue
+			}
+			name := filepath.Join(dir, e.Name())
+			if strings.HasPrefix(e.Name(), tempFilePrefix) {
+				if info, err := e.Info(); err == nil && info.ModTime().Before(before) {
+					leftovers = append(leftovers, &Leftover{Name: name, Kind: LeftoverTempFile})
+				}
+				continue
+			}
+			if dir == metadataDir && validClientID(e.Name()) && !s.tokenExistsLocked(e.Name()) {
+				leftovers = append(leftovers, &Leftover{Name: name, Kind: LeftoverMetadata})
+			}
+		}
+	}
+	return leftovers, nil
+}
+
+// RemoveLeftover removes a file Leftovers reported. Orphaned metadata is re-checked under
+// the lock, so metadata whose token was stored again in the meantime is kept. A file
+// that is already gone is not an error.
+func (s *Store) RemoveLeftover(leftover *Leftover) error {
+	dir, name := filepath.Split(leftover.Name)
+	dir = filepath.Clean(dir)
+	if dir != "." && dir != metadataDir {
+		return fmt.Errorf("%w: %s", errNotLeftover, leftover.Name)
+	}
+	unlock, err := s.lockDir(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	switch {
+	case leftover.Kind == LeftoverTempFile && strings.HasPrefix(name, tempFilePrefix):
+	case leftover.Kind == LeftoverMetadata && dir == metadataDir && validClientID(name):
+		if s.tokenExistsLocked(name) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("%w: %s", errNotLeftover, leftover.Name)
+	}
+	if err := os.Remove(filepath.Join(s.dir, leftover.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove a leftover file: %w", err)
+	}
+	return nil
+}
+
+// DeleteUnreadable deletes the token stored for clientID only when it can't be
+// decrypted with the store's key, e.g. one written under a previous key. The check and
+// the delete run under the client ID's lock, so a token stored again in the meantime is
+// kept. After Zero it deletes nothing, since every token then fails to decrypt. It
+// reports whether a token was deleted.
+func (s *Store) DeleteUnreadable(clientID string) (bool, error) {
+	if !validClientID(clientID) {
+		return false, ErrInvalidClientID
+	}
+	unlock, err := s.lockClientID(clientID, false)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if s.zeroed {
+		return false, nil
+	}
+	raw, _, err := s.getLocked(clientID)
+	for i := range raw {
+		raw[i] = 0
+	}
+	if !errors.Is(err, ErrDecryptToken) {
+		return false, nil
+	}
+	if err := s.deleteLocked(clientID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// tokenExistsLocked reports whether a token file exists for clientID. The caller must
+// hold the directory lock exclusively, or clientID's lock.
+func (s *Store) tokenExistsLocked(clientID string) bool {
+	_, err := os.Stat(filepath.Join(s.dir, clientID))
+	return err == nil
+}
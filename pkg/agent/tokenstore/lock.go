@@ -0,0 +1,148 @@
+package tokenstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/filelock"
+)
+
+// lockFileName is the file in the token directory whose lock guards the directory as a
+// whole across processes (see lockDir and lockClientID). It is not a valid client ID, so
+// it is never mistaken for a token.
+const lockFileName = ".ghtkn-lock"
+
+// idLockDir is the subdirectory of the token directory holding one lock file per client
+// ID, which guards that client ID's files across processes. A lock file is never
+// removed, since removing it would let two processes lock different files under the
+// same name; there is one per app ever stored, and each is empty.
+const idLockDir = ".locks"
+
+// dirPerm is the permission of the directories the locks create (current user only), as
+// crypt.AtomicWrite would create them.
+const dirPerm os.FileMode = 0o700
+
+// idLock is the lock of one client ID within this process. refs counts the operations
+// using or waiting for it, so it is dropped from Store.ids once none is.
+type idLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockClientID takes the locks guarding clientID's token and metadata files and returns
+// the function releasing them: the directory lock shared, then clientID's own lock, each
+// first within this process and then across processes. Operations on other client IDs
+// don't wait for it, while one on the same client ID, from this process or another,
+// can't interleave a read with a write or a delete.
+//
+// When the token directory does not exist yet, create makes it for a write about to fill
+// it; otherwise there is nothing on disk to guard and only the locks within this process
+// are taken.
+func (s *Store) lockClientID(clientID string, create bool) (func(), error) {
+	s.dirMu.RLock()
+	l := s.acquireIDLock(clientID)
+	unlock := func() {
+		s.releaseIDLock(clientID, l)
+		s.dirMu.RUnlock()
+	}
+	dirLock, err := s.fileLock(lockFileName, false, create)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if dirLock == nil {
+		return unlock, nil
+	}
+	fileLock, err := s.fileLock(filepath.Join(idLockDir, clientID), true, true)
+	if err != nil {
+		_ = dirLock.Release()
+		unlock()
+		return nil, err
+	}
+	return func() {
+		_ = fileLock.Release()
+		_ = dirLock.Release()
+		unlock()
+	}, nil
+}
+
+// lockDir takes the directory lock, within this process and then across processes, and
+// returns the function releasing it. Held exclusively it waits for every operation on a
+// client ID to finish and keeps new ones out, for operations spanning the directory such
+// as finding orphaned metadata. Held shared it only keeps those out.
+func (s *Store) lockDir(exclusive bool) (func(), error) {
+	lock, unlock := s.dirMu.RLock, s.dirMu.RUnlock
+	if exclusive {
+		lock, unlock = s.dirMu.Lock, s.dirMu.Unlock
+	}
+	lock()
+	dirLock, err := s.fileLock(lockFileName, exclusive, false)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		if dirLock != nil {
+			_ = dirLock.Release()
+		}
+		unlock()
+	}, nil
+}
+
+// fileLock takes the cross-process lock on the file name in the token directory,
+// creating the file and its directory as needed. It returns nil without an error when
+// the token directory does not exist and create is false. A process holding the lock for
+// longer than filelock.DefaultTimeout is stuck, so the wait ends in an error saying so
+// rather than hanging the request.
+func (s *Store) fileLock(name string, exclusive, create bool) (*filelock.Lock, error) {
+	if create {
+		if err := os.MkdirAll(s.dir, dirPerm); err != nil {
+			return nil, fmt.Errorf("create the token directory: %w", err)
+		}
+	}
+	path := filepath.Join(s.dir, name)
+	acquire := filelock.AcquireShared
+	if exclusive {
+		acquire = filelock.Acquire
+	}
+	l, err := acquire(path, filelock.DefaultTimeout)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return l, err //nolint:wrapcheck
+	}
+	if _, serr := os.Stat(s.dir); errors.Is(serr, os.ErrNotExist) {
+		return nil, nil //nolint:nilnil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), dirPerm); err != nil {
+		return nil, fmt.Errorf("create the lock directory: %w", err)
+	}
+	return acquire(path, filelock.DefaultTimeout) //nolint:wrapcheck
+}
+
+// acquireIDLock locks clientID's lock within this process, creating it if no operation
+// holds it.
+func (s *Store) acquireIDLock(clientID string) *idLock {
+	s.idsMu.Lock()
+	l, ok := s.ids[clientID]
+	if !ok {
+		l = &idLock{}
+		s.ids[clientID] = l
+	}
+	l.refs++
+	s.idsMu.Unlock()
+	l.mu.Lock()
+	return l
+}
+
+// releaseIDLock unlocks l, the lock of clientID, and drops it once no operation uses it.
+func (s *Store) releaseIDLock(clientID string, l *idLock) {
+	l.mu.Unlock()
+	s.idsMu.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(s.ids, clientID)
+	}
+	s.idsMu.Unlock()
+}
@@ -0,0 +1,270 @@
+package tokenstore
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/crypt"
+)
+
+// Memory caches access tokens keyed by client ID in the process memory only, for an
+// ephemeral agent: nothing is written to disk, and everything is gone once the process
+// exits or the store is zeroed.
+//
+// It holds the tokens encrypted under dataKey like the files of Store, so a decrypted
+// token still only lives for the duration of the request that reads it, and a memory
+// dump shows no scannable "ghu_"/"ghr_" prefixes.
+type Memory struct {
+	// mu serializes access to the tokens, as Store.mu does to the token files.
+	mu       sync.Mutex
+	dataKey  []byte
+	tokens   map[string][]byte
+	metadata map[string][]byte
+	zeroed   bool
+}
+
+// NewMemory creates an empty in-memory token store encrypting tokens with dataKey.
+func NewMemory(dataKey []byte) *Memory {
+	return &Memory{
+		dataKey:  dataKey,
+		tokens:   map[string][]byte{},
+		metadata: map[string][]byte{},
+	}
+}
+
+// Get returns the token for clientID, as Store.Get does.
+func (m *Memory) Get(clientID string) (json.RawMessage, bool, error) {
+	if !validClientID(clientID) {
+		return nil, false, ErrInvalidClientID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.getLocked(clientID)
+}
+
+// Set encrypts and stores a token for clientID.
+func (m *Memory) Set(clientID string, token json.RawMessage) error {
+	if !validClientID(clientID) {
+		return ErrInvalidClientID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	blob, err := crypt.Seal(m.dataKey, token)
+	if err != nil {
+		return fmt.Errorf("encrypt the token: %w", err)
+	}
+	m.tokens[clientID] = blob
+	return nil
+}
+
+// Delete removes the token stored for clientID and its metadata. Deleting a client ID
+// with no stored token is a no-op.
+func (m *Memory) Delete(clientID string) error {
+	if !validClientID(clientID) {
+		return ErrInvalidClientID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteLocked(clientID)
+	return nil
+}
+
+// DeleteIf deletes the token stored for clientID only when pred returns true for it, as
+// Store.DeleteIf does.
+func (m *Memory) DeleteIf(clientID string, pred func(raw json.RawMessage) bool) (bool, error) {
+	return m.DeleteIfStale(clientID, func(raw json.RawMessage, _ *Metadata) bool {
+		return pred(raw)
+	})
+}
+
+// DeleteIfStale is DeleteIf with the token's metadata passed to pred, as
+// Store.DeleteIfStale does.
+func (m *Memory) DeleteIfStale(clientID string, pred func(raw json.RawMessage, meta *Metadata) bool) (bool, error) {
+	if !validClientID(clientID) {
+		return false, ErrInvalidClientID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	raw, ok, err := m.getLocked(clientID)
+	if err != nil || !ok {
+		return false, err
+	}
+	meta, err := m.metadataLocked(clientID)
+	if err != nil {
+		meta = &Metadata{}
+	}
+	shouldDelete := pred(raw, meta)
+	for i := range raw {
+		raw[i] = 0
+	}
+	if shouldDelete {
+		m.deleteLocked(clientID)
+	}
+	return shouldDelete, nil
+}
+
+// DeleteUnreadable deletes the token stored for clientID only when it can't be
+// decrypted. Every token in memory was stored under the current key, so this only
+// matters for the Cache contract; after Zero it deletes nothing, as Store's does.
+func (m *Memory) DeleteUnreadable(clientID string) (bool, error) {
+	if !validClientID(clientID) {
+		return false, ErrInvalidClientID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.zeroed {
+		return false, nil
+	}
+	raw, ok, err := m.getLocked(clientID)
+	for i := range raw {
+		raw[i] = 0
+	}
+	if ok || err == nil {
+		return false, nil
+	}
+	m.deleteLocked(clientID)
+	return true, nil
+}
+
+// Touch records that the token for clientID was fetched at usedAt. It is a no-op when no
+// token is stored for clientID.
+func (m *Memory) Touch(clientID string, usedAt time.Time) error {
+	if !validClientID(clientID) {
+		return ErrInvalidClientID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tokens[clientID]; !ok {
+		return nil
+	}
+	b, err := json.Marshal(&Metadata{LastUsed: usedAt})
+	if err != nil {
+		return fmt.Errorf("marshal the token metadata: %w", err)
+	}
+	blob, err := crypt.Seal(m.dataKey, b)
+	if err != nil {
+		return fmt.Errorf("encrypt the token metadata: %w", err)
+	}
+	m.metadata[clientID] = blob
+	return nil
+}
+
+// Metadata returns the metadata recorded for clientID. A token without metadata yields
+// the zero Metadata.
+func (m *Memory) Metadata(clientID string) (*Metadata, error) {
+	if !validClientID(clientID) {
+		return nil, ErrInvalidClientID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.metadataLocked(clientID)
+}
+
+// Len returns the number of stored tokens.
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.tokens)
+}
+
+// ClientIDs returns the client IDs of all stored tokens, sorted like a directory
+// listing of Store.
+func (m *Memory) ClientIDs() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(m.tokens)), nil
+}
+
+// Leftovers reports nothing: without files, no interrupted write or deleted token leaves
+// anything behind.
+func (m *Memory) Leftovers(time.Time) ([]*Leftover, error) {
+	return nil, nil
+}
+
+// RemoveLeftover fails, since Leftovers never reports anything to remove.
+func (m *Memory) RemoveLeftover(leftover *Leftover) error {
+	return fmt.Errorf("%w: %s", errNotLeftover, leftover.Name)
+}
+
+// Zero scrubs the data key and drops every token, which could not be decrypted any more
+// anyway. Locking an ephemeral agent therefore discards its tokens.
+func (m *Memory) Zero() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.dataKey {
+		m.dataKey[i] = 0
+	}
+	m.zeroed = true
+	clear(m.tokens)
+	clear(m.metadata)
+}
+
+// HasKey reports whether key is the store's data key. It compares in constant time, and
+// is false once the store is zeroed.
+func (m *Memory) HasKey(key []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.zeroed && subtle.ConstantTimeCompare(m.dataKey, key) == 1
+}
+
+// CopyKey returns a copy of the store's data key. It is nil once the store is zeroed.
+func (m *Memory) CopyKey() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.zeroed {
+		return nil
+	}
+	return bytes.Clone(m.dataKey)
+}
+
+// getLocked decrypts the token for clientID. The caller must hold m.mu.
+func (m *Memory) getLocked(clientID string) (json.RawMessage, bool, error) {
+	blob, ok := m.tokens[clientID]
+	if !ok {
+		return nil, false, nil
+	}
+	plaintext, err := crypt.Open(m.dataKey, blob)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrDecryptToken, err)
+	}
+	return json.RawMessage(plaintext), true, nil
+}
+
+// metadataLocked decrypts the metadata for clientID. The caller must hold m.mu.
+func (m *Memory) metadataLocked(clientID string) (*Metadata, error) {
+	blob, ok := m.metadata[clientID]
+	if !ok {
+		return &Metadata{}, nil
+	}
+	plaintext, err := crypt.Open(m.dataKey, blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptToken, err)
+	}
+	meta := &Metadata{}
+	if err := json.Unmarshal(plaintext, meta); err != nil {
+		return nil, fmt.Errorf("parse the token metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// deleteLocked removes the token for clientID and its metadata. The caller must hold
+// m.mu.
+func (m *Memory) deleteLocked(clientID string) {
+	delete(m.tokens, clientID)
+	delete(m.metadata, clientID)
+}
@@ -0,0 +1,100 @@
+package tokenstore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+	m := tokenstore.NewMemory(testDataKey(t))
+	token := json.RawMessage(`{"access_token":"ghu_abc"}`)
+	for _, id := range []string{"Iv1.b", "Iv1.a"} {
+		if err := m.Set(id, token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, ok, err := m.Get("Iv1.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !bytes.Equal(got, token) {
+		t.Fatalf("Get = %q, %v, want %q", got, ok, token)
+	}
+	ids, err := m.ClientIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"Iv1.a", "Iv1.b"}, ids); diff != "" {
+		t.Fatalf("ClientIDs (-want +got):\n%s", diff)
+	}
+
+	usedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := m.Touch("Iv1.a", usedAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Touch("Iv1.absent", usedAt); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := m.Metadata("Iv1.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.LastUsed.Equal(usedAt) {
+		t.Fatalf("LastUsed = %s, want %s", meta.LastUsed, usedAt)
+	}
+
+	deleted, err := m.DeleteIfStale("Iv1.a", func(_ json.RawMessage, meta *tokenstore.Metadata) bool {
+		return meta.LastUsed.Before(usedAt)
+	})
+	if err != nil || deleted {
+		t.Fatalf("DeleteIfStale of a fresh token = %v, %v", deleted, err)
+	}
+	if err := m.Delete("Iv1.a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := m.Get("Iv1.a"); ok || err != nil {
+		t.Fatalf("Get after Delete = %v, %v", ok, err)
+	}
+	if n := m.Len(); n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+}
+
+func TestMemory_invalidClientID(t *testing.T) {
+	t.Parallel()
+	m := tokenstore.NewMemory(testDataKey(t))
+	if err := m.Set("../x", json.RawMessage(`{}`)); !errors.Is(err, tokenstore.ErrInvalidClientID) {
+		t.Fatalf("Set = %v, want ErrInvalidClientID", err)
+	}
+}
+
+// TestMemory_zero verifies that zeroing the store, as locking the agent does, discards
+// the tokens along with the key.
+func TestMemory_zero(t *testing.T) {
+	t.Parallel()
+	key := testDataKey(t)
+	m := tokenstore.NewMemory(key)
+	if err := m.Set("Iv1.a", json.RawMessage(`{"access_token":"ghu_abc"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasKey(testDataKey(t)) {
+		t.Fatal("HasKey must match the data key")
+	}
+	m.Zero()
+	if n := m.Len(); n != 0 {
+		t.Fatalf("Len after Zero = %d, want 0", n)
+	}
+	if m.HasKey(testDataKey(t)) || m.CopyKey() != nil {
+		t.Fatal("the key must be gone after Zero")
+	}
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Fatal("Zero must scrub the data key")
+	}
+}
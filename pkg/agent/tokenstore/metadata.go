@@ -0,0 +1,134 @@
+package tokenstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/crypt"
+)
+
+// metadataDir is the subdirectory of the token directory holding each token's metadata,
+// in a file named after the client ID like the token itself. It is a directory, so the
+// listing of token files skips it.
+const metadataDir = ".meta"
+
+// Metadata is what the store records about a token besides the token itself. It is kept
+// in its own file, encrypted under the same data key, so recording a use does not
+// rewrite (and re-encrypt) the token: the refresh token is touched only when it changes.
+type Metadata struct {
+	// LastUsed is when a client last fetched the token. It is zero for a token not
+	// fetched since it was stored by a ghtkn that did not record it.
+	LastUsed time.Time `json:"last_used,omitzero"`
+}
+
+// Touch records that the token for clientID was fetched at usedAt. It is a no-op when no
+// token is stored for clientID, so a use racing a delete does not leave metadata behind.
+func (s *Store) Touch(clientID string, usedAt time.Time) error {
+	if !validClientID(clientID) {
+		return ErrInvalidClientID
+	}
+	unlock, err := s.lockClientID(clientID, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(filepath.Join(s.dir, clientID)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("check the token file: %w", err)
+	}
+	b, err := json.Marshal(&Metadata{LastUsed: usedAt})
+	if err != nil {
+		return fmt.Errorf("marshal the token metadata: %w", err)
+	}
+	blob, err := crypt.Seal(s.dataKey, b)
+	if err != nil {
+		return fmt.Errorf("encrypt the token metadata: %w", err)
+	}
+	if err := crypt.AtomicWrite(s.metadataPath(clientID), blob); err != nil {
+		return fmt.Errorf("write the token metadata file: %w", err)
+	}
+	return nil
+}
+
+// Metadata returns the metadata recorded for clientID. A token without metadata yields
+// the zero Metadata.
+func (s *Store) Metadata(clientID string) (*Metadata, error) {
+	if !validClientID(clientID) {
+		return nil, ErrInvalidClientID
+	}
+	unlock, err := s.lockClientID(clientID, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return s.metadataLocked(clientID)
+}
+
+// DeleteIfStale is DeleteIf with the token's metadata passed to pred alongside the token,
+// so a decision based on both (e.g. "unused for a week") is made under the same lock as
+// the delete. Unreadable metadata is passed as the zero Metadata rather than failing:
+// it only informs the decision, and the token itself was readable.
+func (s *Store) DeleteIfStale(clientID string, pred func(raw json.RawMessage, meta *Metadata) bool) (bool, error) {
+	if !validClientID(clientID) {
+		return false, ErrInvalidClientID
+	}
+	unlock, err := s.lockClientID(clientID, false)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	raw, ok, err := s.getLocked(clientID)
+	if err != nil || !ok {
+		return false, err
+	}
+	meta, err := s.metadataLocked(clientID)
+	if err != nil {
+		meta = &Metadata{}
+	}
+	shouldDelete := pred(raw, meta)
+	for i := range raw { // scrub the decrypted token; DeleteIfStale owns it
+		raw[i] = 0
+	}
+	if !shouldDelete {
+		return false, nil
+	}
+	if err := s.deleteLocked(clientID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// metadataLocked reads and decrypts the metadata for clientID. The caller must hold
+// clientID's lock.
+func (s *Store) metadataLocked(clientID string) (*Metadata, error) {
+	blob, err := os.ReadFile(s.metadataPath(clientID))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Metadata{}, nil
+		}
+		return nil, fmt.Errorf("read the token metadata file: %w", err)
+	}
+	plaintext, err := crypt.Open(s.dataKey, blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecryptToken, err)
+	}
+	meta := &Metadata{}
+	if err := json.Unmarshal(plaintext, meta); err != nil {
+		return nil, fmt.Errorf("parse the token metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// metadataPath returns the path of the metadata file for clientID.
+func (s *Store) metadataPath(clientID string) string {
+	return filepath.Join(s.dir, metadataDir, clientID)
+}
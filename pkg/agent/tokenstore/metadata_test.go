@@ -0,0 +1,82 @@
+package tokenstore_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+func TestStore_touch(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := tokenstore.New(testDataKey(t), dir)
+	usedAt := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+
+	// Touching a client ID with no stored token records nothing.
+	if err := s.Touch("Iv1.absent", usedAt); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := s.Metadata("Iv1.absent"); err != nil || !meta.LastUsed.IsZero() {
+		t.Fatalf("metadata of an absent token = %+v, %v; want the zero value", meta, err)
+	}
+
+	if err := s.Set("Iv1.abc", json.RawMessage(`{"access_token":"abc"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := s.Metadata("Iv1.abc"); err != nil || !meta.LastUsed.IsZero() {
+		t.Fatalf("metadata of a token never used = %+v, %v; want the zero value", meta, err)
+	}
+	if err := s.Touch("Iv1.abc", usedAt); err != nil {
+		t.Fatal(err)
+	}
+	// The metadata is read back by a fresh store, so it is persisted, and it is not
+	// listed as a token.
+	fresh := tokenstore.New(testDataKey(t), dir)
+	meta, err := fresh.Metadata("Iv1.abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.LastUsed.Equal(usedAt) {
+		t.Fatalf("LastUsed = %s, want %s", meta.LastUsed, usedAt)
+	}
+	if ids, err := fresh.ClientIDs(); err != nil || len(ids) != 1 {
+		t.Fatalf("ClientIDs = %v, %v; want only the token", ids, err)
+	}
+
+	// Deleting the token deletes its metadata too.
+	if err := s.Delete("Iv1.abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".meta", "Iv1.abc")); !os.IsNotExist(err) {
+		t.Fatalf("the metadata file must be removed, stat err = %v", err)
+	}
+}
+
+func TestStore_deleteIfStale(t *testing.T) {
+	t.Parallel()
+	s := tokenstore.New(testDataKey(t), t.TempDir())
+	usedAt := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	if err := s.Set("Iv1.abc", json.RawMessage(`{"access_token":"abc"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Touch("Iv1.abc", usedAt); err != nil {
+		t.Fatal(err)
+	}
+	// pred sees the metadata alongside the token.
+	deleted, err := s.DeleteIfStale("Iv1.abc", func(_ json.RawMessage, meta *tokenstore.Metadata) bool {
+		return meta.LastUsed.Before(usedAt)
+	})
+	if err != nil || deleted {
+		t.Fatalf("DeleteIfStale = %v, %v; want the token kept", deleted, err)
+	}
+	deleted, err = s.DeleteIfStale("Iv1.abc", func(_ json.RawMessage, meta *tokenstore.Metadata) bool {
+		return meta.LastUsed.Before(usedAt.Add(time.Second))
+	})
+	if err != nil || !deleted {
+		t.Fatalf("DeleteIfStale = %v, %v; want the token deleted", deleted, err)
+	}
+}
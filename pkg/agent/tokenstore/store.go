@@ -1,9 +1,12 @@
 // Package tokenstore caches GitHub App access tokens for the agent, encrypted at
 // rest with AES-256-GCM (via the crypt package) under the data key produced by the
-// keyfile package. It also resolves the directory the token files live in.
+// keyfile package. It also resolves the directory the token files live in. Memory is the
+// in-memory counterpart of the on-disk Store, for an agent that must persist nothing.
 package tokenstore
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,9 +34,10 @@ var ErrDecryptToken = errors.New("decrypt the token file")
 
 // validClientID reports whether id is safe to use as a token file name.
 // It rejects empty strings, "." and "..", and anything outside clientIDPattern,
-// which prevents path traversal.
+// which prevents path traversal, as well as the names the store uses itself.
 func validClientID(id string) bool {
-	if id == "" || id == "." || id == ".." {
+	switch id {
+	case "", ".", "..", lockFileName, idLockDir, metadataDir:
 		return false
 	}
 	return clientIDPattern.MatchString(id)
@@ -48,17 +52,26 @@ func validClientID(id string) bool {
 // "ghu_"/"ghr_" prefixes) out of a memory dump. Tokens are opaque JSON so the agent does
 // not depend on the concrete access token type defined in the ghtkn SDK.
 type Store struct {
-	// mu serializes access to the token files so concurrent requests for the same client
-	// ID cannot interleave a read with a write or a delete.
-	mu      sync.Mutex
+	// dirMu is the directory lock within this process: an operation on one client ID's
+	// files holds it shared, and one spanning the directory holds it exclusively (see
+	// lockClientID and lockDir). Zero holds it exclusively too, as the data key is read
+	// under it shared.
+	dirMu sync.RWMutex
+	// idsMu guards ids, the lock of each client ID an operation is using.
+	idsMu   sync.Mutex
+	ids     map[string]*idLock
 	dataKey []byte
 	dir     string
+	// zeroed is set by Zero. After it every token fails to decrypt, which must not be
+	// mistaken for tokens written under another key (see DeleteUnreadable).
+	zeroed bool
 }
 
 // New creates a token store that persists encrypted tokens under dir,
 // encrypting them with dataKey. dir must not be empty.
 func New(dataKey []byte, dir string) *Store {
 	return &Store{
+		ids:     map[string]*idLock{},
 		dataKey: dataKey,
 		dir:     dir,
 	}
@@ -72,8 +85,11 @@ func (s *Store) Get(clientID string) (json.RawMessage, bool, error) {
 	if !validClientID(clientID) {
 		return nil, false, ErrInvalidClientID
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lockClientID(clientID, false)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
 
 	return s.getLocked(clientID)
 }
@@ -84,8 +100,11 @@ func (s *Store) Set(clientID string, token json.RawMessage) error {
 	if !validClientID(clientID) {
 		return ErrInvalidClientID
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lockClientID(clientID, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	blob, err := crypt.Seal(s.dataKey, token)
 	if err != nil {
@@ -104,59 +123,50 @@ func (s *Store) Delete(clientID string) error {
 	if !validClientID(clientID) {
 		return ErrInvalidClientID
 	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lockClientID(clientID, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	return s.deleteLocked(clientID)
 }
 
 // DeleteIf deletes the token stored for clientID only when pred returns true for its
 // current decrypted contents. The read, the predicate, and the delete all run under the
-// store lock, so a concurrent Set (e.g. a refresh storing a fresh token) cannot slip in
-// between the check and the delete. pred receives the decrypted token bytes and must not
-// retain them; the store zeroes them once pred returns. It reports whether a token was
-// deleted. A missing token is a no-op (false, nil); a read/decrypt failure is returned as
-// an error and nothing is deleted.
+// client ID's lock, so a concurrent Set (e.g. a refresh storing a fresh token) cannot
+// slip in between the check and the delete, while requests for other client IDs
+// proceed. pred receives the decrypted token bytes and must not retain them; the store
+// zeroes them once pred returns. It reports whether a token was deleted. A missing
+// token is a no-op (false, nil); a read/decrypt failure is returned as an error and
+// nothing is deleted.
 func (s *Store) DeleteIf(clientID string, pred func(raw json.RawMessage) bool) (bool, error) {
-	if !validClientID(clientID) {
-		return false, ErrInvalidClientID
-	}
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	raw, ok, err := s.getLocked(clientID)
-	if err != nil || !ok {
-		return false, err
-	}
-	shouldDelete := pred(raw)
-	for i := range raw { // scrub the decrypted token; DeleteIf owns it
-		raw[i] = 0
-	}
-	if !shouldDelete {
-		return false, nil
-	}
-	if err := s.deleteLocked(clientID); err != nil {
-		return false, err
-	}
-	return true, nil
+	return s.DeleteIfStale(clientID, func(raw json.RawMessage, _ *Metadata) bool {
+		return pred(raw)
+	})
 }
 
 // Len returns the number of stored tokens by counting the valid token files on disk
 // (ignoring temporary files and invalid names). A read error yields 0 so that STATUS
-// stays infallible.
+// stays infallible. Like ClientIDs, it holds the directory lock shared, so it does not
+// count a directory another process is halfway through rewriting.
 func (s *Store) Len() int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	return len(s.diskClientIDs())
+	ids, err := s.ClientIDs()
+	if err != nil {
+		return 0
+	}
+	return len(ids)
 }
 
 // ClientIDs returns the client IDs of all stored tokens, listing the valid token files
 // on disk (ignoring temporary files and invalid names). It lets callers iterate every
 // stored token, e.g. to sweep expired ones or strip refresh tokens.
 func (s *Store) ClientIDs() ([]string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	unlock, err := s.lockDir(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 	entries, err := os.ReadDir(s.dir)
 	if err != nil {
@@ -168,23 +178,46 @@ func (s *Store) ClientIDs() ([]string, error) {
 	return diskClientIDsFromEntries(entries), nil
 }
 
-// Zero scrubs the store's data key so the key no longer lives in memory. It is used when
-// the agent is locked (see the agent controller's handleLock): the store is discarded
-// afterwards, so this only shortens how long the plaintext key lingers. It runs under the
-// store lock so it does not race an in-flight Get/Set/Delete; a decrypt attempted after
-// Zero fails and surfaces as ErrDecryptToken, which callers treat as a cache miss.
+// Zero scrubs the store's data key so the key no longer lives in memory. It is used
+// when the agent is locked (see the agent controller's handleLock): the store is
+// discarded afterwards, so this only shortens how long the plaintext key lingers. It
+// holds the directory lock exclusively so it does not race an in-flight Get/Set/Delete;
+// a decrypt attempted after Zero fails and surfaces as ErrDecryptToken, which callers
+// treat as a cache miss.
 func (s *Store) Zero() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.dirMu.Lock()
+	defer s.dirMu.Unlock()
 	for i := range s.dataKey {
 		s.dataKey[i] = 0
 	}
+	s.zeroed = true
+}
+
+// HasKey reports whether key is the store's data key. It compares in constant time, and
+// is false once the store is zeroed.
+func (s *Store) HasKey(key []byte) bool {
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
+	return !s.zeroed && subtle.ConstantTimeCompare(s.dataKey, key) == 1
+}
+
+// CopyKey returns a copy of the store's data key, for handing the unlocked state to the
+// process an upgrading agent re-executes. The caller must scrub the copy once it is sent.
+// It is nil once the store is zeroed.
+func (s *Store) CopyKey() []byte {
+	s.dirMu.RLock()
+	defer s.dirMu.RUnlock()
+	if s.zeroed {
+		return nil
+	}
+	return bytes.Clone(s.dataKey)
 }
 
-// getLocked reads and decrypts the token for clientID. The caller must hold s.mu. It
-// classifies errors the same way Get does: a missing file is (nil, false, nil) and a
-// decrypt failure is wrapped with ErrDecryptToken. It exists so DeleteIf can read under
-// the same lock it deletes under (calling the public Get would deadlock, as it re-locks).
+// getLocked reads and decrypts the token for clientID. The caller must hold clientID's
+// lock (see lockClientID). It classifies errors the same way Get does: a missing file
+// is (nil, false, nil) and a decrypt failure is wrapped with ErrDecryptToken. It exists
+// so DeleteIf can read under the same lock it deletes under (calling the public Get
+// would deadlock, as it re-locks).
 func (s *Store) getLocked(clientID string) (json.RawMessage, bool, error) {
 	blob, err := os.ReadFile(filepath.Join(s.dir, clientID))
 	if err != nil {
@@ -200,23 +233,17 @@ func (s *Store) getLocked(clientID string) (json.RawMessage, bool, error) {
 	return json.RawMessage(plaintext), true, nil
 }
 
-// deleteLocked removes the token file for clientID (a missing file is not an error).
-// The caller must hold s.mu.
+// deleteLocked removes the token file for clientID and then its metadata (a missing
+// file is not an error). The token goes first, so a failure in between leaves at worst
+// metadata without a token, which nothing reads. The caller must hold clientID's lock.
 func (s *Store) deleteLocked(clientID string) error {
 	if err := os.Remove(filepath.Join(s.dir, clientID)); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("remove the token file: %w", err)
 	}
-	return nil
-}
-
-// diskClientIDs lists the client IDs of the token files under s.dir. It returns nil on
-// a read error so that Len stays infallible. The caller must hold s.mu.
-func (s *Store) diskClientIDs() []string {
-	entries, err := os.ReadDir(s.dir)
-	if err != nil {
-		return nil
+	if err := os.Remove(s.metadataPath(clientID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove the token metadata file: %w", err)
 	}
-	return diskClientIDsFromEntries(entries)
+	return nil
 }
 
 // diskClientIDsFromEntries filters directory entries down to valid token file names,
@@ -224,7 +251,7 @@ func (s *Store) diskClientIDs() []string {
 func diskClientIDsFromEntries(entries []os.DirEntry) []string {
 	ids := make([]string, 0, len(entries))
 	for _, e := range entries {
-		if e.IsDir() || strings.HasPrefix(e.Name(), ".ghtkn-tmp-") {
+		if e.IsDir() || strings.HasPrefix(e.Name(), tempFilePrefix) {
 			continue
 		}
 		if validClientID(e.Name()) {
@@ -1,11 +1,16 @@
 package tokenstore_test
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/filelock"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
 )
 
@@ -289,6 +294,130 @@ func TestStore_ClientIDs(t *testing.T) {
 	}
 }
 
+func TestStore_lockPerClientID(t *testing.T) {
+	t.Parallel()
+	s := tokenstore.New(testDataKey(t), t.TempDir())
+	for _, id := range []string{"Iv1.a", "Iv1.b"} {
+		if err := s.Set(id, json.RawMessage(`{"access_token":"old"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A sweep judging Iv1.a holds its lock until release is closed.
+	judging := make(chan struct{})
+	release := make(chan struct{})
+	swept := make(chan error, 1)
+	go func() {
+		_, err := s.DeleteIf("Iv1.a", func(json.RawMessage) bool {
+			close(judging)
+			<-release
+			return true
+		})
+		swept <- err
+	}()
+	<-judging
+
+	// Another client ID doesn't wait for it.
+	if err := s.Set("Iv1.b", json.RawMessage(`{"access_token":"new"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get("Iv1.b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A refresh of the same client ID waits, so the sweep can't delete the fresh token.
+	refreshed := make(chan error, 1)
+	go func() {
+		refreshed <- s.Set("Iv1.a", json.RawMessage(`{"access_token":"new"}`))
+	}()
+	select {
+	case err := <-refreshed:
+		t.Fatalf("Set of the same client ID must wait for the sweep, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-swept; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-refreshed; err != nil {
+		t.Fatal(err)
+	}
+	got, ok, err := s.Get("Iv1.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || string(got) != `{"access_token":"new"}` {
+		t.Fatalf("Get(Iv1.a) = %s, %v, want the refreshed token", got, ok)
+	}
+}
+
+func TestStore_waitsForOtherProcess(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := tokenstore.New(testDataKey(t), dir)
+	if err := s.Set("Iv1.a", json.RawMessage(`{"access_token":"x"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Another process holding the lock on the token directory, as a second agent
+	// would while writing.
+	l, err := filelock.Acquire(filepath.Join(dir, ".ghtkn-lock"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Set("Iv1.b", json.RawMessage(`{"access_token":"y"}`))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Set must wait while another process holds the lock, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.ClientIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("ClientIDs = %v, want Iv1.a and Iv1.b but not the lock file", ids)
+	}
+}
+
+// TestStore_lenWaitsForOtherProcess verifies that Len, which STATUS reports, waits while
+// another process holds the lock on the token directory rather than counting a directory
+// halfway through a rewrite.
+func TestStore_lenWaitsForOtherProcess(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	s := tokenstore.New(testDataKey(t), dir)
+	if err := s.Set("Iv1.a", json.RawMessage(`{"access_token":"x"}`)); err != nil {
+		t.Fatal(err)
+	}
+	l, err := filelock.Acquire(filepath.Join(dir, ".ghtkn-lock"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int, 1)
+	go func() {
+		done <- s.Len()
+	}()
+	select {
+	case n := <-done:
+		t.Fatalf("Len must wait while another process holds the lock, returned %d", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-done; n != 1 {
+		t.Fatalf("Len = %d, want 1", n)
+	}
+}
+
 // BenchmarkStore_Get measures the per-Get cost of reading and decrypting the token file
 // (the cost of not caching the plaintext in memory).
 func BenchmarkStore_Get(b *testing.B) {
@@ -305,3 +434,90 @@ func BenchmarkStore_Get(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkStore_parallel measures requests for many apps at once, as parallel git fetches
+// of many repositories make them: each goroutine works on its own client ID, so none has to
+// wait for another, and any slowdown against BenchmarkStore_Get is lock contention. The
+// slow variant holds each client ID's lock for 200µs, standing in for a slow disk, so the
+// contention shows even on a single CPU.
+func BenchmarkStore_parallel(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		hold time.Duration
+	}{
+		{name: "fast"},
+		{name: "slow", hold: 200 * time.Microsecond},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := tokenstore.New(make([]byte, 32), b.TempDir())
+			const apps = 16
+			token := json.RawMessage(`{"access_token":"ghu_secret","expiration_date":"2999-01-01T00:00:00Z","refresh_token":"ghr_secret","refresh_token_expiration_date":"2999-06-01T00:00:00Z"}`)
+			for i := range apps {
+				if err := s.Set(fmt.Sprintf("Iv1.app%d", i), token); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// The predicate runs under the client ID's lock and keeps the token.
+			keep := func(json.RawMessage) bool {
+				time.Sleep(bc.hold)
+				return false
+			}
+			var next atomic.Int64
+			b.SetParallelism(apps)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				id := fmt.Sprintf("Iv1.app%d", next.Add(1)%apps)
+				for i := 0; pb.Next(); i++ {
+					var err error
+					switch {
+					case i%8 == 0:
+						err = s.Set(id, token)
+					case bc.hold > 0:
+						_, err = s.DeleteIf(id, keep)
+					default:
+						_, _, err = s.Get(id)
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestStore_HasKey(t *testing.T) {
+	t.Parallel()
+	s := tokenstore.New(testDataKey(t), t.TempDir())
+	if !s.HasKey(testDataKey(t)) {
+		t.Fatal("the store's own key must match")
+	}
+	other := testDataKey(t)
+	other[0] ^= 0xff
+	if s.HasKey(other) {
+		t.Fatal("a different key must not match")
+	}
+	s.Zero()
+	if s.HasKey(make([]byte, 32)) {
+		t.Fatal("a zeroed store must match no key")
+	}
+}
+
+func TestStore_CopyKey(t *testing.T) {
+	t.Parallel()
+	s := tokenstore.New(testDataKey(t), t.TempDir())
+	key := s.CopyKey()
+	if !bytes.Equal(key, testDataKey(t)) {
+		t.Fatalf("CopyKey() = %v, want the store's key", key)
+	}
+	// Scrubbing the copy must leave the store's key intact.
+	clear(key)
+	if !s.HasKey(testDataKey(t)) {
+		t.Fatal("scrubbing the copy must not touch the store's key")
+	}
+	s.Zero()
+	if key := s.CopyKey(); key != nil {
+		t.Fatalf("a zeroed store must hand out no key, got %v", key)
+	}
+}
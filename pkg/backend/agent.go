@@ -0,0 +1,136 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+var (
+	errAgentLocked     = errors.New("the ghtkn agent is locked; run `ghtkn agent unlock` first")
+	errAgentNotRunning = errors.New("the ghtkn agent is not running; start and unlock it first")
+)
+
+// agentStore is the token cache of the agent backend, reached through the running
+// agent. Get and Delete are the SDK's GET and DELETE; Set is an IMPORT of a plaintext
+// token, which needs the agent passphrase since the agent refuses SET from a current
+// client.
+type agentStore struct {
+	socket         string
+	readPassphrase func() ([]byte, error)
+	passphrase     []byte
+	// ephemeral reports that the agent takes no passphrase (see 'ghtkn agent start
+	// --ephemeral').
+	ephemeral bool
+}
+
+func newAgent(getEnv func(string) string, goos string, readPassphrase func() ([]byte, error)) (*agentStore, error) {
+	socket, err := agentapi.SocketPath(getEnv, goos)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return &agentStore{socket: socket, readPassphrase: readPassphrase}, nil
+}
+
+func (a *agentStore) Get(ctx context.Context, clientID string) (*ghtkn.AccessToken, error) {
+	resp, err := a.send(ctx, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandGet, ClientID: clientID}})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error == agentapi.RespNotFound {
+		return nil, nil
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("get the token from the agent: %s", resp.Error)
+	}
+	token := &ghtkn.AccessToken{}
+	if err := json.Unmarshal(resp.Token, token); err != nil {
+		return nil, fmt.Errorf("parse the token from the agent: %w", err)
+	}
+	return token, nil
+}
+
+func (a *agentStore) Set(ctx context.Context, clientID string, token *ghtkn.AccessToken) error {
+	pass, err := a.agentPassphrase(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshal the token: %w", err)
+	}
+	resp, err := a.send(ctx, &adminapi.Request{
+		Request: agentapi.Request{Command: adminapi.CommandImport, Passphrase: pass},
+		Tokens:  []*adminapi.ImportToken{{ClientID: clientID, Token: b}},
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Error == adminapi.RespUnknownCommand {
+		return fmt.Errorf("the agent failed to store the token (an agent from an older ghtkn does not support it; restart it with `ghtkn agent stop` then `ghtkn agent start`): %s", resp.Error)
+	}
+	if len(resp.Imported) == 1 {
+		switch imported := resp.Imported[0]; imported.Result {
+		case adminapi.ImportResultImported:
+			return nil
+		case adminapi.ImportResultKept:
+			return errors.New("the agent already holds a token for the app")
+		default:
+			return fmt.Errorf("store the token in the agent: %s", imported.Error)
+		}
+	}
+	return fmt.Errorf("store the token in the agent: %s", resp.Error)
+}
+
+func (a *agentStore) Delete(ctx context.Context, clientID string) error {
+	resp, err := a.send(ctx, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandDelete, ClientID: clientID}})
+	if err != nil {
+		return err
+	}
+	if !resp.OK {
+		return fmt.Errorf("delete the token from the agent: %s", resp.Error)
+	}
+	return nil
+}
+
+// agentPassphrase returns the agent passphrase, prompting for it on first use. An
+// ephemeral agent needs none.
+func (a *agentStore) agentPassphrase(ctx context.Context) ([]byte, error) {
+	if a.passphrase != nil || a.ephemeral {
+		return a.passphrase, nil
+	}
+	status, err := a.send(ctx, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
+	if err != nil {
+		return nil, err
+	}
+	if status.Ephemeral {
+		a.ephemeral = true
+		return nil, nil
+	}
+	pass, err := a.readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	a.passphrase = pass
+	return pass, nil
+}
+
+// send sends req to the agent, turning a missing agent and a locked one into errors.
+func (a *agentStore) send(ctx context.Context, req *adminapi.Request) (*adminapi.Response, error) {
+	resp, err := adminapi.Send(ctx, a.socket, req)
+	if err != nil {
+		if agentapi.IsNotRunning(err) {
+			return nil, errAgentNotRunning
+		}
+		return nil, err //nolint:wrapcheck
+	}
+	if resp.Error == agentapi.RespLocked {
+		return nil, errAgentLocked
+	}
+	return resp, nil
+}
@@ -0,0 +1,57 @@
+// Package backend reads and writes the tokens the ghtkn SDK caches in each backend
+// (keyring, text, and agent), one app at a time, for 'ghtkn backend migrate'. It
+// follows the SDK's layout for each backend, so a token it writes is the one 'ghtkn
+// get' finds there, but it never mints or refreshes a token itself.
+package backend
+
+import (
+	"context"
+	"errors"
+
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+// The backend names, as GHTKN_BACKEND and backend.type take them.
+const (
+	Keyring = "keyring"
+	Text    = "text"
+	Agent   = "agent"
+)
+
+// Store is the token cache of a backend, keyed by the app's client ID.
+type Store interface {
+	// Get returns the cached token of clientID, or nil when none is cached.
+	Get(ctx context.Context, clientID string) (*ghtkn.AccessToken, error)
+	// Set caches token for clientID, replacing any cached one.
+	Set(ctx context.Context, clientID string, token *ghtkn.AccessToken) error
+	// Delete removes the cached token of clientID. Deleting a missing token is a no-op.
+	Delete(ctx context.Context, clientID string) error
+}
+
+// Input holds what opening a backend may need.
+type Input struct {
+	GetEnv func(string) string
+	GOOS   string
+	// ReadPassphrase prompts for the agent passphrase, which storing a token in the
+	// agent needs. It is called at most once, on the first Set.
+	ReadPassphrase func() ([]byte, error)
+}
+
+// Open returns the Store of the backend name.
+func Open(name string, input *Input) (Store, error) {
+	switch name {
+	case Keyring:
+		return newKeyring(), nil
+	case Text:
+		dir, err := TextDir(input.GetEnv, input.GOOS)
+		if err != nil {
+			return nil, err
+		}
+		return newText(dir), nil
+	case Agent:
+		return newAgent(input.GetEnv, input.GOOS, input.ReadPassphrase)
+	default:
+		return nil, slogerr.With(errors.New("unknown backend; it must be keyring, text, or agent"), "backend", name) //nolint:wrapcheck
+	}
+}
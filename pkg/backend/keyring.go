@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/zalando/go-keyring"
+)
+
+// keyringService is the service the SDK's keyring backend stores tokens under, with the
+// app's client ID as the user.
+const keyringService = "github.com/suzuki-shunsuke/ghtkn"
+
+// keyringAPI is the part of go-keyring the keyring backend uses. It is an interface so
+// tests can replace the OS keyring.
+type keyringAPI interface {
+	Get(service, user string) (string, error)
+	Set(service, user, password string) error
+	Delete(service, user string) error
+}
+
+// osKeyring is keyringAPI backed by the OS keyring.
+type osKeyring struct{}
+
+func (osKeyring) Get(service, user string) (string, error) {
+	return keyring.Get(service, user) //nolint:wrapcheck
+}
+
+func (osKeyring) Set(service, user, password string) error {
+	return keyring.Set(service, user, password) //nolint:wrapcheck
+}
+
+func (osKeyring) Delete(service, user string) error {
+	return keyring.Delete(service, user) //nolint:wrapcheck
+}
+
+// keyringStore is the token cache of the keyring backend: each token is stored as JSON.
+type keyringStore struct {
+	api keyringAPI
+}
+
+func newKeyring() *keyringStore {
+	return &keyringStore{api: osKeyring{}}
+}
+
+func (k *keyringStore) Get(_ context.Context, clientID string) (*ghtkn.AccessToken, error) {
+	s, err := k.api.Get(keyringService, clientID)
+	if err != nil {
+		if errors.Is(err, keyring.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get a secret from the keyring: %w", err)
+	}
+	token := &ghtkn.AccessToken{}
+	if err := json.Unmarshal([]byte(s), token); err != nil {
+		return nil, fmt.Errorf("parse the token in the keyring: %w", err)
+	}
+	return token, nil
+}
+
+func (k *keyringStore) Set(_ context.Context, clientID string, token *ghtkn.AccessToken) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshal the token: %w", err)
+	}
+	if err := k.api.Set(keyringService, clientID, string(b)); err != nil {
+		return fmt.Errorf("set a secret in the keyring: %w", err)
+	}
+	return nil
+}
+
+func (k *keyringStore) Delete(_ context.Context, clientID string) error {
+	if err := k.api.Delete(keyringService, clientID); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("delete a secret from the keyring: %w", err)
+	}
+	return nil
+}
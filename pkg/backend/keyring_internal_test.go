@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/zalando/go-keyring"
+)
+
+// fakeKeyring is keyringAPI in memory, keyed by service and user.
+type fakeKeyring map[[2]string]string
+
+func (f fakeKeyring) Get(service, user string) (string, error) {
+	s, ok := f[[2]string{service, user}]
+	if !ok {
+		return "", keyring.ErrNotFound
+	}
+	return s, nil
+}
+
+func (f fakeKeyring) Set(service, user, password string) error {
+	f[[2]string{service, user}] = password
+	return nil
+}
+
+func (f fakeKeyring) Delete(service, user string) error {
+	if _, ok := f[[2]string{service, user}]; !ok {
+		return keyring.ErrNotFound
+	}
+	delete(f, [2]string{service, user})
+	return nil
+}
+
+// TestKeyringStore verifies that the keyring backend stores a token as JSON under the
+// SDK's service and the client ID, and treats a missing one as absent.
+func TestKeyringStore(t *testing.T) {
+	t.Parallel()
+	api := fakeKeyring{}
+	k := &keyringStore{api: api}
+	token := &ghtkn.AccessToken{AccessToken: "ghu_a", ExpirationDate: time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := k.Set(t.Context(), "Iv1.a", token); err != nil {
+		t.Fatal(err)
+	}
+	want := fakeKeyring{{keyringService, "Iv1.a"}: `{"access_token":"ghu_a","expiration_date":"2999-01-01T00:00:00Z"}`}
+	if diff := cmp.Diff(want, api); diff != "" {
+		t.Fatal(diff)
+	}
+	got, err := k.Get(t.Context(), "Iv1.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(token, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := k.Delete(t.Context(), "Iv1.a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Delete(t.Context(), "Iv1.a"); err != nil {
+		t.Fatalf("deleting a missing token must be a no-op: %v", err)
+	}
+	if got, err := k.Get(t.Context(), "Iv1.a"); err != nil || got != nil {
+		t.Fatalf("Get() after Delete = %v, %v; want nil, nil", got, err)
+	}
+}
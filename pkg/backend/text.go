@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/env"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/crypt"
+)
+
+// EnvTextBackendDir overrides the directory of the text backend.
+const EnvTextBackendDir = "GHTKN_TEXT_BACKEND_DIR"
+
+// TextDir resolves the directory the SDK's text backend stores tokens in:
+// GHTKN_TEXT_BACKEND_DIR, else ${XDG_CACHE_HOME:-$HOME/.cache}/ghtkn/tokens, or
+// %LocalAppData%\cache\ghtkn\tokens on Windows.
+func TextDir(getEnv func(string) string, goos string) (string, error) {
+	if dir := getEnv(EnvTextBackendDir); dir != "" {
+		return dir, nil
+	}
+	if goos == "windows" {
+		if d := getEnv(env.LocalAppData); d != "" {
+			return filepath.Join(d, "cache", "ghtkn", "tokens"), nil
+		}
+		return "", errors.New("LocalAppData is required to use the text backend on Windows")
+	}
+	if d := getEnv(env.XDGCacheHome); d != "" {
+		return filepath.Join(d, "ghtkn", "tokens"), nil
+	}
+	if home := getEnv(env.Home); home != "" {
+		return filepath.Join(home, ".cache", "ghtkn", "tokens"), nil
+	}
+	return "", errors.New("XDG_CACHE_HOME or HOME is required to use the text backend")
+}
+
+// textStore is the token cache of the text backend: a plaintext JSON file per client ID.
+type textStore struct {
+	dir string
+}
+
+func newText(dir string) *textStore {
+	return &textStore{dir: dir}
+}
+
+func (t *textStore) Get(_ context.Context, clientID string) (*ghtkn.AccessToken, error) {
+	path, err := t.path(clientID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read the token file: %w", err)
+	}
+	token := &ghtkn.AccessToken{}
+	if err := json.Unmarshal(b, token); err != nil {
+		return nil, fmt.Errorf("parse the token file: %w", err)
+	}
+	return token, nil
+}
+
+func (t *textStore) Set(_ context.Context, clientID string, token *ghtkn.AccessToken) error {
+	path, err := t.path(clientID)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("marshal the token: %w", err)
+	}
+	if err := crypt.AtomicWrite(path, b); err != nil {
+		return fmt.Errorf("write the token file: %w", err)
+	}
+	return nil
+}
+
+func (t *textStore) Delete(_ context.Context, clientID string) error {
+	path, err := t.path(clientID)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete the token file: %w", err)
+	}
+	return nil
+}
+
+// path returns the token file of clientID, refusing a client ID that is not a plain file
+// name.
+func (t *textStore) path(clientID string) (string, error) {
+	if clientID == "" || clientID != filepath.Base(clientID) || clientID == "." || clientID == ".." {
+		return "", fmt.Errorf("invalid client id %q", clientID)
+	}
+	return filepath.Join(t.dir, clientID), nil
+}
@@ -0,0 +1,85 @@
+package backend_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/backend"
+)
+
+func TestTextDir(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		name    string
+		env     map[string]string
+		goos    string
+		want    string
+		wantErr bool
+	}{
+		{name: "explicit", env: map[string]string{"GHTKN_TEXT_BACKEND_DIR": "/tokens", "HOME": "/home/me"}, goos: "linux", want: "/tokens"},
+		{name: "xdg", env: map[string]string{"XDG_CACHE_HOME": "/cache", "HOME": "/home/me"}, goos: "linux", want: "/cache/ghtkn/tokens"},
+		{name: "home", env: map[string]string{"HOME": "/home/me"}, goos: "darwin", want: "/home/me/.cache/ghtkn/tokens"},
+		{name: "windows", env: map[string]string{"LOCALAPPDATA": `C:\Users\me\AppData\Local`}, goos: "windows", want: filepath.Join(`C:\Users\me\AppData\Local`, "cache", "ghtkn", "tokens")},
+		{name: "nothing", env: map[string]string{}, goos: "linux", wantErr: true},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := backend.TextDir(func(k string) string { return d.env[k] }, d.goos)
+			if d.wantErr {
+				if err == nil {
+					t.Fatal("error must be returned")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != d.want {
+				t.Fatalf("TextDir() = %q, want %q", got, d.want)
+			}
+		})
+	}
+}
+
+// TestOpen_text verifies that the text backend round-trips a token and treats a missing
+// one as absent.
+func TestOpen_text(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	st, err := backend.Open(backend.Text, &backend.Input{
+		GetEnv: func(k string) string {
+			if k == backend.EnvTextBackendDir {
+				return dir
+			}
+			return ""
+		},
+		GOOS: "linux",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := &ghtkn.AccessToken{AccessToken: "ghu_a", ExpirationDate: time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := st.Set(t.Context(), "Iv1.a", token); err != nil {
+		t.Fatal(err)
+	}
+	got, err := st.Get(t.Context(), "Iv1.a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(token, got); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := st.Delete(t.Context(), "Iv1.a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := st.Get(t.Context(), "Iv1.a"); err != nil || got != nil {
+		t.Fatalf("Get() after Delete = %v, %v; want nil, nil", got, err)
+	}
+	if _, err := st.Get(t.Context(), "../a"); err == nil {
+		t.Fatal("a client ID that is not a file name must be rejected")
+	}
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// appRefresh builds the per-app refresh settings of an unlock from the --app-refresh
+// values. Each value is <app name>=<setting>, where the setting is on (refresh with the
+// agent-wide TTL), off (never refresh the app), or a TTL such as 14d (refresh, with that
+// TTL). The app name is resolved to its client ID with clientIDs, since the agent only
+// knows client IDs; an unknown name is an error rather than ignored, since a typo would
+// otherwise silently leave refresh enabled for an app the user meant to protect.
+func appRefresh(values []string, clientIDs map[string]string) ([]*adminapi.AppRefresh, error) {
+	rules := make([]*adminapi.AppRefresh, 0, len(values))
+	for _, value := range values {
+		name, setting, ok := strings.Cut(value, "=")
+		if !ok || name == "" || setting == "" {
+			return nil, fmt.Errorf("--app-refresh must be <app name>=on, <app name>=off, or <app name>=<ttl>, e.g. read-only=14d: %q", value)
+		}
+		clientID, ok := clientIDs[name]
+		if !ok {
+			return nil, fmt.Errorf("--app-refresh: app %q is not in the config", name)
+		}
+		rule := &adminapi.AppRefresh{ClientID: clientID}
+		switch setting {
+		case "on":
+			rule.Enable = true
+		case "off":
+		default:
+			ttl, err := parseRefreshTokenTTL(setting)
+			if err != nil {
+				return nil, fmt.Errorf("--app-refresh %s: %w", name, err)
+			}
+			rule.Enable = true
+			rule.TTL = ttl
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// anyAppRefreshEnabled reports whether a per-app setting enables refresh for some app.
+func anyAppRefreshEnabled(rules []*adminapi.AppRefresh) bool {
+	for _, rule := range rules {
+		if rule.Enable {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredClientIDs returns the client ID of each app in the config, keyed by app name.
+func configuredClientIDs(configFilePath string) (map[string]string, error) {
+	cfg, err := ghtkn.LoadConfig(&ghtkn.InputLoadConfig{ConfigFilePath: configFilePath})
+	if err != nil {
+		return nil, fmt.Errorf("load the config to resolve the apps of --app-refresh: %w", err)
+	}
+	clientIDs := map[string]string{}
+	if cfg == nil {
+		return clientIDs, nil
+	}
+	for _, app := range cfg.Apps {
+		if app.ClientID != "" {
+			clientIDs[app.Name] = app.ClientID
+		}
+	}
+	return clientIDs, nil
+}
@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+func TestAppRefresh(t *testing.T) {
+	t.Parallel()
+	clientIDs := map[string]string{"read-only": "Iv1.ro", "org-admin": "Iv1.admin"}
+	tests := []struct {
+		name    string
+		values  []string
+		want    []*adminapi.AppRefresh
+		wantErr bool
+	}{
+		{name: "none", want: []*adminapi.AppRefresh{}},
+		{
+			name:   "on, off, and a ttl",
+			values: []string{"read-only=14d", "org-admin=off"},
+			want: []*adminapi.AppRefresh{
+				{ClientID: "Iv1.ro", Enable: true, TTL: 14 * 24 * time.Hour},
+				{ClientID: "Iv1.admin"},
+			},
+		},
+		{name: "on", values: []string{"read-only=on"}, want: []*adminapi.AppRefresh{{ClientID: "Iv1.ro", Enable: true}}},
+
+		{name: "unknown app", values: []string{"typo=off"}, wantErr: true},
+		{name: "no setting", values: []string{"read-only"}, wantErr: true},
+		{name: "empty setting", values: []string{"read-only="}, wantErr: true},
+		{name: "no app", values: []string{"=off"}, wantErr: true},
+		{name: "ttl over six months", values: []string{"read-only=7m"}, wantErr: true},
+		{name: "unknown setting", values: []string{"read-only=yes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := appRefresh(tt.values, clientIDs)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no error, got %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("rules (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
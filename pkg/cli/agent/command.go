@@ -3,27 +3,42 @@
 // serves them to clients over a Unix domain socket. It is intended for environments
 // where the OS keyring is unavailable (containers, VMs, minimal Linux, etc.).
 //
-// This package provides the 'start', 'stop', 'status', 'unlock', and 'reset'
-// subcommands. The agent starts locked and is unlocked with a passphrase via
-// 'unlock'; tokens are encrypted at rest. The agent server lives in
-// pkg/agent/server.
+// This package provides the 'start', 'stop', 'status', 'unlock', 'lock', 'configure',
+// 'upgrade', 'install-service', 'prune', 'fsck', 'export', 'import', and 'reset'
+// subcommands. The agent starts locked and is unlocked with a passphrase via 'unlock';
+// tokens are encrypted at rest. The agent server lives in pkg/agent/server.
 package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"runtime"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/daemon"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/logfile"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/server"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/flag"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cobrautil"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/configure"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/export"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/fsck"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/importcmd"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/installservice"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/lock"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/prune"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/reset"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/status"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/stop"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/unlock"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/upgrade"
+	"github.com/suzuki-shunsuke/go-error-with-exit-code/ecerror"
 	"github.com/suzuki-shunsuke/slog-error/slogerr"
 	"github.com/suzuki-shunsuke/slog-util/slogutil"
 )
@@ -35,6 +50,7 @@ func New(logger *slogutil.Logger, env *cobrautil.Env, gFlags *flag.GlobalFlags)
 	r := &runner{
 		logger:  logger,
 		flags:   gFlags,
+		program: env.Program,
 		version: env.Version,
 	}
 	cmd := &cobra.Command{
@@ -56,6 +72,13 @@ Tokens are encrypted at rest with AES-256-GCM.`,
 		r.statusCommand(),
 		r.unlockCommand(),
 		r.lockCommand(),
+		r.configureCommand(),
+		r.upgradeCommand(),
+		r.installServiceCommand(),
+		r.pruneCommand(),
+		r.fsckCommand(),
+		r.exportCommand(),
+		r.importCommand(),
 		r.resetCommand(),
 	)
 	return cmd
@@ -65,12 +88,41 @@ Tokens are encrypted at rest with AES-256-GCM.`,
 type runner struct {
 	logger *slogutil.Logger
 	flags  *flag.GlobalFlags
+	// program is the program name, which the agent's log file records like the console
+	// log does.
+	program string
 	// version is the ghtkn version, handed to the agent server so it can report which
 	// binary the long-running process runs (see the STATUS response and 'ghtkn info').
 	version string
 }
 
-// unlockArgs holds the flag values for the 'agent unlock' subcommand.
+// The default rotation of the agent's log file (see --log-file): about 50MB of history.
+const (
+	defaultLogFileMaxSize    = 10
+	defaultLogFileMaxBackups = 4
+	megabyte                 = 1 << 20
+)
+
+// startArgs holds the flag values for the 'agent start' subcommand.
+type startArgs struct {
+	OnRefreshIncident   []string
+	RefreshIncidentHook string
+	MaxSessionAge       string
+	CheckTokenInterval  time.Duration
+	RevokedTokenHook    string
+	DrainTimeout        time.Duration
+	Daemon              bool
+	PIDFile             string
+	LogFile             string
+	LogFileMaxSize      int
+	LogFileMaxBackups   int
+	Ephemeral           bool
+	MultiUser           bool
+	StateDir            string
+}
+
+// unlockArgs holds the flag values for the 'agent unlock' subcommand, and for 'agent
+// configure', which takes the same refresh flags.
 // The other subcommands have no flags of their own, so they read the global flags
 // from the runner directly.
 type unlockArgs struct {
@@ -78,6 +130,7 @@ type unlockArgs struct {
 
 	EnableRefresh   bool
 	RefreshTokenTTL string
+	AppRefresh      []string
 }
 
 // warnIfBackendNotAgent logs a warning when the resolved storage backend is not the
@@ -109,7 +162,8 @@ func (r *runner) warnIfBackendNotAgent() {
 // startCommand returns the CLI command definition for the 'agent start' subcommand.
 // It configures the command name, usage description, and action handler.
 func (r *runner) startCommand() *cobra.Command {
-	return &cobra.Command{
+	args := &startArgs{}
+	cmd := &cobra.Command{
 		Use:   "start",
 		Short: "Start the ghtkn agent in the foreground (locked)",
 		Args:  cobra.NoArgs,
@@ -118,23 +172,210 @@ func (r *runner) startCommand() *cobra.Command {
 The agent starts locked and listens on a Unix domain socket without asking for a
 passphrase, so it can run as a background service (e.g. systemd). Use
 'ghtkn agent unlock' to enter the passphrase and make cached tokens available.
-It keeps running until it receives SIGINT or SIGTERM, then removes the socket and exits.
+It keeps running until it receives SIGINT or SIGTERM or 'ghtkn agent stop' is run.
+It then stops accepting connections, waits up to --drain-timeout for the device flows
+in progress, so one you have just approved in the browser still stores its token,
+answers the requests in flight, removes the socket, and exits. The device flows it
+gives up on are logged, and reported by 'ghtkn agent stop'.
+
+When a refresh token that is still within its expiration fails to refresh, the
+refresh token may have leaked and been used elsewhere. The agent always warns the
+client; --on-refresh-incident makes it also contain the incident on its own, with a
+comma-separated list of actions:
+
+  revoke  revoke and delete the app's stored tokens
+  delete  delete the app's stored token without revoking it
+  lock    lock the agent until it is unlocked again
+
+--refresh-incident-hook runs a program after those actions, e.g. to notify you. It
+gets the client ID in GHTKN_INCIDENT_CLIENT_ID and the actions taken in
+GHTKN_INCIDENT_ACTIONS. Every action is recorded in the agent log.
+
+--max-session-age bounds how long one authorization can be extended by refreshing.
+Past that age from the device flow, the agent refuses to refresh the app's token and
+'ghtkn auth' must be run again, however often the token is used. It takes the same
+d/w/m units as --refresh-token-ttl, e.g. 30d. A token stored before the agent
+recorded when its session began is not refreshed under a limit either.
+
+--check-token-interval makes the agent check each cached, unexpired access token
+against the GitHub API at that interval while it is unlocked (one GET /user per
+token), and delete the tokens GitHub rejects because they were revoked outside ghtkn,
+e.g. in the GitHub UI. --revoked-token-hook runs a program after such a deletion, with
+the client ID in GHTKN_REVOKED_CLIENT_ID.
+
+--daemon runs the agent in the background, detached from the terminal, e.g. from a
+container entrypoint or on a host without a service manager. The command returns
+once the agent serves the socket, or fails with the reason the agent did not start.
+It is not supported on Windows. --log-file writes the agent's log to a file instead
+of the standard error, as JSON lines; a daemon's log is discarded without it. The
+file is rotated once it would grow past --log-file-max-size megabytes, keeping
+--log-file-max-backups rotated files (<file>.1 being the newest). --pidfile writes
+the agent's process ID to a file while it runs.
+
+--ephemeral keeps the tokens in the agent's memory only, for short-lived VMs and
+sandboxes where anything persisted is a liability. The agent uses no key file and
+writes no token files: 'ghtkn agent unlock' arms it without asking for a passphrase,
+under a data key generated for that unlock. Every token is gone once the agent is
+locked or exits, and the agent can't be upgraded in place.
+
+--multi-user runs one agent, usually as root, for every user of a shared build
+server or bastion host (Linux only). It listens on /run/ghtkn/agent.sock, or
+GHTKN_AGENT_SOCKET, which every user may connect to, tells the users apart by the
+uid the kernel reports for each connection, and keeps a separate key file, token
+directory, and lock state for each user under --state-dir. Users point
+GHTKN_AGENT_SOCKET at the shared socket and unlock, lock, and use their own state
+with the usual commands. Only the user running the agent can stop it, and it can't
+be upgraded in place.
 
-$ ghtkn agent start`,
+$ ghtkn agent start
+$ ghtkn agent start --on-refresh-incident revoke,lock --refresh-incident-hook ~/bin/notify-incident
+$ ghtkn agent start --max-session-age 30d
+$ ghtkn agent start --check-token-interval 1h --revoked-token-hook ~/bin/notify-revoked
+$ ghtkn agent start --drain-timeout 1m
+$ ghtkn agent start --daemon --log-file ~/.cache/ghtkn/agent.log --pidfile ~/.cache/ghtkn/agent.pid
+$ ghtkn agent start --ephemeral --daemon && ghtkn agent unlock
+$ sudo ghtkn agent start --multi-user --state-dir /var/lib/ghtkn/agent`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
-			return r.start(cmd.Context())
+			return r.start(cmd.Context(), args)
 		},
 	}
+	cmd.Flags().StringSliceVar(&args.OnRefreshIncident, "on-refresh-incident",
+		nil, "Actions to take when a still-valid refresh token fails to refresh: revoke, delete, and/or lock")
+	cmd.Flags().StringVar(&args.RefreshIncidentHook, "refresh-incident-hook",
+		"", "A program to run when a still-valid refresh token fails to refresh")
+	cmd.Flags().StringVar(&args.MaxSessionAge, "max-session-age",
+		"", "How long after authentication a token may still be refreshed, e.g. 30d/4w/2m (default: no limit)")
+	cmd.Flags().DurationVar(&args.CheckTokenInterval, "check-token-interval",
+		0, "How often to check cached tokens against the GitHub API and delete revoked ones, e.g. 1h (default: never; at least 1m)")
+	cmd.Flags().StringVar(&args.RevokedTokenHook, "revoked-token-hook",
+		"", "A program to run when a cached token revoked outside ghtkn is deleted")
+	cmd.Flags().DurationVar(&args.DrainTimeout, "drain-timeout",
+		server.DefaultDrainTimeout, "How long stopping waits for the device flows in progress to complete; 0 abandons them at once")
+	cmd.Flags().BoolVar(&args.Daemon, "daemon",
+		false, "Run the agent in the background, detached from the terminal (not on Windows)")
+	cmd.Flags().StringVar(&args.PIDFile, "pidfile",
+		"", "A file to write the agent's process ID to while it runs")
+	cmd.Flags().StringVar(&args.LogFile, "log-file",
+		"", "A file to write the agent's log to instead of the standard error")
+	cmd.Flags().IntVar(&args.LogFileMaxSize, "log-file-max-size",
+		defaultLogFileMaxSize, "The size in megabytes past which the log file is rotated; 0 never rotates it")
+	cmd.Flags().IntVar(&args.LogFileMaxBackups, "log-file-max-backups",
+		defaultLogFileMaxBackups, "How many rotated log files to keep")
+	cmd.Flags().BoolVar(&args.Ephemeral, "ephemeral",
+		false, "Keep the tokens in memory only, with no key file and no passphrase; they are gone once the agent stops")
+	cmd.Flags().BoolVar(&args.MultiUser, "multi-user",
+		false, "Serve every user of the host on a shared socket, keeping each user's state apart (Linux only)")
+	cmd.Flags().StringVar(&args.StateDir, "state-dir",
+		server.DefaultStateDir, "Where a multi-user agent keeps each user's key file and tokens")
+	return cmd
 }
 
 // start executes the 'agent start' command logic.
 // It configures the log level and runs the agent controller until the process is signaled.
-func (r *runner) start(ctx context.Context) error {
+func (r *runner) start(ctx context.Context, args *startArgs) error {
 	if err := r.logger.SetLevel(r.flags.LogLevel); err != nil {
 		return fmt.Errorf("set log level: %w", err)
 	}
 	r.warnIfBackendNotAgent()
-	return server.New(r.version).Start(ctx, r.logger.Logger) //nolint:wrapcheck
+	incident, err := incidentPolicy(args.OnRefreshIncident, args.RefreshIncidentHook)
+	if err != nil {
+		return err
+	}
+	sessionAge, err := maxSessionAge(args.MaxSessionAge)
+	if err != nil {
+		return err
+	}
+	liveness, err := livenessPolicy(args.CheckTokenInterval, args.RevokedTokenHook)
+	if err != nil {
+		return err
+	}
+	if args.DrainTimeout < 0 {
+		return fmt.Errorf("--drain-timeout must not be negative: %s", args.DrainTimeout)
+	}
+	if args.LogFileMaxSize < 0 || args.LogFileMaxBackups < 0 {
+		return errors.New("--log-file-max-size and --log-file-max-backups must not be negative")
+	}
+	readiness, err := daemon.TakeReadiness()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if daemonize(args, readiness) {
+		return r.startDaemon(ctx, args)
+	}
+	// Closed on return, the readiness pipe tells the command that started this daemon
+	// that it failed to start, if it had not reported otherwise.
+	defer readiness.Close()
+	return r.serve(ctx, args, &server.Options{
+		Incident:      incident,
+		MaxSessionAge: sessionAge,
+		Liveness:      liveness,
+		DrainTimeout:  args.DrainTimeout,
+		PIDFile:       args.PIDFile,
+		Ready:         readiness.Ready,
+		Ephemeral:     args.Ephemeral,
+		MultiUser:     args.MultiUser,
+		StateDir:      args.StateDir,
+	}, readiness)
+}
+
+// serve runs the agent server until it stops, logging to the --log-file if one is given.
+// readiness is nil unless this is a daemon started by --daemon. A daemon has no terminal,
+// so the log file also takes what the Go runtime writes to the standard error, e.g. a
+// panic, and a failure to start is reported to the command that started the daemon.
+func (r *runner) serve(ctx context.Context, args *startArgs, opts *server.Options, readiness *daemon.Readiness) error {
+	logger := r.logger.Logger
+	if args.LogFile != "" {
+		w, err := logfile.Open(args.LogFile, &logfile.Options{
+			MaxSize:    int64(args.LogFileMaxSize) * megabyte,
+			MaxBackups: args.LogFileMaxBackups,
+			Stderr:     readiness != nil,
+		})
+		if err != nil {
+			readiness.Fail(err)
+			return err //nolint:wrapcheck
+		}
+		defer w.Close()
+		fileLogger := slogutil.NewJSON(&slogutil.InputNewJSON{Name: r.program, Version: r.version, Out: w})
+		if err := fileLogger.SetLevel(r.flags.LogLevel); err != nil {
+			return fmt.Errorf("set log level: %w", err)
+		}
+		logger = fileLogger.Logger()
+	}
+	err := server.NewWithOptions(r.version, opts).Start(ctx, logger)
+	if err == nil || readiness == nil {
+		return err //nolint:wrapcheck
+	}
+	readiness.Fail(err)
+	if args.LogFile == "" {
+		return err //nolint:wrapcheck
+	}
+	// Record the failure in the log file's format, rather than leaving it to the console
+	// logger, whose standard error is now the same file.
+	slogerr.WithError(logger, err).Error("ghtkn agent failed")
+	return ecerror.Wrap(cobrautil.ErrSilent, 1)
+}
+
+// daemonize reports whether start is to spawn the agent as a daemon rather than serve
+// itself. A daemon started by --daemon runs the same command line; it tells itself apart
+// by the readiness pipe it inherited. So does an agent an UPGRADE re-executed in place of
+// a daemon, by the handoff it inherited: spawning another daemon from it would leave the
+// process the pidfile, 'agent stop', and the service manager watch to exit.
+func daemonize(args *startArgs, readiness *daemon.Readiness) bool {
+	return args.Daemon && readiness == nil && !server.Reexecuted()
+}
+
+// startDaemon starts the agent as a daemon running the same command line, and returns
+// once it serves the socket.
+func (r *runner) startDaemon(ctx context.Context, args *startArgs) error {
+	if args.LogFile == "" {
+		r.logger.Warn("the agent daemon's log is discarded; pass --log-file to keep it")
+	}
+	pid, err := daemon.Spawn(ctx, os.Args)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	r.logger.Info("ghtkn agent started in the background", "pid", pid, "log_file", args.LogFile)
+	return nil
 }
 
 // stopCommand returns the CLI command definition for the 'agent stop' subcommand.
@@ -145,7 +386,11 @@ func (r *runner) stopCommand() *cobra.Command {
 		Args:  cobra.NoArgs,
 		Long: `Stop the running ghtkn agent.
 
-It connects to the agent's Unix domain socket and asks it to shut down.
+It connects to the agent's Unix domain socket and asks it to shut down, and waits
+until the agent has let the device flows in progress complete (see --drain-timeout of
+'ghtkn agent start'). It warns about the apps whose device flow was abandoned; run
+the command that started it again to authenticate. It then waits until the agent
+process has exited.
 
 $ ghtkn agent stop`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
@@ -173,7 +418,9 @@ func (r *runner) statusCommand() *cobra.Command {
 		Long: `Show whether the ghtkn agent is running.
 
 It connects to the agent's Unix domain socket and reports the number of cached
-access tokens, along with the ghtkn version the running agent was built from and
+access tokens, and when the agent is unlocked lists each of them by client ID with
+its expiration, when a client last fetched it, and whether it can be refreshed. It
+also reports the ghtkn version the running agent was built from and
 the agent protocol version it speaks. The agent keeps running the binary it was
 started with, so an agent version older than 'ghtkn --version' means the agent
 must be restarted. It exits 0 whether or not the agent is running.
@@ -222,11 +469,25 @@ than --refresh-token-ttl (default 7 days) so an unused refresh token does not li
 The TTL takes a number with a d (day), w (week), or m (30-day month) suffix, e.g.
 14d, 4w, 2m, and must be less than 6 months.
 
-$ ghtkn agent unlock`,
+--app-refresh overrides these settings for one app, named as in the config, and can
+be repeated: <app>=on enables refresh for the app, <app>=off never refreshes it (and
+drops its stored refresh token), and <app>=<ttl> enables it with its own TTL. Apps
+without a rule follow --enable-refresh and --refresh-token-ttl.
+
+$ ghtkn agent unlock
+$ ghtkn agent unlock --enable-refresh --app-refresh org-admin=off
+$ ghtkn agent unlock --app-refresh read-only=14d`,
 		RunE: func(cmd *cobra.Command, _ []string) error {
 			return r.unlock(cmd.Context(), args)
 		},
 	}
+	addRefreshFlags(cmd, args)
+	return cmd
+}
+
+// addRefreshFlags registers the refresh-token flags 'agent unlock' and 'agent configure'
+// share.
+func addRefreshFlags(cmd *cobra.Command, args *unlockArgs) {
 	cmd.Flags().BoolVar(&args.EnableRefresh, "enable-refresh",
 		false, "Enable refreshing expiring access tokens with stored refresh tokens")
 	// No default value: an empty value means the flag was not given, which lets the
@@ -235,7 +496,8 @@ $ ghtkn agent unlock`,
 	// --enable-refresh.
 	cmd.Flags().StringVar(&args.RefreshTokenTTL, "refresh-token-ttl",
 		"", "How long a stored token may sit unused before the agent discards it, e.g. 14d/4w/2m (default 7d; only with --enable-refresh)")
-	return cmd
+	cmd.Flags().StringArrayVar(&args.AppRefresh, "app-refresh",
+		nil, "Override the refresh setting for one app: <app>=on, <app>=off, or <app>=<ttl> (repeatable)")
 }
 
 // unlock executes the 'agent unlock' command logic.
@@ -245,14 +507,80 @@ func (r *runner) unlock(ctx context.Context, args *unlockArgs) error {
 		return fmt.Errorf("set log level: %w", err)
 	}
 	r.warnIfBackendNotAgent()
-	if err := checkRefreshTokenSupported(args.EnableRefresh, runtime.GOOS); err != nil {
+	ttl, rules, err := refreshSettings(args)
+	if err != nil {
 		return err
 	}
+	return unlock.New().Run(ctx, r.logger.Logger, args.EnableRefresh, ttl, rules) //nolint:wrapcheck
+}
+
+// refreshSettings resolves the refresh-token flags of 'agent unlock' and 'agent
+// configure' into the TTL and per-app rules to send, rejecting them up front where the
+// agent would, so the user isn't asked for the passphrase first.
+func refreshSettings(args *unlockArgs) (time.Duration, []*adminapi.AppRefresh, error) {
+	var rules []*adminapi.AppRefresh
+	if len(args.AppRefresh) > 0 {
+		clientIDs, err := configuredClientIDs(args.Config)
+		if err != nil {
+			return 0, nil, err
+		}
+		rules, err = appRefresh(args.AppRefresh, clientIDs)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := checkRefreshTokenSupported(args.EnableRefresh || anyAppRefreshEnabled(rules), runtime.GOOS); err != nil {
+		return 0, nil, err
+	}
 	ttl, err := refreshTokenTTL(args.EnableRefresh, args.RefreshTokenTTL)
+	if err != nil {
+		return 0, nil, err
+	}
+	return ttl, rules, nil
+}
+
+// configureCommand returns the CLI command definition for the 'agent configure'
+// subcommand.
+func (r *runner) configureCommand() *cobra.Command {
+	args := &unlockArgs{
+		GlobalFlags: r.flags,
+	}
+	cmd := &cobra.Command{
+		Use:   "configure",
+		Short: "Change the refresh-token settings of the unlocked ghtkn agent",
+		Args:  cobra.NoArgs,
+		Long: `Change the refresh-token settings of the running, unlocked ghtkn agent without
+locking it.
+
+It takes the same --enable-refresh, --refresh-token-ttl, and --app-refresh flags as
+'ghtkn agent unlock' and replaces the agent's settings with them as a whole: a flag
+left out takes its default, as it would on unlock. Since it can enable refresh, it
+prompts for the agent passphrase, which the agent verifies.
+
+The change applies at once. Turning refresh off for an app drops its stored refresh
+token, after asking for confirmation when the token is still valid, and the periodic
+sweep restarts with the new TTL.
+
+$ ghtkn agent configure --enable-refresh --refresh-token-ttl 3d
+$ ghtkn agent configure --enable-refresh=false`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return r.configure(cmd.Context(), args)
+		},
+	}
+	addRefreshFlags(cmd, args)
+	return cmd
+}
+
+// configure executes the 'agent configure' command logic.
+func (r *runner) configure(ctx context.Context, args *unlockArgs) error {
+	if err := r.logger.SetLevel(args.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	ttl, rules, err := refreshSettings(args)
 	if err != nil {
 		return err
 	}
-	return unlock.New().Run(ctx, r.logger.Logger, args.EnableRefresh, ttl) //nolint:wrapcheck
+	return configure.New().Run(ctx, r.logger.Logger, args.EnableRefresh, ttl, rules) //nolint:wrapcheck
 }
 
 // lockCommand returns the CLI command definition for the 'agent lock' subcommand.
@@ -287,6 +615,279 @@ func (r *runner) lock(ctx context.Context) error {
 	return lock.New().Run(ctx, r.logger.Logger) //nolint:wrapcheck
 }
 
+// upgradeCommand returns the CLI command definition for the 'agent upgrade' subcommand.
+func (r *runner) upgradeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "upgrade",
+		Short: "Make the running ghtkn agent run the upgraded ghtkn binary without restarting it",
+		Args:  cobra.NoArgs,
+		Long: `Make the running ghtkn agent run the upgraded ghtkn binary.
+
+Upgrading ghtkn doesn't update an agent that is already running. Instead of stopping,
+starting, and unlocking it again, run this after the upgrade: the agent re-executes
+the ghtkn binary it was started from, which is now the new one, in the same process.
+The new agent takes over the socket, and, when the agent is unlocked, the data key and
+the refresh settings, through inherited file descriptors; they are never written to
+disk, so you don't enter the passphrase again. Requests made meanwhile wait for the
+new agent instead of failing.
+
+The agent refuses while a device flow is in progress, since the flow would be lost.
+Not supported on Windows.
+
+$ ghtkn agent upgrade`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return r.upgrade(cmd.Context())
+		},
+	}
+}
+
+// upgrade executes the 'agent upgrade' command logic.
+// It configures the log level and asks the running agent to re-execute itself.
+func (r *runner) upgrade(ctx context.Context) error {
+	if err := r.logger.SetLevel(r.flags.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	r.warnIfBackendNotAgent()
+	return upgrade.New(r.version).Run(ctx, r.logger.Logger) //nolint:wrapcheck
+}
+
+// installServiceArgs holds the flag values for the 'agent install-service' subcommand.
+type installServiceArgs struct {
+	SystemdUser      bool
+	Launchd          bool
+	OpenRC           bool
+	SocketActivation bool
+	Print            bool
+	Enable           bool
+}
+
+// installServiceCommand returns the CLI command definition for the 'agent
+// install-service' subcommand.
+func (r *runner) installServiceCommand() *cobra.Command {
+	args := &installServiceArgs{}
+	cmd := &cobra.Command{
+		Use:   "install-service [-- <agent start flags>...]",
+		Short: "Install a service definition that runs the ghtkn agent",
+		Long: `Install a service definition that runs the ghtkn agent.
+
+It renders a systemd user unit (--systemd-user, the default on Linux), a launchd
+agent (--launchd, the default on macOS), or an OpenRC script (--openrc) that runs
+'ghtkn agent start' with this ghtkn binary, and writes it where the service manager
+reads it. The definition pins the socket, key, and token directory that ghtkn
+resolves in this environment (GHTKN_AGENT_SOCKET, GHTKN_AGENT_KEY, and
+GHTKN_AGENT_TOKEN_DIR), since the service manager doesn't see the environment of your
+shell, and carries over GHTKN_CONFIG, XDG_CONFIG_HOME, GHTKN_BACKEND, and
+GHTKN_LOG_LEVEL when they are set. Flags after -- are passed to 'ghtkn agent start'.
+
+It then offers to enable and start the service; --enable does so without asking.
+The agent starts locked, so run 'ghtkn agent unlock' once it runs.
+
+--socket-activation (systemd only) also installs a socket unit: systemd listens on
+the socket and starts the agent on the first connection, so the agent need not run
+until a client needs it. --print writes the definition to the standard output instead
+of installing it. An OpenRC script goes to /etc/init.d, which needs root; run the
+command as the user the agent runs as, with --print, and write the output as root.
+Not supported on Windows.
+
+$ ghtkn agent install-service
+$ ghtkn agent install-service --socket-activation --enable
+$ ghtkn agent install-service --print -- --check-token-interval 1h
+$ ghtkn agent install-service --openrc --print | sudo tee /etc/init.d/ghtkn-agent`,
+		RunE: func(cmd *cobra.Command, startArgs []string) error {
+			return r.installService(cmd.Context(), cmd.OutOrStdout(), args, startArgs)
+		},
+	}
+	cmd.Flags().BoolVar(&args.SystemdUser, "systemd-user", false, "Install a systemd user unit (the default on Linux)")
+	cmd.Flags().BoolVar(&args.Launchd, "launchd", false, "Install a launchd agent (the default on macOS)")
+	cmd.Flags().BoolVar(&args.OpenRC, "openrc", false, "Install an OpenRC script")
+	cmd.MarkFlagsMutuallyExclusive("systemd-user", "launchd", "openrc")
+	cmd.Flags().BoolVar(&args.SocketActivation, "socket-activation",
+		false, "Let systemd listen on the socket and start the agent on the first connection (systemd only)")
+	cmd.Flags().BoolVar(&args.Print, "print", false, "Write the service definition to the standard output instead of installing it")
+	cmd.Flags().BoolVar(&args.Enable, "enable", false, "Enable and start the service without asking")
+	cmd.MarkFlagsMutuallyExclusive("print", "enable")
+	return cmd
+}
+
+// installService executes the 'agent install-service' command logic.
+// It configures the log level and installs or prints the service definition.
+func (r *runner) installService(ctx context.Context, stdout io.Writer, args *installServiceArgs, startArgs []string) error {
+	if err := r.logger.SetLevel(r.flags.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	input := &installservice.Input{
+		SocketActivation: args.SocketActivation,
+		Print:            args.Print,
+		Enable:           args.Enable,
+		StartArgs:        startArgs,
+	}
+	switch {
+	case args.SystemdUser:
+		input.Manager = installservice.ManagerSystemdUser
+	case args.Launchd:
+		input.Manager = installservice.ManagerLaunchd
+	case args.OpenRC:
+		input.Manager = installservice.ManagerOpenRC
+	}
+	return installservice.New(stdout).Run(ctx, r.logger.Logger, input) //nolint:wrapcheck
+}
+
+// pruneCommand returns the CLI command definition for the 'agent prune' subcommand.
+func (r *runner) pruneCommand() *cobra.Command {
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete expired and undecryptable tokens and leftover files from the agent's token directory",
+		Args:  cobra.NoArgs,
+		Long: `Delete what no longer serves a purpose from the agent's token directory.
+
+It asks the running agent, which must be unlocked, to delete:
+
+- tokens whose access token has expired and that carry no usable refresh token
+  (with refresh disabled, every expired token)
+- tokens that can't be decrypted with the current key, e.g. written under a key
+  that was since replaced
+- temporary files left by an interrupted write, and metadata of deleted tokens
+
+and prints what was deleted. With --dry-run it only prints what would be deleted.
+An agent unlocked without --enable-refresh does this by itself daily.
+
+$ ghtkn agent prune --dry-run
+$ ghtkn agent prune`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return r.prune(cmd.Context(), cmd.OutOrStdout(), dryRun)
+		},
+	}
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only print what would be deleted")
+	return cmd
+}
+
+// prune executes the 'agent prune' command logic.
+// It configures the log level and asks the running agent to prune its token directory.
+func (r *runner) prune(ctx context.Context, stdout io.Writer, dryRun bool) error {
+	if err := r.logger.SetLevel(r.flags.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	return prune.New(stdout).Run(ctx, r.logger.Logger, dryRun) //nolint:wrapcheck
+}
+
+// fsckCommand returns the CLI command definition for the 'agent fsck' subcommand.
+func (r *runner) fsckCommand() *cobra.Command {
+	var repair bool
+	cmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "Inspect the agent's key file and token directory on disk, and optionally repair them",
+		Args:  cobra.NoArgs,
+		Long: `Inspect the agent's key file and token directory on disk.
+
+It does not talk to the agent, so it works while the agent is stopped or
+misbehaving. It prompts for the agent passphrase, decrypts the key file, and lists
+every token file: whether it decrypts, and when its access token and refresh token
+expire. The tokens themselves are never printed.
+
+It also reports:
+
+- temporary files left by an interrupted write
+- metadata of deleted tokens
+- files with names the agent never writes
+- files and directories the group or others can access
+
+and exits with an error when it finds any. With --repair it removes those files
+and restricts the permissions to the owner. --repair refuses to run while the agent
+is running, so stop it first. Tokens that can't be decrypted are kept; 'ghtkn agent
+prune' deletes them.
+
+$ ghtkn agent fsck
+$ ghtkn agent stop
+$ ghtkn agent fsck --repair`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return r.fsck(cmd.Context(), cmd.OutOrStdout(), repair)
+		},
+	}
+	cmd.Flags().BoolVar(&repair, "repair", false, "Remove leftover and unexpected files and fix permissions")
+	return cmd
+}
+
+// fsck executes the 'agent fsck' command logic.
+func (r *runner) fsck(ctx context.Context, stdout io.Writer, repair bool) error {
+	if err := r.logger.SetLevel(r.flags.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	return fsck.New(stdout).Run(ctx, r.logger.Logger, repair) //nolint:wrapcheck
+}
+
+// exportCommand returns the CLI command definition for the 'agent export' subcommand.
+func (r *runner) exportCommand() *cobra.Command {
+	var out string
+	cmd := &cobra.Command{
+		Use:   "export",
+		Short: "Write an encrypted backup of the agent's tokens, refresh tokens included",
+		Args:  cobra.NoArgs,
+		Long: `Write an encrypted backup bundle of the tokens the running, unlocked agent stores,
+refresh tokens included, so 'ghtkn agent import' can carry them to a new machine or a
+rebuilt devcontainer instead of redoing every device flow.
+
+It prompts for the agent passphrase, which the agent verifies since the bundle holds
+the refresh tokens, and twice for a passphrase for the bundle. The bundle is encrypted
+under the bundle passphrase with Argon2id and AES-256-GCM, like the agent's key file,
+and does not depend on the agent's key. It is written with mode 0600.
+
+GitHub invalidates a refresh token once it is used, so after importing the bundle
+elsewhere, stop using this agent for the same apps: whichever agent refreshes first
+leaves the other one's refresh token useless.
+
+$ ghtkn agent export --out bundle.ghtkn`,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return r.export(cmd.Context(), out)
+		},
+	}
+	cmd.Flags().StringVarP(&out, "out", "o", "", "The file to write the bundle to")
+	_ = cmd.MarkFlagRequired("out")
+	return cmd
+}
+
+// export executes the 'agent export' command logic.
+func (r *runner) export(ctx context.Context, out string) error {
+	if err := r.logger.SetLevel(r.flags.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	return export.New().Run(ctx, r.logger.Logger, out) //nolint:wrapcheck
+}
+
+// importCommand returns the CLI command definition for the 'agent import' subcommand.
+func (r *runner) importCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "import <bundle>",
+		Short: "Merge the tokens of a bundle written by 'ghtkn agent export' into the agent",
+		Args:  cobra.ExactArgs(1),
+		Long: `Merge the tokens of a bundle written by 'ghtkn agent export' into the running,
+unlocked agent.
+
+It prompts for the bundle passphrase and prints what became of each token:
+
+- imported: the agent stores it now, encrypted under its own key
+- kept: the agent already had a token for the app and kept its own
+- failed: the agent could not store it
+
+When refresh is disabled for an app, the agent drops the refresh token of the
+imported token, as unlocking with that setting would. The import counts as a use of
+the token for --refresh-token-ttl.
+
+$ ghtkn agent import bundle.ghtkn`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return r.importBundle(cmd.Context(), cmd.OutOrStdout(), args[0])
+		},
+	}
+}
+
+// importBundle executes the 'agent import' command logic.
+func (r *runner) importBundle(ctx context.Context, stdout io.Writer, path string) error {
+	if err := r.logger.SetLevel(r.flags.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	return importcmd.New(stdout).Run(ctx, r.logger.Logger, path) //nolint:wrapcheck
+}
+
 // resetCommand returns the CLI command definition for the 'agent reset' subcommand.
 func (r *runner) resetCommand() *cobra.Command {
 	return &cobra.Command{
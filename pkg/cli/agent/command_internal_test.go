@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/daemon"
+)
+
+//nolint:paralleltest // t.Setenv, which sets GHTKN_AGENT_HANDOFF, cannot be used in a parallel test.
+func TestDaemonize(t *testing.T) {
+	tests := []struct {
+		name      string
+		daemon    bool
+		readiness *daemon.Readiness
+		handoff   string
+		want      bool
+	}{
+		{name: "without --daemon"},
+		{name: "--daemon", daemon: true, want: true},
+		{name: "the daemon --daemon started", daemon: true, readiness: &daemon.Readiness{}},
+		{name: "a daemon re-executed by an upgrade", daemon: true, handoff: "5,6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GHTKN_AGENT_HANDOFF", tt.handoff)
+			if got := daemonize(&startArgs{Daemon: tt.daemon}, tt.readiness); got != tt.want {
+				t.Fatalf("daemonize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
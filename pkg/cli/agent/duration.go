@@ -44,7 +44,7 @@ func ttlUnit(b byte) (time.Duration, bool) {
 // a parameter rather than runtime.GOOS so this is testable on any OS.
 func checkRefreshTokenSupported(enableRefreshToken bool, goos string) error {
 	if enableRefreshToken && !refreshtoken.Supported(goos) {
-		return errors.New("refresh tokens are not supported on Windows; rerun `ghtkn agent unlock` without --enable-refresh")
+		return errors.New("refresh tokens are not supported on Windows; rerun `ghtkn agent unlock` without --enable-refresh, and with --app-refresh only set to off")
 	}
 	return nil
 }
@@ -67,7 +67,7 @@ func refreshTokenTTL(enableRefresh bool, value string) (time.Duration, error) {
 }
 
 func parseRefreshTokenTTL(s string) (time.Duration, error) {
-	d, err := parseDurationValue(s)
+	d, err := parseDurationValue("refresh-token-ttl", s)
 	if err != nil {
 		return 0, err
 	}
@@ -80,17 +80,38 @@ func parseRefreshTokenTTL(s string) (time.Duration, error) {
 	return d, nil
 }
 
-func parseDurationValue(s string) (time.Duration, error) {
+// maxSessionAge resolves the --max-session-age flag of 'agent start', in the same d/w/m
+// units as --refresh-token-ttl. An empty value means the flag was not given: no limit.
+// Unlike the TTL it has no upper bound, since a session is extended by every refresh
+// and has no natural end, but it must be positive: a zero or negative age would refuse
+// every refresh, which is what not enabling refresh does.
+func maxSessionAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := parseDurationValue("max-session-age", value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("max-session-age must be positive: %q", value)
+	}
+	return d, nil
+}
+
+// parseDurationValue parses a number with a d/w/m suffix (see ttlUnit) given to the flag
+// named name, which error messages refer to.
+func parseDurationValue(name, s string) (time.Duration, error) {
 	if s == "" {
-		return 0, errors.New("refresh-token-ttl must not be empty")
+		return 0, fmt.Errorf("%s must not be empty", name)
 	}
 	unit, ok := ttlUnit(s[len(s)-1])
 	if !ok {
-		return 0, fmt.Errorf("refresh-token-ttl must end with d (day), w (week), or m (30-day month), e.g. 7d, 4w, 2m: %q", s)
+		return 0, fmt.Errorf("%s must end with d (day), w (week), or m (30-day month), e.g. 7d, 4w, 2m: %q", name, s)
 	}
 	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
 	if err != nil {
-		return 0, fmt.Errorf("parse refresh-token-ttl %q: %w", s, err)
+		return 0, fmt.Errorf("parse %s %q: %w", name, s, err)
 	}
 	return time.Duration(n * float64(unit)), nil
 }
@@ -124,3 +124,41 @@ func TestRefreshTokenTTL(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxSessionAge(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "not given", in: "", want: 0},
+		{name: "days", in: "30d", want: 30 * 24 * time.Hour},
+		{name: "weeks", in: "4w", want: 4 * 7 * 24 * time.Hour},
+		{name: "no upper bound", in: "12m", want: 12 * 30 * 24 * time.Hour},
+
+		{name: "zero", in: "0d", wantErr: true},
+		{name: "negative", in: "-1w", wantErr: true},
+		{name: "no unit", in: "30", wantErr: true},
+		{name: "not a number", in: "xd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := maxSessionAge(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no error, got %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
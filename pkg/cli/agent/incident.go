@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/server"
+)
+
+// incidentPolicy builds the agent's refresh-token incident policy from the
+// --on-refresh-incident actions and the --refresh-incident-hook program. Each action is
+// one of revoke, delete, and lock; an unknown one is an error rather than ignored, since
+// a typo would otherwise silently leave a possible token theft uncontained.
+func incidentPolicy(actions []string, hook string) (server.IncidentPolicy, error) {
+	policy := server.IncidentPolicy{Hook: hook}
+	for _, action := range actions {
+		switch strings.TrimSpace(action) {
+		case "revoke":
+			policy.Revoke = true
+		case "delete":
+			policy.Delete = true
+		case "lock":
+			policy.Lock = true
+		default:
+			return server.IncidentPolicy{}, fmt.Errorf("unknown --on-refresh-incident action %q: use revoke, delete, or lock", action)
+		}
+	}
+	return policy, nil
+}
+
+// minCheckTokenInterval is the shortest --check-token-interval accepted. Each check is
+// one API call per cached token, which counts against the user's rate limit, and a
+// revocation is rare enough that a minute's delay in noticing it costs nothing.
+const minCheckTokenInterval = time.Minute
+
+// livenessPolicy builds the agent's liveness policy from --check-token-interval and
+// --revoked-token-hook. A zero interval disables the check; a hook without it is an
+// error, since it would never run.
+func livenessPolicy(interval time.Duration, hook string) (server.LivenessPolicy, error) {
+	switch {
+	case interval == 0:
+		if hook != "" {
+			return server.LivenessPolicy{}, errors.New("--revoked-token-hook applies only with --check-token-interval")
+		}
+		return server.LivenessPolicy{}, nil
+	case interval < minCheckTokenInterval:
+		return server.LivenessPolicy{}, fmt.Errorf("--check-token-interval must be at least %s: %s", minCheckTokenInterval, interval)
+	}
+	return server.LivenessPolicy{Interval: interval, Hook: hook}, nil
+}
@@ -0,0 +1,81 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/server"
+)
+
+func TestIncidentPolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		actions []string
+		hook    string
+		want    server.IncidentPolicy
+		wantErr bool
+	}{
+		{name: "no flags only warns"},
+		{name: "all actions", actions: []string{"revoke", "delete", "lock"}, want: server.IncidentPolicy{Revoke: true, Delete: true, Lock: true}},
+		{name: "spaces are trimmed", actions: []string{" lock"}, want: server.IncidentPolicy{Lock: true}},
+		{name: "hook alone", hook: "/usr/local/bin/notify", want: server.IncidentPolicy{Hook: "/usr/local/bin/notify"}},
+		{name: "unknown action", actions: []string{"revoke", "rotate"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := incidentPolicy(tt.actions, tt.hook)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("policy (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLivenessPolicy(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		interval time.Duration
+		hook     string
+		want     server.LivenessPolicy
+		wantErr  bool
+	}{
+		{name: "disabled"},
+		{name: "interval", interval: time.Hour, want: server.LivenessPolicy{Interval: time.Hour}},
+		{name: "interval and hook", interval: time.Hour, hook: "/usr/local/bin/notify", want: server.LivenessPolicy{Interval: time.Hour, Hook: "/usr/local/bin/notify"}},
+		{name: "the minimum", interval: time.Minute, want: server.LivenessPolicy{Interval: time.Minute}},
+		{name: "too short", interval: 30 * time.Second, wantErr: true},
+		{name: "negative", interval: -time.Hour, wantErr: true},
+		{name: "hook without interval", hook: "/usr/local/bin/notify", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := livenessPolicy(tt.interval, tt.hook)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("policy (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Package backend implements the 'ghtkn backend' command and its subcommands, which work
+// on the backends tokens are cached in. It provides the 'migrate' subcommand; the logic
+// lives in pkg/controller/backend/migrate.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/flag"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/backend/migrate"
+	"github.com/suzuki-shunsuke/slog-util/slogutil"
+)
+
+// migrateArgs holds the flag values for the 'backend migrate' subcommand.
+type migrateArgs struct {
+	*flag.GlobalFlags
+
+	From         string
+	To           string
+	DeleteSource bool
+}
+
+// New creates the 'backend' parent command.
+func New(logger *slogutil.Logger, gFlags *flag.GlobalFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backend",
+		Short: "Work with the backends access tokens are cached in",
+	}
+	cmd.AddCommand(migrateCommand(logger, gFlags))
+	return cmd
+}
+
+// migrateCommand returns the 'backend migrate' subcommand.
+func migrateCommand(logger *slogutil.Logger, gFlags *flag.GlobalFlags) *cobra.Command {
+	args := &migrateArgs{GlobalFlags: gFlags}
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Copy the cached tokens of the configured apps from one backend to another",
+		Long: `Copy the cached access token of every app in the config from one backend to
+another (keyring, text, or agent), so switching backends does not force every app
+to authenticate again.
+
+For each app it reads the token from --from, writes it to --to, and reads it back
+to verify the copy. It prints what became of each app's token:
+
+- migrated: copied and verified (and deleted from --from with --delete-source)
+- kept: --to already has a token that has not expired, which is kept
+- no token: --from has no token for the app
+- expired: the token in --from has expired, so it is not copied
+- failed: reading, writing, verifying, or deleting failed
+
+Copying to the agent needs it running and unlocked, and prompts for the agent
+passphrase, since the agent otherwise refuses tokens it did not mint. Only access
+tokens are copied: a refresh token stays in the agent, and copying from the agent
+with --delete-source discards it.
+
+Switch the backend (GHTKN_BACKEND or backend.type) once the tokens are migrated.
+
+$ ghtkn backend migrate --from keyring --to agent
+$ ghtkn backend migrate --from text --to keyring --delete-source`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return migrateAction(cmd.Context(), logger, args, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().StringVar(&args.From, "from", "", "The backend to copy the tokens from: keyring, text, or agent")
+	cmd.Flags().StringVar(&args.To, "to", "", "The backend to copy the tokens to: keyring, text, or agent")
+	cmd.Flags().BoolVar(&args.DeleteSource, "delete-source", false, "Delete each token from --from once its copy is verified")
+	_ = cmd.MarkFlagRequired("from")
+	_ = cmd.MarkFlagRequired("to")
+	return cmd
+}
+
+// migrateAction loads the configured apps and migrates their tokens.
+func migrateAction(ctx context.Context, logger *slogutil.Logger, args *migrateArgs, stdout io.Writer) error {
+	if err := logger.SetLevel(args.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	cfg, err := ghtkn.LoadConfig(&ghtkn.InputLoadConfig{ConfigFilePath: args.Config})
+	if err != nil {
+		return fmt.Errorf("load the config: %w", err)
+	}
+	input := &migrate.InputRun{
+		From:         args.From,
+		To:           args.To,
+		DeleteSource: args.DeleteSource,
+	}
+	if cfg != nil {
+		input.Apps = cfg.Apps
+	}
+	return migrate.New(stdout).Run(ctx, logger.Logger, input) //nolint:wrapcheck
+}
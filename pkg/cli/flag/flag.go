@@ -13,6 +13,7 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
 	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/env"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/instance"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cobrautil"
 	"github.com/suzuki-shunsuke/slog-error/slogerr"
 )
@@ -21,6 +22,7 @@ import (
 type GlobalFlags struct {
 	LogLevel string
 	Config   string
+	Instance string
 }
 
 // SetMinExpiration parses the --min-expiration flag value and sets it on inputGet.
@@ -57,6 +59,14 @@ func Config(fs *pflag.FlagSet, dest *string) {
 	cobrautil.Envs(fs, "config", env.Config)
 }
 
+// Instance registers the flag for selecting a named agent instance, whose socket,
+// key file, and token directory are kept apart from the default agent's.
+// Can be set via GHTKN_AGENT_INSTANCE environment variable.
+func Instance(fs *pflag.FlagSet, dest *string) {
+	fs.StringVar(dest, "instance", "", "name of the agent instance to use (e.g. work)")
+	cobrautil.Envs(fs, "instance", instance.EnvInstance)
+}
+
 // Format registers the flag for specifying the output format.
 // Currently supports: json.
 // Can be set via GHTKN_OUTPUT_FORMAT environment variable.
@@ -148,15 +148,14 @@ func warnStaleAgent(logger *slogutil.Logger, agent *info.AgentStatus, version st
 		return
 	}
 	logger.Warn(`the running ghtkn agent was built from a different ghtkn version than this one, `+
-		`so it serves tokens from that other binary. Restart it with 'ghtkn agent stop', then start `+
-		`and unlock it again to run this version.`,
+		`so it serves tokens from that other binary. Run 'ghtkn agent upgrade' (on Windows, restart the agent) to make it run this version.`,
 		"agent_version", agent.Version, "ghtkn_version", version)
 }
 
 // staleAgent reports whether the running agent was built from a different ghtkn version
 // than the one talking to it. It is a plain inequality rather than an ordering: either
-// direction means the agent is not running this ghtkn's code, and a restart is the fix
-// either way. Ordering would need semantic version parsing to say which side is older,
+// direction means the agent is not running this ghtkn's code, and 'ghtkn agent upgrade' is
+// the fix either way. Ordering would need semantic version parsing to say which side is older,
 // which buys nothing here.
 //
 // The check is disabled unless both versions are known. An empty agentVersion is an agent
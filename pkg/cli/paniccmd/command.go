@@ -0,0 +1,80 @@
+// Package paniccmd implements the 'ghtkn panic' command, the one-shot kill switch for a
+// machine or container suspected to be compromised. The logic lives in
+// pkg/controller/paniccmd.
+package paniccmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/flag"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/config"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/paniccmd"
+	"github.com/suzuki-shunsuke/slog-util/slogutil"
+)
+
+// Args holds the flag values for the panic command.
+type Args struct {
+	*flag.GlobalFlags
+
+	DestroyKey bool
+}
+
+// New creates the 'panic' command.
+func New(logger *slogutil.Logger, gFlags *flag.GlobalFlags) *cobra.Command {
+	args := &Args{
+		GlobalFlags: gFlags,
+	}
+	cmd := &cobra.Command{
+		Use:   "panic",
+		Short: "Revoke and delete every stored token and stop the agent, for a suspected compromise",
+		Long: `Revoke and delete every stored token and stop the ghtkn agent in one step.
+
+Run it when the machine or container running ghtkn is suspected to be compromised.
+It does not ask for confirmation. It:
+
+1. revokes the stored tokens of every app in the config from the configured backend,
+   as 'ghtkn revoke --all' does
+2. asks a running ghtkn agent to revoke every token it stores, including refresh
+   tokens and tokens of apps no longer in the config, then lock and stop
+3. deletes the agent's token directory
+4. with --destroy-key, deletes the agent's key file too, so the passphrase no longer
+   unlocks anything and 'ghtkn agent reset' is needed to use the agent again
+
+Every step runs even if an earlier one fails. It prints a JSON report of which steps
+succeeded and exits non-zero if any failed. A locked agent cannot decrypt its tokens
+to revoke them; they are deleted but reported in revoke_failed, and may still be
+live, so suspend or uninstall those GitHub Apps.
+
+$ ghtkn panic
+$ ghtkn panic --destroy-key`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return action(cmd.Context(), logger, args, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().BoolVar(&args.DestroyKey, "destroy-key", false, "Delete the agent's key file too")
+	return cmd
+}
+
+// action resolves the config path and runs the kill switch, writing the report to stdout.
+func action(ctx context.Context, logger *slogutil.Logger, args *Args, stdout io.Writer) error {
+	if err := logger.SetLevel(args.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	p, err := config.ResolvePath(args.Config)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	client, err := ghtkn.New()
+	if err != nil {
+		return fmt.Errorf("create a ghtkn client: %w", err)
+	}
+	return paniccmd.New(client, stdout).Run(ctx, logger.Logger, &paniccmd.InputRun{ //nolint:wrapcheck
+		ConfigFilePath: p,
+		DestroyKey:     args.DestroyKey,
+	})
+}
@@ -14,18 +14,22 @@
 // The --all flag revokes the stored tokens of every app in the config at once,
 // for incident response when the environment running ghtkn is compromised. With
 // --all, app name arguments are ignored, but raw access tokens are still revoked.
+//
+// To keep a leaked token off the command line, "-" reads tokens from stdin and
+// --from-file extracts them from a file.
 package revoke
 
 import (
 	"context"
 	"fmt"
-	"strings"
+	"io"
 
 	"github.com/spf13/cobra"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/completion"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/flag"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/config"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/revoke"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/credential"
 	"github.com/suzuki-shunsuke/slog-util/slogutil"
 )
 
@@ -33,8 +37,9 @@ import (
 type Args struct {
 	*flag.GlobalFlags
 
-	Args []string // positional arguments (raw tokens and/or app names)
-	All  bool     // --all: revoke the stored tokens of every app in the config
+	Args      []string // positional arguments (raw tokens and/or app names, or "-" for stdin)
+	All       bool     // --all: revoke the stored tokens of every app in the config
+	FromFiles []string // --from-file: files to extract raw tokens from
 }
 
 // New creates a new revoke command instance with the provided logger.
@@ -44,23 +49,30 @@ func New(logger *slogutil.Logger, gFlags *flag.GlobalFlags) *cobra.Command {
 		GlobalFlags: gFlags,
 	}
 	cmd := &cobra.Command{
-		Use:   "revoke [<access token | app name>...]",
+		Use:   "revoke [<access token | app name | ->...]",
 		Short: "Revoke GitHub App User Access Tokens",
 		Long: `Revoke GitHub App User Access Tokens via GitHub's credential revocation API and remove them from the backend.
 
 Each argument is classified by its prefix: arguments starting with a GitHub token prefix (ghp_, github_pat_, gho_, ghu_, ghr_) are revoked directly as raw access tokens, and all other arguments are treated as app names whose stored tokens are revoked and removed from the backend.
 When no argument is given, the token stored for GHTKN_APP (or the default app) is revoked.
 
-With --all, the stored tokens of every app in the config are revoked. This is meant for incident response: when the environment running ghtkn is compromised, all stored tokens can be revoked at once. App name arguments are ignored when --all is set, but raw access tokens are still revoked as usual.`,
+A token on the command line shows up in ps and shell history. To keep it off, pass - to read tokens from stdin, or --from-file to read them from a file such as a log or transcript; every token-shaped string found there is revoked. Raw tokens are deduplicated and revoked in one batch, and the result of each is printed with the token masked.
+
+With --all, the stored tokens of every app in the config are revoked. This is meant for incident response: when the environment running ghtkn is compromised, all stored tokens can be revoked at once. App name arguments are ignored when --all is set, but raw access tokens are still revoked as usual.
+
+$ ghtkn revoke my-app
+$ pbpaste | ghtkn revoke -
+$ ghtkn revoke --from-file session.log`,
 		Args: cobra.ArbitraryArgs,
 		// Raw access tokens are arguments too, but only app names can be completed.
 		ValidArgsFunction: completion.AppNames(&args.Config, ignoresAppNames),
 		RunE: func(cmd *cobra.Command, positional []string) error {
 			args.Args = positional
-			return action(cmd.Context(), logger, args)
+			return action(cmd.Context(), logger, args, cmd.InOrStdin(), cmd.OutOrStdout())
 		},
 	}
 	cmd.Flags().BoolVar(&args.All, "all", false, "Revoke the stored tokens of every app in the config")
+	cmd.Flags().StringSliceVar(&args.FromFiles, "from-file", nil, "Revoke every token found in the file (can be repeated)")
 	return cmd
 }
 
@@ -75,11 +87,11 @@ func ignoresAppNames(cmd *cobra.Command) bool {
 }
 
 // classify splits positional arguments into raw access tokens and app names by
-// their prefix (see isToken). An argument that looks like a GitHub credential is a
-// token; any other argument is an app name.
+// their prefix (see credential.IsToken). An argument that looks like a GitHub
+// credential is a token; any other argument is an app name.
 func classify(positional []string) (tokens, appNames []string) {
 	for _, a := range positional {
-		if isToken(a) {
+		if credential.IsToken(a) {
 			tokens = append(tokens, a)
 		} else {
 			appNames = append(appNames, a)
@@ -88,37 +100,24 @@ func classify(positional []string) (tokens, appNames []string) {
 	return tokens, appNames
 }
 
-// isToken reports whether s looks like a GitHub credential based on its prefix.
-// A positional argument that starts with one of these prefixes is treated as a raw
-// access token rather than an app name.
-func isToken(s string) bool {
-	tokenPrefixes := []string{
-		"ghp_",        // Personal access tokens (classic)
-		"github_pat_", // Fine-grained personal access tokens
-		"gho_",        // OAuth app access tokens
-		"ghu_",        // User-to-server tokens from GitHub Apps
-		"ghr_",        // Refresh tokens from GitHub Apps
-	}
-	for _, p := range tokenPrefixes {
-		if strings.HasPrefix(s, p) {
-			return true
-		}
-	}
-	return false
-}
-
 // action revokes the requested tokens.
 // Positional arguments are classified into raw tokens (revoked directly) and app
 // names (whose stored tokens are revoked via the SDK). When no argument is given,
 // the SDK falls back to GHTKN_APP / the default app; when only raw tokens are
 // given, the SDK is not called so a raw token never touches an unrelated app's
 // stored token.
-func action(ctx context.Context, logger *slogutil.Logger, args *Args) error {
+func action(ctx context.Context, logger *slogutil.Logger, args *Args, stdin io.Reader, stdout io.Writer) error {
 	if err := logger.SetLevel(args.LogLevel); err != nil {
 		return fmt.Errorf("set log level: %w", err)
 	}
 
-	tokens, appNames := classify(args.Args)
+	positional, fromStdin := takeStdinArg(args.Args)
+	tokens, appNames := classify(positional)
+	read, err := readTokens(stdin, fromStdin, args.FromFiles)
+	if err != nil {
+		return err
+	}
+	tokens = append(tokens, read...)
 	if args.All {
 		// --all revokes every app's stored token, so explicit app names are ignored.
 		// Raw tokens are still revoked.
@@ -129,6 +128,7 @@ func action(ctx context.Context, logger *slogutil.Logger, args *Args) error {
 	if err != nil {
 		return fmt.Errorf("create the controller input: %w", err)
 	}
+	input.Stdout = stdout
 	p, err := config.ResolvePath(args.Config)
 	if err != nil {
 		return err //nolint:wrapcheck
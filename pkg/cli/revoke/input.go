@@ -0,0 +1,63 @@
+package revoke
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/credential"
+)
+
+// stdinArg is the positional argument that makes revoke read tokens from stdin.
+const stdinArg = "-"
+
+// errNoTokenFound is returned when stdin or a --from-file file holds no token, so a
+// mistaken pipe or path does not silently revoke nothing.
+var errNoTokenFound = errors.New("no GitHub token was found")
+
+// takeStdinArg removes "-" from the positional arguments and reports whether it was
+// there. It must not be treated as an app name.
+func takeStdinArg(positional []string) ([]string, bool) {
+	ret := make([]string, 0, len(positional))
+	found := false
+	for _, a := range positional {
+		if a == stdinArg {
+			found = true
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return ret, found
+}
+
+// readTokens extracts every token-shaped string (see credential.Find) from stdin when
+// fromStdin is set and from each file, so a leaked token can be revoked without putting
+// it on the command line, where it shows up in ps and shell history. Each source must
+// hold at least one token.
+func readTokens(stdin io.Reader, fromStdin bool, files []string) ([]string, error) {
+	var tokens []string
+	if fromStdin {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("read tokens from stdin: %w", err)
+		}
+		found := credential.Find(string(b))
+		if len(found) == 0 {
+			return nil, fmt.Errorf("read tokens from stdin: %w", errNoTokenFound)
+		}
+		tokens = append(tokens, found...)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read tokens from a file: %w", err)
+		}
+		found := credential.Find(string(b))
+		if len(found) == 0 {
+			return nil, fmt.Errorf("read tokens from %s: %w", file, errNoTokenFound)
+		}
+		tokens = append(tokens, found...)
+	}
+	return tokens, nil
+}
@@ -7,10 +7,14 @@ package cli
 
 import (
 	"context"
+	"os"
+	"runtime"
 
 	"github.com/spf13/cobra"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/instance"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/agent"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/auth"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/backend"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/docs"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/exec"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/flag"
@@ -18,7 +22,10 @@ import (
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/info"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/initcmd"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/jsonschema"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/paniccmd"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/revoke"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/scan"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/token"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/cobrautil"
 	"github.com/suzuki-shunsuke/go-error-with-exit-code/ecerror"
 	"github.com/suzuki-shunsuke/slog-error/slogerr"
@@ -61,11 +68,12 @@ If you are a coding agent, run 'ghtkn docs list' to list the documentation and
 'ghtkn docs show <doc>' to read it before answering questions about ghtkn or
 troubleshooting its errors.`,
 	}
-	// --log-level and --config are persistent, so they can be given either before or
+	// --log-level, --config, and --instance are persistent, so they can be given either before or
 	// after the subcommand. Every subcommand reads them through the same GlobalFlags,
 	// so nothing has to register them again.
 	flag.LogLevel(cmd.PersistentFlags(), &gFlags.LogLevel)
 	flag.Config(cmd.PersistentFlags(), &gFlags.Config)
+	flag.Instance(cmd.PersistentFlags(), &gFlags.Instance)
 	cmd.AddCommand(
 		initcmd.New(logger, gFlags),
 		get.New(logger, env, true, gFlags),
@@ -73,16 +81,37 @@ troubleshooting its errors.`,
 		exec.New(logger, gFlags),
 		auth.New(logger, gFlags),
 		agent.New(logger, env, gFlags),
+		backend.New(logger, gFlags),
 		revoke.New(logger, gFlags),
+		paniccmd.New(logger, gFlags),
+		scan.New(logger, gFlags),
+		token.New(logger, gFlags),
 		info.New(logger, env, gFlags),
 		docs.New(logger, gFlags),
 		jsonschema.New(),
 	)
-	return cobrautil.Command(env, cmd, &cobrautil.Options{
+	cmd = cobrautil.Command(env, cmd, &cobrautil.Options{
 		AfterVersion: func() {
 			hintDocsOnVersion(logger, gFlags)
 		},
 	})
+	applyInstance(cmd, env, gFlags)
+	return cmd
+}
+
+// applyInstance exports the paths of the agent instance --instance names once the
+// environment variables have been applied to the flags, before any command runs.
+// The paths go into the process environment rather than a field of GlobalFlags
+// because everything that locates the agent reads them from there: the SDK's agent
+// backend in 'ghtkn get', the agent itself, and the commands 'ghtkn exec' starts.
+func applyInstance(cmd *cobra.Command, env *cobrautil.Env, gFlags *flag.GlobalFlags) {
+	applyEnvs := cmd.PersistentPreRunE
+	cmd.PersistentPreRunE = func(c *cobra.Command, args []string) error {
+		if err := applyEnvs(c, args); err != nil {
+			return err
+		}
+		return instance.Apply(env.Getenv, os.Setenv, runtime.GOOS, gFlags.Instance) //nolint:wrapcheck
+	}
 }
 
 // withHelp adds the hint about the documentation to an error while keeping any exit
@@ -0,0 +1,76 @@
+// Package scan implements the 'ghtkn scan' command, which finds GitHub credentials
+// leaked into files, Git history, or the staged diff and optionally revokes them. The
+// logic lives in pkg/controller/scan.
+package scan
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/flag"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/scan"
+	"github.com/suzuki-shunsuke/go-revoke-github-access-token/revoke"
+	"github.com/suzuki-shunsuke/slog-util/slogutil"
+)
+
+// Args holds the flag and argument values for the scan command.
+type Args struct {
+	*flag.GlobalFlags
+
+	Paths      []string
+	GitHistory bool
+	Staged     bool
+	Revoke     bool
+}
+
+// New creates the 'scan' command.
+func New(logger *slogutil.Logger, gFlags *flag.GlobalFlags) *cobra.Command {
+	args := &Args{
+		GlobalFlags: gFlags,
+	}
+	cmd := &cobra.Command{
+		Use:   "scan [<path>...]",
+		Short: "Find leaked GitHub tokens in files, Git history, or the staged diff",
+		Long: `Find GitHub credentials (ghp_, github_pat_, gho_, ghu_, ghr_) leaked into files,
+Git history, or the staged diff.
+
+Paths are files or directories, which are scanned recursively, skipping .git and
+binary files. Without a path, --git-history, or --staged, the current directory is
+scanned. --git-history scans every line ever added on any ref of the repository in
+the current directory, and --staged scans the lines added in the staged diff, e.g.
+in a pre-commit hook.
+
+Each finding is printed as <file>:<line>: <masked token>; a finding in history is
+prefixed with its commit. The command exits non-zero if anything is found. With
+--revoke, every credential found is also revoked via GitHub's credential revocation
+API.
+
+$ ghtkn scan ~/.local/state/agent-transcripts
+$ ghtkn scan --git-history
+$ ghtkn scan --staged --revoke`,
+		Args: cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, positional []string) error {
+			args.Paths = positional
+			return action(cmd.Context(), logger, args, cmd.OutOrStdout())
+		},
+	}
+	cmd.Flags().BoolVar(&args.GitHistory, "git-history", false, "Scan the Git history of the repository in the current directory")
+	cmd.Flags().BoolVar(&args.Staged, "staged", false, "Scan the staged diff of the repository in the current directory")
+	cmd.Flags().BoolVar(&args.Revoke, "revoke", false, "Revoke the credentials found")
+	return cmd
+}
+
+// action runs the scan and writes the findings to stdout.
+func action(ctx context.Context, logger *slogutil.Logger, args *Args, stdout io.Writer) error {
+	if err := logger.SetLevel(args.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	return scan.New(stdout, revoke.New(nil)).Run(ctx, logger.Logger, &scan.InputRun{ //nolint:wrapcheck
+		Paths:      args.Paths,
+		GitHistory: args.GitHistory,
+		Staged:     args.Staged,
+		Revoke:     args.Revoke,
+	})
+}
@@ -0,0 +1,117 @@
+// Package token implements the 'ghtkn token' command and its subcommands, which work on
+// a GitHub credential given on stdin rather than on a configured app. It provides the
+// 'inspect' subcommand; the logic lives in pkg/controller/token.
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/spf13/cobra"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/cli/flag"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/token/inspect"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/credential"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+	"github.com/suzuki-shunsuke/slog-util/slogutil"
+)
+
+var (
+	errNoToken        = errors.New("no GitHub token was found on stdin")
+	errMultipleTokens = errors.New("more than one GitHub token was found on stdin; pipe one at a time")
+)
+
+// New creates the 'token' parent command.
+func New(logger *slogutil.Logger, gFlags *flag.GlobalFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "token",
+		Short: "Work with a GitHub token given on stdin",
+	}
+	cmd.AddCommand(inspectCommand(logger, gFlags))
+	return cmd
+}
+
+// inspectCommand returns the 'token inspect' subcommand.
+func inspectCommand(logger *slogutil.Logger, gFlags *flag.GlobalFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect",
+		Short: "Report what a token read from stdin is and whether it still works",
+		Long: `Report what a GitHub token read from stdin is and whether it still works.
+
+The token is read from stdin, so it never appears on the command line, where it
+shows up in ps and shell history. stdin must hold exactly one token-shaped string;
+anything around it (e.g. a log line) is ignored.
+
+The report is JSON: the masked token, its type from its prefix, whether GitHub still
+accepts it, the user it belongs to, the client ID of the issuing app (and the app's
+name when it is in the config), and the expiration GitHub reports. The token itself
+is never printed. A refresh token can't be checked against the API, so only its type
+is reported.
+
+$ pbpaste | ghtkn token inspect
+$ grep -o 'ghu_[A-Za-z0-9]*' build.log | ghtkn token inspect`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return inspectAction(cmd.Context(), logger, gFlags, cmd.InOrStdin(), cmd.OutOrStdout())
+		},
+	}
+}
+
+// inspectAction reads the token from stdin and inspects it.
+func inspectAction(ctx context.Context, logger *slogutil.Logger, gFlags *flag.GlobalFlags, stdin io.Reader, stdout io.Writer) error {
+	if err := logger.SetLevel(gFlags.LogLevel); err != nil {
+		return fmt.Errorf("set log level: %w", err)
+	}
+	token, err := readToken(stdin)
+	if err != nil {
+		return err
+	}
+	return inspect.New(stdout, inspect.DefaultBaseURL).Run(ctx, &inspect.InputRun{ //nolint:wrapcheck
+		Token: token,
+		Apps:  configuredApps(logger, gFlags.Config),
+	})
+}
+
+// readToken extracts the single token-shaped string (see credential.Find) from stdin.
+// The same token repeated, as in a log that printed it twice, counts as one.
+func readToken(stdin io.Reader) (string, error) {
+	b, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", fmt.Errorf("read a token from stdin: %w", err)
+	}
+	tokens := credential.Find(string(b))
+	slices.Sort(tokens)
+	tokens = slices.Compact(tokens)
+	switch len(tokens) {
+	case 0:
+		return "", errNoToken
+	case 1:
+		return tokens[0], nil
+	default:
+		return "", errMultipleTokens
+	}
+}
+
+// configuredApps maps the client IDs of the configured apps to their names. The config
+// only names the issuing app, so a missing or broken config is logged at debug and does
+// not fail the command.
+func configuredApps(logger *slogutil.Logger, configFilePath string) map[string]string {
+	cfg, err := ghtkn.LoadConfig(&ghtkn.InputLoadConfig{ConfigFilePath: configFilePath})
+	if err != nil {
+		slogerr.WithError(logger.Logger, err).Debug("load the config to name the issuing app")
+		return nil
+	}
+	if cfg == nil {
+		return nil
+	}
+	apps := make(map[string]string, len(cfg.Apps))
+	for _, app := range cfg.Apps {
+		if app.ClientID != "" {
+			apps[app.ClientID] = app.Name
+		}
+	}
+	return apps
+}
@@ -0,0 +1,101 @@
+package configure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/harden"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+var (
+	errNotRunning = errors.New("the ghtkn agent is not running; start and unlock it first")
+	errLocked     = errors.New("the ghtkn agent is locked; set the refresh settings with `ghtkn agent unlock` instead")
+)
+
+// Run replaces the refresh-token setting of the running agent with enableRefreshToken,
+// refreshTokenTTL, and appRefresh, as 'ghtkn agent unlock' would set them, without
+// locking it. It prompts for the agent passphrase, which the agent verifies, and, when
+// the change would drop a still-valid stored refresh token, asks for confirmation first;
+// declining leaves the setting unchanged and is not an error.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefreshToken bool, refreshTokenTTL time.Duration, appRefresh []*adminapi.AppRefresh) error {
+	// Best-effort, before the passphrase is read, as in 'ghtkn agent unlock'.
+	harden.Process(logger)
+	path, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	// Check before asking for the passphrase, so it isn't typed for nothing.
+	status, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
+	if err != nil {
+		if agentapi.IsNotRunning(err) {
+			return errNotRunning
+		}
+		return err //nolint:wrapcheck
+	}
+	if !status.OK {
+		return fmt.Errorf("query the agent status: %s", status.Error)
+	}
+	if status.Locked {
+		return errLocked
+	}
+	var pass []byte
+	// An ephemeral agent takes no passphrase (see 'ghtkn agent start --ephemeral').
+	if !status.Ephemeral {
+		pass, err = tty.PromptPassphrase(c.readPassphrase, true)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+	// Best-effort scrubbing of the passphrase bytes.
+	defer func() {
+		for i := range pass {
+			pass[i] = 0
+		}
+	}()
+	req := &adminapi.Request{
+		Request: agentapi.Request{
+			Command:            adminapi.CommandConfigure,
+			Passphrase:         pass,
+			EnableRefreshToken: enableRefreshToken,
+			RefreshTokenTTL:    refreshTokenTTL,
+		},
+		AppRefresh: appRefresh,
+	}
+	resp, err := adminapi.Send(ctx, path, req)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if resp.RefreshTokenRemovalPending {
+		ok, err := c.confirm("Stored refresh tokens will be dropped (access tokens are kept; affected apps re-authenticate on next expiry). Continue? (y/N): ")
+		if err != nil {
+			return fmt.Errorf("confirm dropping stored refresh tokens: %w", err)
+		}
+		if !ok {
+			logger.Info("configure aborted; the refresh settings are unchanged")
+			return nil
+		}
+		req.ConfirmRefreshTokenRemoval = true
+		resp, err = adminapi.Send(ctx, path, req)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+	switch {
+	case resp.OK:
+	case resp.Error == agentapi.RespLocked:
+		return errLocked
+	case resp.Error == adminapi.RespUnknownCommand:
+		return fmt.Errorf("the agent failed to change its settings (an agent from an older ghtkn does not support it; restart it with `ghtkn agent stop` then `ghtkn agent start`): %s", resp.Error)
+	default:
+		return fmt.Errorf("configure the agent: %s", resp.Error)
+	}
+	logger.Info("ghtkn agent reconfigured", "refresh_token_enabled", resp.RefreshTokenEnabled)
+	return nil
+}
@@ -0,0 +1,141 @@
+package configure
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// serveAgent starts a Unix-socket server that answers each request with handler, and
+// returns a getEnv stub that points GHTKN_AGENT_SOCKET at it.
+func serveAgent(t *testing.T, handler func(*adminapi.Request) *adminapi.Response) func(string) string {
+	t.Helper()
+	// A short dir keeps the socket path under the OS sun_path limit (t.TempDir embeds
+	// the long test name).
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(t.Context(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err != nil {
+					return
+				}
+				req := &adminapi.Request{}
+				if err := json.Unmarshal(line, req); err != nil {
+					return
+				}
+				b, err := json.Marshal(handler(req))
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(append(b, '\n'))
+			}()
+		}
+	}()
+	return func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	}
+}
+
+// TestController_Run verifies that configure refuses a locked agent before asking for the
+// passphrase, sends the new setting with the passphrase, and re-sends it with the
+// confirmation only when the agent asks and the user agrees.
+func TestController_Run(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		locked      bool
+		pending     bool
+		confirm     bool
+		wantErr     error
+		wantSent    int
+		wantConfirm bool
+	}{
+		{name: "applied", wantSent: 1},
+		{name: "confirmed", pending: true, confirm: true, wantSent: 2, wantConfirm: true},
+		{name: "declined", pending: true, wantSent: 1},
+		{name: "locked", locked: true, wantErr: errLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var mu sync.Mutex
+			var sent []*adminapi.Request
+			getEnv := serveAgent(t, func(req *adminapi.Request) *adminapi.Response {
+				switch req.Command {
+				case agentapi.CommandStatus:
+					return &adminapi.Response{Response: agentapi.Response{OK: true, Locked: tt.locked, Initialized: true}}
+				case adminapi.CommandConfigure:
+					mu.Lock()
+					sent = append(sent, req)
+					mu.Unlock()
+					if tt.pending && !req.ConfirmRefreshTokenRemoval {
+						return &adminapi.Response{Response: agentapi.Response{RefreshTokenRemovalPending: true, Error: "confirm"}}
+					}
+					return &adminapi.Response{Response: agentapi.Response{OK: true}}
+				default:
+					return &adminapi.Response{Response: agentapi.Response{Error: "unexpected command"}}
+				}
+			})
+			prompted := false
+			c := &Controller{
+				readPassphrase: func(string) ([]byte, error) {
+					prompted = true
+					return []byte("pw"), nil
+				},
+				confirm: func(string) (bool, error) { return tt.confirm, nil },
+				getEnv:  getEnv,
+			}
+			err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false, 0, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if prompted == tt.locked {
+				t.Fatalf("prompted for the passphrase = %v with locked = %v", prompted, tt.locked)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(sent) != tt.wantSent {
+				t.Fatalf("CONFIGURE requests = %d, want %d", len(sent), tt.wantSent)
+			}
+			if len(sent) == 0 {
+				return
+			}
+			if string(sent[0].Passphrase) != "pw" {
+				t.Fatal("CONFIGURE must carry the passphrase")
+			}
+			if last := sent[len(sent)-1]; last.ConfirmRefreshTokenRemoval != tt.wantConfirm {
+				t.Fatalf("the last CONFIGURE carries the confirmation: %v, want %v", last.ConfirmRefreshTokenRemoval, tt.wantConfirm)
+			}
+		})
+	}
+}
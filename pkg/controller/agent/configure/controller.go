@@ -0,0 +1,34 @@
+// Package configure implements the 'ghtkn agent configure' command: it changes the
+// refresh-token setting of a running, unlocked agent without locking it. Since it can
+// enable refresh, it prompts for the agent passphrase and sends it along for the agent
+// to verify. The agent server lives in pkg/agent/server.
+package configure
+
+import (
+	"os"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+// Controller backs the 'ghtkn agent configure' command. It is a client: it never
+// touches the token store, only the socket and the terminal.
+type Controller struct {
+	// readPassphrase reads a passphrase from the terminal. It is a field so tests can
+	// inject a stub instead of driving a real TTY.
+	readPassphrase func(prompt string) ([]byte, error)
+	// confirm asks the user a yes/no question on the terminal. It is a field so tests can
+	// inject a stub. It is used to confirm dropping stored refresh tokens.
+	confirm func(prompt string) (bool, error)
+	// getEnv reads an environment variable. It is a field so tests can inject the socket
+	// path without t.Setenv (which would forbid t.Parallel).
+	getEnv func(string) string
+}
+
+// New creates a new configure Controller using the real terminal helpers.
+func New() *Controller {
+	return &Controller{
+		readPassphrase: tty.ReadPassphrase,
+		confirm:        tty.Confirm,
+		getEnv:         os.Getenv,
+	}
+}
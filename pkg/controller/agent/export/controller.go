@@ -0,0 +1,30 @@
+// Package export implements the 'ghtkn agent export' command: it asks a running, unlocked
+// agent for a backup bundle of its stored tokens, refresh tokens included, encrypted
+// under a passphrase of the user's choosing, and writes it to a file for 'ghtkn agent
+// import' to restore on another machine. The agent server lives in pkg/agent/server.
+package export
+
+import (
+	"os"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+// Controller backs the 'ghtkn agent export' command. It is a client: the agent decrypts
+// the tokens and encrypts the bundle, so they never reach this process in plaintext.
+type Controller struct {
+	// readPassphrase reads a passphrase from the terminal. It is a field so tests can
+	// inject a stub instead of driving a real TTY.
+	readPassphrase func(prompt string) ([]byte, error)
+	// getEnv reads an environment variable. It is a field so tests can inject the socket
+	// path without t.Setenv (which would forbid t.Parallel).
+	getEnv func(string) string
+}
+
+// New creates a new export Controller using the real terminal helpers.
+func New() *Controller {
+	return &Controller{
+		readPassphrase: tty.ReadPassphrase,
+		getEnv:         os.Getenv,
+	}
+}
@@ -0,0 +1,114 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/crypt"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/harden"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+var (
+	errNotRunning            = errors.New("the ghtkn agent is not running; start and unlock it first")
+	errLocked                = errors.New("the ghtkn agent is locked; run `ghtkn agent unlock` first")
+	errEmptyBundlePassphrase = errors.New("the bundle passphrase must not be empty")
+)
+
+// Run asks the agent for a bundle of its stored tokens and writes it to out with mode
+// 0600. It prompts for the agent passphrase, which the agent verifies since the bundle
+// carries the refresh tokens, and twice for the bundle passphrase, which is the only way
+// to ever open the bundle.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, out string) error {
+	// Best-effort, before the passphrases are read, as in 'ghtkn agent unlock'.
+	harden.Process(logger)
+	path, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	// Check before asking for the passphrases, so they aren't typed for nothing.
+	status, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
+	if err != nil {
+		if agentapi.IsNotRunning(err) {
+			return errNotRunning
+		}
+		return err //nolint:wrapcheck
+	}
+	if !status.OK {
+		return fmt.Errorf("query the agent status: %s", status.Error)
+	}
+	if status.Locked {
+		return errLocked
+	}
+	var pass []byte
+	// An ephemeral agent takes no passphrase (see 'ghtkn agent start --ephemeral').
+	if !status.Ephemeral {
+		pass, err = tty.PromptPassphrase(c.readPassphrase, true)
+		if err != nil {
+			return err //nolint:wrapcheck
+		}
+	}
+	defer scrub(pass)
+	bundlePass, err := c.promptBundlePassphrase()
+	if err != nil {
+		return err
+	}
+	defer scrub(bundlePass)
+	resp, err := adminapi.Send(ctx, path, &adminapi.Request{
+		Request:          agentapi.Request{Command: adminapi.CommandExport, Passphrase: pass},
+		BundlePassphrase: bundlePass,
+	})
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	switch {
+	case resp.OK:
+	case resp.Error == agentapi.RespLocked:
+		return errLocked
+	case resp.Error == adminapi.RespUnknownCommand:
+		return fmt.Errorf("the agent failed to export (an agent from an older ghtkn does not support it; restart it with `ghtkn agent stop` then `ghtkn agent start`): %s", resp.Error)
+	default:
+		return fmt.Errorf("export the tokens: %s", resp.Error)
+	}
+	if err := crypt.AtomicWrite(out, resp.Bundle); err != nil {
+		return fmt.Errorf("write the bundle: %w", err)
+	}
+	logger.Info("exported the agent's tokens; import them with `ghtkn agent import`, and stop using this agent for them, since GitHub invalidates a refresh token once either agent uses it",
+		"count", resp.Count, "bundle", out)
+	return nil
+}
+
+// promptBundlePassphrase prompts twice for the bundle passphrase and checks the entries
+// match, as for a new agent passphrase.
+func (c *Controller) promptBundlePassphrase() ([]byte, error) {
+	pass, err := c.readPassphrase("Enter a passphrase for the bundle: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := c.readPassphrase("Confirm the bundle passphrase: ")
+	defer scrub(confirm)
+	if err != nil {
+		scrub(pass)
+		return nil, err
+	}
+	if string(pass) != string(confirm) {
+		scrub(pass)
+		return nil, tty.ErrPassphraseMismatch
+	}
+	if len(pass) == 0 {
+		return nil, errEmptyBundlePassphrase
+	}
+	return pass, nil
+}
+
+// scrub overwrites b with zeros, best-effort, so a passphrase does not linger.
+func scrub(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,137 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+// serveAgent starts a Unix-socket server that answers each request with handler, and
+// returns a getEnv stub that points GHTKN_AGENT_SOCKET at it.
+func serveAgent(t *testing.T, handler func(*adminapi.Request) *adminapi.Response) func(string) string {
+	t.Helper()
+	// A short dir keeps the socket path under the OS sun_path limit (t.TempDir embeds
+	// the long test name).
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(t.Context(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err != nil {
+					return
+				}
+				req := &adminapi.Request{}
+				if err := json.Unmarshal(line, req); err != nil {
+					return
+				}
+				b, err := json.Marshal(handler(req))
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(append(b, '\n'))
+			}()
+		}
+	}()
+	return func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	}
+}
+
+// TestController_Run verifies that export refuses a locked agent before asking for any
+// passphrase, sends both passphrases, and writes the bundle only the user can read.
+func TestController_Run(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		locked   bool
+		confirm  string
+		wantErr  error
+		wantFile bool
+	}{
+		{name: "exported", confirm: "bundle pw", wantFile: true},
+		{name: "mismatch", confirm: "other", wantErr: tty.ErrPassphraseMismatch},
+		{name: "locked", locked: true, wantErr: errLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var sent *adminapi.Request
+			getEnv := serveAgent(t, func(req *adminapi.Request) *adminapi.Response {
+				switch req.Command {
+				case agentapi.CommandStatus:
+					return &adminapi.Response{Response: agentapi.Response{OK: true, Locked: tt.locked, Initialized: true}}
+				case adminapi.CommandExport:
+					sent = req
+					return &adminapi.Response{Response: agentapi.Response{OK: true, Count: 1}, Bundle: []byte("bundle")}
+				default:
+					return &adminapi.Response{Response: agentapi.Response{Error: "unexpected command"}}
+				}
+			})
+			answers := map[string]string{
+				"Enter the agent passphrase: ":        "pw",
+				"Enter a passphrase for the bundle: ": "bundle pw",
+				"Confirm the bundle passphrase: ":     tt.confirm,
+			}
+			var prompts []string
+			c := &Controller{
+				readPassphrase: func(prompt string) ([]byte, error) {
+					prompts = append(prompts, prompt)
+					return []byte(answers[prompt]), nil
+				},
+				getEnv: getEnv,
+			}
+			out := filepath.Join(t.TempDir(), "bundle.ghtkn")
+			err := c.Run(t.Context(), slog.New(slog.DiscardHandler), out)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.locked && len(prompts) != 0 {
+				t.Fatalf("prompted for %v on a locked agent", prompts)
+			}
+			info, statErr := os.Stat(out)
+			if !tt.wantFile {
+				if statErr == nil {
+					t.Fatal("no bundle must be written")
+				}
+				return
+			}
+			if statErr != nil {
+				t.Fatal(statErr)
+			}
+			if perm := info.Mode().Perm(); perm != 0o600 {
+				t.Fatalf("bundle mode = %o, want 600", perm)
+			}
+			if string(sent.Passphrase) != "pw" || string(sent.BundlePassphrase) != "bundle pw" {
+				t.Fatalf("EXPORT must carry both passphrases: %q, %q", sent.Passphrase, sent.BundlePassphrase)
+			}
+		})
+	}
+}
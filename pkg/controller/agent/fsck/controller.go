@@ -0,0 +1,39 @@
+// Package fsck implements the 'ghtkn agent fsck' command: it inspects the agent's key
+// file and token directory on disk and reports what it finds, and with --repair
+// cleans up what it can. Like 'ghtkn agent reset' it works on the files directly (see
+// pkg/agent/keyfile and pkg/agent/tokenstore) rather than talking to the agent, so it
+// works when the agent is stopped or misbehaving.
+package fsck
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+// Controller backs the 'ghtkn agent fsck' command.
+type Controller struct {
+	// readPassphrase reads a passphrase from the terminal. It is a field so tests
+	// can inject a stub instead of driving a real TTY.
+	readPassphrase func(prompt string) ([]byte, error)
+	// getEnv reads an environment variable when resolving the key/token/socket paths. It
+	// is a field so tests can inject it without t.Setenv, which would forbid t.Parallel.
+	getEnv func(string) string
+	// now returns the current time, against which expirations are judged. It is a field
+	// so tests can pin it.
+	now    func() time.Time
+	stdout io.Writer
+}
+
+// New creates a new fsck Controller using the real terminal, environment, and clock,
+// writing the report to stdout.
+func New(stdout io.Writer) *Controller {
+	return &Controller{
+		readPassphrase: tty.ReadPassphrase,
+		getEnv:         os.Getenv,
+		now:            time.Now,
+		stdout:         stdout,
+	}
+}
@@ -0,0 +1,279 @@
+package fsck
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/harden"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+// goosWindows is the runtime.GOOS value for Windows, where file mode bits do not
+// control access, so permissions are not checked.
+const goosWindows = "windows"
+
+// The modes the agent creates its files and directories with (see crypt.AtomicWrite).
+// Anything granting the group or others access is a problem.
+const (
+	filePerm fs.FileMode = 0o600
+	dirPerm  fs.FileMode = 0o700
+)
+
+var (
+	errAgentRunning = errors.New("the ghtkn agent is running; stop it with `ghtkn agent stop` before repairing its files")
+	errProblems     = errors.New("found problems; run `ghtkn agent fsck --repair` to fix them")
+	errIncomplete   = errors.New("some problems could not be fixed")
+)
+
+// tokenReport describes a stored token without revealing it.
+type tokenReport struct {
+	ClientID     string
+	Decrypts     bool
+	AccessToken  string
+	RefreshToken string
+}
+
+// problem is something wrong with a file in the key or token directory, and what
+// --repair made of it.
+type problem struct {
+	// Name is the file's path relative to the token directory, or the key file's path.
+	Name string
+	// Problem says what is wrong.
+	Problem string
+	// Result is what --repair did: "" without --repair.
+	Result string
+	// fix repairs the problem.
+	fix func() error
+}
+
+// Run decrypts the key file with a prompted passphrase and reports every token in the
+// token directory: whether it decrypts and when its access and refresh tokens expire,
+// never the tokens themselves. It also reports leftover temporary files, orphaned
+// metadata, files with names the agent never writes, and files and directories others
+// can access. With repair it removes those files and tightens the permissions, which it
+// refuses to do while the agent is running since the agent may be writing them.
+//
+// It returns an error when it found problems it did not fix.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, repair bool) error {
+	// Best-effort, before the passphrase is read: the decrypted tokens pass through this
+	// process, as they do through the agent.
+	harden.Process(logger)
+
+	keyFile, err := keyfile.KeyPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	dir, err := tokenstore.TokenDir(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if repair {
+		if err := c.checkAgentStopped(ctx); err != nil {
+			return err
+		}
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("the key file %s does not exist; the agent has never been unlocked", keyFile)
+		}
+		return fmt.Errorf("check the key file: %w", err)
+	}
+	pass, err := tty.PromptPassphrase(c.readPassphrase, true)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	dataKey, err := keyfile.LoadDataKey(keyFile, pass)
+	scrub(pass)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	st := tokenstore.New(dataKey, dir)
+	defer st.Zero()
+
+	files, err := st.Files()
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	var tokens []*tokenReport
+	var problems []*problem
+	if p := c.permProblem(keyFile, keyFile, keyInfo.Mode()); p != nil {
+		problems = append(problems, p)
+	}
+	for _, f := range files {
+		switch f.Kind {
+		case tokenstore.FileToken:
+			tokens = append(tokens, c.inspectToken(st, f.Name))
+		case tokenstore.LeftoverTempFile, tokenstore.LeftoverMetadata, tokenstore.FileInvalidName:
+			problems = append(problems, &problem{Name: f.Name, Problem: f.Kind, fix: func() error {
+				return st.RemoveFile(f)
+			}})
+			continue
+		}
+		if p := c.permProblem(f.Name, filepath.Join(dir, f.Name), f.Mode); p != nil {
+			problems = append(problems, p)
+		}
+	}
+
+	failed := false
+	if repair {
+		failed = fix(problems)
+	}
+	if err := c.writeReport(dir, tokens, problems); err != nil {
+		return err
+	}
+	switch {
+	case failed:
+		return errIncomplete
+	case len(problems) > 0 && !repair:
+		return errProblems
+	}
+	return nil
+}
+
+// checkAgentStopped returns errAgentRunning when an agent answers on the socket.
+func (c *Controller) checkAgentStopped(ctx context.Context) error {
+	path, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if _, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}}); err != nil {
+		if agentapi.IsNotRunning(err) {
+			return nil
+		}
+		return err //nolint:wrapcheck
+	}
+	return errAgentRunning
+}
+
+// inspectToken decrypts the token stored for clientID and describes its expirations.
+func (c *Controller) inspectToken(st *tokenstore.Store, clientID string) *tokenReport {
+	report := &tokenReport{ClientID: clientID, AccessToken: "-", RefreshToken: "-"}
+	raw, ok, err := st.Get(clientID)
+	defer scrub(raw)
+	if err != nil || !ok {
+		return report
+	}
+	report.Decrypts = true
+	// Only the expirations and whether a refresh token is present are needed; the tokens
+	// are not materialized as Go strings.
+	token := &struct {
+		ExpirationDate             time.Time       `json:"expiration_date"`
+		RefreshToken               json.RawMessage `json:"refresh_token"`
+		RefreshTokenExpirationDate time.Time       `json:"refresh_token_expiration_date"`
+	}{}
+	if err := json.Unmarshal(raw, token); err != nil {
+		report.AccessToken = "unparsable"
+		return report
+	}
+	defer scrub(token.RefreshToken)
+	report.AccessToken = c.expiration(token.ExpirationDate)
+	report.RefreshToken = "none"
+	if rt := string(token.RefreshToken); rt != "" && rt != `""` && rt != "null" {
+		report.RefreshToken = c.expiration(token.RefreshTokenExpirationDate)
+	}
+	return report
+}
+
+// expiration describes an expiration date relative to now.
+func (c *Controller) expiration(t time.Time) string {
+	switch {
+	case t.IsZero():
+		return "no expiration"
+	case t.After(c.now()):
+		return "expires " + t.Local().Format(time.RFC3339)
+	default:
+		return "expired " + t.Local().Format(time.RFC3339)
+	}
+}
+
+// permProblem reports a file or directory at path that grants the group or others
+// access, or nil when it grants none. Symbolic links and Windows, where the mode bits
+// do not control access, are not checked.
+func (c *Controller) permProblem(name, path string, mode fs.FileMode) *problem {
+	if runtime.GOOS == goosWindows || mode&fs.ModeSymlink != 0 {
+		return nil
+	}
+	want := filePerm
+	if mode.IsDir() {
+		want = dirPerm
+	}
+	if mode.Perm()&0o077 == 0 {
+		return nil
+	}
+	return &problem{
+		Name:    name,
+		Problem: fmt.Sprintf("permissions %04o, want %04o", mode.Perm(), want),
+		fix: func() error {
+			if err := os.Chmod(path, want); err != nil {
+				return fmt.Errorf("change the permissions: %w", err)
+			}
+			return nil
+		},
+	}
+}
+
+// fix repairs each problem, recording the result on it. It reports whether any repair
+// failed.
+func fix(problems []*problem) bool {
+	failed := false
+	for _, p := range problems {
+		if err := p.fix(); err != nil {
+			p.Result = "failed: " + err.Error()
+			failed = true
+			continue
+		}
+		p.Result = "fixed"
+	}
+	return failed
+}
+
+// writeReport writes a table of the tokens and, when there are any, a table of the
+// problems.
+func (c *Controller) writeReport(dir string, tokens []*tokenReport, problems []*problem) error {
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0) //nolint:mnd // the column padding
+	fmt.Fprintf(w, "Token directory: %s\n\n", dir)
+	fmt.Fprintln(w, "CLIENT ID\tDECRYPTS\tACCESS TOKEN\tREFRESH TOKEN")
+	for _, t := range tokens {
+		decrypts := "yes"
+		if !t.Decrypts {
+			decrypts = "no"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", t.ClientID, decrypts, t.AccessToken, t.RefreshToken)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "FILE\tPROBLEM\tRESULT")
+		for _, p := range problems {
+			result := p.Result
+			if result == "" {
+				result = "found"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.Name, p.Problem, result)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write the report: %w", err)
+	}
+	return nil
+}
+
+// scrub zeroes b so a passphrase, key, or token does not linger in memory.
+func scrub(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
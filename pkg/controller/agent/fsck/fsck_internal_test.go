@@ -0,0 +1,179 @@
+package fsck
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+// fsckEnv isolates the agent's key/token/socket paths under temp dirs and points the
+// socket at an absent path, so no agent is running. It creates a key file with the
+// passphrase "pw", stores tokens under it, and returns a Controller reading them.
+func fsckEnv(t *testing.T, tokens map[string]string) (c *Controller, stdout *bytes.Buffer, keyFile, tokenDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyFile = filepath.Join(dir, "key")
+	tokenDir = filepath.Join(dir, "tokens")
+	socket := filepath.Join(dir, "absent.sock")
+	dataKey, err := keyfile.CreateDataKey(keyFile, []byte("pw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := tokenstore.New(dataKey, tokenDir)
+	for id, token := range tokens {
+		if err := st.Set(id, json.RawMessage(token)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stdout = &bytes.Buffer{}
+	c = New(stdout)
+	c.getEnv = func(k string) string {
+		switch k {
+		case "GHTKN_AGENT_KEY":
+			return keyFile
+		case "GHTKN_AGENT_TOKEN_DIR":
+			return tokenDir
+		case "GHTKN_AGENT_SOCKET":
+			return socket
+		default:
+			return ""
+		}
+	}
+	c.readPassphrase = func(string) ([]byte, error) { return []byte("pw"), nil }
+	c.now = func() time.Time { return time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC) }
+	return c, stdout, keyFile, tokenDir
+}
+
+// reportLines splits the report into lines with the column padding collapsed.
+func reportLines(s string) []string {
+	var lines []string
+	for line := range strings.SplitSeq(strings.TrimSpace(s), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	return lines
+}
+
+func TestController_Run_tokens(t *testing.T) {
+	t.Parallel()
+	past := time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)
+	future := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	c, stdout, _, tokenDir := fsckEnv(t, map[string]string{
+		"Iv1.fresh":   `{"access_token":"ghu_x","expiration_date":"2026-06-01T00:00:00Z","refresh_token":"ghr_x","refresh_token_expiration_date":"2026-06-01T00:00:00Z"}`,
+		"Iv1.expired": `{"access_token":"ghu_x","expiration_date":"2025-12-01T00:00:00Z","refresh_token":""}`,
+	})
+	// A token written under another key.
+	other := tokenstore.New(bytes.Repeat([]byte{1}, 32), tokenDir)
+	if err := other.Set("Iv1.other", json.RawMessage(`{"access_token":"ghu_x"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Token directory: " + tokenDir,
+		"",
+		"CLIENT ID DECRYPTS ACCESS TOKEN REFRESH TOKEN",
+		"Iv1.expired yes expired " + past.Local().Format(time.RFC3339) + " none",
+		"Iv1.fresh yes expires " + future.Local().Format(time.RFC3339) + " expires " + future.Local().Format(time.RFC3339),
+		"Iv1.other no - -",
+	}
+	if diff := cmp.Diff(want, reportLines(stdout.String())); diff != "" {
+		t.Fatalf("report mismatch (-want +got):\n%s", diff)
+	}
+	if strings.Contains(stdout.String(), "ghu_") || strings.Contains(stdout.String(), "ghr_") {
+		t.Fatalf("the report must not reveal tokens: %s", stdout.String())
+	}
+}
+
+func TestController_Run_repair(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == goosWindows {
+		t.Skip("permissions are not checked on Windows")
+	}
+	c, stdout, _, tokenDir := fsckEnv(t, map[string]string{
+		"Iv1.a": `{"access_token":"ghu_x"}`,
+	})
+	for name, perm := range map[string]os.FileMode{".ghtkn-tmp-1": 0o600, "bad name": 0o600} {
+		if err := os.WriteFile(filepath.Join(tokenDir, name), []byte("x"), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(tokenDir, "Iv1.a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false)
+	if !errors.Is(err, errProblems) {
+		t.Fatalf("Run() error = %v, want %v", err, errProblems)
+	}
+	want := []string{
+		"FILE PROBLEM RESULT",
+		".ghtkn-tmp-1 temporary file found",
+		"Iv1.a permissions 0644, want 0600 found",
+		"bad name invalid name found",
+	}
+	lines := reportLines(stdout.String())
+	if diff := cmp.Diff(want, lines[len(lines)-len(want):]); diff != "" {
+		t.Fatalf("report mismatch (-want +got):\n%s", diff)
+	}
+
+	stdout.Reset()
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), true); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stdout.String(), "fixed") {
+		t.Fatalf("the report must say the problems were fixed: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false); err != nil {
+		t.Fatalf("Run() after repair: %v\n%s", err, stdout.String())
+	}
+	info, err := os.Stat(filepath.Join(tokenDir, "Iv1.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("token file mode = %o, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestController_Run_incorrectPassphrase(t *testing.T) {
+	t.Parallel()
+	c, stdout, _, _ := fsckEnv(t, nil)
+	c.readPassphrase = func(string) ([]byte, error) { return []byte("wrong"), nil }
+	err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false)
+	if !errors.Is(err, keyfile.ErrIncorrectPassphrase) {
+		t.Fatalf("Run() error = %v, want %v", err, keyfile.ErrIncorrectPassphrase)
+	}
+	if stdout.Len() != 0 {
+		t.Fatalf("nothing must be reported without the key: %s", stdout.String())
+	}
+}
+
+func TestController_Run_noKeyFile(t *testing.T) {
+	t.Parallel()
+	c, _, keyFile, _ := fsckEnv(t, nil)
+	if err := os.Remove(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	c.readPassphrase = func(string) ([]byte, error) {
+		t.Fatal("the passphrase must not be asked for without a key file")
+		return nil, nil
+	}
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false); err == nil {
+		t.Fatal("Run() must fail without a key file")
+	}
+}
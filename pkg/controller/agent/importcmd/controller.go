@@ -0,0 +1,34 @@
+// Package importcmd implements the 'ghtkn agent import' command: it hands a bundle
+// written by 'ghtkn agent export' to a running, unlocked agent, which merges its tokens
+// into its token store, and reports what became of each token. The agent server lives in
+// pkg/agent/server.
+package importcmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+// Controller backs the 'ghtkn agent import' command. It is a client: the agent decrypts
+// the bundle, so its tokens never reach this process in plaintext.
+type Controller struct {
+	// readPassphrase reads a passphrase from the terminal. It is a field so tests can
+	// inject a stub instead of driving a real TTY.
+	readPassphrase func(prompt string) ([]byte, error)
+	// getEnv reads an environment variable. It is a field so tests can inject the socket
+	// path without t.Setenv (which would forbid t.Parallel).
+	getEnv func(string) string
+	stdout io.Writer
+}
+
+// New creates a new import Controller using the real terminal helpers and writing the
+// report to stdout.
+func New(stdout io.Writer) *Controller {
+	return &Controller{
+		readPassphrase: tty.ReadPassphrase,
+		getEnv:         os.Getenv,
+		stdout:         stdout,
+	}
+}
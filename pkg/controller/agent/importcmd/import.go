@@ -0,0 +1,116 @@
+package importcmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"text/tabwriter"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/harden"
+	"github.com/suzuki-shunsuke/slog-error/slogerr"
+)
+
+var (
+	errNotRunning = errors.New("the ghtkn agent is not running; start and unlock it first")
+	errLocked     = errors.New("the ghtkn agent is locked; run `ghtkn agent unlock` first")
+	errTooLarge   = errors.New("the file is too large to be a ghtkn agent bundle")
+	errIncomplete = errors.New("some tokens could not be imported")
+)
+
+// Run reads the bundle at path, prompts for its passphrase, and asks the agent to merge
+// its tokens. It writes a table of what became of each token to stdout, and returns an
+// error when the agent is not running, is locked, is too old to import, or failed to
+// store a token.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, path string) error {
+	// Best-effort, before the passphrase is read, as in 'ghtkn agent unlock'.
+	harden.Process(logger)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("read the bundle: %w", err)
+	}
+	if info.Size() > adminapi.MaxBundleSize {
+		return slogerr.With(errTooLarge, "bundle", path) //nolint:wrapcheck
+	}
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read the bundle: %w", err)
+	}
+	socket, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	// Check before asking for the passphrase, so it isn't typed for nothing.
+	status, err := adminapi.Send(ctx, socket, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
+	if err != nil {
+		if agentapi.IsNotRunning(err) {
+			return errNotRunning
+		}
+		return err //nolint:wrapcheck
+	}
+	if !status.OK {
+		return fmt.Errorf("query the agent status: %s", status.Error)
+	}
+	if status.Locked {
+		return errLocked
+	}
+	pass, err := c.readPassphrase("Enter the bundle passphrase: ")
+	if err != nil {
+		return err
+	}
+	// Best-effort scrubbing of the passphrase bytes.
+	defer func() {
+		for i := range pass {
+			pass[i] = 0
+		}
+	}()
+	resp, err := adminapi.Send(ctx, socket, &adminapi.Request{
+		Request:          agentapi.Request{Command: adminapi.CommandImport},
+		BundlePassphrase: pass,
+		Bundle:           bundle,
+	})
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	switch resp.Error {
+	case agentapi.RespLocked:
+		return errLocked
+	case adminapi.RespUnknownCommand:
+		return fmt.Errorf("the agent failed to import (an agent from an older ghtkn does not support it; restart it with `ghtkn agent stop` then `ghtkn agent start`): %s", resp.Error)
+	}
+	if len(resp.Imported) == 0 {
+		if !resp.OK {
+			return fmt.Errorf("import the bundle: %s", resp.Error)
+		}
+		logger.Info("the bundle holds no tokens")
+		return nil
+	}
+	if err := c.writeReport(resp.Imported); err != nil {
+		return err
+	}
+	if !resp.OK {
+		return errIncomplete
+	}
+	return nil
+}
+
+// writeReport writes a table of what became of each token of the bundle.
+func (c *Controller) writeReport(imported []*adminapi.ImportedToken) error {
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0) //nolint:mnd // the column padding
+	fmt.Fprintln(w, "CLIENT ID\tRESULT")
+	for _, t := range imported {
+		r := t.Result
+		if t.Error != "" {
+			r += ": " + t.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\n", t.ClientID, r)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write the report: %w", err)
+	}
+	return nil
+}
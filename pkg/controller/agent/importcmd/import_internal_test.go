@@ -0,0 +1,144 @@
+package importcmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// serveAgent starts a Unix-socket server that answers each request with handler, and
+// returns a getEnv stub that points GHTKN_AGENT_SOCKET at it.
+func serveAgent(t *testing.T, handler func(*adminapi.Request) *adminapi.Response) func(string) string {
+	t.Helper()
+	// A short dir keeps the socket path under the OS sun_path limit (t.TempDir embeds
+	// the long test name).
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(t.Context(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err != nil {
+					return
+				}
+				req := &adminapi.Request{}
+				if err := json.Unmarshal(line, req); err != nil {
+					return
+				}
+				b, err := json.Marshal(handler(req))
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(append(b, '\n'))
+			}()
+		}
+	}()
+	return func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	}
+}
+
+// TestController_Run verifies that import sends the bundle with its passphrase and
+// reports what the agent did with each token, failing when one could not be stored.
+func TestController_Run(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		resp       *adminapi.Response
+		wantErr    error
+		wantReport string
+	}{
+		{
+			name: "imported",
+			resp: &adminapi.Response{
+				Response: agentapi.Response{OK: true, Count: 1},
+				Imported: []*adminapi.ImportedToken{
+					{ClientID: "Iv1.a", Result: adminapi.ImportResultKept},
+					{ClientID: "Iv1.b", Result: adminapi.ImportResultImported},
+				},
+			},
+			wantReport: "CLIENT ID  RESULT\nIv1.a      kept\nIv1.b      imported\n",
+		},
+		{
+			name: "failed",
+			resp: &adminapi.Response{
+				Response: agentapi.Response{Error: "import the tokens"},
+				Imported: []*adminapi.ImportedToken{
+					{ClientID: "Iv1.a", Result: adminapi.ImportResultFailed, Error: "set the token"},
+				},
+			},
+			wantErr:    errIncomplete,
+			wantReport: "CLIENT ID  RESULT\nIv1.a      failed: set the token\n",
+		},
+		{
+			name:    "locked",
+			resp:    &adminapi.Response{Response: agentapi.Response{Error: agentapi.RespLocked}},
+			wantErr: errLocked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var sent *adminapi.Request
+			getEnv := serveAgent(t, func(req *adminapi.Request) *adminapi.Response {
+				switch req.Command {
+				case agentapi.CommandStatus:
+					return &adminapi.Response{Response: agentapi.Response{OK: true, Initialized: true}}
+				case adminapi.CommandImport:
+					sent = req
+					return tt.resp
+				default:
+					return &adminapi.Response{Response: agentapi.Response{Error: "unexpected command"}}
+				}
+			})
+			path := filepath.Join(t.TempDir(), "bundle.ghtkn")
+			if err := os.WriteFile(path, []byte("bundle"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			stdout := &bytes.Buffer{}
+			c := &Controller{
+				readPassphrase: func(string) ([]byte, error) { return []byte("bundle pw"), nil },
+				getEnv:         getEnv,
+				stdout:         stdout,
+			}
+			err := c.Run(t.Context(), slog.New(slog.DiscardHandler), path)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if string(sent.Bundle) != "bundle" || string(sent.BundlePassphrase) != "bundle pw" {
+				t.Fatalf("IMPORT must carry the bundle and its passphrase: %q, %q", sent.Bundle, sent.BundlePassphrase)
+			}
+			if diff := cmp.Diff(tt.wantReport, stdout.String()); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
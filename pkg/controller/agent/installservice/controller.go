@@ -0,0 +1,64 @@
+// Package installservice implements the 'ghtkn agent install-service' command: it
+// renders a service definition running the agent (a systemd user unit, a launchd agent,
+// or an OpenRC script) for this ghtkn binary and the agent paths this environment
+// resolves, installs it, and offers to enable it. The agent server lives in
+// pkg/agent/server.
+package installservice
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/server"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+)
+
+// Controller backs the 'ghtkn agent install-service' command. It never talks to the
+// agent; it only writes the service definition and runs the service manager.
+type Controller struct {
+	// getEnv reads an environment variable when resolving the agent paths. It is a field
+	// so tests can inject it without t.Setenv, which would forbid t.Parallel.
+	getEnv func(string) string
+	goos   string
+	// executable resolves the ghtkn binary the service runs.
+	executable func() (string, error)
+	// currentUser returns the user the service runs as.
+	currentUser func() (*user.User, error)
+	// stdout receives the service definition with --print.
+	stdout io.Writer
+	// confirm asks the user a yes/no question on the terminal. It is a field so tests can
+	// inject a stub. It is used to offer to enable the service.
+	confirm func(prompt string) (bool, error)
+	// run runs a service manager command. It is a field so tests can record the
+	// commands instead of running them.
+	run func(ctx context.Context, name string, args ...string) error
+}
+
+// New creates a new install-service Controller for this process, printing to stdout.
+func New(stdout io.Writer) *Controller {
+	return &Controller{
+		getEnv: os.Getenv,
+		goos:   runtime.GOOS,
+		executable: func() (string, error) {
+			return server.ExecutablePath(os.Args[0]) //nolint:wrapcheck
+		},
+		currentUser: user.Current,
+		stdout:      stdout,
+		confirm:     tty.Confirm,
+		run:         runCommand,
+	}
+}
+
+// runCommand runs a command with the terminal's standard streams, so the service
+// manager's output and prompts (e.g. for polkit) reach the user.
+func runCommand(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run() //nolint:wrapcheck
+}
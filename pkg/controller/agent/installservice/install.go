@@ -0,0 +1,288 @@
+package installservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/env"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/instance"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+)
+
+// The service managers a definition can be rendered for.
+const (
+	ManagerSystemdUser = "systemd-user"
+	ManagerLaunchd     = "launchd"
+	ManagerOpenRC      = "openrc"
+)
+
+// envXDGConfigHome is where the agent looks for the ghtkn config, which decides the
+// backend it warns about.
+const envXDGConfigHome = "XDG_CONFIG_HOME"
+
+// passedEnv are the variables a service definition carries over from this environment
+// when they are set: they change what the agent reads besides the paths Input pins.
+var passedEnv = []string{env.Config, envXDGConfigHome, env.Backend, env.LogLevel}
+
+// Input is the parameters of Run.
+type Input struct {
+	// Manager is the service manager to render the definition for. Empty means the one
+	// of this OS: launchd on macOS, systemd otherwise.
+	Manager string
+	// SocketActivation has systemd open the socket and start the agent on the first
+	// connection. It is only supported with systemd.
+	SocketActivation bool
+	// Print writes the definition to the standard output instead of installing it.
+	Print bool
+	// Enable enables and starts the service without asking.
+	Enable bool
+	// StartArgs are extra flags for 'ghtkn agent start'.
+	StartArgs []string
+}
+
+// Run renders the service definition and prints or installs it. After installing, it
+// enables the service when the user agrees (or Input.Enable is set), and otherwise tells
+// the commands that do.
+//
+// The definition pins the socket, key, and token directory this environment resolves
+// (GHTKN_AGENT_SOCKET, GHTKN_AGENT_KEY, and GHTKN_AGENT_TOKEN_DIR), since a service
+// manager runs the agent with an environment of its own, where the XDG variables of the
+// user's shell are usually not set. The agent then uses the same files as the clients
+// running in this environment.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, input *Input) error {
+	manager, err := c.manager(input)
+	if err != nil {
+		return err
+	}
+	svc, err := c.service(input)
+	if err != nil {
+		return err
+	}
+	files, err := c.render(manager, svc, input.SocketActivation)
+	if err != nil {
+		return err
+	}
+	if input.Print {
+		return c.print(files)
+	}
+	for _, f := range files {
+		if err := install(f); err != nil {
+			return err
+		}
+		logger.Info("installed the ghtkn agent service", "path", f.Path)
+	}
+
+	commands := enableCommands(manager, svc, files, input.SocketActivation)
+	enable := input.Enable
+	if !enable {
+		enable, err = c.confirm("Enable and start the ghtkn agent service now? (y/N): ")
+		if err != nil {
+			// Not on a terminal: leave enabling to the user.
+			enable = false
+		}
+	}
+	if !enable {
+		logger.Info("enable and start the service with: " + joinCommands(commands))
+		return nil
+	}
+	for _, cmd := range commands {
+		if err := c.run(ctx, cmd[0], cmd[1:]...); err != nil {
+			return fmt.Errorf("run %s: %w", strings.Join(cmd, " "), err)
+		}
+	}
+	logger.Info("the ghtkn agent service is enabled; the agent starts locked, so run 'ghtkn agent unlock'")
+	return nil
+}
+
+// manager resolves the service manager to render for.
+func (c *Controller) manager(input *Input) (string, error) {
+	if c.goos == "windows" {
+		return "", errors.New("install-service is not supported on Windows")
+	}
+	manager := input.Manager
+	if manager == "" {
+		manager = ManagerSystemdUser
+		if c.goos == "darwin" {
+			manager = ManagerLaunchd
+		}
+	}
+	if input.SocketActivation && manager != ManagerSystemdUser {
+		return "", fmt.Errorf("socket activation is only supported with systemd, not %s", manager)
+	}
+	return manager, nil
+}
+
+// service resolves what the definition runs.
+func (c *Controller) service(input *Input) (*service, error) {
+	executable, err := c.executable()
+	if err != nil {
+		return nil, err
+	}
+	socket, err := agentapi.SocketPath(c.getEnv, c.goos)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	key, err := keyfile.KeyPath(c.getEnv, c.goos)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	tokenDir, err := tokenstore.TokenDir(c.getEnv, c.goos)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	u, err := c.currentUser()
+	if err != nil {
+		return nil, fmt.Errorf("get the current user: %w", err)
+	}
+	svc := &service{
+		Executable: executable,
+		Args:       append([]string{"agent", "start"}, input.StartArgs...),
+		Env: []*envVar{
+			{Name: env.AgentSocket, Value: socket},
+			{Name: env.AgentKey, Value: key},
+			{Name: env.AgentTokenDir, Value: tokenDir},
+		},
+		SocketPath: socket,
+		User:       u.Username,
+		UID:        u.Uid,
+		// The instance's paths are pinned above already; the name only keeps the
+		// service apart from those of the other instances.
+		Instance: c.getEnv(instance.EnvInstance),
+	}
+	for _, name := range passedEnv {
+		if v := c.getEnv(name); v != "" {
+			svc.Env = append(svc.Env, &envVar{Name: name, Value: v})
+		}
+	}
+	return svc, nil
+}
+
+// render renders the definition for manager, and where it is installed.
+func (c *Controller) render(manager string, svc *service, socketActivation bool) ([]*file, error) {
+	home := c.getEnv(env.Home)
+	switch manager {
+	case ManagerSystemdUser:
+		configHome := c.getEnv(envXDGConfigHome)
+		if configHome == "" {
+			if home == "" {
+				return nil, errors.New("XDG_CONFIG_HOME or HOME is required to install a systemd user unit")
+			}
+			configHome = filepath.Join(home, ".config")
+		}
+		dir := filepath.Join(configHome, "systemd", "user")
+		files := []*file{{
+			Path:    filepath.Join(dir, svc.name(unitName)+".service"),
+			Content: renderSystemdService(svc, socketActivation),
+			Mode:    0o644,
+		}}
+		if socketActivation {
+			files = append(files, &file{
+				Path:    filepath.Join(dir, svc.name(unitName)+".socket"),
+				Content: renderSystemdSocket(svc),
+				Mode:    0o644,
+			})
+		}
+		return files, nil
+	case ManagerLaunchd:
+		if home == "" {
+			return nil, errors.New("HOME is required to install a launchd agent")
+		}
+		svc.LogPath = filepath.Join(home, "Library", "Logs", svc.name("ghtkn-agent")+".log")
+		return []*file{{
+			Path:    filepath.Join(home, "Library", "LaunchAgents", svc.name(launchdLabel)+".plist"),
+			Content: renderLaunchd(svc),
+			Mode:    0o644,
+		}}, nil
+	case ManagerOpenRC:
+		return []*file{{
+			Path:    filepath.Join("/etc", "init.d", svc.name(openrcService)),
+			Content: renderOpenRC(svc),
+			Mode:    0o755,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown service manager: %s", manager)
+	}
+}
+
+// enableCommands returns the commands that enable and start the installed service.
+func enableCommands(manager string, svc *service, files []*file, socketActivation bool) [][]string {
+	switch manager {
+	case ManagerSystemdUser:
+		unit := svc.name(unitName) + ".service"
+		if socketActivation {
+			unit = svc.name(unitName) + ".socket"
+		}
+		return [][]string{
+			{"systemctl", "--user", "daemon-reload"},
+			{"systemctl", "--user", "enable", "--now", unit},
+		}
+	case ManagerLaunchd:
+		return [][]string{
+			{"launchctl", "bootstrap", "gui/" + svc.UID, files[0].Path},
+		}
+	default:
+		return [][]string{
+			{"rc-update", "add", svc.name(openrcService), "default"},
+			{"rc-service", svc.name(openrcService), "start"},
+		}
+	}
+}
+
+// print writes the definition to the standard output. When it consists of more than one
+// file, each is preceded by a comment naming its path.
+func (c *Controller) print(files []*file) error {
+	for i, f := range files {
+		if len(files) > 1 {
+			if i > 0 {
+				if _, err := fmt.Fprintln(c.stdout); err != nil {
+					return fmt.Errorf("write the service definition: %w", err)
+				}
+			}
+			if _, err := fmt.Fprintf(c.stdout, "# %s\n", f.Path); err != nil {
+				return fmt.Errorf("write the service definition: %w", err)
+			}
+		}
+		if _, err := fmt.Fprint(c.stdout, f.Content); err != nil {
+			return fmt.Errorf("write the service definition: %w", err)
+		}
+	}
+	return nil
+}
+
+// install writes f, creating its directory.
+func install(f *file) error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil { //nolint:gosec // service directories are world-readable
+		return fmt.Errorf("create the service directory: %w", err)
+	}
+	if err := os.WriteFile(f.Path, []byte(f.Content), os.FileMode(f.Mode)); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("write %s: %w; write it as root, e.g. with --print | sudo tee %s", f.Path, err, f.Path)
+		}
+		return fmt.Errorf("write the service definition: %w", err)
+	}
+	// WriteFile keeps the mode of an existing file; an OpenRC script must be executable.
+	if err := os.Chmod(f.Path, os.FileMode(f.Mode)); err != nil {
+		return fmt.Errorf("set the permission of the service definition: %w", err)
+	}
+	return nil
+}
+
+// joinCommands renders commands as one shell command line.
+func joinCommands(commands [][]string) string {
+	lines := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		quoted := make([]string, 0, len(cmd))
+		for _, arg := range cmd {
+			quoted = append(quoted, shellQuote(arg))
+		}
+		lines = append(lines, strings.Join(quoted, " "))
+	}
+	return strings.Join(lines, " && ")
+}
@@ -0,0 +1,194 @@
+package installservice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/instance"
+)
+
+// newTestController returns a Controller for a Linux user alice whose XDG variables
+// point under home, recording the service manager commands it runs.
+func newTestController(home string, confirm bool, commands *[][]string) (*Controller, *bytes.Buffer) {
+	envs := map[string]string{
+		"HOME":            home,
+		"XDG_RUNTIME_DIR": "/run/user/1000",
+		"XDG_DATA_HOME":   "/home/alice/data",
+		"XDG_CACHE_HOME":  "/home/alice/cache",
+		"GHTKN_BACKEND":   "agent",
+	}
+	stdout := &bytes.Buffer{}
+	return &Controller{
+		getEnv:      func(k string) string { return envs[k] },
+		goos:        "linux",
+		executable:  func() (string, error) { return "/usr/local/bin/ghtkn", nil },
+		currentUser: func() (*user.User, error) { return &user.User{Username: "alice", Uid: "1000"}, nil },
+		stdout:      stdout,
+		confirm:     func(string) (bool, error) { return confirm, nil },
+		run: func(_ context.Context, name string, args ...string) error {
+			*commands = append(*commands, append([]string{name}, args...))
+			return nil
+		},
+	}, stdout
+}
+
+const wantService = `[Unit]
+Description=ghtkn agent
+
+[Service]
+Environment=GHTKN_AGENT_SOCKET=/run/user/1000/ghtkn/agent.sock
+Environment=GHTKN_AGENT_KEY=/home/alice/data/ghtkn/key
+Environment=GHTKN_AGENT_TOKEN_DIR=/home/alice/cache/ghtkn/agent
+Environment=GHTKN_BACKEND=agent
+ExecStart=/usr/local/bin/ghtkn agent start --max-session-age 30d
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`
+
+func TestController_Run_print(t *testing.T) {
+	t.Parallel()
+	var commands [][]string
+	c, stdout := newTestController("/home/alice", false, &commands)
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), &Input{
+		Print:     true,
+		StartArgs: []string{"--max-session-age", "30d"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantService, stdout.String()); diff != "" {
+		t.Fatalf("service definition (-want +got):\n%s", diff)
+	}
+	if commands != nil {
+		t.Fatalf("--print must not run the service manager: %v", commands)
+	}
+}
+
+func TestController_Run_install(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name             string
+		instance         string
+		socketActivation bool
+		enable           bool
+		confirm          bool
+		wantFiles        []string
+		wantCommands     [][]string
+	}{
+		{
+			name:      "declined",
+			wantFiles: []string{"ghtkn-agent.service"},
+		},
+		{
+			name:      "confirmed",
+			confirm:   true,
+			wantFiles: []string{"ghtkn-agent.service"},
+			wantCommands: [][]string{
+				{"systemctl", "--user", "daemon-reload"},
+				{"systemctl", "--user", "enable", "--now", "ghtkn-agent.service"},
+			},
+		},
+		{
+			name:             "socket activation, enabled without asking",
+			socketActivation: true,
+			enable:           true,
+			wantFiles:        []string{"ghtkn-agent.service", "ghtkn-agent.socket"},
+			wantCommands: [][]string{
+				{"systemctl", "--user", "daemon-reload"},
+				{"systemctl", "--user", "enable", "--now", "ghtkn-agent.socket"},
+			},
+		},
+		{
+			name:             "named instance",
+			instance:         "work",
+			socketActivation: true,
+			enable:           true,
+			wantFiles:        []string{"ghtkn-agent-work.service", "ghtkn-agent-work.socket"},
+			wantCommands: [][]string{
+				{"systemctl", "--user", "daemon-reload"},
+				{"systemctl", "--user", "enable", "--now", "ghtkn-agent-work.socket"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			home := t.TempDir()
+			var commands [][]string
+			c, _ := newTestController(home, tt.confirm, &commands)
+			getEnv := c.getEnv
+			c.getEnv = func(k string) string {
+				if k == instance.EnvInstance {
+					return tt.instance
+				}
+				return getEnv(k)
+			}
+			if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), &Input{
+				SocketActivation: tt.socketActivation,
+				Enable:           tt.enable,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(filepath.Join(home, ".config", "systemd", "user"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, e := range entries {
+				files = append(files, e.Name())
+			}
+			if diff := cmp.Diff(tt.wantFiles, files); diff != "" {
+				t.Fatalf("installed files (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tt.wantCommands, commands); diff != "" {
+				t.Fatalf("service manager commands (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestController_Run_unsupported(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		goos  string
+		input *Input
+	}{
+		{name: "windows", goos: "windows", input: &Input{Print: true}},
+		{name: "socket activation with launchd", goos: "darwin", input: &Input{Print: true, SocketActivation: true}},
+		{name: "socket activation with openrc", goos: "linux", input: &Input{Print: true, Manager: ManagerOpenRC, SocketActivation: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var commands [][]string
+			c, _ := newTestController("/home/alice", false, &commands)
+			c.goos = tt.goos
+			if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), tt.input); err == nil {
+				t.Fatal("want an error, got nil")
+			}
+		})
+	}
+}
+
+// TestController_Run_enableFails verifies that a failing service manager command is
+// reported.
+func TestController_Run_enableFails(t *testing.T) {
+	t.Parallel()
+	var commands [][]string
+	c, _ := newTestController(t.TempDir(), true, &commands)
+	c.run = func(context.Context, string, ...string) error { return errors.New("exit status 1") }
+	err := c.Run(t.Context(), slog.New(slog.DiscardHandler), &Input{})
+	if err == nil || !strings.Contains(err.Error(), "systemctl --user daemon-reload") {
+		t.Fatalf("want the failing command in the error, got %v", err)
+	}
+}
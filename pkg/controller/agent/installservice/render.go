@@ -0,0 +1,191 @@
+package installservice
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Names the service of the default agent instance is installed under. The service of a
+// named instance adds "-<instance>" to them, so that the instances can be installed side
+// by side.
+const (
+	unitName      = "ghtkn-agent"
+	launchdLabel  = "com.github.suzuki-shunsuke.ghtkn.agent"
+	openrcService = "ghtkn-agent"
+)
+
+// service is what a service definition runs: the agent command and its environment.
+type service struct {
+	// Executable is the absolute path of the ghtkn binary.
+	Executable string
+	// Args are the arguments after the binary: "agent start" and the extra flags given.
+	Args []string
+	// Env is the environment the agent runs with, in order.
+	Env []*envVar
+	// SocketPath is the agent socket, which a socket unit listens on.
+	SocketPath string
+	// User is the name of the user the agent runs as, for OpenRC, which starts services
+	// as root.
+	User string
+	// UID is the user's ID, which names the launchd domain the agent runs in.
+	UID string
+	// LogPath is the file launchd writes the agent's standard error to. It is set when
+	// rendering for launchd.
+	LogPath string
+	// Instance is the name of the agent instance, empty for the default one.
+	Instance string
+}
+
+// name returns the name of svc's service given the default instance's base.
+func (svc *service) name(base string) string {
+	if svc.Instance == "" {
+		return base
+	}
+	return base + "-" + svc.Instance
+}
+
+// envVar is an environment variable set in a service definition.
+type envVar struct {
+	Name  string
+	Value string
+}
+
+// file is a rendered service definition and where it is installed.
+type file struct {
+	Path    string
+	Content string
+	// Mode is the file's permission; an OpenRC script must be executable.
+	Mode uint32
+}
+
+// renderSystemdService renders the systemd user unit running the agent. With socket
+// activation the unit is started by its socket unit rather than enabled on its own.
+func renderSystemdService(svc *service, socketActivation bool) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\nDescription=ghtkn agent\n")
+	if socketActivation {
+		unit := svc.name(unitName)
+		fmt.Fprintf(&b, "Requires=%s.socket\nAfter=%s.socket\n", unit, unit)
+	}
+	b.WriteString("\n[Service]\n")
+	for _, e := range svc.Env {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(e.Name+"="+e.Value))
+	}
+	args := make([]string, 0, len(svc.Args)+1)
+	for _, arg := range append([]string{svc.Executable}, svc.Args...) {
+		args = append(args, systemdQuote(arg))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	// Not Restart=always: 'ghtkn agent stop' exits successfully and must stay stopped.
+	b.WriteString("Restart=on-failure\n")
+	if !socketActivation {
+		b.WriteString("\n[Install]\nWantedBy=default.target\n")
+	}
+	return b.String()
+}
+
+// renderSystemdSocket renders the systemd user socket unit that starts the agent on the
+// first connection.
+func renderSystemdSocket(svc *service) string {
+	return fmt.Sprintf(`[Unit]
+Description=ghtkn agent socket
+
+[Socket]
+ListenStream=%s
+SocketMode=0600
+DirectoryMode=0700
+
+[Install]
+WantedBy=sockets.target
+`, systemdEscapeSpecifiers(svc.SocketPath))
+}
+
+// plainArg matches an argument systemd and the shell take as is.
+var plainArg = regexp.MustCompile(`^[A-Za-z0-9_./:@+=,-]+$`)
+
+// systemdQuote quotes s for a systemd unit setting, in which % starts a specifier and $
+// a variable expansion.
+func systemdQuote(s string) string {
+	if plainArg.MatchString(s) {
+		return s
+	}
+	s = strings.ReplaceAll(systemdEscapeSpecifiers(s), "$", "$$")
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// systemdEscapeSpecifiers escapes the % of s, which systemd reads as a specifier.
+func systemdEscapeSpecifiers(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// renderLaunchd renders the launchd agent property list running the agent.
+func renderLaunchd(svc *service) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>%s</string>\n", xmlEscape(svc.name(launchdLabel)))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{svc.Executable}, svc.Args...) {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", xmlEscape(arg))
+	}
+	b.WriteString("\t</array>\n")
+	if len(svc.Env) > 0 {
+		b.WriteString("\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+		for _, e := range svc.Env {
+			fmt.Fprintf(&b, "\t\t<key>%s</key>\n\t\t<string>%s</string>\n", xmlEscape(e.Name), xmlEscape(e.Value))
+		}
+		b.WriteString("\t</dict>\n")
+	}
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	// Restart the agent when it fails, but not after 'ghtkn agent stop'.
+	b.WriteString("\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", xmlEscape(svc.LogPath))
+	b.WriteString("</dict>\n</plist>\n")
+	return b.String()
+}
+
+// xmlEscape escapes s for XML character data.
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// renderOpenRC renders the OpenRC script running the agent as svc.User under
+// supervise-daemon, which restarts it when it fails.
+func renderOpenRC(svc *service) string {
+	var b strings.Builder
+	b.WriteString("#!/sbin/openrc-run\n\n")
+	b.WriteString("description=\"ghtkn agent\"\n")
+	fmt.Fprintf(&b, "command=%s\n", shellQuote(svc.Executable))
+	args := make([]string, 0, len(svc.Args))
+	for _, arg := range svc.Args {
+		args = append(args, shellQuote(arg))
+	}
+	// command_args is expanded by the shell, so it holds the quoted arguments.
+	fmt.Fprintf(&b, "command_args=%s\n", shellQuote(strings.Join(args, " ")))
+	fmt.Fprintf(&b, "command_user=%s\n", shellQuote(svc.User))
+	b.WriteString("supervisor=supervise-daemon\n")
+	if len(svc.Env) > 0 {
+		b.WriteString("\n")
+		for _, e := range svc.Env {
+			fmt.Fprintf(&b, "export %s=%s\n", e.Name, shellQuote(e.Value))
+		}
+	}
+	b.WriteString("\ndepend() {\n\tneed localmount\n}\n")
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell, leaving a plain word as is.
+func shellQuote(s string) string {
+	if plainArg.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,117 @@
+package installservice
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderSystemdService_quoting(t *testing.T) {
+	t.Parallel()
+	got := renderSystemdService(&service{
+		Executable: "/opt/my tools/ghtkn",
+		Args:       []string{"agent", "start", "--revoked-token-hook", `/home/alice/bin/notify "100%" $USER`},
+		Env:        []*envVar{{Name: "GHTKN_CONFIG", Value: "/home/alice/my config.yaml"}},
+	}, false)
+	want := `[Unit]
+Description=ghtkn agent
+
+[Service]
+Environment="GHTKN_CONFIG=/home/alice/my config.yaml"
+ExecStart="/opt/my tools/ghtkn" agent start --revoked-token-hook "/home/alice/bin/notify \"100%%\" $$USER"
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unit (-want +got):\n%s", diff)
+	}
+}
+
+func TestRenderSystemdSocket(t *testing.T) {
+	t.Parallel()
+	want := `[Unit]
+Description=ghtkn agent socket
+
+[Socket]
+ListenStream=/run/user/1000/ghtkn/agent.sock
+SocketMode=0600
+DirectoryMode=0700
+
+[Install]
+WantedBy=sockets.target
+`
+	if diff := cmp.Diff(want, renderSystemdSocket(&service{SocketPath: "/run/user/1000/ghtkn/agent.sock"})); diff != "" {
+		t.Fatalf("socket unit (-want +got):\n%s", diff)
+	}
+}
+
+func TestRenderLaunchd(t *testing.T) {
+	t.Parallel()
+	got := renderLaunchd(&service{
+		Executable: "/opt/homebrew/bin/ghtkn",
+		Args:       []string{"agent", "start"},
+		Env:        []*envVar{{Name: "GHTKN_AGENT_SOCKET", Value: "/Users/alice/.ghtkn/a&b.sock"}},
+		LogPath:    "/Users/alice/Library/Logs/ghtkn-agent.log",
+	})
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>com.github.suzuki-shunsuke.ghtkn.agent</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>/opt/homebrew/bin/ghtkn</string>
+		<string>agent</string>
+		<string>start</string>
+	</array>
+	<key>EnvironmentVariables</key>
+	<dict>
+		<key>GHTKN_AGENT_SOCKET</key>
+		<string>/Users/alice/.ghtkn/a&amp;b.sock</string>
+	</dict>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardErrorPath</key>
+	<string>/Users/alice/Library/Logs/ghtkn-agent.log</string>
+</dict>
+</plist>
+`
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("plist (-want +got):\n%s", diff)
+	}
+}
+
+func TestRenderOpenRC(t *testing.T) {
+	t.Parallel()
+	got := renderOpenRC(&service{
+		Executable: "/usr/local/bin/ghtkn",
+		Args:       []string{"agent", "start", "--revoked-token-hook", "/home/alice/bin/notify me"},
+		Env:        []*envVar{{Name: "GHTKN_AGENT_SOCKET", Value: "/home/alice/.ghtkn/agent.sock"}},
+		User:       "alice",
+	})
+	want := `#!/sbin/openrc-run
+
+description="ghtkn agent"
+command=/usr/local/bin/ghtkn
+command_args='agent start --revoked-token-hook '\''/home/alice/bin/notify me'\'''
+command_user=alice
+supervisor=supervise-daemon
+
+export GHTKN_AGENT_SOCKET=/home/alice/.ghtkn/agent.sock
+
+depend() {
+	need localmount
+}
+`
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("script (-want +got):\n%s", diff)
+	}
+}
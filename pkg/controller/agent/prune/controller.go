@@ -0,0 +1,30 @@
+// Package prune implements the 'ghtkn agent prune' command: it asks a running, unlocked
+// agent to delete what no longer serves a purpose from its token directory (expired and
+// undecryptable tokens and leftover files) and reports what was deleted. The agent
+// server lives in pkg/agent/server.
+package prune
+
+import (
+	"io"
+	"os"
+)
+
+// Controller backs the 'ghtkn agent prune' command. It is a client: the agent judges and
+// deletes the files, since judging a token needs the data key only the agent holds.
+type Controller struct {
+	// getEnv reads an environment variable when resolving the socket path. It is a field
+	// so tests can inject it without t.Setenv, which would forbid t.Parallel.
+	getEnv func(string) string
+	stdout io.Writer
+}
+
+// New creates a new prune Controller that reads the real environment and writes the
+// report to stdout.
+func New(stdout io.Writer) *Controller {
+	return NewWithEnv(os.Getenv, stdout)
+}
+
+// NewWithEnv creates a prune Controller that resolves the socket path through getEnv.
+func NewWithEnv(getEnv func(string) string, stdout io.Writer) *Controller {
+	return &Controller{getEnv: getEnv, stdout: stdout}
+}
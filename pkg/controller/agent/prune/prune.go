@@ -0,0 +1,81 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"text/tabwriter"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+var (
+	errNotRunning = errors.New("the ghtkn agent is not running; start and unlock it first")
+	errLocked     = errors.New("the ghtkn agent is locked; run `ghtkn agent unlock` first")
+	errIncomplete = errors.New("some files could not be deleted")
+)
+
+// Run asks the agent to prune its token directory, or with dryRun only to report what it
+// would delete, and writes the report to stdout: one line per file with the reason, and
+// the error when deleting it failed. It returns an error when the agent is not running,
+// is locked, is too old to prune, or failed to delete a file.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, dryRun bool) error {
+	path, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	resp, err := adminapi.Send(ctx, path, &adminapi.Request{
+		Request: agentapi.Request{Command: adminapi.CommandPrune},
+		DryRun:  dryRun,
+	})
+	if err != nil {
+		if agentapi.IsNotRunning(err) {
+			return errNotRunning
+		}
+		return err //nolint:wrapcheck
+	}
+	switch resp.Error {
+	case agentapi.RespLocked:
+		return errLocked
+	case adminapi.RespUnknownCommand:
+		return fmt.Errorf("the agent failed to prune (an agent from an older ghtkn does not support it; restart it with `ghtkn agent stop` then `ghtkn agent start`): %s", resp.Error)
+	}
+	if len(resp.Pruned) == 0 && resp.OK {
+		logger.Info("nothing to prune")
+		return nil
+	}
+	if err := c.writeReport(resp.Pruned, dryRun); err != nil {
+		return err
+	}
+	if !resp.OK {
+		if len(resp.Pruned) == 0 {
+			return fmt.Errorf("the agent failed to prune: %s", resp.Error)
+		}
+		return errIncomplete
+	}
+	return nil
+}
+
+// writeReport writes a table of the pruned files.
+func (c *Controller) writeReport(pruned []*adminapi.PrunedFile, dryRun bool) error {
+	result := "deleted"
+	if dryRun {
+		result = "would delete"
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0) //nolint:mnd // the column padding
+	fmt.Fprintln(w, "FILE\tREASON\tRESULT")
+	for _, p := range pruned {
+		r := result
+		if p.Error != "" {
+			r = "failed: " + p.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p.Name, p.Reason, r)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write the report: %w", err)
+	}
+	return nil
+}
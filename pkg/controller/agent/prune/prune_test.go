@@ -0,0 +1,26 @@
+package prune_test
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/prune"
+)
+
+// TestPrune_notRunning verifies that pruning fails when no agent is running: only the
+// agent holds the key needed to judge the tokens.
+func TestPrune_notRunning(t *testing.T) {
+	t.Parallel()
+	socket := filepath.Join(t.TempDir(), "absent.sock")
+	c := prune.NewWithEnv(func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	}, &bytes.Buffer{})
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false); err == nil {
+		t.Fatal("Run with no agent running must fail")
+	}
+}
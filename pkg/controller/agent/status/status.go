@@ -6,12 +6,15 @@ import (
 	"log/slog"
 	"os"
 	"runtime"
+	"time"
 
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
 )
 
-// Run reports whether a ghtkn agent is running, whether it is locked, and how
-// many access tokens it currently caches when unlocked. A stopped agent is a normal
+// Run reports whether a ghtkn agent is running, whether it is locked or being unlocked,
+// and how many access tokens it currently caches when unlocked, listing each of them
+// with its expiration and last use. A stopped agent is a normal
 // result, not an error, so this method returns nil in that case.
 func (c *Controller) Run(ctx context.Context, logger *slog.Logger) error {
 	path, err := agentapi.SocketPath(os.Getenv, runtime.GOOS)
@@ -26,15 +29,58 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger) error {
 	switch {
 	case !running:
 		logger.Info("ghtkn agent is not running")
+	case resp.Unlocking:
+		// Locked until the UNLOCK in progress has derived the key.
+		logger.Info("ghtkn agent is running and unlocking", append(versionAttrs(&resp.Response), "socket", path)...)
 	case resp.Locked:
-		logger.Info("ghtkn agent is running but locked", append(versionAttrs(resp), "socket", path)...)
+		logger.Info("ghtkn agent is running but locked", append(versionAttrs(&resp.Response), "socket", path)...)
 	default:
 		logger.Info("ghtkn agent is running and unlocked",
-			append(versionAttrs(resp), "cached_tokens", resp.Count, "refresh_token_enabled", resp.RefreshTokenEnabled, "socket", path)...)
+			append(versionAttrs(&resp.Response), "cached_tokens", resp.Count, "refresh_token_enabled", resp.RefreshTokenEnabled, "socket", path)...)
+		listTokens(ctx, logger, path)
 	}
 	return nil
 }
 
+// listTokens logs each token the unlocked agent caches: its client ID, expiration, last
+// use, and whether it can be refreshed. The listing is supplementary, so a failure is
+// logged and does not fail the command, and an agent too old to list its tokens is
+// skipped quietly.
+func listTokens(ctx context.Context, logger *slog.Logger, path string) {
+	resp, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandTokens}})
+	if err != nil {
+		logger.Warn("list the cached tokens", "error", err)
+		return
+	}
+	if !resp.OK {
+		if resp.Error == adminapi.RespUnknownCommand {
+			logger.Debug("the agent is too old to list its cached tokens; restart it to list them")
+			return
+		}
+		logger.Warn("list the cached tokens", "error", resp.Error)
+		return
+	}
+	for _, token := range resp.Tokens {
+		logger.Info("cached token", tokenAttrs(token)...)
+	}
+}
+
+// tokenAttrs returns the log attributes describing a cached token. Times that are not
+// known are left out rather than logged as the zero time.
+func tokenAttrs(token *adminapi.TokenInfo) []any {
+	attrs := []any{"client_id", token.ClientID}
+	if token.Unreadable {
+		return append(attrs, "unreadable", true)
+	}
+	if !token.ExpiresAt.IsZero() {
+		attrs = append(attrs, "expires_at", token.ExpiresAt.Local().Format(time.RFC3339))
+	}
+	if !token.LastUsed.IsZero() {
+		attrs = append(attrs, "last_used", token.LastUsed.Local().Format(time.RFC3339))
+	}
+	return append(attrs, "refreshable", token.Refreshable)
+}
+
 // versionAttrs returns the log attributes describing which binary the running agent
 // runs: the ghtkn version it was built from and the agent protocol version it speaks.
 // The agent keeps running the binary it was started with, so this is how a user sees
@@ -56,13 +102,17 @@ func Query(ctx context.Context, getEnv func(string) string) (*agentapi.Response,
 	if err != nil {
 		return nil, false, err //nolint:wrapcheck
 	}
-	return queryStatus(ctx, path)
+	resp, running, err := queryStatus(ctx, path)
+	if resp == nil {
+		return nil, running, err
+	}
+	return &resp.Response, running, err
 }
 
 // queryStatus asks the agent at path for its status. The bool result is false (with
 // a nil error and a nil response) when no agent is listening.
-func queryStatus(ctx context.Context, path string) (*agentapi.Response, bool, error) {
-	resp, err := agentapi.Send(ctx, path, &agentapi.Request{Command: agentapi.CommandStatus})
+func queryStatus(ctx context.Context, path string) (*adminapi.Response, bool, error) {
+	resp, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
 	if err != nil {
 		if agentapi.IsNotRunning(err) {
 			return nil, false, nil
@@ -0,0 +1,16 @@
+//go:build unix
+
+package stop
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// processExists reports whether the process pid exists. A process owned by another user
+// exists too, though it can't be signaled.
+func processExists(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
@@ -5,22 +5,39 @@ import (
 	"fmt"
 	"log/slog"
 	"runtime"
+	"time"
 
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
 )
 
+// exitTimeout bounds how long Run waits for the agent process to exit after it answered
+// the STOP. By then it only has to finish writing its last responses and remove its
+// socket, so this is a generous backstop.
+const exitTimeout = 30 * time.Second
+
+// exitPollInterval is how often Run checks whether the agent process has exited.
+const exitPollInterval = 100 * time.Millisecond
+
 // Run connects to a running agent over its Unix domain socket and asks it to
 // shut down by sending a STOP command. Stopping an agent that is not running is a
 // normal result (like 'systemctl stop'), so it returns nil in that case. It returns
 // an error only when the agent is reachable but reports a failure, or on an
 // unexpected protocol error.
+//
+// The agent answers once it has let its device flows in progress complete, up to its
+// drain timeout; the flows it abandoned are reported as a warning, since those apps
+// must authenticate again. Run then waits until the agent process has exited, so a
+// command run after it (e.g. starting the agent again, or replacing its binary) doesn't
+// race with the stopping one. An agent from an older ghtkn doesn't report its process ID,
+// and Run returns once it has answered.
 func (c *Controller) Run(ctx context.Context, logger *slog.Logger) error {
 	path, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
 	if err != nil {
 		return err //nolint:wrapcheck
 	}
 
-	resp, err := agentapi.Send(ctx, path, &agentapi.Request{Command: agentapi.CommandStop})
+	resp, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStop}})
 	if err != nil {
 		if agentapi.IsNotRunning(err) {
 			logger.Info("ghtkn agent is not running")
@@ -32,6 +49,33 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger) error {
 		return fmt.Errorf("the agent failed to stop: %s", resp.Error)
 	}
 
+	if resp.PID > 0 {
+		if err := waitForExit(ctx, resp.PID, exitTimeout); err != nil {
+			return err
+		}
+	}
+
+	if len(resp.AbandonedDeviceFlows) > 0 {
+		logger.Warn("ghtkn agent stopped before these device flows completed; run the command again to authenticate",
+			"client_ids", resp.AbandonedDeviceFlows)
+		return nil
+	}
 	logger.Info("ghtkn agent stopped")
 	return nil
 }
+
+// waitForExit waits until the process pid has exited, up to timeout.
+func waitForExit(ctx context.Context, pid int, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(exitPollInterval)
+	defer ticker.Stop()
+	for processExists(pid) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the agent (pid %d) answered the stop request but has not exited within %s: %w", pid, timeout, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
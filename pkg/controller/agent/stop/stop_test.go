@@ -1,9 +1,17 @@
 package stop_test
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"log/slog"
+	"net"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/stop"
 )
@@ -23,3 +31,103 @@ func TestStop_notRunning(t *testing.T) {
 		t.Fatalf("Run with no agent running must return nil, got: %v", err)
 	}
 }
+
+// TestStop_abandonedDeviceFlows verifies that the device flows the agent abandoned while
+// stopping are reported.
+func TestStop_abandonedDeviceFlows(t *testing.T) {
+	t.Parallel()
+	// A short dir keeps the socket path under the OS sun_path limit (t.TempDir embeds
+	// the long test name).
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(t.Context(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadBytes('\n'); err != nil {
+			return
+		}
+		conn.Write([]byte(`{"ok":true,"abandoned_device_flows":["Iv1.slow"]}` + "\n")) //nolint:errcheck
+	}()
+
+	var buf bytes.Buffer
+	c := stop.NewWithEnv(func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	})
+	if err := c.Run(t.Context(), slog.New(slog.NewTextHandler(&buf, nil))); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "level=WARN") || !strings.Contains(got, "Iv1.slow") {
+		t.Fatalf("the abandoned device flow must be warned about, got:\n%s", got)
+	}
+}
+
+// TestStop_waitsForExit verifies that stop returns only once the process of the agent
+// that answered has exited.
+func TestStop_waitsForExit(t *testing.T) {
+	t.Parallel()
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep is not available")
+	}
+	// The stand-in for the agent process exits a moment after answering.
+	agent := exec.CommandContext(t.Context(), sleep, "0.5")
+	if err := agent.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Reap it as soon as it exits; a zombie would still count as running.
+	go agent.Wait() //nolint:errcheck
+
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(t.Context(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := bufio.NewReader(conn).ReadBytes('\n'); err != nil {
+			return
+		}
+		fmt.Fprintf(conn, `{"ok":true,"pid":%d}`+"\n", agent.Process.Pid)
+	}()
+
+	c := stop.NewWithEnv(func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	})
+	start := time.Now()
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("stop returned after %s, before the agent process exited", elapsed)
+	}
+}
@@ -2,12 +2,14 @@ package unlock
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"runtime"
 	"time"
 
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/harden"
 	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
 )
@@ -21,8 +23,10 @@ import (
 // unlock. The current refresh state is logged so the user can notice if it was enabled
 // without their intent (e.g. by an injected flag). refreshTokenTTL is how long a stored
 // token may sit unused before the agent discards it; it applies only when refresh is
-// enabled.
-func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefreshToken bool, refreshTokenTTL time.Duration) error {
+// enabled. appRefresh overrides both per app. An agent too old to apply appRefresh is
+// locked again rather than left unlocked with refresh enabled for an app the user
+// disabled it for.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefreshToken bool, refreshTokenTTL time.Duration, appRefresh []*adminapi.AppRefresh) error {
 	// Best-effort, before the passphrase is read: block same-user memory reads and core
 	// dumps of this process (Linux-only, no-op elsewhere). This command is usually
 	// short-lived, but it holds the passphrase while it waits at the refresh-token
@@ -35,7 +39,7 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefresh
 		return err //nolint:wrapcheck
 	}
 
-	status, err := agentapi.Send(ctx, path, &agentapi.Request{Command: agentapi.CommandStatus})
+	status, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
 	if err != nil {
 		return err //nolint:wrapcheck // Send returns a descriptive error (e.g. ErrAgentNotRunning)
 	}
@@ -44,6 +48,9 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefresh
 	}
 	if !status.Locked {
 		logger.Info("ghtkn agent is already unlocked", "refresh_token_enabled", status.RefreshTokenEnabled)
+		if len(appRefresh) > 0 {
+			logger.Warn("the per-app refresh settings are not applied, since the agent is already unlocked; change them with ghtkn agent configure")
+		}
 		return nil
 	}
 
@@ -51,13 +58,11 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefresh
 	// Ctrl-C) if the refresh setting is not what they meant. When refresh is off, the
 	// agent may additionally prompt to confirm dropping stored refresh tokens after the
 	// passphrase is entered (see doUnlock).
-	logRefreshIntent(logger, enableRefreshToken)
+	logRefreshIntent(logger, enableRefreshToken, appRefresh)
 
-	// status.Initialized reports whether a key file already exists. On first use
-	// (not initialized) PromptPassphrase asks twice and verifies the entries match.
-	pass, err := tty.PromptPassphrase(c.readPassphrase, status.Initialized)
+	pass, err := c.passphrase(status)
 	if err != nil {
-		return err //nolint:wrapcheck
+		return err
 	}
 	// Best-effort scrubbing of the passphrase bytes.
 	defer func() {
@@ -66,7 +71,15 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefresh
 		}
 	}()
 
-	resp, err := c.doUnlock(ctx, logger, path, pass, enableRefreshToken, refreshTokenTTL)
+	resp, err := c.doUnlock(ctx, logger, path, &adminapi.Request{
+		Request: agentapi.Request{
+			Command:            agentapi.CommandUnlock,
+			Passphrase:         pass,
+			EnableRefreshToken: enableRefreshToken,
+			RefreshTokenTTL:    refreshTokenTTL,
+		},
+		AppRefresh: appRefresh,
+	})
 	if err != nil {
 		return err
 	}
@@ -76,38 +89,72 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger, enableRefresh
 	if !resp.OK {
 		return fmt.Errorf("unlock the agent: %s", resp.Error)
 	}
+	if len(appRefresh) > 0 && !resp.AppRefreshApplied {
+		return relock(ctx, path)
+	}
 
 	logger.Info("ghtkn agent unlocked", "refresh_token_enabled", resp.RefreshTokenEnabled)
 	return nil
 }
 
+// passphrase prompts for the passphrase to unlock the agent status describes with.
+// status.Initialized reports whether a key file already exists. On first use (not
+// initialized) PromptPassphrase asks twice and verifies the entries match. An ephemeral
+// agent has no key file and takes no passphrase, so nothing is asked.
+func (c *Controller) passphrase(status *adminapi.Response) ([]byte, error) {
+	if status.Ephemeral {
+		return nil, nil
+	}
+	pass, err := tty.PromptPassphrase(c.readPassphrase, status.Initialized)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	return pass, nil
+}
+
+// relock locks the agent again after it unlocked without applying the per-app refresh
+// settings, which an agent from an older ghtkn ignores, and returns the error to report.
+func relock(ctx context.Context, path string) error {
+	resp, err := agentapi.Send(ctx, path, &agentapi.Request{Command: agentapi.CommandLock})
+	if err != nil {
+		return fmt.Errorf("the agent does not support per-app refresh settings, and locking it again failed; run 'ghtkn agent lock': %w", err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("the agent does not support per-app refresh settings, and locking it again failed; run 'ghtkn agent lock': %s", resp.Error)
+	}
+	return errors.New("the agent does not support per-app refresh settings, so it was locked again; restart it with this version of ghtkn")
+}
+
 // logRefreshIntent surfaces, before the passphrase is entered, whether this unlock will
 // enable or disable refresh tokens so the user can abort a mistaken setting.
-func logRefreshIntent(logger *slog.Logger, enableRefreshToken bool) {
+func logRefreshIntent(logger *slog.Logger, enableRefreshToken bool, appRefresh []*adminapi.AppRefresh) {
 	if enableRefreshToken {
 		logger.Info("refresh tokens will be enabled for this agent")
 	} else {
 		logger.Info("refresh tokens will be disabled for this agent")
 	}
+	for _, app := range appRefresh {
+		if app.Enable {
+			logger.Info("refresh tokens will be enabled for an app", "client_id", app.ClientID)
+		} else {
+			logger.Info("refresh tokens will be disabled for an app", "client_id", app.ClientID)
+		}
+	}
 }
 
 // doUnlock sends the unlock request and, when the agent reports RefreshTokenRemovalPending
 // (unlocking without --enable-refresh while a still-valid refresh token is stored), prompts
 // the user and re-sends with the confirmation set. It returns a nil response (and nil error)
-// when the user declines, so the caller aborts and the agent stays locked. pass is passed
-// directly (not as a string) so Run's deferred scrub zeroes the copy the request carries.
-func (c *Controller) doUnlock(ctx context.Context, logger *slog.Logger, path string, pass []byte, enableRefreshToken bool, refreshTokenTTL time.Duration) (*agentapi.Response, error) {
-	resp, err := agentapi.Send(ctx, path, &agentapi.Request{
-		Command:            agentapi.CommandUnlock,
-		Passphrase:         pass,
-		EnableRefreshToken: enableRefreshToken,
-		RefreshTokenTTL:    refreshTokenTTL,
-	})
+// when the user declines, so the caller aborts and the agent stays locked. The passphrase
+// is carried as bytes (not as a string) so Run's deferred scrub zeroes the copy the
+// request carries.
+func (c *Controller) doUnlock(ctx context.Context, logger *slog.Logger, path string, req *adminapi.Request) (*adminapi.Response, error) {
+	resp, err := adminapi.Send(ctx, path, req)
 	if err != nil {
 		return nil, err //nolint:wrapcheck
 	}
 	if resp.RefreshTokenRemovalPending {
-		return c.confirmRefreshRemoval(ctx, logger, path, pass, enableRefreshToken, refreshTokenTTL)
+		return c.confirmRefreshRemoval(ctx, logger, path, req)
 	}
 	return resp, nil
 }
@@ -115,9 +162,9 @@ func (c *Controller) doUnlock(ctx context.Context, logger *slog.Logger, path str
 // confirmRefreshRemoval prompts the user (default No) to confirm dropping the stored
 // refresh tokens and, on yes, re-sends the unlock with ConfirmRefreshTokenRemoval set,
 // returning the agent's response. On no it logs the abort and returns (nil, nil) so the
-// caller stops without unlocking; the agent stays locked. pass is reused as is: its scrub
-// runs only when Run returns.
-func (c *Controller) confirmRefreshRemoval(ctx context.Context, logger *slog.Logger, path string, pass []byte, enableRefreshToken bool, refreshTokenTTL time.Duration) (*agentapi.Response, error) {
+// caller stops without unlocking; the agent stays locked. The passphrase is reused as
+// is: its scrub runs only when Run returns.
+func (c *Controller) confirmRefreshRemoval(ctx context.Context, logger *slog.Logger, path string, req *adminapi.Request) (*adminapi.Response, error) {
 	ok, err := c.confirm("Stored refresh tokens will be dropped (access tokens are kept; affected apps re-authenticate on next expiry). Rerun with --enable-refresh to keep them. Continue? (y/N): ")
 	if err != nil {
 		return nil, fmt.Errorf("confirm dropping stored refresh tokens: %w", err)
@@ -126,13 +173,8 @@ func (c *Controller) confirmRefreshRemoval(ctx context.Context, logger *slog.Log
 		logger.Info("unlock aborted; rerun with --enable-refresh to keep the stored refresh tokens")
 		return nil, nil //nolint:nilnil // (nil, nil) signals a user-declined abort, distinct from an error.
 	}
-	resp, err := agentapi.Send(ctx, path, &agentapi.Request{
-		Command:                    agentapi.CommandUnlock,
-		Passphrase:                 pass,
-		EnableRefreshToken:         enableRefreshToken,
-		RefreshTokenTTL:            refreshTokenTTL,
-		ConfirmRefreshTokenRemoval: true,
-	})
+	req.ConfirmRefreshTokenRemoval = true
+	resp, err := adminapi.Send(ctx, path, req)
 	if err != nil {
 		return nil, err //nolint:wrapcheck
 	}
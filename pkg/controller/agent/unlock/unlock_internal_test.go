@@ -9,14 +9,25 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
 )
 
 // serveAgent starts a Unix-socket server that answers each request with handler, and
 // returns a getEnv stub that points GHTKN_AGENT_SOCKET at it. Injecting the socket path
 // through the Controller's getEnv (instead of t.Setenv) keeps the tests parallel-safe.
 func serveAgent(t *testing.T, handler func(*agentapi.Request) *agentapi.Response) func(string) string {
+	t.Helper()
+	return serveAdminAgent(t, func(req *adminapi.Request) *adminapi.Response {
+		return &adminapi.Response{Response: *handler(&req.Request)}
+	})
+}
+
+// serveAdminAgent is serveAgent for a handler that reads and answers the adminapi fields.
+func serveAdminAgent(t *testing.T, handler func(*adminapi.Request) *adminapi.Response) func(string) string {
 	t.Helper()
 	// A short dir keeps the socket path under the OS sun_path limit (t.TempDir embeds
 	// the long test name).
@@ -54,13 +65,13 @@ func serveAgent(t *testing.T, handler func(*agentapi.Request) *agentapi.Response
 
 // serveConn reads one newline-delimited request, answers it with handler, and writes the
 // response back.
-func serveConn(conn net.Conn, handler func(*agentapi.Request) *agentapi.Response) {
+func serveConn(conn net.Conn, handler func(*adminapi.Request) *adminapi.Response) {
 	defer conn.Close()
 	line, err := bufio.NewReader(conn).ReadBytes('\n')
 	if err != nil {
 		return
 	}
-	req := &agentapi.Request{}
+	req := &adminapi.Request{}
 	if err := json.Unmarshal(line, req); err != nil {
 		return
 	}
@@ -116,7 +127,7 @@ func TestController_Run_enableRefresh(t *testing.T) {
 		readPassphrase: func(string) ([]byte, error) { return []byte("pw"), nil },
 		getEnv:         getEnv,
 	}
-	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), true, 0); err != nil {
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), true, 0, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -144,7 +155,7 @@ func TestController_Run_confirmRefreshRemoval(t *testing.T) {
 		confirm:        func(string) (bool, error) { return true, nil },
 		getEnv:         getEnv,
 	}
-	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false, 0); err != nil {
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false, 0, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -174,7 +185,7 @@ func TestController_Run_declineRefreshRemoval(t *testing.T) {
 		confirm:        func(string) (bool, error) { return false, nil },
 		getEnv:         getEnv,
 	}
-	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false, 0); err != nil {
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false, 0, nil); err != nil {
 		t.Fatal(err)
 	}
 
@@ -184,3 +195,109 @@ func TestController_Run_declineRefreshRemoval(t *testing.T) {
 		t.Fatalf("expected only the initial UNLOCK after declining, got %d", len(unlocks))
 	}
 }
+
+// TestController_Run_appRefresh verifies that the per-app refresh settings reach the
+// wire, and that an agent that unlocks without applying them (one from an older ghtkn)
+// is locked again and the unlock fails.
+func TestController_Run_appRefresh(t *testing.T) {
+	t.Parallel()
+	appRefresh := []*adminapi.AppRefresh{
+		{ClientID: "Iv1.ro", Enable: true, TTL: 14 * 24 * time.Hour},
+		{ClientID: "Iv1.admin"},
+	}
+	tests := []struct {
+		name       string
+		applied    bool
+		wantErr    bool
+		wantLocked bool
+	}{
+		{name: "applied", applied: true},
+		{name: "older agent", wantErr: true, wantLocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var mu sync.Mutex
+			var unlockReq *adminapi.Request
+			locked := false
+			getEnv := serveAdminAgent(t, func(req *adminapi.Request) *adminapi.Response {
+				mu.Lock()
+				defer mu.Unlock()
+				switch req.Command {
+				case agentapi.CommandStatus:
+					return &adminapi.Response{Response: agentapi.Response{OK: true, Locked: true, Initialized: true}}
+				case agentapi.CommandUnlock:
+					unlockReq = req
+					return &adminapi.Response{Response: agentapi.Response{OK: true}, AppRefreshApplied: tt.applied}
+				case agentapi.CommandLock:
+					locked = true
+					return &adminapi.Response{Response: agentapi.Response{OK: true, Locked: true}}
+				default:
+					return &adminapi.Response{Response: agentapi.Response{Error: "unexpected command"}}
+				}
+			})
+
+			c := &Controller{
+				readPassphrase: func(string) ([]byte, error) { return []byte("pw"), nil },
+				getEnv:         getEnv,
+			}
+			err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false, 0, appRefresh)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if unlockReq == nil {
+				t.Fatal("no UNLOCK request was received")
+			}
+			if diff := cmp.Diff(appRefresh, unlockReq.AppRefresh); diff != "" {
+				t.Fatalf("per-app settings on the wire (-want +got):\n%s", diff)
+			}
+			if locked != tt.wantLocked {
+				t.Fatalf("locked again = %v, want %v", locked, tt.wantLocked)
+			}
+		})
+	}
+}
+
+// TestController_Run_ephemeral verifies that an ephemeral agent is unlocked without
+// asking for a passphrase.
+func TestController_Run_ephemeral(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var unlockReq *agentapi.Request
+	getEnv := serveAdminAgent(t, func(req *adminapi.Request) *adminapi.Response {
+		switch req.Command {
+		case agentapi.CommandStatus:
+			return &adminapi.Response{Response: agentapi.Response{OK: true, Locked: true}, Ephemeral: true}
+		case agentapi.CommandUnlock:
+			mu.Lock()
+			unlockReq = &req.Request
+			mu.Unlock()
+			return &adminapi.Response{Response: agentapi.Response{OK: true}}
+		default:
+			return &adminapi.Response{Response: agentapi.Response{Error: "unexpected command"}}
+		}
+	})
+
+	c := &Controller{
+		readPassphrase: func(string) ([]byte, error) {
+			t.Error("an ephemeral agent must not prompt for a passphrase")
+			return nil, nil
+		},
+		getEnv: getEnv,
+	}
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), false, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if unlockReq == nil {
+		t.Fatal("no UNLOCK request was received")
+	}
+	if len(unlockReq.Passphrase) != 0 {
+		t.Fatal("the UNLOCK request must carry no passphrase")
+	}
+}
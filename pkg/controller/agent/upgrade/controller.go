@@ -0,0 +1,28 @@
+// Package upgrade implements the 'ghtkn agent upgrade' command: it asks the running
+// agent to re-execute the upgraded ghtkn binary in place, keeping its socket and its
+// unlocked state, so the passphrase need not be entered again. The agent server lives
+// in pkg/agent/server.
+package upgrade
+
+import "os"
+
+// Controller backs the 'ghtkn agent upgrade' command. It is a client: it only talks to
+// the agent over the socket and never touches the token store.
+type Controller struct {
+	// getEnv reads an environment variable when resolving the socket path. It is a field
+	// so tests can inject it without t.Setenv, which would forbid t.Parallel.
+	getEnv func(string) string
+	// version is this ghtkn's version, which the upgraded agent is expected to report.
+	version string
+}
+
+// New creates a new upgrade Controller that reads the real environment. version is this
+// ghtkn's version.
+func New(version string) *Controller {
+	return NewWithEnv(os.Getenv, version)
+}
+
+// NewWithEnv creates an upgrade Controller that resolves the socket path through getEnv.
+func NewWithEnv(getEnv func(string) string, version string) *Controller {
+	return &Controller{getEnv: getEnv, version: version}
+}
@@ -0,0 +1,82 @@
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/server"
+)
+
+// upgradeTimeout bounds how long Run waits for the upgraded agent to answer. Starting
+// the new binary takes well under a second; this only keeps a failed upgrade from
+// hanging the command.
+const upgradeTimeout = 30 * time.Second
+
+var (
+	errNotRunning    = errors.New("the ghtkn agent is not running; start it with 'ghtkn agent start'")
+	errObsoleteAgent = errors.New("the running ghtkn agent predates 'ghtkn agent upgrade'; restart it this once: run 'ghtkn agent stop', then start and unlock it again")
+)
+
+// Run asks the running agent to re-execute the ghtkn binary it was started from, which
+// after an upgrade is the new one, and waits for the upgraded agent to answer. It
+// reports the versions before and after, and warns when the agent still runs a version
+// other than this ghtkn's, e.g. because the re-exec failed (the agent then keeps running
+// and logs why) or the agent was started from another binary.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger) error {
+	path, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	before, err := agentapi.Send(ctx, path, &agentapi.Request{Command: agentapi.CommandStatus})
+	if err != nil {
+		if agentapi.IsNotRunning(err) {
+			return errNotRunning
+		}
+		return err //nolint:wrapcheck
+	}
+
+	resp, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: adminapi.CommandUpgrade}})
+	if err != nil {
+		return err //nolint:wrapcheck
+	}
+	if !resp.OK {
+		if resp.Error == adminapi.RespUnknownCommand {
+			return errObsoleteAgent
+		}
+		return fmt.Errorf("upgrade the agent: %s", resp.Error)
+	}
+
+	// The agent stopped accepting before it answered, so this request waits in the
+	// socket's backlog and is answered by the upgraded process.
+	ctx, cancel := context.WithTimeout(ctx, upgradeTimeout)
+	defer cancel()
+	after, err := adminapi.Send(ctx, path, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandStatus}})
+	if err != nil {
+		return fmt.Errorf("the agent did not answer after the upgrade; check its log: %w", err)
+	}
+	if before.Locked != after.Locked {
+		logger.Warn("the upgraded agent's lock state changed; check the agent log", "locked_before", before.Locked, "locked", after.Locked)
+	}
+	if staleVersion(after.Version, c.version) {
+		logger.Warn("the agent still runs a different ghtkn version than this one; the upgrade may have failed, or the agent was started from another ghtkn binary. Check the agent log.",
+			"agent_version", after.Version, "ghtkn_version", c.version)
+		return nil
+	}
+	logger.Info("ghtkn agent upgraded", "previous_version", before.Version, "agent_version", after.Version, "locked", after.Locked)
+	return nil
+}
+
+// staleVersion reports whether the agent reports a version other than ghtknVersion. Like
+// the check of 'ghtkn info', it is disabled unless both versions are known.
+func staleVersion(agentVersion, ghtknVersion string) bool {
+	if agentVersion == "" || ghtknVersion == "" || agentVersion == server.UnknownVersion || ghtknVersion == server.UnknownVersion {
+		return false
+	}
+	return agentVersion != ghtknVersion
+}
@@ -0,0 +1,175 @@
+package upgrade
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// serveAgent starts a Unix-socket server that answers each request with handler, and
+// returns a getEnv stub that points GHTKN_AGENT_SOCKET at it.
+func serveAgent(t *testing.T, handler func(*adminapi.Request) *adminapi.Response) func(string) string {
+	t.Helper()
+	// A short dir keeps the socket path under the OS sun_path limit (t.TempDir embeds
+	// the long test name).
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(t.Context(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadBytes('\n')
+				if err != nil {
+					return
+				}
+				req := &adminapi.Request{}
+				if err := json.Unmarshal(line, req); err != nil {
+					return
+				}
+				b, err := json.Marshal(handler(req))
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(append(b, '\n'))
+			}()
+		}
+	}()
+	return func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	}
+}
+
+// TestController_Run verifies that upgrade asks the agent to re-exec and checks the
+// version the agent answers with afterwards.
+func TestController_Run(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		// upgrade is the response to UPGRADE.
+		upgrade *adminapi.Response
+		// upgradedVersion is the version the agent reports after the UPGRADE.
+		upgradedVersion string
+		wantErr         error
+		wantOtherErr    bool
+	}{
+		{
+			name:            "upgraded",
+			upgrade:         &adminapi.Response{Response: agentapi.Response{OK: true}, Upgrading: true},
+			upgradedVersion: "v2.0.0",
+		},
+		{
+			// The re-exec failed and the old agent kept running: a warning, not an error.
+			name:            "still the old version",
+			upgrade:         &adminapi.Response{Response: agentapi.Response{OK: true}, Upgrading: true},
+			upgradedVersion: "v1.0.0",
+		},
+		{
+			name:    "an agent without UPGRADE",
+			upgrade: &adminapi.Response{Response: agentapi.Response{Error: adminapi.RespUnknownCommand}},
+			wantErr: errObsoleteAgent,
+		},
+		{
+			name:         "refused",
+			upgrade:      &adminapi.Response{Response: agentapi.Response{Error: "a device flow is in progress"}},
+			wantOtherErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			version := "v1.0.0"
+			getEnv := serveAgent(t, func(req *adminapi.Request) *adminapi.Response {
+				switch req.Command {
+				case adminapi.CommandUpgrade:
+					if tt.upgrade.OK {
+						version = tt.upgradedVersion
+					}
+					return tt.upgrade
+				case agentapi.CommandStatus:
+					return &adminapi.Response{Response: agentapi.Response{OK: true, Version: version}}
+				}
+				return &adminapi.Response{Response: agentapi.Response{Error: adminapi.RespUnknownCommand}}
+			})
+			err := NewWithEnv(getEnv, "v2.0.0").Run(t.Context(), slog.New(slog.DiscardHandler))
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantOtherErr:
+				if err == nil {
+					t.Fatal("want an error, got nil")
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestController_Run_notRunning(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	getEnv := func(k string) string {
+		if k == "GHTKN_AGENT_SOCKET" {
+			return socket
+		}
+		return ""
+	}
+	if err := NewWithEnv(getEnv, "v2.0.0").Run(t.Context(), slog.New(slog.DiscardHandler)); !errors.Is(err, errNotRunning) {
+		t.Fatalf("error = %v, want %v", err, errNotRunning)
+	}
+}
+
+func TestStaleVersion(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name  string
+		agent string
+		ghtkn string
+		want  bool
+	}{
+		{name: "same", agent: "v2.0.0", ghtkn: "v2.0.0"},
+		{name: "different", agent: "v1.0.0", ghtkn: "v2.0.0", want: true},
+		{name: "agent version unknown", agent: "", ghtkn: "v2.0.0"},
+		{name: "ghtkn version unknown", agent: "v1.0.0", ghtkn: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := staleVersion(tt.agent, tt.ghtkn); got != tt.want {
+				t.Fatalf("staleVersion(%q, %q) = %v, want %v", tt.agent, tt.ghtkn, got, tt.want)
+			}
+		})
+	}
+}
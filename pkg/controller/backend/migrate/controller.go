@@ -0,0 +1,36 @@
+// Package migrate implements the 'ghtkn backend migrate' command: it copies the cached
+// token of every app in the config from one backend to another, verifies each copy, and
+// optionally deletes the source, so switching backends does not force every app to
+// authenticate again.
+package migrate
+
+import (
+	"io"
+	"os"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tty"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/backend"
+)
+
+// Controller backs the 'ghtkn backend migrate' command.
+type Controller struct {
+	// open opens a backend's token cache. It is a field so tests can inject in-memory
+	// stores instead of the OS keyring, files, and an agent.
+	open func(name string, input *backend.Input) (backend.Store, error)
+	// readPassphrase reads a passphrase from the terminal. It is a field so tests can
+	// inject a stub instead of driving a real TTY.
+	readPassphrase func(prompt string) ([]byte, error)
+	getEnv         func(string) string
+	stdout         io.Writer
+}
+
+// New creates a new migrate Controller that opens the real backends and writes the
+// report to stdout.
+func New(stdout io.Writer) *Controller {
+	return &Controller{
+		open:           backend.Open,
+		readPassphrase: tty.ReadPassphrase,
+		getEnv:         os.Getenv,
+		stdout:         stdout,
+	}
+}
@@ -0,0 +1,176 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/backend"
+)
+
+var (
+	errSameBackend = errors.New("--from and --to must be different backends")
+	errNoApps      = errors.New("the config has no apps")
+	errIncomplete  = errors.New("some tokens could not be migrated")
+)
+
+// Results of migrating the token of an app.
+const (
+	resultMigrated = "migrated"
+	// resultKept means the destination already caches a token that has not expired,
+	// which is kept rather than replaced.
+	resultKept    = "kept"
+	resultNoToken = "no token"
+	// resultExpired means the source token has expired, so copying it would only make
+	// the destination run the device flow anyway.
+	resultExpired = "expired"
+	resultFailed  = "failed"
+)
+
+// InputRun holds the values needed to run the migration.
+type InputRun struct {
+	// Apps are the apps of the config, whose tokens are migrated.
+	Apps []*ghtkn.AppConfig
+	From string
+	To   string
+	// DeleteSource deletes each migrated token from the source once its copy is verified.
+	DeleteSource bool
+}
+
+// result is what became of the token of one app.
+type result struct {
+	app    *ghtkn.AppConfig
+	result string
+	err    error
+}
+
+// Run copies the token of every app from input.From to input.To, verifies each copy by
+// reading it back, and with input.DeleteSource deletes the source token once the copy
+// is verified. It writes a table of the results to stdout, and fails when any token
+// could not be migrated; the other apps are migrated regardless.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, input *InputRun) error {
+	if input.From == input.To {
+		return errSameBackend
+	}
+	if len(input.Apps) == 0 {
+		return errNoApps
+	}
+	var pass []byte
+	// Best-effort scrubbing of the agent passphrase, if it was read.
+	defer func() {
+		for i := range pass {
+			pass[i] = 0
+		}
+	}()
+	bInput := &backend.Input{
+		GetEnv: c.getEnv,
+		GOOS:   runtime.GOOS,
+		ReadPassphrase: func() ([]byte, error) {
+			p, err := c.readPassphrase("Enter the agent passphrase: ")
+			pass = p
+			return p, err
+		},
+	}
+	src, err := c.open(input.From, bInput)
+	if err != nil {
+		return fmt.Errorf("open the source backend: %w", err)
+	}
+	dst, err := c.open(input.To, bInput)
+	if err != nil {
+		return fmt.Errorf("open the destination backend: %w", err)
+	}
+	now := time.Now()
+	results := make([]*result, 0, len(input.Apps))
+	failed := false
+	for _, app := range input.Apps {
+		r := migrate(ctx, src, dst, app, now, input.DeleteSource)
+		if r.err != nil {
+			failed = true
+		}
+		results = append(results, r)
+	}
+	if err := c.writeReport(results); err != nil {
+		return err
+	}
+	if failed {
+		return errIncomplete
+	}
+	logger.Info("migrated the cached tokens", "from", input.From, "to", input.To)
+	return nil
+}
+
+// migrate migrates the token of app.
+func migrate(ctx context.Context, src, dst backend.Store, app *ghtkn.AppConfig, now time.Time, deleteSource bool) *result {
+	r := &result{app: app, result: resultFailed}
+	token, err := src.Get(ctx, app.ClientID)
+	if err != nil {
+		r.err = fmt.Errorf("read the source: %w", err)
+		return r
+	}
+	switch {
+	case token == nil:
+		r.result = resultNoToken
+		return r
+	case expired(token, now):
+		r.result = resultExpired
+		return r
+	}
+	existing, err := dst.Get(ctx, app.ClientID)
+	if err != nil {
+		r.err = fmt.Errorf("read the destination: %w", err)
+		return r
+	}
+	if existing != nil && !expired(existing, now) {
+		r.result = resultKept
+		return r
+	}
+	if err := dst.Set(ctx, app.ClientID, token); err != nil {
+		r.err = fmt.Errorf("write the destination: %w", err)
+		return r
+	}
+	copied, err := dst.Get(ctx, app.ClientID)
+	if err != nil {
+		r.err = fmt.Errorf("verify the copy: %w", err)
+		return r
+	}
+	if copied == nil || copied.AccessToken != token.AccessToken || !copied.ExpirationDate.Equal(token.ExpirationDate) {
+		r.err = errors.New("verify the copy: the destination does not return the copied token")
+		return r
+	}
+	if deleteSource {
+		if err := src.Delete(ctx, app.ClientID); err != nil {
+			r.err = fmt.Errorf("delete the source: %w", err)
+			return r
+		}
+	}
+	r.result = resultMigrated
+	return r
+}
+
+// expired reports whether token has expired at now. A token without an expiration is
+// treated as valid.
+func expired(token *ghtkn.AccessToken, now time.Time) bool {
+	return !token.ExpirationDate.IsZero() && !token.ExpirationDate.After(now)
+}
+
+// writeReport writes a table of what became of the token of each app.
+func (c *Controller) writeReport(results []*result) error {
+	w := tabwriter.NewWriter(c.stdout, 0, 0, 2, ' ', 0) //nolint:mnd // the column padding
+	fmt.Fprintln(w, "APP\tCLIENT ID\tRESULT")
+	for _, r := range results {
+		res := r.result
+		if r.err != nil {
+			res += ": " + r.err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.app.Name, r.app.ClientID, res)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("write the report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/server"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/backend"
+)
+
+// memStore is a backend.Store in memory. setErr makes Set fail.
+type memStore struct {
+	tokens map[string]*ghtkn.AccessToken
+	setErr error
+}
+
+func (m *memStore) Get(_ context.Context, clientID string) (*ghtkn.AccessToken, error) {
+	return m.tokens[clientID], nil
+}
+
+func (m *memStore) Set(_ context.Context, clientID string, token *ghtkn.AccessToken) error {
+	if m.setErr != nil {
+		return m.setErr
+	}
+	m.tokens[clientID] = token
+	return nil
+}
+
+func (m *memStore) Delete(_ context.Context, clientID string) error {
+	delete(m.tokens, clientID)
+	return nil
+}
+
+// TestController_Run verifies that each app's token is copied unless the destination
+// already has a valid one or the source has none worth copying, that the source is only
+// deleted when asked, and that a failed copy fails the run without stopping the others.
+func TestController_Run(t *testing.T) {
+	t.Parallel()
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	past := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	apps := []*ghtkn.AppConfig{
+		{Name: "a", ClientID: "Iv1.a"},
+		{Name: "b", ClientID: "Iv1.b"},
+		{Name: "c", ClientID: "Iv1.c"},
+		{Name: "d", ClientID: "Iv1.d"},
+	}
+	newSrc := func() *memStore {
+		return &memStore{tokens: map[string]*ghtkn.AccessToken{
+			"Iv1.a": {AccessToken: "ghu_a", ExpirationDate: future},
+			"Iv1.b": {AccessToken: "ghu_b", ExpirationDate: future},
+			"Iv1.c": {AccessToken: "ghu_c", ExpirationDate: past},
+		}}
+	}
+	newDst := func() *memStore {
+		return &memStore{tokens: map[string]*ghtkn.AccessToken{
+			"Iv1.b": {AccessToken: "ghu_b_dst", ExpirationDate: future},
+		}}
+	}
+	tests := []struct {
+		name         string
+		deleteSource bool
+		setErr       error
+		wantErr      error
+		wantReport   string
+		wantSrc      []string
+	}{
+		{
+			name:       "copied",
+			wantReport: "APP  CLIENT ID  RESULT\na    Iv1.a      migrated\nb    Iv1.b      kept\nc    Iv1.c      expired\nd    Iv1.d      no token\n",
+			wantSrc:    []string{"Iv1.a", "Iv1.b", "Iv1.c"},
+		},
+		{
+			name:         "source deleted",
+			deleteSource: true,
+			wantReport:   "APP  CLIENT ID  RESULT\na    Iv1.a      migrated\nb    Iv1.b      kept\nc    Iv1.c      expired\nd    Iv1.d      no token\n",
+			wantSrc:      []string{"Iv1.b", "Iv1.c"},
+		},
+		{
+			name:         "write failed",
+			deleteSource: true,
+			setErr:       errors.New("denied"),
+			wantErr:      errIncomplete,
+			wantReport:   "APP  CLIENT ID  RESULT\na    Iv1.a      failed: write the destination: denied\nb    Iv1.b      kept\nc    Iv1.c      expired\nd    Iv1.d      no token\n",
+			wantSrc:      []string{"Iv1.a", "Iv1.b", "Iv1.c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			src, dst := newSrc(), newDst()
+			dst.setErr = tt.setErr
+			stdout := &bytes.Buffer{}
+			c := &Controller{
+				open: func(name string, _ *backend.Input) (backend.Store, error) {
+					if name == backend.Keyring {
+						return src, nil
+					}
+					return dst, nil
+				},
+				getEnv: func(string) string { return "" },
+				stdout: stdout,
+			}
+			err := c.Run(t.Context(), slog.New(slog.DiscardHandler), &InputRun{
+				Apps:         apps,
+				From:         backend.Keyring,
+				To:           backend.Agent,
+				DeleteSource: tt.deleteSource,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.wantReport, stdout.String()); diff != "" {
+				t.Fatal(diff)
+			}
+			var gotSrc []string
+			for _, app := range apps {
+				if _, ok := src.tokens[app.ClientID]; ok {
+					gotSrc = append(gotSrc, app.ClientID)
+				}
+			}
+			if diff := cmp.Diff(tt.wantSrc, gotSrc); diff != "" {
+				t.Fatalf("tokens left in the source (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestController_Run_sameBackend(t *testing.T) {
+	t.Parallel()
+	c := New(&bytes.Buffer{})
+	err := c.Run(t.Context(), slog.New(slog.DiscardHandler), &InputRun{
+		Apps: []*ghtkn.AppConfig{{Name: "a", ClientID: "Iv1.a"}},
+		From: backend.Text,
+		To:   backend.Text,
+	})
+	if !errors.Is(err, errSameBackend) {
+		t.Fatalf("Run() error = %v, want %v", err, errSameBackend)
+	}
+}
+
+// startAgent runs an unlocked ephemeral agent on a socket under a temp dir, which
+// GHTKN_AGENT_SOCKET points at, until the test ends.
+func startAgent(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "a.sock")
+	t.Setenv("GHTKN_AGENT_SOCKET", socket)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = server.NewWithOptions("", &server.Options{Ephemeral: true}).Start(ctx, slog.New(slog.DiscardHandler))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	for {
+		resp, err := adminapi.Send(t.Context(), socket, &adminapi.Request{Request: agentapi.Request{Command: agentapi.CommandUnlock}})
+		if err == nil {
+			if !resp.OK {
+				t.Fatalf("unlock the agent: %s", resp.Error)
+			}
+			return socket
+		}
+		if !agentapi.IsNotRunning(err) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestController_Run_agentExpired verifies that migrating into an agent replaces a
+// token the agent holds but can no longer serve: GET reports its expired token as not
+// found, so the migration must be able to store the copy.
+func TestController_Run_agentExpired(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the agent socket is a Unix domain socket")
+	}
+	socket := startAgent(t)
+	past := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	expired, err := json.Marshal(&ghtkn.AccessToken{AccessToken: "ghu_expired", ExpirationDate: past})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := adminapi.Send(t.Context(), socket, &adminapi.Request{
+		Request: agentapi.Request{Command: adminapi.CommandImport},
+		Tokens:  []*adminapi.ImportToken{{ClientID: "Iv1.a", Token: expired}},
+	})
+	if err != nil || !resp.OK {
+		t.Fatalf("store an expired token in the agent: resp=%+v err=%v", resp, err)
+	}
+
+	src := &memStore{tokens: map[string]*ghtkn.AccessToken{"Iv1.a": {AccessToken: "ghu_fresh", ExpirationDate: future}}}
+	stdout := &bytes.Buffer{}
+	c := &Controller{
+		open: func(name string, input *backend.Input) (backend.Store, error) {
+			if name == backend.Keyring {
+				return src, nil
+			}
+			return backend.Open(name, input)
+		},
+		getEnv: os.Getenv,
+		stdout: stdout,
+	}
+	if err := c.Run(t.Context(), slog.New(slog.DiscardHandler), &InputRun{
+		Apps: []*ghtkn.AppConfig{{Name: "a", ClientID: "Iv1.a"}},
+		From: backend.Keyring,
+		To:   backend.Agent,
+	}); err != nil {
+		t.Fatalf("Run() error = %v\n%s", err, stdout.String())
+	}
+	if diff := cmp.Diff("APP  CLIENT ID  RESULT\na    Iv1.a      migrated\n", stdout.String()); diff != "" {
+		t.Fatal(diff)
+	}
+}
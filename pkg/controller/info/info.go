@@ -8,6 +8,7 @@ import (
 	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
 	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/config"
 	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/env"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/instance"
 )
 
 // redacted replaces the value of credential-bearing environment variables in the output.
@@ -140,6 +141,11 @@ func (c *Controller) collectEnvs() map[string]string {
 		}
 		envs[name] = value
 	}
+	// The agent instance is a CLI concept the SDK knows nothing of, so it is not in
+	// env.All; the paths it resolves to are, as GHTKN_AGENT_SOCKET and the like.
+	if v := c.getEnv(instance.EnvInstance); v != "" {
+		envs[instance.EnvInstance] = v
+	}
 	for _, name := range []string{"GH_TOKEN", "GITHUB_TOKEN"} {
 		if c.getEnv(name) != "" {
 			envs[name] = redacted
@@ -125,6 +125,25 @@ func TestController_Info(t *testing.T) { //nolint:funlen
 				ConfigPath: configPath,
 			},
 		},
+		{
+			name: "agent instance",
+			env: map[string]string{
+				"GHTKN_AGENT_INSTANCE": "work",
+				"GHTKN_AGENT_SOCKET":   "/run/user/1000/ghtkn/agent-work.sock",
+			},
+			version: "v1.0.0",
+			want: &info.Output{
+				OS:      runtime.GOOS,
+				Arch:    runtime.GOARCH,
+				Version: "v1.0.0",
+				Envs: map[string]string{
+					"GHTKN_AGENT_INSTANCE": "work",
+					"GHTKN_AGENT_SOCKET":   "/run/user/1000/ghtkn/agent-work.sock",
+				},
+				App:        "",
+				ConfigPath: configPath,
+			},
+		},
 		{
 			name: "empty environment variables are omitted",
 			env: map[string]string{
@@ -0,0 +1,37 @@
+// Package paniccmd implements the 'ghtkn panic' command, the one-shot kill switch for a
+// machine suspected to be compromised. It revokes every stored token in the configured
+// backend and in the ghtkn agent, deletes the agent's token directory, locks and stops
+// the agent, optionally destroys the agent's key file, and prints a JSON report of
+// which steps succeeded.
+package paniccmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/revoke"
+)
+
+// Controller runs the kill switch. client revokes the tokens stored in the configured
+// backend, stdout is where the JSON report is written, and getEnv resolves the agent's
+// socket, key file, and token directory. They are fields so tests can inject them
+// without t.Setenv, which would forbid t.Parallel.
+type Controller struct {
+	client revoke.Client
+	stdout io.Writer
+	getEnv func(string) string
+}
+
+// New creates a Controller that reads the real environment.
+func New(client revoke.Client, stdout io.Writer) *Controller {
+	return NewWithEnv(client, stdout, os.Getenv)
+}
+
+// NewWithEnv creates a Controller that resolves the agent's paths through getEnv.
+func NewWithEnv(client revoke.Client, stdout io.Writer, getEnv func(string) string) *Controller {
+	return &Controller{
+		client: client,
+		stdout: stdout,
+		getEnv: getEnv,
+	}
+}
@@ -0,0 +1,169 @@
+package paniccmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/keyfile"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/tokenstore"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/agent/stop"
+)
+
+// errIncomplete is returned when any step of the kill switch failed. The report already
+// says which, so the error only makes the command exit non-zero.
+var errIncomplete = errors.New("some steps of ghtkn panic failed; see the report")
+
+// InputRun holds the values needed to run the kill switch.
+type InputRun struct {
+	// ConfigFilePath is the resolved configuration file path, which selects the backend
+	// and the apps whose stored tokens are revoked.
+	ConfigFilePath string
+	// DestroyKey deletes the agent's key file too, so the passphrase no longer unlocks
+	// anything and a copy of the token directory taken earlier stays undecryptable.
+	DestroyKey bool
+}
+
+// Report is the machine-readable outcome of 'ghtkn panic', written as JSON.
+type Report struct {
+	// Backend is revoking the tokens of every app in the config from the configured
+	// backend (as 'ghtkn revoke --all' does).
+	Backend *Step `json:"backend"`
+	// Agent is the ghtkn agent's part: revoking everything it stores, locking, and
+	// stopping.
+	Agent *AgentStep `json:"agent"`
+	// TokenDir is deleting the agent's token directory, which also covers an agent that
+	// is not running.
+	TokenDir *Step `json:"token_dir"`
+	// KeyFile is deleting the agent's key file. It is omitted without --destroy-key.
+	KeyFile *Step `json:"key_file,omitempty"`
+}
+
+// Step is the outcome of one step.
+type Step struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// AgentStep is the outcome of the agent's part of the kill switch.
+type AgentStep struct {
+	Step
+
+	// Running reports whether an agent was running. An agent that is not running has
+	// nothing in memory to revoke or lock, so that counts as success.
+	Running bool `json:"running"`
+	// Revoked is the number of apps (client IDs) whose stored tokens the agent revoked.
+	Revoked int `json:"revoked,omitempty"`
+	// RevokeFailed lists the client IDs whose stored tokens could not be revoked, e.g.
+	// because the agent was locked. They were deleted anyway, but may still be live, so
+	// suspend or uninstall those GitHub Apps.
+	RevokeFailed []string `json:"revoke_failed,omitempty"`
+}
+
+// ok reports whether every step in the report succeeded.
+func (r *Report) ok() bool {
+	return r.Backend.OK && r.Agent.OK && len(r.Agent.RevokeFailed) == 0 && r.TokenDir.OK && (r.KeyFile == nil || r.KeyFile.OK)
+}
+
+// Run pulls the kill switch. There is no confirmation prompt: it is meant for a moment
+// when every second counts, and none of the steps destroys anything that cannot be
+// recreated by authenticating again (except the key file with DestroyKey, which the user
+// asks for explicitly). Every step runs even when an earlier one fails, and the report is
+// written in any case; Run returns an error afterwards if any step failed.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, input *InputRun) error {
+	report := &Report{
+		Backend:  c.revokeBackend(ctx, logger, input.ConfigFilePath),
+		Agent:    c.panicAgent(ctx, logger),
+		TokenDir: c.deleteTokenDir(),
+	}
+	if input.DestroyKey {
+		report.KeyFile = c.deleteKeyFile()
+	}
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("write the report: %w", err)
+	}
+	if !report.ok() {
+		return errIncomplete
+	}
+	return nil
+}
+
+// revokeBackend revokes the tokens of every app in the config from the configured
+// backend, which may be the agent as well.
+func (c *Controller) revokeBackend(ctx context.Context, logger *slog.Logger, configFilePath string) *Step {
+	if err := c.client.Revoke(ctx, logger, &ghtkn.InputRevoke{
+		ConfigFilePath: configFilePath,
+		All:            true,
+	}); err != nil {
+		return &Step{Error: err.Error()}
+	}
+	return &Step{OK: true}
+}
+
+// panicAgent asks a running agent to revoke everything it stores, lock, and stop (see
+// adminapi.CommandPanic). An agent from an older ghtkn does not know the command, so it
+// is stopped instead: that discards its data key, and its tokens are deleted afterwards
+// by deleteTokenDir, but they are not revoked.
+func (c *Controller) panicAgent(ctx context.Context, logger *slog.Logger) *AgentStep {
+	path, err := agentapi.SocketPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return &AgentStep{Step: Step{Error: err.Error()}}
+	}
+	resp, err := agentapi.Send(ctx, path, &agentapi.Request{Command: adminapi.CommandPanic})
+	if err != nil {
+		if agentapi.IsNotRunning(err) {
+			return &AgentStep{Step: Step{OK: true}}
+		}
+		return &AgentStep{Step: Step{Error: err.Error()}, Running: true}
+	}
+	step := &AgentStep{
+		Step:         Step{OK: resp.OK, Error: resp.Error},
+		Running:      true,
+		Revoked:      resp.Count,
+		RevokeFailed: resp.RevokeFailed,
+	}
+	if resp.OK {
+		return step
+	}
+	// A failure may come from an agent too old to know PANIC, which is still running, so
+	// make sure it stops. An agent that understood the command stops on its own, and
+	// stopping one that is gone is a no-op.
+	if err := stop.NewWithEnv(c.getEnv).Run(ctx, logger); err != nil {
+		step.Error = fmt.Sprintf("%s; stop the agent: %s", step.Error, err)
+	}
+	return step
+}
+
+// deleteTokenDir deletes the agent's token directory. A running agent that understood
+// PANIC has deleted it already, so this matters when the agent is down or too old.
+func (c *Controller) deleteTokenDir() *Step {
+	dir, err := tokenstore.TokenDir(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return &Step{Error: err.Error()}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return &Step{Error: err.Error()}
+	}
+	return &Step{OK: true}
+}
+
+// deleteKeyFile deletes the agent's key file. A missing key file is a success.
+func (c *Controller) deleteKeyFile() *Step {
+	path, err := keyfile.KeyPath(c.getEnv, runtime.GOOS)
+	if err != nil {
+		return &Step{Error: err.Error()}
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return &Step{Error: err.Error()}
+	}
+	return &Step{OK: true}
+}
@@ -0,0 +1,192 @@
+package paniccmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	agentapi "github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn/backend/agent"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/agent/adminapi"
+)
+
+// fakeClient records the SDK revoke request and returns a configurable error.
+type fakeClient struct {
+	input *ghtkn.InputRevoke
+	err   error
+}
+
+func (f *fakeClient) Revoke(_ context.Context, _ *slog.Logger, input *ghtkn.InputRevoke) error {
+	f.input = input
+	return f.err
+}
+
+// serveAgent starts a Unix-socket server that answers each request with handler and
+// returns its socket path. A short dir keeps the path under the OS sun_path limit.
+func serveAgent(t *testing.T, handler func(*agentapi.Request) *agentapi.Response) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "gh") //nolint:usetesting // t.TempDir's path is too long for a unix socket
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "s.sock")
+	lc := net.ListenConfig{}
+	ln, err := lc.Listen(t.Context(), "unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			line, err := bufio.NewReader(conn).ReadBytes('\n')
+			req := &agentapi.Request{}
+			if err == nil && json.Unmarshal(line, req) == nil {
+				b, _ := json.Marshal(handler(req))
+				_, _ = conn.Write(append(b, '\n'))
+			}
+			conn.Close()
+		}
+	}()
+	return socket
+}
+
+// agentFiles creates a token directory and a key file and returns a getEnv stub that
+// points the agent's paths at them and its socket at socket.
+func agentFiles(t *testing.T, socket string) (func(string) string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	tokenDir := filepath.Join(dir, "tokens")
+	keyFile := filepath.Join(dir, "key")
+	if err := os.MkdirAll(tokenDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tokenDir, "Iv1.a"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	envs := map[string]string{
+		"GHTKN_AGENT_SOCKET":    socket,
+		"GHTKN_AGENT_TOKEN_DIR": tokenDir,
+		"GHTKN_AGENT_KEY":       keyFile,
+	}
+	return func(k string) string { return envs[k] }, tokenDir, keyFile
+}
+
+func TestController_Run(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		clientErr  error
+		handler    func(*agentapi.Request) *agentapi.Response
+		destroyKey bool
+		want       *Report
+		wantErr    bool
+		wantKey    bool
+	}{
+		{
+			name: "everything succeeds",
+			handler: func(req *agentapi.Request) *agentapi.Response {
+				if req.Command != adminapi.CommandPanic {
+					return &agentapi.Response{Error: "unexpected command"}
+				}
+				return &agentapi.Response{OK: true, Locked: true, Count: 2}
+			},
+			destroyKey: true,
+			want: &Report{
+				Backend:  &Step{OK: true},
+				Agent:    &AgentStep{Step: Step{OK: true}, Running: true, Revoked: 2},
+				TokenDir: &Step{OK: true},
+				KeyFile:  &Step{OK: true},
+			},
+		},
+		{
+			name:      "agent not running and the backend fails",
+			clientErr: errors.New("boom"),
+			want: &Report{
+				Backend:  &Step{Error: "boom"},
+				Agent:    &AgentStep{Step: Step{OK: true}},
+				TokenDir: &Step{OK: true},
+			},
+			wantErr: true,
+			wantKey: true,
+		},
+		{
+			name: "locked agent leaves tokens unrevoked",
+			handler: func(*agentapi.Request) *agentapi.Response {
+				return &agentapi.Response{OK: true, Locked: true, RevokeFailed: []string{"Iv1.a"}}
+			},
+			want: &Report{
+				Backend:  &Step{OK: true},
+				Agent:    &AgentStep{Step: Step{OK: true}, Running: true, RevokeFailed: []string{"Iv1.a"}},
+				TokenDir: &Step{OK: true},
+			},
+			wantErr: true,
+			wantKey: true,
+		},
+		{
+			name: "old agent is stopped",
+			handler: func(req *agentapi.Request) *agentapi.Response {
+				if req.Command == agentapi.CommandStop {
+					return &agentapi.Response{OK: true}
+				}
+				return &agentapi.Response{Error: "unknown command"}
+			},
+			want: &Report{
+				Backend:  &Step{OK: true},
+				Agent:    &AgentStep{Step: Step{Error: "unknown command"}, Running: true},
+				TokenDir: &Step{OK: true},
+			},
+			wantErr: true,
+			wantKey: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			socket := filepath.Join(t.TempDir(), "absent.sock")
+			if tt.handler != nil {
+				socket = serveAgent(t, tt.handler)
+			}
+			getEnv, tokenDir, keyFile := agentFiles(t, socket)
+			client := &fakeClient{err: tt.clientErr}
+			stdout := &bytes.Buffer{}
+			c := NewWithEnv(client, stdout, getEnv)
+
+			err := c.Run(t.Context(), slog.New(slog.DiscardHandler), &InputRun{ConfigFilePath: "ghtkn.yaml", DestroyKey: tt.destroyKey})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := &Report{}
+			if err := json.Unmarshal(stdout.Bytes(), got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("report (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(&ghtkn.InputRevoke{ConfigFilePath: "ghtkn.yaml", All: true}, client.input); diff != "" {
+				t.Fatalf("SDK revoke (-want +got):\n%s", diff)
+			}
+			if _, err := os.Stat(tokenDir); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("the token directory must be deleted, stat err = %v", err)
+			}
+			if _, err := os.Stat(keyFile); (err == nil) != tt.wantKey {
+				t.Fatalf("key file exists = %v, want %v", err == nil, tt.wantKey)
+			}
+		})
+	}
+}
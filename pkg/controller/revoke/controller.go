@@ -8,9 +8,13 @@ package revoke
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"text/tabwriter"
 
 	"github.com/suzuki-shunsuke/ghtkn-go-sdk/ghtkn"
+	"github.com/suzuki-shunsuke/ghtkn/pkg/credential"
 	"github.com/suzuki-shunsuke/go-revoke-github-access-token/revoke"
 )
 
@@ -28,6 +32,9 @@ type Revoker interface {
 type Input struct {
 	Client  Client
 	Revoker Revoker
+	// Stdout, when set, receives a table of the result of each raw token. It is nil in
+	// tests that only check what is revoked.
+	Stdout io.Writer
 }
 
 // NewInput creates a new Input with default production dependencies.
@@ -39,13 +46,15 @@ func NewInput() (*Input, error) {
 	return &Input{
 		Client:  client,
 		Revoker: revoke.New(nil),
+		Stdout:  os.Stdout,
 	}, nil
 }
 
 // InputRevoke holds the values needed to revoke tokens.
 type InputRevoke struct {
-	// Tokens are raw access tokens given as positional arguments. They are revoked
-	// directly and are not looked up in or deleted from any backend.
+	// Tokens are raw access tokens given as positional arguments, on stdin, or found in
+	// files. They are revoked directly in one batch, once each, and are not looked up in
+	// or deleted from any backend.
 	Tokens []string
 	// AppNames are the apps whose stored tokens should be revoked (empty if none given).
 	AppNames []string
@@ -78,7 +87,10 @@ func New(input *Input) *Controller {
 // stored token.
 func (c *Controller) Run(ctx context.Context, logger *slog.Logger, input *InputRevoke) error {
 	if len(input.Tokens) > 0 {
-		if err := c.input.Revoker.Revoke(ctx, input.Tokens); err != nil {
+		tokens := unique(input.Tokens)
+		err := c.input.Revoker.Revoke(ctx, tokens)
+		c.writeResults(tokens, err)
+		if err != nil {
 			return fmt.Errorf("revoke access tokens: %w", err)
 		}
 	}
@@ -94,3 +106,37 @@ func (c *Controller) Run(ctx context.Context, logger *slog.Logger, input *InputR
 	}
 	return nil
 }
+
+// unique returns tokens without duplicates, in order of first appearance. The same
+// token pasted twice, or found on several lines of a log, is revoked once.
+func unique(tokens []string) []string {
+	seen := make(map[string]struct{}, len(tokens))
+	ret := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		if _, ok := seen[token]; ok {
+			continue
+		}
+		seen[token] = struct{}{}
+		ret = append(ret, token)
+	}
+	return ret
+}
+
+// writeResults writes the result of each raw token as a table, with the tokens masked
+// so the output does not leak them again. The credential revocation API takes the tokens
+// in one batch and fails or succeeds as a whole, so they share one result.
+func (c *Controller) writeResults(tokens []string, err error) {
+	if c.input.Stdout == nil {
+		return
+	}
+	result := "revoked"
+	if err != nil {
+		result = "failed"
+	}
+	w := tabwriter.NewWriter(c.input.Stdout, 0, 0, 2, ' ', 0) //nolint:mnd // the column padding
+	fmt.Fprintln(w, "TOKEN\tRESULT")
+	for _, token := range tokens {
+		fmt.Fprintf(w, "%s\t%s\n", credential.Mask(token), result)
+	}
+	_ = w.Flush()
+}
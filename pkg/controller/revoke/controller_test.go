@@ -1,6 +1,7 @@
 package revoke_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"log/slog"
@@ -120,6 +121,12 @@ func runTestCases() []runTestCase {
 			wantClient:  true,
 			wantAll:     true,
 		},
+		{
+			name:        "duplicate raw tokens are revoked once",
+			input:       &revoke.InputRevoke{Tokens: []string{"ghu_x", "ghu_y", "ghu_x"}},
+			wantRevoker: true,
+			wantTokens:  []string{"ghu_x", "ghu_y"},
+		},
 		{
 			name:       "revoker error is propagated",
 			input:      &revoke.InputRevoke{Tokens: []string{"ghu_x"}},
@@ -160,3 +167,41 @@ func TestController_Run(t *testing.T) {
 		})
 	}
 }
+
+// TestController_Run_results verifies that each raw token's result is written as a
+// table with the token masked.
+func TestController_Run_results(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		revokerErr error
+		want       string
+	}{
+		{
+			name: "revoked",
+			want: "TOKEN                RESULT\n" +
+				"ghu_0123****         revoked\n" +
+				"github_pat_abcd****  revoked\n",
+		},
+		{
+			name:       "failed",
+			revokerErr: errors.New("boom"),
+			want: "TOKEN                RESULT\n" +
+				"ghu_0123****         failed\n" +
+				"github_pat_abcd****  failed\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			stdout := &bytes.Buffer{}
+			c := revoke.New(&revoke.Input{Client: &mockClient{}, Revoker: &mockRevoker{err: tt.revokerErr}, Stdout: stdout})
+			_ = c.Run(t.Context(), slog.New(slog.DiscardHandler), &revoke.InputRevoke{
+				Tokens: []string{"ghu_0123456789", "github_pat_abcdefgh", "ghu_0123456789"},
+			})
+			if diff := cmp.Diff(tt.want, stdout.String()); diff != "" {
+				t.Fatalf("output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
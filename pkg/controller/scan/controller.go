@@ -0,0 +1,73 @@
+// Package scan implements the 'ghtkn scan' command, which looks for GitHub credentials
+// leaked into files, Git history, or the staged diff, and optionally revokes them. Agent
+// transcripts and logs are exactly where tokens end up, so detection belongs in the tool
+// that issued them.
+package scan
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/controller/revoke"
+)
+
+// Controller scans for leaked credentials. stdout is where the findings are written,
+// revoker revokes them with --revoke, and git starts a git command and returns its
+// standard output; they are fields so tests can inject them.
+type Controller struct {
+	stdout  io.Writer
+	revoker revoke.Revoker
+	git     func(ctx context.Context, args ...string) (io.ReadCloser, error)
+}
+
+// New creates a Controller that runs the real git.
+func New(stdout io.Writer, revoker revoke.Revoker) *Controller {
+	return &Controller{
+		stdout:  stdout,
+		revoker: revoker,
+		git:     runGit,
+	}
+}
+
+// runGit starts git in the current directory and returns its standard output, which is
+// streamed rather than buffered: the history of a large repository is far bigger than
+// what should be held in memory. Closing the output waits for git to exit, and reports
+// its failure along with what it wrote to the standard error.
+func runGit(ctx context.Context, args ...string) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("run git %s: %w", args[0], err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("run git %s: %w", args[0], err)
+	}
+	return &gitOutput{ReadCloser: stdout, cmd: cmd, stderr: stderr, subcommand: args[0]}, nil
+}
+
+// gitOutput is the standard output of a running git command.
+type gitOutput struct {
+	io.ReadCloser
+	cmd        *exec.Cmd
+	stderr     *bytes.Buffer
+	subcommand string
+}
+
+// Close closes the pipe first, so git stops rather than blocking on a full pipe when the
+// output was not read to its end, and then waits for it to exit.
+func (o *gitOutput) Close() error {
+	_ = o.ReadCloser.Close()
+	if err := o.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(o.stderr.String()); msg != "" {
+			return fmt.Errorf("run git %s: %w: %s", o.subcommand, err, msg)
+		}
+		return fmt.Errorf("run git %s: %w", o.subcommand, err)
+	}
+	return nil
+}
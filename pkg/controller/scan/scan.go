@@ -0,0 +1,333 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/credential"
+)
+
+// binarySniffLen is how much of a file is checked for a NUL byte to tell a binary file,
+// which is skipped, from a text file. Git uses the same heuristic and length.
+const binarySniffLen = 8000
+
+// maxLineBytes caps a single line read from a file or a diff. A minified file or a log
+// can have very long lines; a longer line is still scanned, in chunks of this size (see
+// tokenScanner).
+const maxLineBytes = 1024 * 1024
+
+// hunkHeader captures the first line number of the new side of a diff hunk.
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)`)
+
+// InputRun holds the values needed to run a scan.
+type InputRun struct {
+	// Paths are files and directories to scan. Directories are walked recursively,
+	// skipping .git. When empty and neither GitHistory nor Staged is set, the current
+	// directory is scanned.
+	Paths []string
+	// GitHistory scans every line ever added in the repository's history, on every ref.
+	GitHistory bool
+	// Staged scans the lines added in the staged diff, for a pre-commit hook.
+	Staged bool
+	// Revoke revokes every credential found via GitHub's credential revocation API.
+	Revoke bool
+}
+
+// Finding is a credential found at a location.
+type Finding struct {
+	// Location is the file path, prefixed with the abbreviated commit for history.
+	Location string
+	Line     int
+	Token    string
+}
+
+// Run scans the requested sources and writes one line per finding to stdout, with the
+// credential masked. It returns an error when anything was found, so a pre-commit hook
+// or CI job fails, after revoking the findings when Revoke is set.
+func (c *Controller) Run(ctx context.Context, logger *slog.Logger, input *InputRun) error {
+	findings, err := c.scan(ctx, logger, input)
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		fmt.Fprintf(c.stdout, "%s:%d: %s\n", f.Location, f.Line, credential.Mask(f.Token))
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+	if input.Revoke {
+		tokens := uniqueTokens(findings)
+		if err := c.revoker.Revoke(ctx, tokens); err != nil {
+			return fmt.Errorf("revoke the leaked credentials: %w", err)
+		}
+		logger.Info("revoked the leaked credentials", "count", len(tokens))
+	}
+	return fmt.Errorf("found %d leaked GitHub credential(s)", len(findings))
+}
+
+// scan collects the findings of every requested source.
+func (c *Controller) scan(ctx context.Context, logger *slog.Logger, input *InputRun) ([]*Finding, error) {
+	paths := input.Paths
+	if len(paths) == 0 && !input.GitHistory && !input.Staged {
+		paths = []string{"."}
+	}
+	var findings []*Finding
+	for _, p := range paths {
+		found, err := scanPath(logger, p)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+	if input.GitHistory {
+		found, err := c.scanGit(ctx, "log", "-p", "--all", "--no-color", "--no-ext-diff", "-U0", "--format=commit %H")
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+	if input.Staged {
+		found, err := c.scanGit(ctx, "diff", "--cached", "--no-color", "--no-ext-diff", "-U0")
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, found...)
+	}
+	return findings, nil
+}
+
+// scanGit scans the diff a git command prints as git writes it.
+func (c *Controller) scanGit(ctx context.Context, args ...string) ([]*Finding, error) {
+	out, err := c.git(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	findings, readErr := scanDiff(out)
+	// git failing explains a read error better than the error itself.
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("read the output of git %s: %w", args[0], readErr)
+	}
+	return findings, nil
+}
+
+// scanPath scans a file, or every file under a directory except .git.
+func scanPath(logger *slog.Logger, root string) ([]*Finding, error) {
+	var findings []*Finding
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		found, err := scanFile(path)
+		if err != nil {
+			// One unreadable file must not hide what the others contain.
+			logger.Warn("skip a file that can't be scanned", "path", path, "error", err)
+			return nil
+		}
+		findings = append(findings, found...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan %s: %w", root, err)
+	}
+	return findings, nil
+}
+
+// scanFile scans a text file line by line. A binary file has no findings.
+func scanFile(path string) ([]*Finding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err //nolint:wrapcheck
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, maxLineBytes)
+	head, err := r.Peek(binarySniffLen)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err //nolint:wrapcheck
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil, nil
+	}
+	var (
+		findings []*Finding
+		tokens   tokenScanner
+	)
+	err = eachLine(r, func(c *lineChunk) {
+		for _, token := range tokens.find(c) {
+			findings = append(findings, &Finding{Location: path, Line: c.n, Token: token})
+		}
+	})
+	return findings, err
+}
+
+// scanDiff scans the lines added in a unified diff, as printed by 'git diff' or, with
+// "commit <hash>" lines in front of each commit, 'git log -p'. Removed lines are not
+// scanned: a credential removed in a commit was added in an earlier one, where it is
+// reported.
+func scanDiff(r io.Reader) ([]*Finding, error) {
+	var (
+		findings []*Finding
+		commit   string
+		path     string
+		lineNum  int
+		// inHunk is set from a hunk header to the next file or commit. Within a hunk, a
+		// line starting with "--- " or "+++ " is a removed or added line, not a header.
+		inHunk bool
+		// oldPath is set on the "--- " header, which the "+++ " header follows.
+		oldPath bool
+		// added is set while the chunks of an added line are read, and addedLine is the
+		// line's number in the new file.
+		added     bool
+		addedLine int
+		tokens    tokenScanner
+	)
+	report := func(c *lineChunk) {
+		location := path
+		if commit != "" {
+			location = commit + ":" + path
+		}
+		for _, token := range tokens.find(c) {
+			findings = append(findings, &Finding{Location: location, Line: addedLine, Token: token})
+		}
+	}
+	err := eachLine(bufio.NewReaderSize(r, maxLineBytes), func(c *lineChunk) {
+		if !c.first {
+			// The rest of a long line, which is only scanned if the line was added.
+			if added {
+				report(c)
+			}
+			return
+		}
+		line := c.text
+		afterOldPath := oldPath
+		added, oldPath = false, false
+		switch {
+		case strings.HasPrefix(line, "commit "):
+			commit = strings.TrimPrefix(line, "commit ")
+			if len(commit) > 12 { //nolint:mnd // an abbreviated commit hash
+				commit = commit[:12]
+			}
+			inHunk = false
+		case strings.HasPrefix(line, "diff "):
+			inHunk = false
+		case !inHunk && strings.HasPrefix(line, "--- "):
+			oldPath = true
+		case afterOldPath && strings.HasPrefix(line, "+++ "):
+			path = strings.TrimPrefix(strings.TrimPrefix(line, "+++ "), "b/")
+		case strings.HasPrefix(line, "@@ "):
+			if m := hunkHeader.FindStringSubmatch(line); m != nil {
+				lineNum, _ = strconv.Atoi(m[1])
+			}
+			inHunk = true
+		case strings.HasPrefix(line, "+"):
+			added, addedLine = true, lineNum
+			report(&lineChunk{n: c.n, text: line[1:], first: true, last: c.last})
+			lineNum++
+		case strings.HasPrefix(line, " "):
+			lineNum++
+		}
+	})
+	return findings, err
+}
+
+// lineChunk is a line eachLine read, or part of it when the line is longer than the
+// reader's buffer.
+type lineChunk struct {
+	// n is the line's 1-based number.
+	n    int
+	text string
+	// first and last report whether the chunk starts and ends the line.
+	first bool
+	last  bool
+}
+
+// eachLine calls fn with each line of r, without the line ending. A line longer than the
+// reader's buffer is passed in several chunks with the same number; the last one may be
+// empty.
+func eachLine(r *bufio.Reader, fn func(c *lineChunk)) error {
+	c := &lineChunk{n: 1, first: true}
+	for {
+		b, err := r.ReadSlice('\n')
+		c.last = !errors.Is(err, bufio.ErrBufferFull)
+		c.text = string(b)
+		if c.last {
+			c.text = strings.TrimRight(c.text, "\r\n")
+		}
+		if len(b) > 0 || !c.first {
+			fn(c)
+		}
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			c.first = false
+			continue
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err //nolint:wrapcheck
+		}
+		c = &lineChunk{n: c.n + 1, first: true}
+	}
+}
+
+// tokenScanner finds the credentials in the chunks of a line, including one cut in two
+// at a chunk boundary. It carries the last credential.MaxTokenLen bytes of a chunk over
+// to the next, and reports a credential reaching the end of a chunk with the next one,
+// since it may continue there.
+type tokenScanner struct {
+	// tail is the end of the line scanned so far.
+	tail string
+}
+
+// find returns the credentials in c not reported with the previous chunks of the line.
+func (ts *tokenScanner) find(c *lineChunk) []string {
+	if c.first {
+		ts.tail = ""
+	}
+	s := ts.tail + c.text
+	var tokens []string
+	for _, m := range credential.FindIndex(s) {
+		if m[1] < len(ts.tail) || (!c.last && m[1] == len(s)) {
+			continue
+		}
+		tokens = append(tokens, s[m[0]:m[1]])
+	}
+	ts.tail = s[max(0, len(s)-credential.MaxTokenLen):]
+	return tokens
+}
+
+// uniqueTokens returns the distinct credentials among the findings, in order of first
+// appearance, so each is revoked once.
+func uniqueTokens(findings []*Finding) []string {
+	seen := make(map[string]struct{}, len(findings))
+	var tokens []string
+	for _, f := range findings {
+		if _, ok := seen[f.Token]; ok {
+			continue
+		}
+		seen[f.Token] = struct{}{}
+		tokens = append(tokens, f.Token)
+	}
+	return tokens
+}
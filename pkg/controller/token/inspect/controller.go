@@ -0,0 +1,35 @@
+// Package inspect implements the 'ghtkn token inspect' command. It tells what a GitHub
+// credential is, whom it belongs to, which app issued it, when it expires, and whether it
+// still works, by asking the GitHub API with it. It is meant for a token found in a log:
+// knowing whether it is still dangerous comes before deciding to revoke it.
+package inspect
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultBaseURL is the GitHub REST API.
+const DefaultBaseURL = "https://api.github.com"
+
+// httpTimeout bounds the API request, so an unreachable API fails the command instead of
+// hanging it.
+const httpTimeout = 30 * time.Second
+
+// Controller inspects a token. baseURL is the GitHub REST API root, which tests point at
+// a local stand-in, and stdout is where the JSON report is written.
+type Controller struct {
+	httpClient *http.Client
+	baseURL    string
+	stdout     io.Writer
+}
+
+// New creates a Controller that asks the GitHub API at baseURL.
+func New(stdout io.Writer, baseURL string) *Controller {
+	return &Controller{
+		httpClient: &http.Client{Timeout: httpTimeout},
+		baseURL:    baseURL,
+		stdout:     stdout,
+	}
+}
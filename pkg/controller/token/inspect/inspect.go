@@ -0,0 +1,131 @@
+package inspect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/suzuki-shunsuke/ghtkn/pkg/credential"
+)
+
+// tokenTypes maps a credential prefix to a readable type. The order matters: no prefix
+// is a prefix of another, so the first match is the only one.
+var tokenTypes = []struct { //nolint:gochecknoglobals // a read-only table
+	prefix string
+	name   string
+}{
+	{prefix: "ghu_", name: "GitHub App user access token"},
+	{prefix: "ghr_", name: "GitHub App refresh token"},
+	{prefix: "gho_", name: "OAuth app access token"},
+	{prefix: "ghp_", name: "personal access token (classic)"},
+	{prefix: "github_pat_", name: "fine-grained personal access token"},
+}
+
+// InputRun holds the values needed to inspect a token.
+type InputRun struct {
+	// Token is the credential to inspect. It is never written to the output.
+	Token string
+	// Apps maps the client IDs of the configured apps to their names, so the issuing app
+	// of a user access token can be reported by name.
+	Apps map[string]string
+}
+
+// Report is what is known about a token, written as JSON.
+type Report struct {
+	// Token is the token masked, so the report can be shared.
+	Token string `json:"token"`
+	Type  string `json:"type"`
+	// Live reports whether GitHub still accepts the token. It is nil for a refresh
+	// token, which the API does not accept in the first place.
+	Live  *bool  `json:"live,omitempty"`
+	Login string `json:"login,omitempty"`
+	// ClientID is the client ID of the app that issued the token, for a GitHub App user
+	// access token or an OAuth app token. AppName is that app's name in the config, when
+	// it is configured.
+	ClientID string `json:"client_id,omitempty"`
+	AppName  string `json:"app_name,omitempty"`
+	// ExpiresAt is the expiration GitHub reports for the token, verbatim. A token that
+	// never expires has none.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Note      string `json:"note,omitempty"`
+}
+
+// Run inspects the token and writes the report to stdout.
+func (c *Controller) Run(ctx context.Context, input *InputRun) error {
+	report := &Report{
+		Token: credential.Mask(input.Token),
+		Type:  tokenType(input.Token),
+	}
+	if strings.HasPrefix(input.Token, "ghr_") {
+		report.Note = "a refresh token can't be checked against the API; revoke it if in doubt"
+		return c.write(report)
+	}
+	if err := c.getUser(ctx, input, report); err != nil {
+		return err
+	}
+	return c.write(report)
+}
+
+// getUser asks GET /user with the token and fills in what the response tells: whether
+// the token works, the user, the issuing app, and the expiration.
+func (c *Controller) getUser(ctx context.Context, input *InputRun, report *Report) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(c.baseURL, "/")+"/user", nil)
+	if err != nil {
+		return fmt.Errorf("create a request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+input.Token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-Github-Api-Version", "2022-11-28")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("get the authenticated user: %w", err)
+	}
+	defer resp.Body.Close()
+	live := false
+	switch resp.StatusCode {
+	case http.StatusOK:
+		live = true
+	case http.StatusUnauthorized:
+		// Expired, revoked, or never valid: GitHub does not tell them apart.
+		report.Live = &live
+		return nil
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) //nolint:mnd // enough of the body for an error message
+		return fmt.Errorf("get the authenticated user: unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	report.Live = &live
+	report.ExpiresAt = resp.Header.Get("Github-Authentication-Token-Expiration")
+	report.ClientID = resp.Header.Get("X-Oauth-Client-Id")
+	report.AppName = input.Apps[report.ClientID]
+	user := &struct {
+		Login string `json:"login"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(user); err != nil {
+		return fmt.Errorf("decode the authenticated user: %w", err)
+	}
+	report.Login = user.Login
+	return nil
+}
+
+// write writes the report as indented JSON.
+func (c *Controller) write(report *Report) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return fmt.Errorf("write the report: %w", err)
+	}
+	return nil
+}
+
+// tokenType returns the readable type of a token from its prefix.
+func tokenType(token string) string {
+	for _, t := range tokenTypes {
+		if strings.HasPrefix(token, t.prefix) {
+			return t.name
+		}
+	}
+	return "unknown"
+}
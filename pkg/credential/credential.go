@@ -0,0 +1,67 @@
+// Package credential recognizes GitHub credentials by their prefix. It is shared by the
+// commands that take tokens as input ('ghtkn revoke') and those that look for them in
+// text ('ghtkn scan'), so they agree on what a token is.
+package credential
+
+import (
+	"regexp"
+	"strings"
+)
+
+// prefixes are the prefixes of the GitHub credentials ghtkn recognizes.
+var prefixes = []string{ //nolint:gochecknoglobals // a read-only table
+	"ghp_",        // Personal access tokens (classic)
+	"github_pat_", // Fine-grained personal access tokens
+	"gho_",        // OAuth app access tokens
+	"ghu_",        // User-to-server tokens from GitHub Apps
+	"ghr_",        // Refresh tokens from GitHub Apps
+}
+
+// tokenPattern matches a GitHub credential inside arbitrary text. Unlike IsToken, which
+// judges a value the user passed on purpose, it requires the body after the prefix to be
+// at least 30 characters long, which every real token is, so a mention of a prefix in
+// prose or an example such as "ghu_xxx" is not reported.
+var tokenPattern = regexp.MustCompile(`\b(?:gh[pour]_[A-Za-z0-9]{30,}|github_pat_[A-Za-z0-9_]{30,})\b`)
+
+// MaxTokenLen is the longest a GitHub credential gets: GitHub documents that its tokens
+// may grow up to 255 characters.
+const MaxTokenLen = 255
+
+// IsToken reports whether s looks like a GitHub credential based on its prefix.
+func IsToken(s string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns the GitHub credentials found in s, in the order they appear.
+func Find(s string) []string {
+	return tokenPattern.FindAllString(s, -1)
+}
+
+// FindIndex is Find, returning the start and end offsets of each credential in s.
+func FindIndex(s string) [][]int {
+	return tokenPattern.FindAllStringIndex(s, -1)
+}
+
+// Mask returns token with everything but its prefix and the first four characters after
+// it replaced by a fixed "****", so it can be reported without leaking it again while
+// still telling tokens apart.
+func Mask(token string) string {
+	prefix := ""
+	for _, p := range prefixes {
+		if strings.HasPrefix(token, p) {
+			prefix = p
+			break
+		}
+	}
+	const shown = 4
+	body := token[len(prefix):]
+	if len(body) > shown {
+		body = body[:shown]
+	}
+	return prefix + body + "****"
+}